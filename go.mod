@@ -10,5 +10,7 @@ require (
 	github.com/moby/hyperkit v0.0.0-20210108224842-2f061e447e14
 	github.com/pkg/errors v0.9.1
 	github.com/zchee/go-vmnet v0.0.0-20161021174912-97ebf9174097
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	golang.org/x/sys v0.0.0-20210910150752-751e447fb3d0
 	k8s.io/apimachinery v0.22.1
 )
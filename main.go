@@ -16,10 +16,613 @@ limitations under the License.
 package main
 
 import (
-	"github.com/leoh0/machine/libmachine/drivers/plugin"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/console"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/helper"
 	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/hyperkit"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/portforward"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+	"github.com/leoh0/machine/commands/mcndirs"
+	"github.com/leoh0/machine/libmachine/drivers/plugin"
 )
 
+// commands are the subcommands of the driver binary, which otherwise serves
+// the docker-machine plugin.
+var commands = map[string]func(args []string) error{
+	"helper":           runHelper,
+	"port-forward":     runPortForward,
+	"console-socket":   runConsoleSocket,
+	"disk-monitor":     runDiskMonitor,
+	"config":           runConfig,
+	"sshfs-share":      runSSHFSShare,
+	"snapshot":         runSnapshot,
+	"export":           runExport,
+	"import":           runImport,
+	"self-test":        runSelfTest,
+	"remount-shares":   runRemountShares,
+	"ssh-key":          runSSHKey,
+	"vpnkit":           runVPNKit,
+	"status":           runStatus,
+	"crash-watch":      runCrashWatch,
+	"send-keys":        runSendKeys,
+	"metrics":          runMetrics,
+	"stats":            runStats,
+	"kernel-monitor":   runKernelMonitor,
+	"kernel-events":    runKernelEvents,
+	"provision":        runProvision,
+	"status-server":    runStatusServer,
+	"wake-watch":       runWakeWatch,
+	"time-sync":        runTimeSync,
+	"health":           runHealth,
+	"supervise":        runSupervise,
+	"host-check":       runHostCheck,
+	"migrate":          runMigrate,
+	"gc-exports":       runGCExports,
+	"exports":          runExports,
+	"console-log":      runConsoleLog,
+	"console":          runConsole,
+	"plan":             runPlan,
+	"install-hyperkit": runInstallHyperKit,
+}
+
+// privilegedCommands keep the privileges of the driver binary installed
+// setuid root: the helper, the port forwards binding privileged ports, the
+// edits of /etc/exports and the wake watcher restarting the port forwards.
+// The edits of /etc/exports are also run as root through sudo.
+// The other commands run as the invoking user.
+var privilegedCommands = map[string]bool{
+	"helper":       true,
+	"port-forward": true,
+	"gc-exports":   true,
+	"exports":      true,
+	"wake-watch":   true,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if !privilegedCommands[os.Args[1]] {
+				if err := realuser.Drop(); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 	plugin.RegisterDriver(hyperkit.NewDriver("", ""))
 }
+
+// runHelper implements the "helper run|install|uninstall" commands managing
+// the privileged helper.
+func runHelper(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s helper run|install|uninstall", os.Args[0])
+	}
+	switch args[0] {
+	case "run":
+		return helper.Serve(helper.DefaultSocketPath)
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		return helper.Install(exe)
+	case "uninstall":
+		return helper.Uninstall()
+	}
+	return fmt.Errorf("unknown helper command %q", args[0])
+}
+
+// runPortForward implements the "port-forward spec guestIP" command serving
+// a port forward of a machine.
+func runPortForward(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s port-forward hostPort:guestPort[/proto] guestIP", os.Args[0])
+	}
+	f, err := portforward.Parse(args[0])
+	if err != nil {
+		return err
+	}
+	// Only privileged ports need the privileges of the setuid binary, which
+	// portforward.Serve drops once listening. They are only used to forward
+	// to a VM.
+	if f.HostPort >= portforward.FirstUnprivilegedPort {
+		if err := realuser.Drop(); err != nil {
+			return err
+		}
+	} else if realuser.Setuid() {
+		subnet, err := hyperkit.GetSubnet()
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(args[1]); ip == nil || !subnet.Contains(ip) {
+			return fmt.Errorf("refusing to forward to %s: it is outside of the vmnet network %s", args[1], subnet)
+		}
+	}
+	return portforward.Serve(f, args[1])
+}
+
+// runConsoleSocket implements the "console-socket tty socket" command
+// bridging the console tty of a machine to a unix socket.
+func runConsoleSocket(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s console-socket tty socket", os.Args[0])
+	}
+	return console.ServeSocket(args[0], args[1])
+}
+
+// runDiskMonitor implements the "disk-monitor machineDir" command checking
+// the guest disk usage of a machine.
+func runDiskMonitor(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s disk-monitor machineDir", os.Args[0])
+	}
+	return hyperkit.MonitorDisk(args[0])
+}
+
+// runConfig implements the "config set machineDir key=value..." command
+// changing the settings of an existing machine.
+func runConfig(args []string) error {
+	if len(args) < 3 || args[0] != "set" {
+		return fmt.Errorf("usage: %s config set machineDir key=value...", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[1])
+	if err != nil {
+		return err
+	}
+	for _, setting := range args[2:] {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid setting %q, expected key=value", setting)
+		}
+		if err := d.SetConfigRaw(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	fmt.Println("The new settings take effect on the next start of the machine")
+	return nil
+}
+
+// runSSHFSShare implements the "sshfs-share machineDir hostDir guestDir"
+// command serving a shared folder of a machine over sshfs.
+func runSSHFSShare(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: %s sshfs-share machineDir hostDir guestDir", os.Args[0])
+	}
+	return hyperkit.ServeSSHFSShare(args[0], args[1], args[2])
+}
+
+// runSnapshot implements the "snapshot machineDir save|restore|delete name"
+// and "snapshot machineDir list" commands.
+func runSnapshot(args []string) error {
+	usage := fmt.Errorf("usage: %s snapshot machineDir save|restore|delete name, or snapshot machineDir list", os.Args[0])
+	if len(args) < 2 {
+		return usage
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	if args[1] == "list" {
+		snapshots, err := d.ListSnapshots()
+		if err != nil {
+			return err
+		}
+		for _, s := range snapshots {
+			fmt.Printf("%s\t%s\n", s.Name, s.CreatedAt.Format(time.RFC3339))
+		}
+		return nil
+	}
+	if len(args) != 3 {
+		return usage
+	}
+	switch args[1] {
+	case "save":
+		return d.Snapshot(args[2])
+	case "restore":
+		return d.RestoreSnapshot(args[2])
+	case "delete":
+		return d.DeleteSnapshot(args[2])
+	}
+	return usage
+}
+
+// runExport implements the "export machineDir file" command writing a
+// stopped machine to a tarball.
+func runExport(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s export machineDir file.tar.gz", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	return d.Export(args[1])
+}
+
+// runImport implements the "import file storePath name" command registering
+// an exported machine in a docker-machine store.
+func runImport(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: %s import file.tar.gz storePath name", os.Args[0])
+	}
+	_, err := hyperkit.ImportMachine(args[0], args[1], args[2])
+	return err
+}
+
+// runMigrate implements the "migrate storePath source [name]" command
+// converting a stopped xhyve or VirtualBox machine into a hyperkit one.
+func runMigrate(args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return fmt.Errorf("usage: %s migrate storePath source [name]", os.Args[0])
+	}
+	name := args[1]
+	if len(args) == 3 {
+		name = args[2]
+	}
+	_, err := hyperkit.MigrateMachine(args[0], args[1], name)
+	return err
+}
+
+// runGCExports implements the "gc-exports list|remove" command printing,
+// or removing, the /etc/exports entries of the invoking user whose machine
+// directory no longer exists.
+func runGCExports(args []string) error {
+	if len(args) != 1 || (args[0] != "list" && args[0] != "remove") {
+		return fmt.Errorf("usage: %s gc-exports list|remove", os.Args[0])
+	}
+	var orphans []hyperkit.OrphanedExport
+	var err error
+	if args[0] == "list" {
+		orphans, err = hyperkit.OrphanedExports()
+	} else {
+		// Without root, the exports are edited by the privileged helper.
+		orphans, err = hyperkit.GCExports(os.Geteuid() != 0)
+	}
+	for _, o := range orphans {
+		fmt.Printf("%s\t%s\n", o.MachineDir, o.Share)
+	}
+	return err
+}
+
+// runExports implements the "exports add identifier share options" and
+// "exports remove identifier" commands, run as root through sudo by an
+// unprivileged driver to edit the /etc/exports entries of the user.
+func runExports(args []string) error {
+	switch {
+	case len(args) == 4 && args[0] == hyperkit.ExportAdd:
+		return hyperkit.EditExport(args[0], args[1], args[2], args[3])
+	case len(args) == 2 && args[0] == hyperkit.ExportRemove:
+		return hyperkit.EditExport(args[0], args[1], "", "")
+	}
+	return fmt.Errorf("usage: sudo %s exports add identifier share options|remove identifier", os.Args[0])
+}
+
+// runInstallHyperKit implements the "install-hyperkit url sha256" command
+// installing the hyperkit binary machines pin with --hyperkit-binary-url
+// and --hyperkit-binary-sha256.
+func runInstallHyperKit(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: sudo %s install-hyperkit url sha256", os.Args[0])
+	}
+	path, err := hyperkit.InstallHyperKit(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Println(path)
+	return nil
+}
+
+// runConsoleLog implements the "console-log machineDir" command appending
+// the console of a machine to its console.log.
+func runConsoleLog(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s console-log machineDir", os.Args[0])
+	}
+	return hyperkit.LogConsole(args[0])
+}
+
+// runConsole implements the "console machineDir [follow]" command printing
+// the console output of the current boot of a machine, and with follow the
+// new output until the machine stops.
+func runConsole(args []string) error {
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "follow") {
+		return fmt.Errorf("usage: %s console machineDir [follow]", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	return d.StreamConsole(os.Stdout, len(args) == 2)
+}
+
+// runSelfTest implements the "self-test machineDir" command checking the
+// reachability of the Docker endpoint of a running machine.
+func runSelfTest(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s self-test machineDir", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	checks, err := d.CheckReachability()
+	for _, c := range checks {
+		fmt.Println(c)
+	}
+	return err
+}
+
+// runRemountShares implements the "remount-shares machineDir" command
+// mounting the NFS shares missing in a running machine.
+func runRemountShares(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s remount-shares machineDir", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	return d.RemountShares()
+}
+
+// runHealth implements the "health machineDir" command printing the health
+// checks of a machine as JSON, failing if one of them failed.
+func runHealth(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s health machineDir", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	checks, checkErr := d.CheckHealth()
+	b, err := json.MarshalIndent(checks, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return checkErr
+}
+
+// runHostCheck implements the "host-check [machineDir]" command printing
+// the checks of the host requirements as JSON, for the machine stored in
+// machineDir or a machine with the default settings, failing if one of
+// them failed.
+func runHostCheck(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: %s host-check [machineDir]", os.Args[0])
+	}
+	d := hyperkit.NewDriver("", "")
+	d.StorePath = os.Getenv("MACHINE_STORAGE_PATH")
+	if d.StorePath == "" {
+		d.StorePath = mcndirs.GetBaseDir()
+	}
+	if len(args) == 1 {
+		var err error
+		if d, err = hyperkit.LoadDriver(args[0]); err != nil {
+			return err
+		}
+	}
+	checks, checkErr := d.CheckHost()
+	b, err := json.MarshalIndent(checks, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return checkErr
+}
+
+// runSSHKey implements the "ssh-key machineDir rotate" command replacing the
+// SSH key of a running machine.
+func runSSHKey(args []string) error {
+	if len(args) != 2 || args[1] != "rotate" {
+		return fmt.Errorf("usage: %s ssh-key machineDir rotate", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	return d.RotateSSHKey()
+}
+
+// runVPNKit implements the "vpnkit machineDir" command running the managed
+// vpnkit of a machine.
+func runVPNKit(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s vpnkit machineDir", os.Args[0])
+	}
+	return hyperkit.SuperviseVPNKit(args[0])
+}
+
+// runStatus implements the "status machineDir" command printing the state,
+// uptime and boot counters of a machine as JSON.
+func runStatus(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s status machineDir", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	status, err := d.Status()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// runCrashWatch implements the "crash-watch machineDir" command notifying
+// when the hyperkit of a machine exits unexpectedly.
+func runCrashWatch(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s crash-watch machineDir", os.Args[0])
+	}
+	return hyperkit.WatchCrash(args[0])
+}
+
+// runSendKeys implements the "send-keys machineDir keys..." command typing
+// keys on the console of a machine, the arguments being joined by spaces.
+func runSendKeys(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: %s send-keys machineDir keys...", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	return d.SendKeys(strings.Join(args[1:], " "))
+}
+
+// runMetrics implements the "metrics machineDir" command serving the
+// metrics of a machine.
+func runMetrics(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s metrics machineDir", os.Args[0])
+	}
+	return hyperkit.ServeMetrics(args[0])
+}
+
+// runStatusServer implements the "status-server machineDir" command
+// serving the status endpoint of a machine.
+func runStatusServer(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s status-server machineDir", os.Args[0])
+	}
+	return hyperkit.ServeStatus(args[0])
+}
+
+// runWakeWatch implements the "wake-watch machineDir" command reconciling
+// the guest of a machine with the host after host sleeps.
+func runWakeWatch(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s wake-watch machineDir", os.Args[0])
+	}
+	return hyperkit.WatchWake(args[0])
+}
+
+// runTimeSync implements the "time-sync machineDir" command setting the
+// guest clock of a machine from the host periodically.
+func runTimeSync(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s time-sync machineDir", os.Args[0])
+	}
+	return hyperkit.SyncTime(args[0])
+}
+
+// runSupervise implements the "supervise machineDir" command run by the
+// launchd agent of a machine to restart it when hyperkit died.
+func runSupervise(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s supervise machineDir", os.Args[0])
+	}
+	return hyperkit.Supervise(args[0])
+}
+
+// runStats implements the "stats machineDir" command printing the resource
+// usage of a machine as JSON.
+func runStats(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s stats machineDir", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	stats, err := d.Stats()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// runKernelMonitor implements the "kernel-monitor machineDir" command
+// watching the guest kernel log of a machine.
+func runKernelMonitor(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s kernel-monitor machineDir", os.Args[0])
+	}
+	return hyperkit.MonitorKernel(args[0])
+}
+
+// runKernelEvents implements the "kernel-events machineDir" command printing
+// the notable guest kernel events of a machine as JSON.
+func runKernelEvents(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s kernel-events machineDir", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	events, err := d.KernelEvents()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// runProvision implements the "provision machineDir" command running the
+// provisioning scripts again in a running machine.
+func runProvision(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s provision machineDir", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	return d.RunProvisionScripts()
+}
+
+// runPlan implements the "plan machineDir [json]" command printing what a
+// start of a machine would do, without starting it.
+func runPlan(args []string) error {
+	if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "json") {
+		return fmt.Errorf("usage: %s plan machineDir [json]", os.Args[0])
+	}
+	d, err := hyperkit.LoadDriver(args[0])
+	if err != nil {
+		return err
+	}
+	plan, err := d.Plan()
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		plan.Write(os.Stdout)
+		return nil
+	}
+	b, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cloudinit generates cloud-init NoCloud seeds used to provision
+// generic Linux cloud images.
+package cloudinit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// VolumeLabel is the volume label the NoCloud datasource looks for.
+	VolumeLabel = "cidata"
+
+	metaDataFileName = "meta-data"
+	userDataFileName = "user-data"
+
+	dockerInstallCommand = "curl -fsSL https://get.docker.com | sh"
+)
+
+// Config describes the NoCloud seed of a machine.
+type Config struct {
+	InstanceID        string
+	Hostname          string
+	User              string
+	SSHAuthorizedKeys []string
+	InstallDocker     bool
+	// BootCmd runs early on every boot.
+	BootCmd []string
+	// Files are written before RunCmd, which runs after the Docker
+	// installation.
+	Files  []File
+	RunCmd []string
+}
+
+// File is a file written into the guest on first boot.
+type File struct {
+	Path        string
+	Content     []byte
+	Permissions string
+}
+
+// MetaData returns the content of the meta-data file.
+func (c *Config) MetaData() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "instance-id: %s\n", quote(c.InstanceID))
+	fmt.Fprintf(&b, "local-hostname: %s\n", quote(c.Hostname))
+	return b.Bytes()
+}
+
+// UserData returns the content of the user-data file.
+func (c *Config) UserData() []byte {
+	var b bytes.Buffer
+	b.WriteString("#cloud-config\n")
+	fmt.Fprintf(&b, "hostname: %s\n", quote(c.Hostname))
+	b.WriteString("users:\n")
+	fmt.Fprintf(&b, "  - name: %s\n", quote(c.User))
+	b.WriteString("    sudo: \"ALL=(ALL) NOPASSWD:ALL\"\n")
+	b.WriteString("    shell: /bin/bash\n")
+	if len(c.SSHAuthorizedKeys) > 0 {
+		b.WriteString("    ssh_authorized_keys:\n")
+		for _, key := range c.SSHAuthorizedKeys {
+			fmt.Fprintf(&b, "      - %s\n", quote(key))
+		}
+	}
+	if len(c.BootCmd) > 0 {
+		b.WriteString("bootcmd:\n")
+		for _, cmd := range c.BootCmd {
+			fmt.Fprintf(&b, "  - %s\n", quote(cmd))
+		}
+	}
+	if len(c.Files) > 0 {
+		b.WriteString("write_files:\n")
+		for _, f := range c.Files {
+			fmt.Fprintf(&b, "  - path: %s\n", quote(f.Path))
+			b.WriteString("    encoding: b64\n")
+			fmt.Fprintf(&b, "    content: %s\n", base64.StdEncoding.EncodeToString(f.Content))
+			if f.Permissions != "" {
+				fmt.Fprintf(&b, "    permissions: %s\n", quote(f.Permissions))
+			}
+		}
+	}
+	var runcmd []string
+	if c.InstallDocker {
+		runcmd = append(runcmd, dockerInstallCommand, fmt.Sprintf("usermod -aG docker %s", c.User))
+	}
+	runcmd = append(runcmd, c.RunCmd...)
+	if len(runcmd) > 0 {
+		b.WriteString("runcmd:\n")
+		for _, cmd := range runcmd {
+			fmt.Fprintf(&b, "  - %s\n", quote(cmd))
+		}
+	}
+	return b.Bytes()
+}
+
+// WriteSeedDir writes the meta-data and user-data files into dir, creating it
+// if needed. The directory can then be turned into an ISO labeled
+// VolumeLabel.
+func (c *Config) WriteSeedDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, metaDataFileName), c.MetaData(), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, userDataFileName), c.UserData(), 0644)
+}
+
+// quote returns s as a double quoted YAML scalar.
+func quote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package console gives access to the serial console of a hyperkit VM,
+// either directly through its tty or through a unix socket bridged to it.
+package console
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// openTTY opens the console tty for reading and writing.
+func openTTY(ttyPath string) (*os.File, error) {
+	return os.OpenFile(ttyPath, os.O_RDWR|syscall.O_NOCTTY, 0)
+}
+
+// open connects to the console at path, a tty or a unix socket.
+func open(path string) (io.ReadWriteCloser, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeSocket != 0 {
+		return net.Dial("unix", path)
+	}
+	return openTTY(path)
+}
+
+// Attach connects in and out to the console at path until either side is
+// closed.
+func Attach(path string, in io.Reader, out io.Writer) error {
+	conn, err := open(path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(conn, in)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(out, conn)
+		errCh <- err
+	}()
+	return <-errCh
+}
+
+// ServeSocket bridges the console tty at ttyPath to a unix socket at
+// socketPath, serving one client at a time, until the listener fails.
+func ServeSocket(ttyPath, socketPath string) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		return err
+	}
+
+	log.Infof("Serving console %s on %s", ttyPath, socketPath)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if err := Attach(ttyPath, conn, conn); err != nil {
+			log.Debugf("console: client disconnected: %v", err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package console
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keyInterval separates the keys sent to the console, boot loaders polling
+// the serial port may otherwise drop some.
+const keyInterval = 10 * time.Millisecond
+
+// specialKeys are the named keys of a key sequence, as sent by a VT100
+// terminal.
+var specialKeys = map[string]string{
+	"enter":    "\r",
+	"return":   "\r",
+	"esc":      "\x1b",
+	"tab":      "\t",
+	"bs":       "\x7f",
+	"del":      "\x1b[3~",
+	"spacebar": " ",
+	"lt":       "<",
+	"gt":       ">",
+	"up":       "\x1b[A",
+	"down":     "\x1b[B",
+	"right":    "\x1b[C",
+	"left":     "\x1b[D",
+	"home":     "\x1b[H",
+	"end":      "\x1b[F",
+	"pageup":   "\x1b[5~",
+	"pagedown": "\x1b[6~",
+	"f1":       "\x1bOP",
+	"f2":       "\x1bOQ",
+	"f3":       "\x1bOR",
+	"f4":       "\x1bOS",
+	"f5":       "\x1b[15~",
+	"f6":       "\x1b[17~",
+	"f7":       "\x1b[18~",
+	"f8":       "\x1b[19~",
+	"f9":       "\x1b[20~",
+	"f10":      "\x1b[21~",
+	"f11":      "\x1b[23~",
+	"f12":      "\x1b[24~",
+}
+
+// KeyStep is a step of a key sequence: either a key to send, written at
+// once since it may be an escape sequence, or a pause.
+type KeyStep struct {
+	Key  string
+	Wait time.Duration
+}
+
+// ParseKeys parses a key sequence: text is sent as is, and names in angle
+// brackets are special keys (<enter>, <esc>, <up>, <f10>...), control keys
+// (<ctrl-c>) or pauses (<wait> for a second, <wait5> or <wait500ms>).
+func ParseKeys(s string) ([]KeyStep, error) {
+	var steps []KeyStep
+	for s != "" {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			steps = appendText(steps, s)
+			break
+		}
+		if i > 0 {
+			steps = appendText(steps, s[:i])
+		}
+		j := strings.IndexByte(s[i:], '>')
+		if j < 0 {
+			return nil, fmt.Errorf("unterminated key name in %q", s[i:])
+		}
+		step, err := parseKey(strings.ToLower(s[i+1 : i+j]))
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+		s = s[i+j+1:]
+	}
+	return steps, nil
+}
+
+// appendText appends the keys typing text to steps.
+func appendText(steps []KeyStep, text string) []KeyStep {
+	for _, r := range text {
+		steps = append(steps, KeyStep{Key: string(r)})
+	}
+	return steps
+}
+
+// parseKey parses the name of a special key.
+func parseKey(name string) (KeyStep, error) {
+	if keys, ok := specialKeys[name]; ok {
+		return KeyStep{Key: keys}, nil
+	}
+	if strings.HasPrefix(name, "ctrl-") && len(name) == len("ctrl-")+1 {
+		c := name[len(name)-1]
+		if c >= 'a' && c <= 'z' || strings.IndexByte("@[\\]^_", c) >= 0 {
+			return KeyStep{Key: string(c & 0x1f)}, nil
+		}
+	}
+	if strings.HasPrefix(name, "wait") {
+		arg := strings.TrimPrefix(name, "wait")
+		if arg == "" {
+			return KeyStep{Wait: time.Second}, nil
+		}
+		if n, err := strconv.Atoi(arg); err == nil && n >= 0 {
+			return KeyStep{Wait: time.Duration(n) * time.Second}, nil
+		}
+		if d, err := time.ParseDuration(arg); err == nil && d >= 0 {
+			return KeyStep{Wait: d}, nil
+		}
+	}
+	return KeyStep{}, fmt.Errorf("unknown key <%s>", name)
+}
+
+// SendKeys types the key sequence keys, see ParseKeys, on the console at
+// path. A socket console serves one client at a time, so it blocks while
+// another client is attached.
+func SendKeys(path, keys string) error {
+	steps, err := ParseKeys(keys)
+	if err != nil {
+		return err
+	}
+	conn, err := open(path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, step := range steps {
+		if step.Wait > 0 {
+			time.Sleep(step.Wait)
+			continue
+		}
+		if _, err := conn.Write([]byte(step.Key)); err != nil {
+			return err
+		}
+		time.Sleep(keyInterval)
+	}
+	return nil
+}
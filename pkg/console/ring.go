@@ -0,0 +1,70 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package console
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// hyperkit logs the console into a fixed size ring buffer file, without
+// recording where it writes next. The ring is followed from a fresh,
+// zero-filled, file: the bytes differing from the previous read, from the
+// position after the last byte written on, are the new output. A byte
+// written again with its previous value is only noticed along with the next
+// different one.
+
+// FollowRing copies to w the output hyperkit writes to the console ring at
+// path, reading it every interval, until writing to w fails. The ring must
+// be empty or missing when following starts, i.e. before hyperkit starts.
+func FollowRing(path string, w io.Writer, interval time.Duration) error {
+	var prev []byte
+	pos := 0
+	for {
+		b, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(b) != len(prev) {
+			// A new ring: hyperkit truncated and extended it with zeros.
+			prev = make([]byte, len(b))
+			pos = 0
+		}
+		if n := len(b); n > 0 {
+			last := -1
+			for k := 0; k < n; k++ {
+				if i := (pos + k) % n; b[i] != prev[i] {
+					last = k
+				}
+			}
+			if last >= 0 {
+				out := make([]byte, 0, last+1)
+				for k := 0; k <= last; k++ {
+					out = append(out, b[(pos+k)%n])
+				}
+				if _, err := w.Write(out); err != nil {
+					return err
+				}
+				copy(prev, b)
+				pos = (pos + last + 1) % n
+			}
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cpio writes cpio archives in the "newc" format the Linux kernel
+// unpacks as initramfs. Archives appended to an initrd are unpacked over it,
+// which adds files to the root filesystem of the guest before it boots.
+package cpio
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	newcMagic = "070701"
+	trailer   = "TRAILER!!!"
+
+	modeDir  = 0040000
+	modeFile = 0100000
+)
+
+// Writer writes a newc archive whose entries are owned by root.
+type Writer struct {
+	w     io.Writer
+	n     int64
+	inode int
+	dirs  map[string]bool
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, inode: 1, dirs: map[string]bool{}}
+}
+
+// WriteDir adds the directory name with the permissions perm.
+func (w *Writer) WriteDir(name string, perm os.FileMode) error {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == trailer || strings.ContainsRune(name, 0) {
+		return fmt.Errorf("invalid directory name %q", name)
+	}
+	if name == "" || w.dirs[name] {
+		return nil
+	}
+	w.dirs[name] = true
+	return w.writeEntry(name, modeDir|uint32(perm&os.ModePerm)|sticky(perm), nil)
+}
+
+// MarkExisting records that the directory name exists in the archives the
+// written one is unpacked over, so that WriteFile doesn't add it again:
+// unpacking a directory resets the owner and permissions of an existing
+// one.
+func (w *Writer) MarkExisting(name string) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name != "" {
+		w.dirs[name] = true
+	}
+}
+
+// WriteFile adds the regular file name with the permissions perm and the
+// content data, preceded by its missing parent directories, created with
+// dirPerm.
+func (w *Writer) WriteFile(name string, perm os.FileMode, data []byte, dirPerm func(dir string) os.FileMode) error {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" || name == trailer || strings.ContainsRune(name, 0) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	var parents []string
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		parents = append([]string{dir}, parents...)
+	}
+	for _, dir := range parents {
+		if err := w.WriteDir(dir, dirPerm(dir)); err != nil {
+			return err
+		}
+	}
+	return w.writeEntry(name, modeFile|uint32(perm&os.ModePerm), data)
+}
+
+// Close writes the trailer of the archive. It doesn't close the underlying
+// writer.
+func (w *Writer) Close() error {
+	return w.writeEntry(trailer, 0, nil)
+}
+
+func sticky(perm os.FileMode) uint32 {
+	if perm&os.ModeSticky != 0 {
+		return 01000
+	}
+	return 0
+}
+
+// writeEntry writes a header, the name and the data, each padded to 4 bytes.
+func (w *Writer) writeEntry(name string, mode uint32, data []byte) error {
+	inode := 0
+	nlink := 1
+	if name != trailer {
+		inode = w.inode
+		w.inode++
+		if mode&modeDir != 0 {
+			nlink = 2
+		}
+	}
+	header := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		newcMagic, inode, mode, 0, 0, nlink, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+	if err := w.write([]byte(header + name + "\x00")); err != nil {
+		return err
+	}
+	if err := w.write(data); err != nil {
+		return err
+	}
+	return nil
+}
+
+// write writes b followed by the zeros aligning the archive to 4 bytes.
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	if err != nil {
+		return err
+	}
+	if pad := (4 - w.n%4) % 4; pad > 0 {
+		n, err = w.w.Write(make([]byte, pad))
+		w.n += int64(n)
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cpio
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// entry is an entry read back from a newc archive.
+type entry struct {
+	name string
+	mode uint32
+	data string
+}
+
+// readArchive parses the newc archive b up to its trailer, checking the
+// alignment of the headers and data.
+func readArchive(t *testing.T, b []byte) []entry {
+	t.Helper()
+	var entries []entry
+	for off := 0; ; {
+		if off%4 != 0 {
+			t.Fatalf("header at offset %d isn't aligned", off)
+		}
+		if len(b)-off < 110 || string(b[off:off+6]) != newcMagic {
+			t.Fatalf("no header at offset %d", off)
+		}
+		field := func(i int) int {
+			v, err := strconv.ParseUint(string(b[off+6+8*i:off+14+8*i]), 16, 32)
+			if err != nil {
+				t.Fatalf("header field %d at offset %d: %v", i, off, err)
+			}
+			return int(v)
+		}
+		mode, size, nameSize := uint32(field(1)), field(6), field(11)
+		nameEnd := off + 110 + nameSize
+		if nameSize == 0 || nameEnd > len(b) || b[nameEnd-1] != 0 {
+			t.Fatalf("bad name size %d at offset %d", nameSize, off)
+		}
+		name := string(b[off+110 : nameEnd-1])
+		dataStart := (nameEnd + 3) &^ 3
+		if dataStart+size > len(b) {
+			t.Fatalf("data of %s past the end of the archive", name)
+		}
+		if name == trailer {
+			if len(b)%4 != 0 {
+				t.Fatalf("archive of %d bytes isn't aligned", len(b))
+			}
+			return entries
+		}
+		entries = append(entries, entry{name: name, mode: mode, data: string(b[dataStart : dataStart+size])})
+		off = (dataStart + size + 3) &^ 3
+	}
+}
+
+func dirPerm(string) os.FileMode {
+	return 0755
+}
+
+func TestWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.MarkExisting("etc")
+	steps := []error{
+		w.WriteFile("etc/ssh/sshd_config", 0600, []byte("PermitRootLogin no\n"), dirPerm),
+		w.WriteFile("/etc/ssh/../ssh/ssh_host_key", 0600, []byte("key"), dirPerm),
+		w.WriteFile("../../root/.ssh/authorized_keys", 0600, []byte("ssh-rsa"), dirPerm),
+		w.WriteDir("tmp", 0777|os.ModeSticky),
+		w.WriteDir("tmp", 0700),
+		w.Close(),
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+	want := []entry{
+		{name: "etc/ssh", mode: modeDir | 0755},
+		{name: "etc/ssh/sshd_config", mode: modeFile | 0600, data: "PermitRootLogin no\n"},
+		{name: "etc/ssh/ssh_host_key", mode: modeFile | 0600, data: "key"},
+		{name: "root", mode: modeDir | 0755},
+		{name: "root/.ssh", mode: modeDir | 0755},
+		{name: "root/.ssh/authorized_keys", mode: modeFile | 0600, data: "ssh-rsa"},
+		{name: "tmp", mode: modeDir | 01777},
+	}
+	if got := readArchive(t, b.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("archive entries = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriterNameLengths(t *testing.T) {
+	// Names of every length modulo 4 keep the data aligned.
+	for n := 1; n <= 8; n++ {
+		var b bytes.Buffer
+		w := NewWriter(&b)
+		name := fmt.Sprintf("%0*d", n, 0)
+		if err := w.WriteFile(name, 0644, []byte("abcde")[:n%5], dirPerm); err != nil {
+			t.Fatalf("WriteFile(%q): %v", name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got := readArchive(t, b.Bytes())
+		if len(got) != 1 || got[0].name != name || got[0].data != "abcde"[:n%5] {
+			t.Errorf("archive of %q = %+v", name, got)
+		}
+	}
+}
+
+func TestWriterInvalidNames(t *testing.T) {
+	for _, name := range []string{"", "/", "..", "a\x00b", trailer} {
+		w := NewWriter(&bytes.Buffer{})
+		if err := w.WriteFile(name, 0644, nil, dirPerm); err == nil {
+			t.Errorf("WriteFile(%q) succeeded, want an error", name)
+		}
+	}
+	for _, name := range []string{"a\x00b", trailer} {
+		w := NewWriter(&bytes.Buffer{})
+		if err := w.WriteDir(name, 0755); err == nil {
+			t.Errorf("WriteDir(%q) succeeded, want an error", name)
+		}
+	}
+}
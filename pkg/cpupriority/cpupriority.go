@@ -0,0 +1,69 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cpupriority lowers the CPU priority of hyperkit processes.
+//
+// macOS has no API to pin the threads of a process to host cores: thread
+// affinity tags are mere scheduling hints, and hyperkit has no pinning option.
+// What it does allow is lowering the scheduling priority and moving a process
+// to the background QoS band, which keeps a busy VM from disrupting
+// latency-sensitive host work.
+package cpupriority
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+const (
+	// Normal leaves the process alone.
+	Normal = "normal"
+	// Low lowers the process priority to LowNice.
+	Low = "low"
+	// Background moves the process to the background QoS band, which
+	// throttles its CPU and I/O whenever the host is busy.
+	Background = "background"
+
+	// LowNice is the nice value of the Low priority.
+	LowNice = 10
+)
+
+// Validate checks priority is one of the supported priorities.
+func Validate(priority string) error {
+	switch priority {
+	case "", Normal, Low, Background:
+		return nil
+	}
+	return fmt.Errorf("invalid CPU priority %q: must be %q, %q or %q", priority, Normal, Low, Background)
+}
+
+// Apply sets the CPU priority of the process pid. The caller needs to own the
+// process or be root.
+func Apply(pid int, priority string) error {
+	switch priority {
+	case "", Normal:
+		return nil
+	case Low:
+		return syscall.Setpriority(syscall.PRIO_PROCESS, pid, LowNice)
+	case Background:
+		if out, err := exec.Command("taskpolicy", "-b", "-p", fmt.Sprint(pid)).CombinedOutput(); err != nil {
+			return fmt.Errorf("taskpolicy: %v: %s", err, out)
+		}
+		return nil
+	}
+	return Validate(priority)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package diagnostics bundles files and command outputs into a tarball
+// attached to bug reports.
+package diagnostics
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// commandTimeout bounds the time a collected command may run.
+const commandTimeout = 10 * time.Second
+
+type entry struct {
+	name string
+	// exactly one of the following is set
+	path    string
+	command []string
+	content []byte
+}
+
+// Collector gathers diagnostics entries. Entries that can't be collected
+// are reported in errors.txt instead of failing the whole collection.
+type Collector struct {
+	entries []entry
+}
+
+// New returns an empty collector.
+func New() *Collector {
+	return &Collector{}
+}
+
+// AddFile collects the file at path as name.
+func (c *Collector) AddFile(name, path string) {
+	c.entries = append(c.entries, entry{name: name, path: path})
+}
+
+// AddCommand collects the combined output of a command as name.
+func (c *Collector) AddCommand(name string, args ...string) {
+	c.entries = append(c.entries, entry{name: name, command: args})
+}
+
+// AddContent collects content as name.
+func (c *Collector) AddContent(name string, content []byte) {
+	c.entries = append(c.entries, entry{name: name, content: content})
+}
+
+// WriteTarball collects all entries into a gzipped tarball at path.
+func (c *Collector) WriteTarball(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	var errs []string
+	now := time.Now()
+	for _, e := range c.entries {
+		content, err := e.collect()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", e.name, err))
+			if content == nil {
+				continue
+			}
+		}
+		if err := writeEntry(tw, e.name, content, now); err != nil {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		if err := writeEntry(tw, "errors.txt", []byte(strings.Join(errs, "\n")+"\n"), now); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (e entry) collect() ([]byte, error) {
+	switch {
+	case e.path != "":
+		return ioutil.ReadFile(e.path)
+	case len(e.command) > 0:
+		return runCommand(e.command)
+	}
+	return e.content, nil
+}
+
+func runCommand(args []string) ([]byte, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-time.After(commandTimeout):
+		cmd.Process.Kill()
+		return out.Bytes(), fmt.Errorf("timed out after %s", commandTimeout)
+	}
+}
+
+func writeEntry(tw *tar.Writer, name string, content []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package disk creates and manages the disk images of the machines through
+// the Backend of their format, so that new formats only need a new Backend.
+package disk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/machine/libmachine/mcnutils"
+	hyperkit "github.com/moby/hyperkit/go"
+)
+
+// Backends
+const (
+	// Sparse images only allocate host storage for the blocks the guest
+	// wrote, and give it back when the guest trims them.
+	Sparse = "sparse"
+	// Raw images are allocated in full on creation, so that the guest
+	// never runs into a full host disk.
+	Raw = "raw"
+
+	// Default is the backend of the machines created without one.
+	Default = Sparse
+)
+
+// mb is the size unit of the disk sizes, in bytes.
+const mb = 1000000
+
+// Backend manages the disk images of one format.
+type Backend interface {
+	// Name returns the name of the backend, as given to New.
+	Name() string
+	// Create creates the image at path, of sizeMB megabytes, starting with
+	// header, e.g. the boot2docker SSH key tarball.
+	Create(path string, sizeMB int, header []byte) error
+	// Attach returns the hyperkit disk serving the image at path.
+	Attach(path string, sizeMB int) hyperkit.Disk
+	// Resize grows the image at path to sizeMB megabytes.
+	Resize(path string, sizeMB int) error
+	// Clone copies the image at src to dst.
+	Clone(src, dst string) error
+	// Delete removes the image at path, if any.
+	Delete(path string) error
+}
+
+var backends = map[string]Backend{
+	Sparse: sparseBackend{},
+	Raw:    rawBackend{},
+}
+
+// New returns the backend name, Default if empty.
+func New(name string) (Backend, error) {
+	if name == "" {
+		name = Default
+	}
+	b, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid disk backend %q: must be one of %s", name, strings.Join(Names(), ", "))
+	}
+	return b, nil
+}
+
+// Names returns the names of the backends.
+func Names() []string {
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sparseBackend stores images as sparse raw files.
+type sparseBackend struct{}
+
+func (sparseBackend) Name() string {
+	return Sparse
+}
+
+func (sparseBackend) Create(path string, sizeMB int, header []byte) error {
+	if err := createImage(path, header); err != nil {
+		return err
+	}
+	return os.Truncate(path, int64(sizeMB)*mb)
+}
+
+func (sparseBackend) Attach(path string, sizeMB int) hyperkit.Disk {
+	return &hyperkit.RawDisk{Path: path, Size: sizeMB, Trim: true}
+}
+
+func (sparseBackend) Resize(path string, sizeMB int) error {
+	if _, err := checkGrowth(path, sizeMB); err != nil {
+		return err
+	}
+	return os.Truncate(path, int64(sizeMB)*mb)
+}
+
+func (sparseBackend) Clone(src, dst string) error {
+	return cloneFile(src, dst)
+}
+
+func (sparseBackend) Delete(path string) error {
+	return deleteImage(path)
+}
+
+// rawBackend stores images as raw files with all their blocks allocated.
+type rawBackend struct{}
+
+func (rawBackend) Name() string {
+	return Raw
+}
+
+func (rawBackend) Create(path string, sizeMB int, header []byte) error {
+	if err := createImage(path, header); err != nil {
+		return err
+	}
+	return allocate(path, int64(len(header)), int64(sizeMB)*mb)
+}
+
+func (rawBackend) Attach(path string, sizeMB int) hyperkit.Disk {
+	// Trimming would give the allocated blocks back to the host.
+	return &hyperkit.RawDisk{Path: path, Size: sizeMB}
+}
+
+func (rawBackend) Resize(path string, sizeMB int) error {
+	size, err := checkGrowth(path, sizeMB)
+	if err != nil {
+		return err
+	}
+	return allocate(path, size, int64(sizeMB)*mb)
+}
+
+func (rawBackend) Clone(src, dst string) error {
+	return cloneFile(src, dst)
+}
+
+func (rawBackend) Delete(path string) error {
+	return deleteImage(path)
+}
+
+// createImage creates the file of a new image at path, starting with header.
+func createImage(path string, header []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing file %s: %v", path, err)
+	}
+	return nil
+}
+
+// checkGrowth returns the current size of the image at path, and an error
+// if it is larger than sizeMB megabytes: images can't shrink without
+// losing data.
+func checkGrowth(path string, sizeMB int) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() > int64(sizeMB)*mb {
+		return 0, fmt.Errorf("can't shrink disk image %s from %dMB to %dMB", path, fi.Size()/mb, sizeMB)
+	}
+	return fi.Size(), nil
+}
+
+// allocate writes zeros from offset from to to in the file at path.
+func allocate(path string, from, to int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	zeros := make([]byte, mb)
+	for offset := from; offset < to; offset += int64(len(zeros)) {
+		n := int64(len(zeros))
+		if to-offset < n {
+			n = to - offset
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			f.Close()
+			return fmt.Errorf("allocating %s: %v", path, err)
+		}
+	}
+	return f.Close()
+}
+
+// cloneFile copies src to dst as an APFS clone, falling back to a regular
+// copy on other filesystems.
+func cloneFile(src, dst string) error {
+	if err := exec.Command("cp", "-c", src, dst).Run(); err == nil {
+		return nil
+	}
+	log.Debugf("Cloning %s failed, copying it", src)
+	return mcnutils.CopyFile(src, dst)
+}
+
+func deleteImage(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package download fetches boot and disk images from the locations plain
+// HTTP downloads don't cover: object storage (s3://, gs://), OCI registry
+// artifacts (oci://) and HTTP servers requiring credentials. Credentials come
+// from the environment, the tools' own configuration or the macOS Keychain.
+package download
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// TokenEnv holds a bearer token sent to the HTTP server of TokenHostEnv.
+const TokenEnv = "HYPERKIT_DOWNLOAD_TOKEN"
+
+// TokenHostEnv holds the host name the bearer token of TokenEnv is sent to.
+const TokenHostEnv = "HYPERKIT_DOWNLOAD_TOKEN_HOST"
+
+// maxRedirects is how many redirects a download follows.
+const maxRedirects = 10
+
+// Backend fetches the URLs it handles into local files.
+type Backend interface {
+	Handles(u *url.URL) bool
+	Fetch(u *url.URL, dest string) error
+}
+
+var backends []Backend
+
+// Register adds a backend, which takes precedence over the ones registered
+// before.
+func Register(b Backend) {
+	backends = append([]Backend{b}, backends...)
+}
+
+func init() {
+	Register(httpBackend{})
+	Register(commandBackend{scheme: "s3", command: func(u *url.URL, dest string) []string {
+		return []string{"aws", "s3", "cp", u.String(), dest}
+	}})
+	Register(commandBackend{scheme: "gs", command: func(u *url.URL, dest string) []string {
+		return []string{"gsutil", "cp", u.String(), dest}
+	}})
+	Register(ociBackend{})
+}
+
+func backendFor(rawURL string) (Backend, *url.URL) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil
+	}
+	for _, b := range backends {
+		if b.Handles(u) {
+			return b, u
+		}
+	}
+	return nil, nil
+}
+
+// Handles tells whether rawURL has to be fetched by this package rather than
+// by a plain HTTP download.
+func Handles(rawURL string) bool {
+	b, _ := backendFor(rawURL)
+	return b != nil
+}
+
+// Fetch downloads rawURL into dest, which is only replaced once the download
+// completed.
+func Fetch(rawURL, dest string) error {
+	b, u := backendFor(rawURL)
+	if b == nil {
+		return fmt.Errorf("no download backend for %s", rawURL)
+	}
+	tmp := dest + ".download"
+	os.Remove(tmp)
+	if err := b.Fetch(u, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("downloading %s: %v", Redact(u), err)
+	}
+	return os.Rename(tmp, dest)
+}
+
+// Redact returns u without its password, for logging.
+func Redact(u *url.URL) string {
+	if _, ok := u.User.Password(); ok {
+		c := *u
+		c.User = url.UserPassword(u.User.Username(), "xxxxx")
+		return c.String()
+	}
+	return u.String()
+}
+
+// commandBackend delegates a scheme to the command line tool of its
+// provider, which picks up the credentials from its usual configuration.
+type commandBackend struct {
+	scheme  string
+	command func(u *url.URL, dest string) []string
+}
+
+func (b commandBackend) Handles(u *url.URL) bool {
+	return u.Scheme == b.scheme
+}
+
+func (b commandBackend) Fetch(u *url.URL, dest string) error {
+	return run(b.command(u, dest))
+}
+
+// ociBackend pulls single file artifacts, e.g.
+// oci://ghcr.io/org/boot2docker:v19.03.12, with oras.
+type ociBackend struct{}
+
+func (ociBackend) Handles(u *url.URL) bool {
+	return u.Scheme == "oci"
+}
+
+func (ociBackend) Fetch(u *url.URL, dest string) error {
+	dir, err := ioutil.TempDir(filepath.Dir(dest), "oci-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	ref := u.Host + u.Path
+	if err := run([]string{"oras", "pull", ref, "-o", dir}); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 || !files[0].Mode().IsRegular() {
+		return fmt.Errorf("artifact %s must contain exactly one file, got %d", ref, len(files))
+	}
+	return os.Rename(filepath.Join(dir, files[0].Name()), dest)
+}
+
+// httpBackend handles the HTTP downloads requiring credentials: a bearer
+// token from TokenEnv for the host of TokenHostEnv, or a user in the URL
+// whose password is either in the URL too or stored in the Keychain as an
+// internet password of the host. The credentials aren't sent on when a
+// redirect leaves the host.
+type httpBackend struct{}
+
+// bearerToken returns the bearer token for the host of u, if any.
+func bearerToken(u *url.URL) string {
+	host := os.Getenv(TokenHostEnv)
+	if host == "" || !strings.EqualFold(host, u.Hostname()) {
+		return ""
+	}
+	return os.Getenv(TokenEnv)
+}
+
+func (httpBackend) Handles(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	return u.User != nil || bearerToken(u) != ""
+}
+
+func (httpBackend) Fetch(u *url.URL, dest string) error {
+	c := *u
+	c.User = nil
+	req, err := http.NewRequest(http.MethodGet, c.String(), nil)
+	if err != nil {
+		return err
+	}
+	if token := bearerToken(u); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if u.User != nil {
+		password, ok := u.User.Password()
+		if !ok {
+			if password, err = keychainPassword(u.Hostname(), u.User.Username()); err != nil {
+				return err
+			}
+		}
+		req.SetBasicAuth(u.User.Username(), password)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if !strings.EqualFold(r.URL.Hostname(), u.Hostname()) || r.URL.Scheme != u.Scheme {
+				r.Header.Del("Authorization")
+			}
+			return nil
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// keychainPassword looks up the internet password of account on host in the
+// login Keychain.
+func keychainPassword(host, account string) (string, error) {
+	out, err := exec.Command("security", "find-internet-password", "-s", host, "-a", account, "-w").Output()
+	if err != nil {
+		return "", fmt.Errorf("no Keychain password for %s@%s: %v", account, host, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func run(args []string) error {
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", strings.Join(args[:2], " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -17,12 +17,17 @@ limitations under the License.
 package drivers
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"syscall"
 
-	"github.com/cloudflare/cfssl/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/disk"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/download"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/lock"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
 	"github.com/leoh0/machine/libmachine/drivers"
 	"github.com/leoh0/machine/libmachine/mcnflag"
 	"github.com/leoh0/machine/libmachine/mcnutils"
@@ -46,30 +51,14 @@ func (d *CommonDriver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	return nil
 }
 
-func createRawDiskImage(sshKeyPath, diskPath string, diskSizeMb int) error {
+// createDiskImage creates the boot2docker disk image with backend, holding
+// the SSH key the guest installs on its first boot.
+func createDiskImage(backend disk.Backend, sshKeyPath, diskPath string, diskSizeMb int) error {
 	tarBuf, err := mcnutils.MakeDiskImage(sshKeyPath)
 	if err != nil {
 		return err
 	}
-
-	file, err := os.OpenFile(diskPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	file.Seek(0, os.SEEK_SET)
-
-	if _, err := file.Write(tarBuf.Bytes()); err != nil {
-		return err
-	}
-	if err := file.Close(); err != nil {
-		return errors.Wrapf(err, "closing file %s", diskPath)
-	}
-
-	if err := os.Truncate(diskPath, int64(diskSizeMb*1000000)); err != nil {
-		return err
-	}
-	return nil
+	return backend.Create(diskPath, diskSizeMb, tarBuf.Bytes())
 }
 
 func publicSSHKeyPath(d *drivers.BaseDriver) string {
@@ -87,11 +76,27 @@ func Restart(d drivers.Driver) error {
 	return nil
 }
 
-func MakeDiskImage(d *drivers.BaseDriver, boot2dockerURL string, diskSize int) error {
-	//TODO(r2d4): rewrite this, not using b2dutils
-	b2dutils := mcnutils.NewB2dUtils(d.StorePath)
-	if err := b2dutils.CopyIsoToMachineDir(boot2dockerURL, d.MachineName); err != nil {
-		return errors.Wrap(err, "Error copying ISO to machine dir")
+// MakeDiskImage copies the ISO into the machine directory and creates the
+// SSH key and the disk image with backend, each unless already there, e.g.
+// restored from a removed machine.
+func MakeDiskImage(d *drivers.BaseDriver, boot2dockerURL string, diskSize int, backend disk.Backend) error {
+	if _, err := os.Stat(d.ResolveStorePath("boot2docker.iso")); err == nil {
+		log.Info("Reusing the ISO in the machine directory")
+	} else if download.Handles(boot2dockerURL) {
+		if err := DownloadImage(d.StorePath, d.ResolveStorePath("."), "boot2docker.iso", boot2dockerURL); err != nil {
+			return errors.Wrap(err, "Error copying ISO to machine dir")
+		}
+	} else {
+		//TODO(r2d4): rewrite this, not using b2dutils
+		b2dutils := mcnutils.NewB2dUtils(d.StorePath)
+		// Concurrent creations share the ISO cache: the first one downloads
+		// it while the others wait, then copy it.
+		err := lock.With(filepath.Join(d.StorePath, "cache", "boot2docker.iso.lock"), func() error {
+			return b2dutils.CopyIsoToMachineDir(boot2dockerURL, d.MachineName)
+		})
+		if err != nil {
+			return errors.Wrap(err, "Error copying ISO to machine dir")
+		}
 	}
 
 	log.Info("Creating ssh key...")
@@ -99,10 +104,10 @@ func MakeDiskImage(d *drivers.BaseDriver, boot2dockerURL string, diskSize int) e
 		return err
 	}
 
-	log.Info("Creating raw disk image...")
+	log.Infof("Creating %s disk image...", backend.Name())
 	diskPath := GetDiskPath(d)
 	if _, err := os.Stat(diskPath); os.IsNotExist(err) {
-		if err := createRawDiskImage(publicSSHKeyPath(d), diskPath, diskSize); err != nil {
+		if err := createDiskImage(backend, publicSSHKeyPath(d), diskPath, diskSize); err != nil {
 			return err
 		}
 		if err := fixPermissions(d.ResolveStorePath(".")); err != nil {
@@ -112,6 +117,84 @@ func MakeDiskImage(d *drivers.BaseDriver, boot2dockerURL string, diskSize int) e
 	return nil
 }
 
+// DownloadImage downloads imageURL as dir/file, through package download for
+// the URLs it handles and as a plain HTTP download otherwise.
+func DownloadImage(storePath, dir, file, imageURL string) error {
+	if download.Handles(imageURL) {
+		log.Infof("Downloading %s...", file)
+		return download.Fetch(imageURL, filepath.Join(dir, file))
+	}
+	return mcnutils.NewB2dUtils(storePath).DownloadISO(dir, file, imageURL)
+}
+
+// MakeCloudDiskImage downloads the cloud image at imageURL and uses it as the
+// machine disk, grown to diskSize megabytes by backend.
+func MakeCloudDiskImage(d *drivers.BaseDriver, imageURL string, diskSize int, backend disk.Backend) error {
+	log.Info("Creating ssh key...")
+	if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
+		return err
+	}
+
+	diskPath := GetDiskPath(d)
+	if _, err := os.Stat(diskPath); os.IsNotExist(err) {
+		if err := DownloadImage(d.StorePath, d.ResolveStorePath("."), filepath.Base(diskPath), imageURL); err != nil {
+			return errors.Wrap(err, "Error copying cloud image to machine dir")
+		}
+
+		format, err := DetectImageFormat(diskPath)
+		if err != nil {
+			return err
+		}
+		if format != ImageFormatRaw {
+			backend.Delete(diskPath)
+			return fmt.Errorf("cloud image %s is in %s format, only raw disk images are supported "+
+				"(convert it with: qemu-img convert -O raw <image> <image>.raw)", imageURL, format)
+		}
+
+		fi, err := os.Stat(diskPath)
+		if err != nil {
+			return err
+		}
+		if size := int64(diskSize * 1000000); fi.Size() < size {
+			log.Infof("Growing cloud image to %d MB...", diskSize)
+			if err := backend.Resize(diskPath, diskSize); err != nil {
+				return err
+			}
+		}
+		if err := fixPermissions(d.ResolveStorePath(".")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Image formats reported by DetectImageFormat
+const (
+	ImageFormatISO   = "iso"
+	ImageFormatQcow2 = "qcow2"
+	ImageFormatRaw   = "raw"
+)
+
+// DetectImageFormat sniffs the format of the image at path.
+func DetectImageFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err == nil && bytes.Equal(magic, []byte{'Q', 'F', 'I', 0xfb}) {
+		return ImageFormatQcow2, nil
+	}
+	// ISO9660 primary volume descriptor identifier at sector 16
+	id := make([]byte, 5)
+	if _, err := f.ReadAt(id, 0x8001); err == nil && string(id) == "CD001" {
+		return ImageFormatISO, nil
+	}
+	return ImageFormatRaw, nil
+}
+
 func fixPermissions(path string) error {
 	os.Chown(path, syscall.Getuid(), syscall.Getegid())
 	files, _ := ioutil.ReadDir(path)
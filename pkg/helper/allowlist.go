@@ -0,0 +1,66 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helper
+
+import (
+	"fmt"
+)
+
+// Scopes are the driver operations performing privileged operations.
+const (
+	ScopeStart  = "start"
+	ScopeStop   = "stop"
+	ScopeKill   = "kill"
+	ScopeRemove = "remove"
+	// ScopeIPChange follows a change of the VM address noticed outside
+	// of the driver operations above, see Driver.GetIP.
+	ScopeIPChange = "ip-change"
+	// ScopeGC removes the exports of machines that no longer exist, see
+	// hyperkit.GCExports.
+	ScopeGC = "gc"
+)
+
+// allowlist lists the privileged operations each scope may perform, as
+// defense in depth against a driver doing more than it should: only Start
+// attaches VMs to vmnet, and only Start and IP address changes export
+// shares. The scope of a request is that claimed by the client, so it is no
+// boundary against other clients, see checkOwner.
+var allowlist = map[string][]string{
+	ScopeStart:    {OpStartVM, OpSignal, OpAddExport, OpRemoveExport, OpReloadNFS, OpWriteResolver, OpSetVMNetSubnet},
+	ScopeStop:     {OpSignal, OpRemoveExport, OpReloadNFS, OpRemoveResolver},
+	ScopeKill:     {OpSignal, OpRemoveResolver},
+	ScopeRemove:   {OpRemoveResolver},
+	ScopeIPChange: {OpAddExport, OpRemoveExport, OpReloadNFS, OpWriteResolver},
+	ScopeGC:       {OpRemoveExport, OpReloadNFS},
+}
+
+// Authorize returns an error unless scope may perform the privileged
+// operation op.
+func Authorize(scope, op string) error {
+	if op == OpPing {
+		return nil
+	}
+	for _, allowed := range allowlist[scope] {
+		if op == allowed {
+			return nil
+		}
+	}
+	if scope == "" {
+		return fmt.Errorf("privileged operation %q outside of a driver operation is not allowed", op)
+	}
+	return fmt.Errorf("privileged operation %q is not allowed during %s", op, scope)
+}
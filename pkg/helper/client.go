@@ -0,0 +1,122 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helper
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+const dialTimeout = 5 * time.Second
+
+// Client talks to the privileged helper.
+type Client struct {
+	SocketPath string
+	// Scope is sent along with every request, see Authorize.
+	Scope string
+}
+
+// NewClient returns a client for the helper listening on socketPath, or on
+// DefaultSocketPath if empty.
+func NewClient(socketPath string) *Client {
+	if socketPath == "" {
+		socketPath = DefaultSocketPath
+	}
+	return &Client{SocketPath: socketPath}
+}
+
+func (c *Client) call(req *Request) (*Response, error) {
+	req.Scope = c.Scope
+	conn, err := net.DialTimeout("unix", c.SocketPath, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	resp := &Response{}
+	if err := json.NewDecoder(conn).Decode(resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// Ping checks the helper is reachable.
+func (c *Client) Ping() error {
+	_, err := c.call(&Request{Op: OpPing})
+	return err
+}
+
+// AddExport adds the export of share with options under identifier to
+// /etc/exports.
+func (c *Client) AddExport(identifier, share, options string) error {
+	_, err := c.call(&Request{Op: OpAddExport, Export: &ExportRequest{Identifier: identifier, Share: share, Options: options}})
+	return err
+}
+
+// RemoveExport removes the export identified by identifier from /etc/exports.
+func (c *Client) RemoveExport(identifier string) error {
+	_, err := c.call(&Request{Op: OpRemoveExport, Export: &ExportRequest{Identifier: identifier}})
+	return err
+}
+
+// ReloadNFS makes nfsd pick up /etc/exports changes.
+func (c *Client) ReloadNFS() error {
+	_, err := c.call(&Request{Op: OpReloadNFS})
+	return err
+}
+
+// StartVM starts hyperkit and returns its pid.
+func (c *Client) StartVM(start *StartRequest) (int, error) {
+	resp, err := c.call(&Request{Op: OpStartVM, Start: start})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Pid, nil
+}
+
+// Signal sends sig to the hyperkit process pid.
+func (c *Client) Signal(pid int, sig syscall.Signal) error {
+	_, err := c.call(&Request{Op: OpSignal, Signal: &SignalRequest{Pid: pid, Signal: int(sig)}})
+	return err
+}
+
+// WriteResolver points the resolution of domain at ip.
+func (c *Client) WriteResolver(domain, ip string) error {
+	_, err := c.call(&Request{Op: OpWriteResolver, Resolver: &ResolverRequest{Domain: domain, IP: ip}})
+	return err
+}
+
+// RemoveResolver removes the resolver entry of domain.
+func (c *Client) RemoveResolver(domain string) error {
+	_, err := c.call(&Request{Op: OpRemoveResolver, Resolver: &ResolverRequest{Domain: domain}})
+	return err
+}
+
+// SetVMNetSubnet makes subnet the vmnet shared network.
+func (c *Client) SetVMNetSubnet(subnet string) error {
+	_, err := c.call(&Request{Op: OpSetVMNetSubnet, Subnet: subnet})
+	return err
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helper
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// adminGID is the gid of the admin group of macOS.
+const adminGID = 80
+
+// ExportLine builds the /etc/exports line exporting share with options for
+// the user uid. The options may not name another path than the share and,
+// unless uid is root, must pass checkMapping.
+func ExportLine(share, options string, uid int) (string, error) {
+	if !filepath.IsAbs(share) || strings.ContainsAny(share, "\"\r\n") {
+		return "", fmt.Errorf("invalid NFS share %q", share)
+	}
+	if strings.ContainsAny(options, "\"\r\n") {
+		return "", fmt.Errorf("invalid NFS export options %q", options)
+	}
+	for _, opt := range strings.Fields(options) {
+		if strings.HasPrefix(opt, "/") {
+			return "", fmt.Errorf("the NFS export options %q name another path than %s", options, share)
+		}
+	}
+	if uid != 0 {
+		if err := checkMapping(share, strings.Fields(options), uid); err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(`"` + share + `" ` + options), nil
+}
+
+// checkMapping fails unless the export options of share are safe for the
+// user uid. They may not map the clients to root, and, as the user is root
+// in the guest, which NFS passes its uids through from, they must map every
+// access to the user with -mapall, or else the share and everything below it
+// must belong to the user.
+func checkMapping(share string, options []string, uid int) error {
+	mapsAll := false
+	for _, opt := range options {
+		m, ok, err := parseMapOption(opt)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if root, _ := MapsToRoot(opt); root {
+			return fmt.Errorf("the NFS export option %s maps to root", opt)
+		}
+		if !m.all || m.uid != uid {
+			mapsAll = false
+			break
+		}
+		if err := checkGroups(opt, m.gids, uid); err != nil {
+			return err
+		}
+		mapsAll = true
+	}
+	if mapsAll {
+		return nil
+	}
+	if err := checkTreeOwner(share, uid); err != nil {
+		return fmt.Errorf("%v; map every access to uid %d with -mapall to export it", err, uid)
+	}
+	return nil
+}
+
+// checkGroups fails unless the user uid is a member of the groups gids the
+// option opt maps to.
+func checkGroups(opt string, gids []int, uid int) error {
+	if len(gids) == 0 {
+		return nil
+	}
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return err
+	}
+	groups, err := u.GroupIds()
+	if err != nil {
+		return err
+	}
+	member := map[string]bool{u.Gid: true}
+	for _, g := range groups {
+		member[g] = true
+	}
+	for _, gid := range gids {
+		if !member[strconv.Itoa(gid)] {
+			return fmt.Errorf("the NFS export option %s maps to gid %d, which uid %d isn't a member of", opt, gid, uid)
+		}
+	}
+	return nil
+}
+
+// checkTreeOwner fails unless dir and everything below it belong to uid.
+func checkTreeOwner(dir string, uid int) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok || int(st.Uid) != uid {
+			return fmt.Errorf("%s doesn't belong to uid %d", path, uid)
+		}
+		return nil
+	})
+}
+
+// MapsToRoot tells whether the -maproot or -mapall option opt maps the
+// clients to root or to the wheel or admin groups.
+func MapsToRoot(opt string) (bool, error) {
+	m, ok, err := parseMapOption(opt)
+	if err != nil || !ok {
+		return false, err
+	}
+	if m.uid == 0 {
+		return true, nil
+	}
+	for _, gid := range m.gids {
+		if gid == 0 || gid == adminGID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mapOption is the credential a -maproot or -mapall option maps the
+// clients to.
+type mapOption struct {
+	all  bool
+	uid  int
+	gids []int
+}
+
+// parseMapOption parses the -maproot or -mapall option opt,
+// "-mapall=user[:group[:group...]]", the way mountd does: ids are numbers,
+// leading zeros included, or names, and a user without groups gets those of
+// the user database. ok is false for other options.
+func parseMapOption(opt string) (m mapOption, ok bool, err error) {
+	kv := strings.SplitN(opt, "=", 2)
+	if len(kv) != 2 || (kv[0] != "-maproot" && kv[0] != "-mapall") {
+		return mapOption{}, false, nil
+	}
+	m.all = kv[0] == "-mapall"
+	ids := strings.Split(kv[1], ":")
+	u, uid, err := lookupMapUser(ids[0])
+	if err != nil {
+		return mapOption{}, false, fmt.Errorf("the NFS export option %s: %v", opt, err)
+	}
+	m.uid = uid
+	for _, g := range ids[1:] {
+		gid, err := lookupMapGroup(g)
+		if err != nil {
+			return mapOption{}, false, fmt.Errorf("the NFS export option %s: %v", opt, err)
+		}
+		m.gids = append(m.gids, gid)
+	}
+	if len(ids) == 1 && u != nil {
+		groups, err := u.GroupIds()
+		if err != nil {
+			return mapOption{}, false, fmt.Errorf("the NFS export option %s: looking up the groups of %s: %v", opt, u.Username, err)
+		}
+		for _, g := range groups {
+			gid, err := strconv.Atoi(g)
+			if err != nil {
+				return mapOption{}, false, fmt.Errorf("the NFS export option %s: invalid gid %q", opt, g)
+			}
+			m.gids = append(m.gids, gid)
+		}
+	}
+	return m, true, nil
+}
+
+// lookupMapUser returns the uid of the user name or id s, along with the
+// user if known.
+func lookupMapUser(s string) (*user.User, int, error) {
+	if uid, err := strconv.Atoi(s); err == nil {
+		u, _ := user.LookupId(strconv.Itoa(uid))
+		return u, uid, nil
+	}
+	u, err := user.Lookup(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid uid %q of %s", u.Uid, s)
+	}
+	return u, uid, nil
+}
+
+// lookupMapGroup returns the gid of the group name or id s.
+func lookupMapGroup(s string) (int, error) {
+	if gid, err := strconv.Atoi(s); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("invalid gid %q of %s", g.Gid, s)
+	}
+	return gid, nil
+}
+
+// ExportIdentifierPrefix starts the identifiers of the /etc/exports entries
+// of the machine shares.
+const ExportIdentifierPrefix = "minikube-hyperkit "
+
+// ExportOwner is what the identifier of an /etc/exports entry records about
+// it: the uid of the user who added it, the directory of its machine and
+// its share.
+type ExportOwner struct {
+	UID        int
+	MachineDir string
+	Share      string
+}
+
+// ExportIdentifier returns the identifier of the export of share added by
+// uid for the machine stored in machineDir.
+func ExportIdentifier(uid int, machineDir, share string) string {
+	return fmt.Sprintf("%suid=%d dir=%q share=%q", ExportIdentifierPrefix, uid, machineDir, share)
+}
+
+// ParseExportIdentifier returns the owner of an identifier of
+// ExportIdentifier. Identifiers of older drivers, which only recorded the
+// machine name, aren't parsed.
+func ParseExportIdentifier(identifier string) (*ExportOwner, bool) {
+	if !strings.HasPrefix(identifier, ExportIdentifierPrefix) {
+		return nil, false
+	}
+	o := &ExportOwner{}
+	rest := strings.TrimPrefix(identifier, ExportIdentifierPrefix)
+	if _, err := fmt.Sscanf(rest, "uid=%d dir=%q share=%q", &o.UID, &o.MachineDir, &o.Share); err != nil {
+		return nil, false
+	}
+	if ExportIdentifier(o.UID, o.MachineDir, o.Share) != identifier {
+		return nil, false
+	}
+	return o, true
+}
+
+// LegacyExportShare returns the share of an identifier of older drivers,
+// "<prefix><machine>-<share>". Machine names can't hold a "/", which
+// starts shares.
+func LegacyExportShare(identifier string) (string, bool) {
+	if !strings.HasPrefix(identifier, ExportIdentifierPrefix) {
+		return "", false
+	}
+	rest := strings.TrimPrefix(identifier, ExportIdentifierPrefix)
+	i := strings.Index(rest, "-/")
+	if i <= 0 {
+		return "", false
+	}
+	return rest[i+1:], true
+}
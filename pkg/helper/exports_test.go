@@ -0,0 +1,174 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helper
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMapsToRoot(t *testing.T) {
+	for _, tt := range []struct {
+		opt  string
+		want bool
+	}{
+		{"-maproot=0", true},
+		{"-maproot=00", true},
+		{"-maproot=0000", true},
+		{"-maproot=root", true},
+		{"-maproot=0:20", true},
+		{"-mapall=root:staff", true},
+		{"-mapall=501:0", true},
+		{"-mapall=501:00", true},
+		{"-mapall=501:80", true},
+		{"-mapall=501:0080", true},
+		{"-mapall=501:wheel", true},
+		{"-mapall=501:admin", true},
+		{"-mapall=501:20:80", true},
+		{"-mapall=501:20", false},
+		{"-maproot=501:20:12", false},
+		{"-mapall=65432", false},
+		{"-alldirs", false},
+		{"-ro", false},
+		{"-network=192.168.64.0", false},
+	} {
+		got, err := MapsToRoot(tt.opt)
+		if err != nil {
+			t.Errorf("MapsToRoot(%q): %v", tt.opt, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("MapsToRoot(%q) = %v, want %v", tt.opt, got, tt.want)
+		}
+	}
+}
+
+func TestMapsToRootUnknownNames(t *testing.T) {
+	for _, opt := range []string{
+		"-maproot=no-such-user",
+		"-mapall=501:no-such-group",
+	} {
+		if _, err := MapsToRoot(opt); err == nil {
+			t.Errorf("MapsToRoot(%q) succeeded, want an error", opt)
+		}
+	}
+}
+
+func TestParseMapOption(t *testing.T) {
+	m, ok, err := parseMapOption("-mapall=0501:020:80")
+	if err != nil || !ok {
+		t.Fatalf("parseMapOption() = %v, %v", ok, err)
+	}
+	if want := (mapOption{all: true, uid: 501, gids: []int{20, 80}}); !reflect.DeepEqual(m, want) {
+		t.Errorf("parseMapOption() = %+v, want %+v", m, want)
+	}
+	if _, ok, _ := parseMapOption("-mapallx=0"); ok {
+		t.Error("parseMapOption() parsed -mapallx")
+	}
+}
+
+func TestExportLine(t *testing.T) {
+	for _, tt := range []struct {
+		share, options string
+	}{
+		{"Users", ""},
+		{"/Users/a\"b", ""},
+		{"/Users/a\nb", ""},
+		{"/Users", "-alldirs\n/etc -maproot=0"},
+		{"/Users", "-alldirs\" /etc"},
+		{"/Users", "-alldirs /etc"},
+	} {
+		if line, err := ExportLine(tt.share, tt.options, 0); err == nil {
+			t.Errorf("ExportLine(%q, %q) = %q, want an error", tt.share, tt.options, line)
+		}
+	}
+	line, err := ExportLine("/Users", "-alldirs -maproot=0 -network 192.168.64.0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"/Users" -alldirs -maproot=0 -network 192.168.64.0`; line != want {
+		t.Errorf("ExportLine() = %q, want %q", line, want)
+	}
+}
+
+func TestExportLineMapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The share belongs to the caller, not to uid.
+	const uid = 65432
+	for _, tt := range []struct {
+		options string
+		ok      bool
+	}{
+		{"-alldirs", false},
+		{"-alldirs -mapall=65432", true},
+		{"-alldirs -mapall=065432", true},
+		{"-alldirs -mapall=65433", false},
+		{"-alldirs -maproot=65432", false},
+		{"-alldirs -mapall=65432:0", false},
+		{"-alldirs -mapall=65432 -maproot=0", false},
+		{"-alldirs -maproot=0 -mapall=65432", false},
+	} {
+		_, err := ExportLine(dir, tt.options, uid)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("ExportLine(%q) for uid %d: %v, want ok %v", tt.options, uid, err, tt.ok)
+		}
+	}
+
+	if caller := os.Getuid(); caller != 0 {
+		if _, err := ExportLine(dir, "-alldirs", caller); err != nil {
+			t.Errorf("ExportLine() of a share of the caller: %v", err)
+		}
+		if _, err := ExportLine(dir, "-alldirs -maproot=0", caller); err == nil {
+			t.Error("ExportLine() with -maproot=0 succeeded for the caller, want an error")
+		}
+	}
+}
+
+func TestParseExportIdentifier(t *testing.T) {
+	id := ExportIdentifier(501, `/Users/me/.minikube/machines/a "b"`, "/Users/me")
+	o, ok := ParseExportIdentifier(id)
+	if !ok {
+		t.Fatalf("ParseExportIdentifier(%q) failed", id)
+	}
+	if want := (ExportOwner{UID: 501, MachineDir: `/Users/me/.minikube/machines/a "b"`, Share: "/Users/me"}); *o != want {
+		t.Errorf("ParseExportIdentifier() = %+v, want %+v", *o, want)
+	}
+	for _, id := range []string{
+		id + " extra",
+		"minikube-hyperkit minikube-/Users",
+		"other uid=501 dir=\"/a\" share=\"/b\"",
+	} {
+		if _, ok := ParseExportIdentifier(id); ok {
+			t.Errorf("ParseExportIdentifier(%q) succeeded", id)
+		}
+	}
+	if share, ok := LegacyExportShare("minikube-hyperkit minikube-/Users"); !ok || share != "/Users" {
+		t.Errorf("LegacyExportShare() = %q, %v, want /Users", share, ok)
+	}
+}
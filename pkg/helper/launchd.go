@@ -0,0 +1,78 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const launchdPlistTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%s</string>
+		<string>helper</string>
+		<string>run</string>
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardErrorPath</key>
+	<string>/var/log/%s.log</string>
+</dict>
+</plist>
+`
+
+// PlistPath is where the launchd job of the helper is installed.
+func PlistPath() string {
+	return filepath.Join("/Library/LaunchDaemons", Label+".plist")
+}
+
+// Install registers executable as the helper launchd daemon and starts it.
+// It has to be run as root.
+func Install(executable string) error {
+	plist := fmt.Sprintf(launchdPlistTemplate, Label, executable, Label)
+	if err := ioutil.WriteFile(PlistPath(), []byte(plist), 0644); err != nil {
+		return err
+	}
+	return launchctl("load", "-w", PlistPath())
+}
+
+// Uninstall stops and unregisters the helper launchd daemon.
+func Uninstall() error {
+	if err := launchctl("unload", "-w", PlistPath()); err != nil {
+		return err
+	}
+	return os.Remove(PlistPath())
+}
+
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %v: %v: %s", args, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helper
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerUID returns the user id of the process on the other end of conn,
+// as reported by the kernel with LOCAL_PEERCRED.
+func peerUID(conn net.Conn) (int, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("%s is not a unix socket connection", conn.RemoteAddr())
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *unix.Xucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, fmt.Errorf("reading the peer credentials: %v", credErr)
+	}
+	return int(cred.Uid), nil
+}
+
+// checkOwner fails unless path, which mustn't be a symbolic link, belongs
+// to uid. Root may use any path.
+func checkOwner(path string, uid int) error {
+	if uid == 0 {
+		return nil
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing %s: it is a symlink", path)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Uid) != uid {
+		return fmt.Errorf("refusing %s: it isn't owned by uid %d", path, uid)
+	}
+	return nil
+}
+
+// checkExportOwner fails unless the export identified by identifier was
+// added by uid. The entries of older drivers don't record who added them;
+// they are accepted from the owner of their share. Root may use any entry.
+func checkExportOwner(identifier string, uid int) error {
+	if uid == 0 {
+		return nil
+	}
+	if o, ok := ParseExportIdentifier(identifier); ok {
+		if o.UID != uid {
+			return fmt.Errorf("refusing the export %q: it belongs to uid %d", identifier, o.UID)
+		}
+		return nil
+	}
+	if share, ok := LegacyExportShare(identifier); ok {
+		return checkOwner(share, uid)
+	}
+	return fmt.Errorf("refusing the export %q: not an export of the driver", identifier)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package helper implements the privileged helper of the hyperkit driver.
+//
+// The helper is a small daemon managed by launchd that runs as root and
+// performs, on behalf of an unprivileged driver, the few operations needing
+// elevated permissions: starting hyperkit (which attaches to vmnet), editing
+// /etc/exports, /etc/resolver and the vmnet configuration, and reloading
+// nfsd. The driver talks to it through JSON messages over a unix socket, one
+// request per connection.
+package helper
+
+import (
+	hyperkit "github.com/moby/hyperkit/go"
+)
+
+const (
+	// Label is the launchd label of the helper.
+	Label = "io.github.leoh0.docker-machine-driver-hyperkit.helper"
+	// DefaultSocketPath is where the helper listens.
+	DefaultSocketPath = "/var/run/docker-machine-driver-hyperkit.sock"
+	// HyperKitDir is where root installs the hyperkit binaries pinned with
+	// --hyperkit-binary-url, see TrustedBinary.
+	HyperKitDir = "/Library/Application Support/docker-machine-driver-hyperkit/hyperkit"
+)
+
+// Operations understood by the helper
+const (
+	OpPing           = "ping"
+	OpAddExport      = "add-export"
+	OpRemoveExport   = "remove-export"
+	OpReloadNFS      = "reload-nfs"
+	OpStartVM        = "start-vm"
+	OpSignal         = "signal"
+	OpWriteResolver  = "write-resolver"
+	OpRemoveResolver = "remove-resolver"
+	OpSetVMNetSubnet = "set-vmnet-subnet"
+)
+
+// Request is sent by the driver to the helper.
+type Request struct {
+	Op       string           `json:"op"`
+	Export   *ExportRequest   `json:"export,omitempty"`
+	Start    *StartRequest    `json:"start,omitempty"`
+	Signal   *SignalRequest   `json:"signal,omitempty"`
+	Resolver *ResolverRequest `json:"resolver,omitempty"`
+	// Subnet is the CIDR of the vmnet shared network to set.
+	Subnet string `json:"subnet,omitempty"`
+	// Scope is the driver operation the request is made for, see
+	// Authorize.
+	Scope string `json:"scope,omitempty"`
+}
+
+// ExportRequest adds or removes an /etc/exports entry. The helper builds
+// the line of an added entry from Share, which must belong to the client,
+// and Options, see ExportLine.
+type ExportRequest struct {
+	Identifier string `json:"identifier"`
+	Share      string `json:"share,omitempty"`
+	Options    string `json:"options,omitempty"`
+}
+
+// Disk is a raw disk attached to the VM.
+type Disk struct {
+	Path string `json:"path"`
+	Size int    `json:"size"`
+	Trim bool   `json:"trim"`
+}
+
+// StartRequest describes the hyperkit VM to start. It mirrors the subset of
+// the hyperkit configuration used by the driver. The state directory and the
+// files of the VM must belong to the client.
+type StartRequest struct {
+	// HyperKit is the hyperkit binary, looked up by moby/hyperkit/go if
+	// empty. It must be owned by root, see TrustedBinary.
+	HyperKit  string   `json:"hyperkit,omitempty"`
+	StateDir  string   `json:"state_dir"`
+	Kernel    string   `json:"kernel,omitempty"`
+	Initrd    string   `json:"initrd,omitempty"`
+	Bootrom   string   `json:"bootrom,omitempty"`
+	Cmdline   string   `json:"cmdline"`
+	CPUs      int      `json:"cpus"`
+	Memory    int      `json:"memory"`
+	UUID      string   `json:"uuid"`
+	ISOImages []string `json:"iso_images"`
+	Disks     []Disk   `json:"disks"`
+	// Serials overrides the default file console when set.
+	Serials []hyperkit.Serial `json:"serials,omitempty"`
+
+	VSock      bool  `json:"vsock,omitempty"`
+	VSockPorts []int `json:"vsock_ports,omitempty"`
+	// VPNKitSock attaches a vpnkit network interface in addition to vmnet.
+	VPNKitSock string `json:"vpnkit_sock,omitempty"`
+	VPNKitUUID string `json:"vpnkit_uuid,omitempty"`
+	// CPUPriority is applied to the started process, see package
+	// cpupriority.
+	CPUPriority string `json:"cpu_priority,omitempty"`
+}
+
+// SignalRequest sends a signal to a hyperkit process started by the helper.
+type SignalRequest struct {
+	Pid    int `json:"pid"`
+	Signal int `json:"signal"`
+}
+
+// ResolverRequest writes or removes the /etc/resolver entry of a domain.
+type ResolverRequest struct {
+	Domain string `json:"domain"`
+	IP     string `json:"ip,omitempty"`
+}
+
+// Response is sent back by the helper.
+type Response struct {
+	Error string `json:"error,omitempty"`
+	Pid   int    `json:"pid,omitempty"`
+}
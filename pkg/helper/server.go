@@ -0,0 +1,363 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	nfsexports "github.com/johanneswuerbach/nfsexports"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/cpupriority"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/lock"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/resolver"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/vmnetconf"
+	ps "github.com/mitchellh/go-ps"
+	hyperkit "github.com/moby/hyperkit/go"
+)
+
+// socketGroup is allowed to talk to the helper.
+const socketGroup = "staff"
+
+// exportsLock is the host-wide lock of /etc/exports, also taken by the
+// drivers editing it as root, see lock.HostPath.
+const exportsLock = "exports"
+
+// exportsMu serializes the edits of /etc/exports and the nfsd reloads of
+// concurrent requests: the lock files of the clients only serialize the
+// processes of a user, see lock.HostPath.
+var exportsMu sync.Mutex
+
+// Serve listens on socketPath and handles requests until the listener fails.
+func Serve(socketPath string) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	if err := restrictSocket(socketPath); err != nil {
+		return err
+	}
+
+	log.Infof("Privileged helper listening on %s", socketPath)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go handle(conn)
+	}
+}
+
+// restrictSocket lets only root and socketGroup members connect.
+func restrictSocket(socketPath string) error {
+	g, err := user.LookupGroup(socketGroup)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(socketPath, 0, gid); err != nil {
+		return err
+	}
+	return os.Chmod(socketPath, 0660)
+}
+
+func handle(conn net.Conn) {
+	defer conn.Close()
+
+	req := &Request{}
+	resp := &Response{}
+	uid, err := peerUID(conn)
+	if err != nil {
+		log.Warnf("helper: %v", err)
+		resp.Error = err.Error()
+	} else if err := json.NewDecoder(conn).Decode(req); err != nil {
+		resp.Error = fmt.Sprintf("decoding request: %v", err)
+	} else if err := dispatch(req, resp, uid); err != nil {
+		log.Warnf("helper: %s failed: %v", req.Op, err)
+		resp.Error = err.Error()
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Warnf("helper: writing response: %v", err)
+	}
+}
+
+// dispatch performs req for the client running as uid.
+func dispatch(req *Request, resp *Response, uid int) error {
+	log.Debugf("helper: %s for %s by uid %d", req.Op, req.Scope, uid)
+	if err := Authorize(req.Scope, req.Op); err != nil {
+		return err
+	}
+	switch req.Op {
+	case OpPing:
+		return nil
+	case OpAddExport:
+		if req.Export == nil {
+			return fmt.Errorf("missing export")
+		}
+		return lock.With(lock.HostPath(exportsLock), func() error {
+			return AddExport(req.Export, uid)
+		})
+	case OpRemoveExport:
+		if req.Export == nil {
+			return fmt.Errorf("missing export")
+		}
+		return lock.With(lock.HostPath(exportsLock), func() error {
+			return RemoveExport(req.Export.Identifier, uid)
+		})
+	case OpReloadNFS:
+		exportsMu.Lock()
+		defer exportsMu.Unlock()
+		// The helper runs as root, nfsd is reloaded without sudo.
+		if out, err := exec.Command("/sbin/nfsd", "update").CombinedOutput(); err != nil {
+			return fmt.Errorf("reloading nfsd: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	case OpStartVM:
+		if req.Start == nil {
+			return fmt.Errorf("missing VM specification")
+		}
+		pid, err := startVM(req.Start, uid)
+		resp.Pid = pid
+		return err
+	case OpSignal:
+		if req.Signal == nil {
+			return fmt.Errorf("missing signal")
+		}
+		return signal(req.Signal, uid)
+	case OpWriteResolver:
+		if req.Resolver == nil {
+			return fmt.Errorf("missing resolver")
+		}
+		return resolver.Write(req.Resolver.Domain, req.Resolver.IP, uid)
+	case OpRemoveResolver:
+		if req.Resolver == nil {
+			return fmt.Errorf("missing resolver")
+		}
+		return resolver.Remove(req.Resolver.Domain, uid)
+	case OpSetVMNetSubnet:
+		subnet, err := vmnetconf.ParseSubnet(req.Subnet)
+		if err != nil {
+			return err
+		}
+		// The subnet is that of every VM on the host.
+		if uid != 0 {
+			pid, err := otherUserVM(uid)
+			if err != nil {
+				return err
+			}
+			if pid != 0 {
+				return fmt.Errorf("refusing to change the vmnet subnet: the VM of hyperkit %d of another user is running", pid)
+			}
+		}
+		return vmnetconf.Write(subnet)
+	}
+	return fmt.Errorf("unknown operation %q", req.Op)
+}
+
+// AddExport adds the /etc/exports entry of export for the user uid, who must
+// own its share and machine directory, see ExportLine. It is also used by the
+// driver running as root on behalf of uid.
+func AddExport(export *ExportRequest, uid int) error {
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	if err := checkOwner(export.Share, uid); err != nil {
+		return err
+	}
+	o, ok := ParseExportIdentifier(export.Identifier)
+	if !ok || o.Share != export.Share {
+		return fmt.Errorf("invalid export identifier %q for %s", export.Identifier, export.Share)
+	}
+	if uid != 0 && o.UID != uid {
+		return fmt.Errorf("refusing the export %q: it names uid %d", export.Identifier, o.UID)
+	}
+	if err := checkOwner(o.MachineDir, uid); err != nil {
+		return err
+	}
+	line, err := ExportLine(export.Share, export.Options, uid)
+	if err != nil {
+		return err
+	}
+	_, err = nfsexports.Add("", export.Identifier, line)
+	return err
+}
+
+// RemoveExport removes the /etc/exports entry identifier added by the user
+// uid.
+func RemoveExport(identifier string, uid int) error {
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	if err := checkExportOwner(identifier, uid); err != nil {
+		return err
+	}
+	_, err := nfsexports.Remove("", identifier)
+	return err
+}
+
+// startVM starts the VM of start for the client running as uid.
+func startVM(start *StartRequest, uid int) (int, error) {
+	if err := checkStartFiles(start, uid); err != nil {
+		return 0, err
+	}
+	if start.HyperKit != "" {
+		if err := TrustedBinary(start.HyperKit); err != nil {
+			return 0, err
+		}
+	}
+	h, err := hyperkit.New(start.HyperKit, "", start.StateDir)
+	if err != nil {
+		return 0, err
+	}
+
+	h.Kernel = start.Kernel
+	h.Initrd = start.Initrd
+	h.Bootrom = start.Bootrom
+	h.VMNet = true
+	h.ISOImages = start.ISOImages
+	h.Console = hyperkit.ConsoleFile
+	h.Serials = start.Serials
+	h.VSock = start.VSock
+	h.VSockPorts = start.VSockPorts
+	h.VPNKitSock = start.VPNKitSock
+	h.VPNKitUUID = start.VPNKitUUID
+	h.CPUs = start.CPUs
+	h.Memory = start.Memory
+	h.UUID = start.UUID
+	for _, disk := range start.Disks {
+		h.Disks = append(h.Disks, &hyperkit.RawDisk{
+			Path: disk.Path,
+			Size: disk.Size,
+			Trim: disk.Trim,
+		})
+	}
+
+	if _, err := h.Start(start.Cmdline); err != nil {
+		return 0, err
+	}
+	if err := recordVM(h.Pid, uid); err != nil {
+		log.Warnf("Recording hyperkit %d: %v", h.Pid, err)
+	}
+	if err := cpupriority.Apply(h.Pid, start.CPUPriority); err != nil {
+		log.Warnf("Setting the CPU priority of hyperkit %d: %v", h.Pid, err)
+	}
+	return h.Pid, nil
+}
+
+// checkStartFiles fails unless the state directory and the files of the VM
+// belong to uid, as hyperkit opens them as root.
+func checkStartFiles(start *StartRequest, uid int) error {
+	paths := []string{start.StateDir}
+	for _, p := range append([]string{start.Kernel, start.Initrd, start.VPNKitSock}, start.ISOImages...) {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	for _, disk := range start.Disks {
+		paths = append(paths, disk.Path)
+	}
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("%s is not an absolute path", p)
+		}
+		if err := checkOwner(p, uid); err != nil {
+			return err
+		}
+	}
+	// The firmware is usually that of Docker for Mac: it only has to be
+	// readable by everyone.
+	if start.Bootrom != "" && checkOwner(start.Bootrom, uid) != nil {
+		fi, err := os.Stat(start.Bootrom)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&0004 == 0 {
+			return fmt.Errorf("refusing %s: it is neither owned by uid %d nor readable by everyone", start.Bootrom, uid)
+		}
+	}
+	return nil
+}
+
+// TrustedBinary only lets root run binaries that no one but root could
+// have replaced.
+func TrustedBinary(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%s is not an absolute path", path)
+	}
+	for p := path; ; p = filepath.Dir(p) {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok || st.Uid != 0 || fi.Mode()&0022 != 0 && fi.Mode()&os.ModeSticky == 0 {
+			return fmt.Errorf("refusing to run %s: %s must be owned by root and only writable by it", path, p)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to run %s: %s is a symlink", path, p)
+		}
+		if p == "/" {
+			return nil
+		}
+	}
+}
+
+// signal only signals hyperkit processes so that the helper can't be used to
+// kill arbitrary root processes, and only those started for uid unless it
+// is root.
+func signal(req *SignalRequest, uid int) error {
+	p, err := ps.FindProcess(req.Pid)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return fmt.Errorf("process %d not found", req.Pid)
+	}
+	if !isHyperKit(p) {
+		return fmt.Errorf("process %d (%s) is not a hyperkit process", req.Pid, p.Executable())
+	}
+	if uid != 0 {
+		owner, ok, err := vmOwner(req.Pid)
+		if err != nil {
+			return err
+		}
+		if !ok || owner != uid {
+			return fmt.Errorf("refusing to signal hyperkit %d: it wasn't started for uid %d", req.Pid, uid)
+		}
+	}
+	proc, err := os.FindProcess(req.Pid)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(syscall.Signal(req.Signal))
+}
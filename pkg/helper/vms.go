@@ -0,0 +1,123 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/lock"
+	ps "github.com/mitchellh/go-ps"
+)
+
+// vmsFile records the uid each running VM was started for by the helper,
+// so that a client may only signal its own VMs, also after launchd
+// restarted the helper. It lives in the root-only lock.HostDir, which is
+// emptied at boot along with the pids it records.
+var vmsFile = filepath.Join(lock.HostDir, "vms.json")
+
+// vmsMu serializes the updates of vmsFile.
+var vmsMu sync.Mutex
+
+// readVMs returns the uids of the VMs recorded in vmsFile by pid, leaving out
+// those whose hyperkit process is gone.
+func readVMs() (map[int]int, error) {
+	vms := map[int]int{}
+	b, err := ioutil.ReadFile(vmsFile)
+	if os.IsNotExist(err) {
+		return vms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &vms); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", vmsFile, err)
+	}
+	for pid := range vms {
+		if p, err := ps.FindProcess(pid); err == nil && !isHyperKit(p) {
+			delete(vms, pid)
+		}
+	}
+	return vms, nil
+}
+
+// writeVMs writes vms to vmsFile.
+func writeVMs(vms map[int]int) error {
+	b, err := json.Marshal(vms)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(lock.HostDir, 0755); err != nil {
+		return err
+	}
+	tmp := vmsFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, vmsFile)
+}
+
+// recordVM records that the VM of pid was started for uid.
+func recordVM(pid, uid int) error {
+	vmsMu.Lock()
+	defer vmsMu.Unlock()
+	vms, err := readVMs()
+	if err != nil {
+		return err
+	}
+	vms[pid] = uid
+	return writeVMs(vms)
+}
+
+// vmOwner returns the uid the running VM of pid was started for.
+func vmOwner(pid int) (int, bool, error) {
+	vmsMu.Lock()
+	defer vmsMu.Unlock()
+	vms, err := readVMs()
+	if err != nil {
+		return 0, false, err
+	}
+	uid, ok := vms[pid]
+	return uid, ok, nil
+}
+
+// otherUserVM returns the pid of a running VM started for another uid than
+// uid, 0 if there is none.
+func otherUserVM(uid int) (int, error) {
+	vmsMu.Lock()
+	defer vmsMu.Unlock()
+	vms, err := readVMs()
+	if err != nil {
+		return 0, err
+	}
+	for pid, owner := range vms {
+		if owner != uid {
+			return pid, nil
+		}
+	}
+	return 0, nil
+}
+
+// isHyperKit tells whether p, which may be nil, runs hyperkit.
+func isHyperKit(p ps.Process) bool {
+	return p != nil && strings.Contains(p.Executable(), "hyper")
+}
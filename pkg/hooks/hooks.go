@@ -0,0 +1,118 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package hooks notifies external systems of the lifecycle transitions of
+// a machine, e.g. to wire them into dashboards or CI orchestration, by
+// posting them to a URL or handing them to a command as JSON.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+)
+
+// timeout bounds the delivery of an event to a hook.
+const timeout = 10 * time.Second
+
+// Lifecycle events
+const (
+	Created = "created"
+	Started = "started"
+	GotIP   = "got_ip"
+	Stopped = "stopped"
+	Removed = "removed"
+	Error   = "error"
+)
+
+// Event is a lifecycle transition of a machine.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Machine string    `json:"machine"`
+	Event   string    `json:"event"`
+	// IP is the VM address, if known.
+	IP string `json:"ip,omitempty"`
+	// Error is the failure of an Error event.
+	Error         string `json:"error,omitempty"`
+	DriverVersion string `json:"driver_version"`
+}
+
+// Hook receives the events.
+type Hook interface {
+	Fire(e Event) error
+}
+
+// URLHook posts the events as JSON to a URL.
+type URLHook struct {
+	URL string
+}
+
+func (h URLHook) Fire(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "docker-machine-driver-hyperkit/"+e.DriverVersion)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", h.URL, resp.Status)
+	}
+	return nil
+}
+
+// CommandHook runs a shell command for each event, with the event as JSON
+// on its standard input and HOOK_EVENT and HOOK_MACHINE set.
+type CommandHook struct {
+	Command string
+}
+
+func (h CommandHook) Fire(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.Command)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Env = append(os.Environ(), "HOOK_EVENT="+e.Event, "HOOK_MACHINE="+e.Machine)
+	// The driver binary may be setuid root: run the hook as the invoking
+	// user.
+	cmd.SysProcAttr = realuser.SysProcAttr()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", h.Command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/helper"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func (d *Driver) validateHyperKitBinary() error {
+	if d.HyperKitBinaryPath != "" && !filepath.IsAbs(d.HyperKitBinaryPath) {
+		return fmt.Errorf("invalid --%s %q: must be an absolute path", flagHyperKitBinaryPath, d.HyperKitBinaryPath)
+	}
+	if d.HyperKitBinaryURL == "" {
+		if d.HyperKitBinarySHA256 != "" {
+			return fmt.Errorf("--%s requires --%s", flagHyperKitBinarySHA256, flagHyperKitBinaryURL)
+		}
+		return nil
+	}
+	if d.HyperKitBinaryPath != "" {
+		return fmt.Errorf("--%s and --%s are mutually exclusive", flagHyperKitBinaryPath, flagHyperKitBinaryURL)
+	}
+	u, err := url.Parse(d.HyperKitBinaryURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid --%s %q: must be an http(s) URL", flagHyperKitBinaryURL, d.HyperKitBinaryURL)
+	}
+	if !sha256Pattern.MatchString(d.HyperKitBinarySHA256) {
+		return fmt.Errorf("--%s requires --%s, the hex encoded sha256 of the binary", flagHyperKitBinaryURL, flagHyperKitBinarySHA256)
+	}
+	return nil
+}
+
+// managedHyperKitPath is where the binary pinned by HyperKitBinarySHA256 is
+// installed. hyperkit runs as root, so the binary is kept out of the store
+// in a directory only root can write to, one per checksum so that machines
+// pinned to different releases share it.
+func (d *Driver) managedHyperKitPath() string {
+	return filepath.Join(helper.HyperKitDir, d.HyperKitBinarySHA256, "hyperkit")
+}
+
+// configuredHyperKit returns the hyperkit binary the machine is configured
+// with without downloading it, "" letting moby/hyperkit/go look it up in
+// $PATH and Docker Desktop.
+func (d *Driver) configuredHyperKit() string {
+	if d.HyperKitBinaryURL != "" {
+		return d.managedHyperKitPath()
+	}
+	return d.HyperKitBinaryPath
+}
+
+// hyperKitBinary returns the hyperkit binary to run the machine with,
+// downloading the pinned release the first time when running as root. The
+// checksum of a managed binary is verified on every call so that a binary
+// replaced meanwhile is never run.
+func (d *Driver) hyperKitBinary() (string, error) {
+	if d.HyperKitBinaryURL == "" {
+		return d.HyperKitBinaryPath, nil
+	}
+	path := d.managedHyperKitPath()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// Setuid or through the helper, the user would choose the binary
+		// root runs: root has to install it.
+		if os.Getuid() != 0 {
+			exe, _ := os.Executable()
+			return "", fmt.Errorf("hyperkit %s is not installed. Install it with: sudo %s install-hyperkit %s %s",
+				d.HyperKitBinarySHA256, exe, d.HyperKitBinaryURL, d.HyperKitBinarySHA256)
+		}
+		if err := d.downloadHyperKit(path); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+	if err := helper.TrustedBinary(path); err != nil {
+		return "", err
+	}
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return "", err
+	}
+	if checksum != d.HyperKitBinarySHA256 {
+		return "", fmt.Errorf("%s has sha256 %s instead of %s, remove it to download it again", path, checksum, d.HyperKitBinarySHA256)
+	}
+	return path, nil
+}
+
+// InstallHyperKit downloads the hyperkit binary of url, pinned to the
+// sha256 checksum, where the machines configured with them run it from. It
+// must run as root.
+func InstallHyperKit(url, checksum string) (string, error) {
+	if os.Getuid() != 0 {
+		return "", fmt.Errorf("installing hyperkit requires root")
+	}
+	d := NewDriver("", "")
+	d.HyperKitBinaryURL, d.HyperKitBinarySHA256 = url, checksum
+	if err := d.validateHyperKitBinary(); err != nil {
+		return "", err
+	}
+	return d.hyperKitBinary()
+}
+
+// downloadHyperKit downloads HyperKitBinaryURL as path, only moving it in
+// place once its checksum matched.
+func (d *Driver) downloadHyperKit(path string) error {
+	log.Infof("Downloading hyperkit from %s...", d.HyperKitBinaryURL)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// The umask may have left the directories writable by others.
+	for p := dir; pathWithin(p, filepath.Dir(helper.HyperKitDir)); p = filepath.Dir(p) {
+		if err := os.Chmod(p, 0755); err != nil {
+			return err
+		}
+	}
+	resp, err := http.Get(d.HyperKitBinaryURL)
+	if err != nil {
+		return fmt.Errorf("downloading hyperkit: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading hyperkit: %s", resp.Status)
+	}
+
+	f, err := ioutil.TempFile(dir, ".hyperkit-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("downloading hyperkit: %v", err)
+	}
+
+	checksum, err := fileChecksum(f.Name())
+	if err != nil {
+		return err
+	}
+	if checksum != d.HyperKitBinarySHA256 {
+		return fmt.Errorf("hyperkit downloaded from %s has sha256 %s instead of %s", d.HyperKitBinaryURL, checksum, d.HyperKitBinarySHA256)
+	}
+	if err := os.Chmod(f.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
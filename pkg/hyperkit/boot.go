@@ -0,0 +1,152 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	hyperkit "github.com/moby/hyperkit/go"
+	"github.com/pkg/errors"
+)
+
+// Boot modes
+const (
+	// bootModeKernel boots the kernel and initrd extracted from the ISO.
+	bootModeKernel = "kernel"
+	// bootModeUEFI boots through a UEFI firmware, no kernel extraction needed.
+	bootModeUEFI = "uefi"
+
+	// defaultBootrom is the UEFI firmware shipped with Docker for Mac.
+	defaultBootrom = "/Applications/Docker.app/Contents/Resources/uefi/UEFI.fd"
+)
+
+// bzImageMagic is found at bzImageMagicOffset in the x86 boot protocol
+// header of the kernels hyperkit can boot.
+var (
+	bzImageMagic       = []byte("HdrS")
+	bzImageMagicOffset = int64(0x202)
+)
+
+func validateBootMode(mode string) error {
+	switch mode {
+	case "", bootModeKernel, bootModeUEFI:
+		return nil
+	}
+	return fmt.Errorf("invalid boot mode %q: must be %q or %q", mode, bootModeKernel, bootModeUEFI)
+}
+
+func (d *Driver) isUEFIBoot() bool {
+	return d.BootMode == bootModeUEFI
+}
+
+// bootromPath returns the UEFI firmware to boot with.
+func (d *Driver) bootromPath() (string, error) {
+	bootrom := d.Bootrom
+	if bootrom == "" {
+		bootrom = defaultBootrom
+	}
+	if _, err := os.Stat(bootrom); err != nil {
+		return "", fmt.Errorf("UEFI firmware %s not found, set --%s: %v", bootrom, flagBootrom, err)
+	}
+	return bootrom, nil
+}
+
+// configureBoot sets up h to boot either the extracted kernel or the UEFI
+// firmware.
+func (d *Driver) configureBoot(h *hyperkit.HyperKit) error {
+	if d.isUEFIBoot() {
+		bootrom, err := d.bootromPath()
+		if err != nil {
+			return err
+		}
+		h.Bootrom = bootrom
+		return nil
+	}
+
+	h.Kernel = d.bootPath(d.Vmlinuz)
+	h.Initrd = d.bootPath(d.Initrd)
+	if len(d.CustomizeFiles) > 0 && !d.isCloudImage() {
+		initrd, err := d.customizedInitrd()
+		if err != nil {
+			return errors.Wrap(err, "customizing the initrd")
+		}
+		h.Initrd = initrd
+	}
+	return nil
+}
+
+// hasCustomKernel tells whether the user provided the kernel and initrd, in
+// which case they are booted instead of those of the ISO.
+func (d *Driver) hasCustomKernel() bool {
+	return d.CustomKernel != "" && d.CustomInitrd != ""
+}
+
+// copyCustomKernel validates the user provided kernel and initrd and copies
+// them into the machine directory. Without a custom command line, the kernel
+// options are read from isoPath.
+func (d *Driver) copyCustomKernel(isoPath string) error {
+	if err := validateKernelImage(d.CustomKernel); err != nil {
+		return err
+	}
+	if _, err := os.Stat(d.CustomInitrd); err != nil {
+		return fmt.Errorf("initrd %s: %v", d.CustomInitrd, err)
+	}
+	d.BootKernel, d.BootInitrd, d.earlyInitrds = d.CustomKernel, d.CustomInitrd, nil
+	if d.Cmdline == "" {
+		unmount, err := d.mountISO(isoPath)
+		if err != nil {
+			return err
+		}
+		err = d.extractKernelOptions()
+		unmount()
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Booting the custom kernel %s", d.BootKernel)
+	d.Vmlinuz = filepath.Base(d.BootKernel)
+	d.Initrd = filepath.Base(d.BootInitrd)
+	if d.Vmlinuz == d.Initrd {
+		return fmt.Errorf("kernel and initrd must have different file names, got %s twice", d.Vmlinuz)
+	}
+	return d.copyKernel()
+}
+
+// validateKernelImage checks path is a bzImage kernel.
+func validateKernelImage(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("kernel %s: %v", path, err)
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(bzImageMagic))
+	if _, err := f.ReadAt(magic, bzImageMagicOffset); err != nil && err != io.EOF {
+		return fmt.Errorf("reading kernel %s: %v", path, err)
+	}
+	if !bytes.Equal(magic, bzImageMagic) {
+		return fmt.Errorf("%s is not a bzImage kernel", path)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// While waiting for the VM address, the console log is scanned for the
+// markers of the boot progress: the progress ones are logged, the fatal ones
+// fail the start at once rather than after the whole IP timeout.
+
+// bootMarker is a console line pattern showing how far the guest booted.
+type bootMarker struct {
+	Name    string
+	Pattern *regexp.Regexp
+	// Fatal markers fail the start with Hint.
+	Fatal bool
+	Hint  string
+}
+
+// bootMarkers are checked in order on each console line.
+var bootMarkers = []bootMarker{
+	{
+		Name:    "kernel panic",
+		Pattern: regexp.MustCompile(`Kernel panic - not syncing`),
+		Fatal:   true,
+		Hint:    "check the kernel, the initrd and --" + flagCmdline,
+	},
+	{
+		Name:    "out of memory",
+		Pattern: regexp.MustCompile(`Out of memory: Kill|oom-kill:|invoked oom-killer`),
+		Fatal:   true,
+		Hint:    "give the machine more memory with --" + flagMemory,
+	},
+	{
+		Name:    "root filesystem",
+		Pattern: regexp.MustCompile(`VFS: Unable to mount root fs|No working init found`),
+		Fatal:   true,
+		Hint:    "check the kernel command line and the disk image",
+	},
+	{
+		Name:    "docker",
+		Pattern: regexp.MustCompile(`Starting [Dd]ocker|Started Docker Application Container Engine`),
+	},
+	{
+		Name:    "login prompt",
+		Pattern: regexp.MustCompile(`login: *$`),
+	},
+}
+
+// bootProgress follows the markers seen on the console of a boot.
+type bootProgress struct {
+	path string
+	seen map[string]bool
+}
+
+func (d *Driver) newBootProgress() *bootProgress {
+	return &bootProgress{path: d.scratchPath(consoleLogFile), seen: map[string]bool{}}
+}
+
+// check scans the console log, logging the progress markers seen for the
+// first time, and returns an error on a fatal one.
+func (p *bootProgress) check() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var tail []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if tail = append(tail, line); len(tail) > 10 {
+			tail = tail[1:]
+		}
+		for _, m := range bootMarkers {
+			if !m.Pattern.MatchString(line) {
+				continue
+			}
+			if m.Fatal {
+				// Let the few next lines in, they hold the trace.
+				for i := 0; i < 5 && scanner.Scan(); i++ {
+					tail = append(tail, strings.TrimRight(scanner.Text(), "\r"))
+				}
+				return fmt.Errorf("the guest failed to boot (%s), %s; console output:\n%s", m.Name, m.Hint, strings.Join(tail, "\n"))
+			}
+			if !p.seen[m.Name] {
+				p.seen[m.Name] = true
+				log.Infof("Boot progress: %s", m.Name)
+			}
+		}
+	}
+	return nil
+}
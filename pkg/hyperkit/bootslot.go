@@ -0,0 +1,213 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	pkgdrivers "github.com/leoh0/docker-machine-driver-hyperkit/pkg/drivers"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/schema"
+	"github.com/pkg/errors"
+)
+
+// Boot slots hold the boot artifacts (ISO, kernel, initrd) of a machine.
+// Upgrades are written to the inactive slot and activated by flipping
+// Driver.BootSlot, so that a broken upgrade can be rolled back by flipping it
+// back. An empty BootSlot is the legacy layout with the artifacts at the root
+// of the machine directory.
+const (
+	bootSlotA = "a"
+	bootSlotB = "b"
+
+	bootSlotFileName = schema.BootSlotFile
+)
+
+// bootSlotInfo is persisted in each slot directory.
+type bootSlotInfo = schema.BootSlot
+
+func bootSlotDir(slot string) string {
+	if slot == "" {
+		return "."
+	}
+	return "boot-" + slot
+}
+
+func otherBootSlot(slot string) string {
+	if slot == bootSlotA {
+		return bootSlotB
+	}
+	return bootSlotA
+}
+
+// bootPath resolves a boot artifact in the active boot slot.
+func (d *Driver) bootPath(file string) string {
+	return d.ResolveStorePath(filepath.Join(bootSlotDir(d.BootSlot), file))
+}
+
+func (d *Driver) readBootSlot(slot string) (*bootSlotInfo, error) {
+	path := d.ResolveStorePath(filepath.Join(bootSlotDir(slot), bootSlotFileName))
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading boot slot %s", slot)
+	}
+	info := &bootSlotInfo{}
+	if err := json.Unmarshal(b, info); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", path)
+	}
+	return info, nil
+}
+
+func (d *Driver) writeBootSlot(slot string, info *bootSlotInfo) error {
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.ResolveStorePath(filepath.Join(bootSlotDir(slot), bootSlotFileName)), b, 0644)
+}
+
+// activateBootSlot points the driver at slot.
+func (d *Driver) activateBootSlot(slot string, info *bootSlotInfo) {
+	d.BootSlot = slot
+	d.Boot2DockerURL = info.ISOURL
+	d.Vmlinuz = info.Vmlinuz
+	d.Initrd = info.Initrd
+	d.Cmdline = info.Cmdline
+}
+
+// migrateLegacyBootSlot moves the boot artifacts of the legacy layout into
+// slot a.
+func (d *Driver) migrateLegacyBootSlot() error {
+	if d.BootSlot != "" {
+		return nil
+	}
+
+	log.Infof("Moving boot artifacts into boot slot %s", bootSlotA)
+	if err := os.MkdirAll(d.ResolveStorePath(bootSlotDir(bootSlotA)), 0755); err != nil {
+		return err
+	}
+	for _, file := range []string{isoFilename, d.Vmlinuz, d.Initrd} {
+		if file == "" {
+			continue
+		}
+		if err := os.Rename(d.ResolveStorePath(file), d.ResolveStorePath(filepath.Join(bootSlotDir(bootSlotA), file))); err != nil {
+			return err
+		}
+	}
+
+	info := &bootSlotInfo{
+		ISOURL:  d.Boot2DockerURL,
+		Vmlinuz: d.Vmlinuz,
+		Initrd:  d.Initrd,
+		Cmdline: d.Cmdline,
+	}
+	if err := d.writeBootSlot(bootSlotA, info); err != nil {
+		return err
+	}
+	d.BootSlot = bootSlotA
+	return nil
+}
+
+// Upgrade writes the boot ISO at isoURL and its kernel into the inactive boot
+// slot and activates it. The previous slot is kept for Rollback. The new slot
+// is used from the next Start on, and the caller is responsible for saving
+// the updated driver configuration.
+func (d *Driver) Upgrade(isoURL string) error {
+	if d.isCloudImage() {
+		return fmt.Errorf("upgrading cloud image machines is not supported")
+	}
+	if err := d.migrateLegacyBootSlot(); err != nil {
+		return errors.Wrap(err, "migrating boot artifacts")
+	}
+
+	previous := &bootSlotInfo{
+		ISOURL:  d.Boot2DockerURL,
+		Vmlinuz: d.Vmlinuz,
+		Initrd:  d.Initrd,
+		Cmdline: d.Cmdline,
+	}
+	previousSlot := d.BootSlot
+	slot := otherBootSlot(previousSlot)
+
+	slotDir := d.ResolveStorePath(bootSlotDir(slot))
+	if err := os.RemoveAll(slotDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(slotDir, 0755); err != nil {
+		return err
+	}
+	if err := pkgdrivers.DownloadImage(d.StorePath, slotDir, isoFilename, isoURL); err != nil {
+		return errors.Wrap(err, "downloading ISO into boot slot")
+	}
+
+	d.activateBootSlot(slot, &bootSlotInfo{ISOURL: isoURL})
+	d.BootKernel, d.BootInitrd = "", ""
+	if d.hasCustomKernel() {
+		if err := d.copyCustomKernel(d.bootPath(isoFilename)); err != nil {
+			d.activateBootSlot(previousSlot, previous)
+			return errors.Wrapf(err, "copying the custom kernel into boot slot %s", slot)
+		}
+	} else if !d.isUEFIBoot() {
+		if err := d.extractKernel(d.bootPath(isoFilename)); err != nil {
+			d.activateBootSlot(previousSlot, previous)
+			return errors.Wrapf(err, "extracting kernel into boot slot %s", slot)
+		}
+	}
+
+	info := &bootSlotInfo{
+		ISOURL:  isoURL,
+		Vmlinuz: d.Vmlinuz,
+		Initrd:  d.Initrd,
+		Cmdline: d.Cmdline,
+	}
+	if err := d.writeBootSlot(slot, info); err != nil {
+		d.activateBootSlot(previousSlot, previous)
+		return err
+	}
+
+	if err := d.updateISOChecksum(); err != nil {
+		log.Warnf("Failed to record ISO checksum: %v", err)
+	}
+
+	log.Infof("Boot slot %s is now active, it will be used from the next start on", slot)
+	return nil
+}
+
+// Rollback re-activates the boot slot that was active before the last
+// Upgrade.
+func (d *Driver) Rollback() error {
+	if d.BootSlot == "" {
+		return fmt.Errorf("machine %s has never been upgraded", d.MachineName)
+	}
+	slot := otherBootSlot(d.BootSlot)
+	info, err := d.readBootSlot(slot)
+	if err != nil {
+		return err
+	}
+	d.activateBootSlot(slot, info)
+	if err := d.updateISOChecksum(); err != nil {
+		log.Warnf("Failed to record ISO checksum: %v", err)
+	}
+	log.Infof("Rolled back to boot slot %s, it will be used from the next start on", slot)
+	return nil
+}
@@ -0,0 +1,73 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	hyperkit "github.com/moby/hyperkit/go"
+)
+
+// Capabilities reports the features supported by this driver build on the
+// current host, so that front-ends can adapt their flags and messages.
+type Capabilities struct {
+	// Driver features
+	NinePShares       bool `json:"9p_shares"`
+	VSock             bool `json:"vsock"`
+	BridgedNetworking bool `json:"bridged_networking"`
+	MemoryBalloon     bool `json:"memory_balloon"`
+	Snapshots         bool `json:"snapshots"`
+	VZBackend         bool `json:"vz_backend"`
+	CloudImages       bool `json:"cloud_images"`
+	PortForwarding    bool `json:"port_forwarding"`
+
+	// Host environment
+	HypervisorFramework bool   `json:"hypervisor_framework"`
+	HyperKit            string `json:"hyperkit,omitempty"`
+	VMNetMACFromUUID    bool   `json:"vmnet_mac_from_uuid"`
+	UEFIFirmware        bool   `json:"uefi_firmware"`
+	PrivilegedHelper    bool   `json:"privileged_helper"`
+}
+
+// Capabilities probes the host and returns what is supported.
+func (d *Driver) Capabilities() *Capabilities {
+	c := &Capabilities{
+		VSock:          true,
+		Snapshots:      true,
+		CloudImages:    true,
+		PortForwarding: true,
+	}
+
+	if out, err := exec.Command("sysctl", "-n", "kern.hv_support").Output(); err == nil {
+		c.HypervisorFramework = strings.TrimSpace(string(out)) == "1"
+	}
+	if h, err := hyperkit.New(d.configuredHyperKit(), "", ""); err == nil {
+		c.HyperKit = h.HyperKit
+	}
+	c.VMNetMACFromUUID = vmnetSupported
+	if _, err := d.bootromPath(); err == nil {
+		c.UEFIFirmware = true
+	}
+	if _, err := os.Stat(d.helperClient().SocketPath); err == nil {
+		c.PrivilegedHelper = d.helperClient().Ping() == nil
+	}
+	return c
+}
@@ -0,0 +1,207 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+	"github.com/leoh0/machine/libmachine/auth"
+	"github.com/leoh0/machine/libmachine/cert"
+	"github.com/leoh0/machine/libmachine/mcnutils"
+	"github.com/pkg/errors"
+)
+
+// The docker-machine provisioner issues the server certificate of the
+// guest docker daemon for the VM address of the time. When the address
+// changes, the certificate is issued again for the new one, the way
+// "docker-machine regenerate-certs" would, so that GetURL stays valid.
+const (
+	// serverCertBits is the key size of the server certificates issued by
+	// docker-machine.
+	serverCertBits = 2048
+
+	boot2dockerServerCert = "/var/lib/boot2docker/server.pem"
+	boot2dockerServerKey  = "/var/lib/boot2docker/server-key.pem"
+	dockerServerCert      = "/etc/docker/server.pem"
+	dockerServerKey       = "/etc/docker/server-key.pem"
+)
+
+// hostTLSOptions are the TLS settings of the machine, kept by docker-machine
+// next to the driver settings.
+type hostTLSOptions struct {
+	AuthOptions  *auth.Options
+	SwarmOptions *struct {
+		Master bool
+	}
+}
+
+// readHostTLSOptions reads the TLS settings of the machine, nil before
+// docker-machine provisioned it.
+func (d *Driver) readHostTLSOptions() (*hostTLSOptions, error) {
+	b, err := ioutil.ReadFile(d.ResolveStorePath(machineConfigFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		HostOptions *hostTLSOptions
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, errors.Wrap(err, "parsing machine configuration")
+	}
+	if config.HostOptions == nil || config.HostOptions.AuthOptions == nil || config.HostOptions.AuthOptions.ServerCertPath == "" {
+		return nil, nil
+	}
+	return config.HostOptions, nil
+}
+
+// readCertificate reads the PEM certificate at path.
+func readCertificate(path string) (*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// ensureServerCert issues the server certificate of the guest docker
+// daemon again when it isn't valid for the VM address, installs it in the
+// guest and restarts the daemon.
+func (d *Driver) ensureServerCert() error {
+	if d.IPAddress == "" {
+		return nil
+	}
+	opts, err := d.readHostTLSOptions()
+	if err != nil || opts == nil {
+		return err
+	}
+	a := opts.AuthOptions
+	if _, err := os.Lstat(a.ServerCertPath); os.IsNotExist(err) {
+		// Not provisioned yet.
+		return nil
+	}
+	if err := d.checkCertPaths(a); err != nil {
+		return err
+	}
+	// The paths come from the machine configuration, which the user may
+	// edit: issue the certificate with the privileges of that user.
+	issued := false
+	err = realuser.Do(func() error {
+		serverCert, err := readCertificate(a.ServerCertPath)
+		if err != nil {
+			return err
+		}
+		if serverCert.VerifyHostname(d.IPAddress) == nil {
+			return nil
+		}
+
+		log.Infof("The docker certificate of %s isn't valid for %s, issuing it again", d.MachineName, d.IPAddress)
+		hosts := append(append([]string{}, a.ServerCertSANs...), d.IPAddress, "localhost")
+		err = cert.GenerateCert(&cert.Options{
+			Hosts:       hosts,
+			CertFile:    a.ServerCertPath,
+			KeyFile:     a.ServerKeyPath,
+			CAFile:      a.CaCertPath,
+			CAKeyFile:   a.CaPrivateKeyPath,
+			Org:         mcnutils.GetUsername() + "." + d.MachineName,
+			Bits:        serverCertBits,
+			SwarmMaster: opts.SwarmOptions != nil && opts.SwarmOptions.Master,
+		})
+		if err != nil {
+			return errors.Wrap(err, "issuing the docker server certificate")
+		}
+		issued = true
+		return nil
+	})
+	if err != nil || !issued {
+		return err
+	}
+	return d.installServerCert(a)
+}
+
+// checkCertPaths fails unless the certificates and keys of a are files of
+// the machine store owned by the invoking user.
+func (d *Driver) checkCertPaths(a *auth.Options) error {
+	for _, p := range []string{a.ServerCertPath, a.ServerKeyPath, a.CaCertPath, a.CaPrivateKeyPath} {
+		p = filepath.Clean(p)
+		if !filepath.IsAbs(p) || !pathWithin(p, d.StorePath) {
+			return fmt.Errorf("the certificate %s isn't in the machine store %s", p, d.StorePath)
+		}
+		if err := realuser.CheckOwned(p); err != nil {
+			return errors.Wrap(err, "checking the docker certificates")
+		}
+	}
+	return nil
+}
+
+// readFileNoFollow reads the file at path, failing on a symbolic link.
+func readFileNoFollow(path string) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// installServerCert copies the server certificate and key into the guest
+// and restarts the docker daemon.
+func (d *Driver) installServerCert(a *auth.Options) error {
+	remoteCert, remoteKey := a.ServerCertRemotePath, a.ServerKeyRemotePath
+	if remoteCert == "" || remoteKey == "" {
+		remoteCert, remoteKey = boot2dockerServerCert, boot2dockerServerKey
+		if d.isCloudImage() {
+			remoteCert, remoteKey = dockerServerCert, dockerServerKey
+		}
+	}
+	restart := "sudo /etc/init.d/docker restart"
+	if d.isCloudImage() {
+		restart = "sudo systemctl restart docker"
+	}
+	for _, f := range []struct{ local, remote string }{
+		{a.ServerCertPath, remoteCert},
+		{a.ServerKeyPath, remoteKey},
+	} {
+		content, err := readFileNoFollow(f.local)
+		if err != nil {
+			return err
+		}
+		command := fmt.Sprintf("sudo mkdir -p %s && sudo tee %s >/dev/null", shellQuote(filepath.Dir(f.remote)), shellQuote(f.remote))
+		if _, err := d.runSSHCommandWithInput(command, content); err != nil {
+			return errors.Wrapf(err, "copying %s into the guest", filepath.Base(f.local))
+		}
+	}
+	_, err := d.runSSHCommand(restart)
+	return err
+}
@@ -0,0 +1,165 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/cloudinit"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/disk"
+	pkgdrivers "github.com/leoh0/docker-machine-driver-hyperkit/pkg/drivers"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/machine/libmachine/mcnutils"
+	"github.com/pkg/errors"
+)
+
+const (
+	imageTypeBoot2Docker = "boot2docker"
+	imageTypeCloud       = "cloud"
+
+	cloudInitSeedDir      = "cloud-init"
+	cloudInitSeedFileName = "seed.iso"
+	cloudKernelFileName   = "vmlinuz"
+	cloudInitrdFileName   = "initrd"
+	cloudImageCmdline     = "root=/dev/vda1 console=ttyS0"
+)
+
+// detectImageType tells boot ISOs, which are handled like boot2docker, apart
+// from cloud disk images.
+func detectImageType(imageURL string) string {
+	if imageURL == "" {
+		return imageTypeBoot2Docker
+	}
+	p := imageURL
+	if u, err := url.Parse(imageURL); err == nil && u.Path != "" {
+		p = u.Path
+	}
+	if strings.EqualFold(filepath.Ext(p), ".iso") {
+		return imageTypeBoot2Docker
+	}
+	return imageTypeCloud
+}
+
+func (d *Driver) isCloudImage() bool {
+	return d.ImageType == imageTypeCloud
+}
+
+// createFromCloudImage prepares the disk, kernel and cloud-init seed of a
+// machine booting a generic Linux cloud image.
+func (d *Driver) createFromCloudImage() error {
+	if !d.isUEFIBoot() && d.ImageKernel == "" {
+		return fmt.Errorf("--%s is required to boot the cloud image %s", flagImageKernel, d.ImageURL)
+	}
+
+	backend, err := disk.New(d.DiskBackend)
+	if err != nil {
+		return err
+	}
+	err = d.timed(eventDownload, func() error {
+		return pkgdrivers.MakeCloudDiskImage(d.BaseDriver, d.ImageURL, d.DiskSize, backend)
+	})
+	if err != nil {
+		return errors.Wrap(err, "making disk image")
+	}
+
+	if d.isUEFIBoot() {
+		if _, err := d.bootromPath(); err != nil {
+			return err
+		}
+	} else if err := d.copyCloudKernel(); err != nil {
+		return err
+	}
+
+	return d.makeCloudInitSeed()
+}
+
+// copyCloudKernel copies the kernel and initrd booting the cloud image into
+// the machine directory.
+func (d *Driver) copyCloudKernel() error {
+	log.Debugf("Copying %s into %s", d.ImageKernel, d.ResolveStorePath(cloudKernelFileName))
+	if err := mcnutils.CopyFile(d.ImageKernel, d.ResolveStorePath(cloudKernelFileName)); err != nil {
+		return errors.Wrap(err, "copying kernel")
+	}
+	d.Vmlinuz = cloudKernelFileName
+
+	if d.ImageInitrd != "" {
+		log.Debugf("Copying %s into %s", d.ImageInitrd, d.ResolveStorePath(cloudInitrdFileName))
+		if err := mcnutils.CopyFile(d.ImageInitrd, d.ResolveStorePath(cloudInitrdFileName)); err != nil {
+			return errors.Wrap(err, "copying initrd")
+		}
+		d.Initrd = cloudInitrdFileName
+	}
+
+	if d.Cmdline == "" {
+		d.Cmdline = cloudImageCmdline
+	}
+	return nil
+}
+
+// makeCloudInitSeed generates the NoCloud seed ISO attached to the machine.
+func (d *Driver) makeCloudInitSeed() error {
+	pubKey, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
+	if err != nil {
+		return errors.Wrap(err, "reading public ssh key")
+	}
+
+	config := &cloudinit.Config{
+		InstanceID:        d.UUID,
+		Hostname:          d.MachineName,
+		User:              d.GetSSHUsername(),
+		SSHAuthorizedKeys: []string{strings.TrimSpace(string(pubKey))},
+		InstallDocker:     true,
+	}
+	if d.hasCustomDNS() {
+		cmd, err := d.dnsBootCmd()
+		if err != nil {
+			return err
+		}
+		config.BootCmd = append(config.BootCmd, cmd)
+	}
+	if d.GuestUser != "" {
+		script, err := d.guestUserScriptContent()
+		if err != nil {
+			return err
+		}
+		config.Files = append(config.Files, cloudinit.File{Path: cloudGuestUserScript, Content: script, Permissions: "0755"})
+		config.RunCmd = append(config.RunCmd, "sh "+cloudGuestUserScript)
+	}
+
+	if err := d.addCloudCustomizations(config); err != nil {
+		return errors.Wrap(err, "customizing the guest")
+	}
+
+	seedDir := d.ResolveStorePath(cloudInitSeedDir)
+	if err := config.WriteSeedDir(seedDir); err != nil {
+		return errors.Wrap(err, "writing cloud-init seed")
+	}
+
+	seedPath := d.ResolveStorePath(cloudInitSeedFileName)
+	if err := os.Remove(seedPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Info("Creating cloud-init seed image...")
+	return hdiutil("makehybrid", "-iso", "-joliet", "-default-volume-name", cloudinit.VolumeLabel, "-o", seedPath, seedDir)
+}
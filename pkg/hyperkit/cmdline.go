@@ -0,0 +1,201 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// CmdlineExtra is a text/template adjusting the kernel command line read
+// from the ISO or given by Cmdline, e.g.
+//
+//	{{.ExtractedCmdline}} console=ttyS0 swap=off -quiet
+//
+// A template not using .ExtractedCmdline is appended to it. In the result,
+// a key=value parameter of the template overrides the parameters of the
+// same key of the command line before it, and "-key" removes the parameter
+// key. Parameters repeated in the command line, e.g. "console=tty0
+// console=ttyS0", are kept unless the template sets their key. Double
+// quoted values may hold spaces.
+
+// cmdlineData is the data of the CmdlineExtra template.
+type cmdlineData struct {
+	// ExtractedCmdline is the command line read from the ISO, or Cmdline.
+	ExtractedCmdline string
+	MachineName      string
+	CPUs             int
+	Memory           int
+	UUID             string
+}
+
+// parseCmdlineExtra parses the CmdlineExtra template text.
+func parseCmdlineExtra(text string) (*template.Template, error) {
+	if !strings.Contains(text, ".ExtractedCmdline") {
+		text = "{{.ExtractedCmdline}} " + text
+	}
+	t, err := template.New("cmdline").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kernel command line template: %v", err)
+	}
+	return t, nil
+}
+
+// validateCmdlineExtra checks text renders a command line.
+func validateCmdlineExtra(text string) error {
+	if text == "" {
+		return nil
+	}
+	t, err := parseCmdlineExtra(text)
+	if err != nil {
+		return err
+	}
+	_, err = renderCmdline(t, cmdlineData{ExtractedCmdline: "loglevel=3 console=ttyS0", MachineName: "default", CPUs: 1, Memory: 1024})
+	return err
+}
+
+// extractedPlaceholder stands for .ExtractedCmdline while the template is
+// rendered, telling its parameters apart from those of the template.
+const extractedPlaceholder = "\x1eextracted\x1e"
+
+// renderCmdline renders the command line of data with t.
+func renderCmdline(t *template.Template, data cmdlineData) (string, error) {
+	extracted := data.ExtractedCmdline
+	data.ExtractedCmdline = extractedPlaceholder
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("invalid kernel command line template: %v", err)
+	}
+	if strings.ContainsAny(b.String(), "\r\n") {
+		return "", fmt.Errorf("invalid kernel command line template: it must render a single line, got %q", b.String())
+	}
+	var params []cmdlineParam
+	for _, p := range splitCmdline(b.String()) {
+		switch {
+		case p == extractedPlaceholder:
+			params = append(params, cmdlineParams(extracted, false)...)
+		case strings.Contains(p, extractedPlaceholder):
+			return "", fmt.Errorf("invalid kernel command line template: .ExtractedCmdline must be separated from the other parameters")
+		default:
+			params = append(params, cmdlineParam{text: p, override: true})
+		}
+	}
+	return mergeCmdline(params), nil
+}
+
+// cmdlineParam is a kernel parameter, which overrides the parameters of the
+// same key before it when override is set.
+type cmdlineParam struct {
+	text     string
+	override bool
+}
+
+// cmdlineParams returns the parameters of cmdline.
+func cmdlineParams(cmdline string, override bool) []cmdlineParam {
+	var params []cmdlineParam
+	for _, p := range splitCmdline(cmdline) {
+		params = append(params, cmdlineParam{text: p, override: override})
+	}
+	return params
+}
+
+// splitCmdline splits cmdline into its parameters, at the spaces outside
+// double quotes.
+func splitCmdline(cmdline string) []string {
+	var params []string
+	var b strings.Builder
+	quoted := false
+	for _, r := range cmdline {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			b.WriteRune(r)
+		case !quoted && (r == ' ' || r == '\t'):
+			if b.Len() > 0 {
+				params = append(params, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 0 {
+		params = append(params, b.String())
+	}
+	return params
+}
+
+// cmdlineKey returns the key of the kernel parameter param.
+func cmdlineKey(param string) string {
+	return strings.Trim(strings.SplitN(param, "=", 2)[0], `"`)
+}
+
+// mergeCmdline joins params. An overriding key=value parameter removes the
+// other parameters of the same key before it, except the overriding ones,
+// and "-key" removes all of them.
+func mergeCmdline(params []cmdlineParam) string {
+	var merged []cmdlineParam
+	for _, param := range params {
+		removed := param.override && strings.HasPrefix(param.text, "-") && len(param.text) > 1
+		if param.override {
+			k := cmdlineKey(strings.TrimPrefix(param.text, "-"))
+			kept := merged[:0]
+			for _, p := range merged {
+				if cmdlineKey(p.text) != k || (p.override && !removed) {
+					kept = append(kept, p)
+				}
+			}
+			merged = kept
+		}
+		if !removed {
+			merged = append(merged, param)
+		}
+	}
+	texts := make([]string, len(merged))
+	for i, p := range merged {
+		texts[i] = p.text
+	}
+	return strings.Join(texts, " ")
+}
+
+// expandCmdline returns Cmdline adjusted by CmdlineExtra.
+func (d *Driver) expandCmdline() (string, error) {
+	if d.CmdlineExtra == "" {
+		return d.Cmdline, nil
+	}
+	t, err := parseCmdlineExtra(d.CmdlineExtra)
+	if err != nil {
+		return "", err
+	}
+	cmdline, err := renderCmdline(t, cmdlineData{
+		ExtractedCmdline: d.Cmdline,
+		MachineName:      d.MachineName,
+		CPUs:             d.CPU,
+		Memory:           d.Memory,
+		UUID:             d.UUID,
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("Kernel command line %q rendered from %q with %q", cmdline, d.Cmdline, d.CmdlineExtra)
+	return cmdline, nil
+}
@@ -0,0 +1,62 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+	"github.com/pkg/errors"
+)
+
+// Companions are user provided host commands (log tailers, proxies, ...)
+// started once the VM is up and terminated with it. They run through sh with
+// MACHINE_NAME and MACHINE_IP set in their environment, as the invoking user
+// when the driver is installed setuid root.
+const companionPrefix = "companion-"
+
+// companionName returns the managed process name of the i-th companion.
+func companionName(i int) string {
+	return fmt.Sprintf("%s%d", companionPrefix, i)
+}
+
+// startCompanions starts the configured companion processes, first stopping
+// any leftover from an unclean shutdown.
+func (d *Driver) startCompanions() error {
+	d.stopCompanions()
+	for i, command := range d.Companions {
+		cmd := realuser.Command("/bin/sh", "-c", command)
+		cmd.Env = append(os.Environ(),
+			"MACHINE_NAME="+d.MachineName,
+			"MACHINE_IP="+d.IPAddress,
+		)
+		log.Infof("Starting companion process: %s", command)
+		if err := d.startManagedProcess(companionName(i), cmd); err != nil {
+			return errors.Wrapf(err, "starting companion %q", command)
+		}
+	}
+	return nil
+}
+
+// stopCompanions terminates the companion processes and their children.
+func (d *Driver) stopCompanions() {
+	d.stopManagedProcesses(companionPrefix)
+}
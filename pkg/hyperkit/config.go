@@ -0,0 +1,420 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/cpupriority"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/disk"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/resolver"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/schema"
+	"github.com/pkg/errors"
+)
+
+const (
+	// machineConfigFileName is the docker-machine configuration of a
+	// machine, which holds the driver fields under "Driver".
+	machineConfigFileName = schema.DriverConfigFile
+	// machineConfigBackupSuffix is appended to the configuration kept by
+	// UpdateConfig.
+	machineConfigBackupSuffix = ".bak"
+)
+
+// validate checks the driver configuration, including the constraints
+// between fields which single flags can't express.
+func (d *Driver) validate() error {
+	if d.CPU < 1 || d.CPU > maxCPUs {
+		return fmt.Errorf("invalid CPU count %d: must be between 1 and %d", d.CPU, maxCPUs)
+	}
+	if d.Memory < 1 {
+		return fmt.Errorf("invalid memory size %dMB: must be positive", d.Memory)
+	}
+	if d.DiskSize < 1 {
+		return fmt.Errorf("invalid disk size %dMB: must be positive", d.DiskSize)
+	}
+	if !uuidRegexp.MatchString(d.UUID) {
+		return fmt.Errorf("%q is not a valid UUID", d.UUID)
+	}
+	if err := validateNFSExportScope(d.NFSExportScope); err != nil {
+		return err
+	}
+	if err := validateNFSExportTemplate(d.NFSExportTemplate); err != nil {
+		return err
+	}
+	if err := validateMetricsAddress(d.MetricsAddress); err != nil {
+		return err
+	}
+	if err := validateTelemetryFile(d.TelemetryFile); err != nil {
+		return err
+	}
+	if _, err := log.ParseLevel(d.LogLevel); err != nil {
+		return err
+	}
+	if err := log.ValidateFormat(d.LogFormat); err != nil {
+		return err
+	}
+	if err := validateDNS(d.DNS, d.DNSSearch); err != nil {
+		return err
+	}
+	for _, proxy := range []string{d.HTTPProxy, d.HTTPSProxy} {
+		if err := validateProxy(proxy); err != nil {
+			return err
+		}
+	}
+	if d.RegistryAuthFile != "" && !filepath.IsAbs(d.RegistryAuthFile) {
+		return fmt.Errorf("invalid registry credentials file %q: must be an absolute path", d.RegistryAuthFile)
+	}
+	if err := d.validateHyperKitBinary(); err != nil {
+		return err
+	}
+	if d.SuperviseMaxRestarts < 0 {
+		return fmt.Errorf("invalid --%s %d: must not be negative", flagSuperviseMaxRestarts, d.SuperviseMaxRestarts)
+	}
+	if err := validateHookURL(d.HookURL); err != nil {
+		return err
+	}
+	if err := d.validateDockerdOptions(); err != nil {
+		return err
+	}
+	if err := validateCPUHideFeatures(d.CPUHideFeatures); err != nil {
+		return err
+	}
+	if len(d.CPUHideFeatures) > 0 && d.isUEFIBoot() {
+		return fmt.Errorf("--%s requires the %q boot mode", flagCPUHideFeature, bootModeKernel)
+	}
+	if err := validateTimeSync(d.TimeSync); err != nil {
+		return err
+	}
+	if err := validateCustomizeFiles(d.CustomizeFiles); err != nil {
+		return err
+	}
+	if len(d.CustomizeFiles) > 0 && d.isUEFIBoot() && !d.isCloudImage() {
+		return fmt.Errorf("--%s requires the %q boot mode for ISOs", flagCustomizeFile, bootModeKernel)
+	}
+	if _, err := disk.New(d.DiskBackend); err != nil {
+		return err
+	}
+	if err := validateStatusAddress(d.StatusAddress); err != nil {
+		return err
+	}
+	if err := validateFirewallAllow(d.FirewallAllow); err != nil {
+		return err
+	}
+	if len(d.FirewallAllow) > 0 && !d.Firewall {
+		return fmt.Errorf("--%s requires --%s", flagFirewallAllow, flagFirewall)
+	}
+	if err := validateCmdlineExtra(d.CmdlineExtra); err != nil {
+		return err
+	}
+	if err := validateAttachedISOs(d.AttachISOs); err != nil {
+		return err
+	}
+	if _, err := parseExtraArgs(d.ExtraArgs); err != nil {
+		return err
+	}
+	if len(d.ExtraArgs) > 0 && d.PrivilegedHelper {
+		return fmt.Errorf("--%s is not supported with --%s", flagExtraArgs, flagPrivilegedHelper)
+	}
+	if len(d.ExtraArgs) > 0 && os.Geteuid() != os.Getuid() {
+		return fmt.Errorf("--%s is not supported when the driver is installed setuid root", flagExtraArgs)
+	}
+	if err := validateVMNetSubnet(d.VMNetSubnet); err != nil {
+		return err
+	}
+	if err := validateProvisionOnError(d.ProvisionOnError); err != nil {
+		return err
+	}
+	if err := validateScratchDir(d.ScratchDir); err != nil {
+		return err
+	}
+	if err := validateShareMode(d.ShareMode); err != nil {
+		return err
+	}
+	if err := d.validateHomeShare(); err != nil {
+		return err
+	}
+	if err := d.validateNFSMaps(); err != nil {
+		return err
+	}
+	if d.SSHUser != "" && !guestNameRegexp.MatchString(d.SSHUser) {
+		return fmt.Errorf("invalid --%s %q: must be a user name", flagSSHUser, d.SSHUser)
+	}
+	if d.SSHPort < 0 || d.SSHPort > 65535 {
+		return fmt.Errorf("invalid --%s %d: must be a TCP port", flagSSHPort, d.SSHPort)
+	}
+	if d.SudoAskpass != "" && !filepath.IsAbs(d.SudoAskpass) {
+		return fmt.Errorf("invalid --%s %q: must be an absolute path", flagSudoAskpass, d.SudoAskpass)
+	}
+	if err := validateMountOwner(d.NFSMountOwner); err != nil {
+		return err
+	}
+	if err := validateMountMode(d.NFSMountMode); err != nil {
+		return err
+	}
+	if err := validateVPNKit(d.VPNKit); err != nil {
+		return err
+	}
+	if err := validateMACAddress(d.MACAddress); err != nil {
+		return err
+	}
+	if d.VPNKitBinary != "" && d.VPNKit != vpnkitManaged {
+		return fmt.Errorf("--%s requires --%s=%s", flagVPNKitBinary, flagVPNKit, vpnkitManaged)
+	}
+	if err := validateBootMode(d.BootMode); err != nil {
+		return err
+	}
+	if err := validateConsoleMode(d.ConsoleMode); err != nil {
+		return err
+	}
+	if err := validateIPBackoff(d.IPBackoff); err != nil {
+		return err
+	}
+	if err := cpupriority.Validate(d.CPUPriority); err != nil {
+		return err
+	}
+	if d.ResolverDomain != "" {
+		if err := resolver.CheckDomain(d.ResolverDomain, os.Getuid()); err != nil {
+			return err
+		}
+	}
+	if err := validateDiskThreshold(flagDiskWarnThreshold, d.DiskWarnThreshold); err != nil {
+		return err
+	}
+	if err := validateDiskThreshold(flagDiskPruneThreshold, d.DiskPruneThreshold); err != nil {
+		return err
+	}
+
+	if err := validatePortForwards(d.PortForwards); err != nil {
+		return err
+	}
+
+	if detectImageType(d.ImageURL) == imageTypeCloud && !d.isUEFIBoot() && d.ImageKernel == "" {
+		return fmt.Errorf("--%s is required to boot the cloud image %s", flagImageKernel, d.ImageURL)
+	}
+	if err := d.validateGuestUser(); err != nil {
+		return err
+	}
+	if (d.CustomKernel == "") != (d.CustomInitrd == "") {
+		return fmt.Errorf("--%s and --%s have to be set together", flagKernel, flagInitrd)
+	}
+	if len(d.VSockPorts) > 0 && !d.VSock {
+		return fmt.Errorf("--%s requires --%s", flagVSockPort, flagVSock)
+	}
+	if d.DiskPruneThreshold > 0 && d.DiskMonitorInterval <= 0 {
+		return fmt.Errorf("--%s requires --%s", flagDiskPruneThreshold, flagDiskMonitor)
+	}
+	if d.ReuseDisk && !d.ReuseArtifacts {
+		return fmt.Errorf("--%s requires --%s", flagReuseDisk, flagReuseArtifacts)
+	}
+	return nil
+}
+
+// UpdateConfig applies patch, a JSON object of Driver fields, to the machine
+// configuration. The resulting configuration is validated before being
+// written to config.json, the previous version being kept in config.json.bak.
+// Changes take effect on the next start.
+func (d *Driver) UpdateConfig(patch []byte) error {
+	updated, err := d.clone()
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(patch))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(updated); err != nil {
+		return errors.Wrap(err, "parsing configuration patch")
+	}
+	if err := checkImmutableFields(d, updated); err != nil {
+		return err
+	}
+	if updated.Cmdline != d.Cmdline {
+		// A command line set here is the user's, kept when the ISO
+		// changes. A cleared one is read from the ISO again.
+		updated.CmdlineFromISO = false
+	}
+	if err := updated.validate(); err != nil {
+		return errors.Wrap(err, "invalid configuration")
+	}
+	if err := updated.saveConfig(); err != nil {
+		return err
+	}
+
+	// The shared SSH connection outlives the configuration change.
+	sshMu.Lock()
+	updated.sshClient, updated.sshAddr = d.sshClient, d.sshAddr
+	*d = *updated
+	sshMu.Unlock()
+	return d.updateMetadata(nil)
+}
+
+// saveConfig writes the driver configuration of d to config.json, keeping
+// the previous version in config.json.bak.
+func (d *Driver) saveConfig() error {
+	path := d.ResolveStorePath(machineConfigFileName)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(b, &config); err != nil {
+		return errors.Wrapf(err, "parsing %s", path)
+	}
+
+	if config["Driver"], err = json.Marshal(d); err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path+machineConfigBackupSuffix, b, 0600); err != nil {
+		return errors.Wrap(err, "backing up configuration")
+	}
+	if err := writeFileAtomic(path, out, 0600); err != nil {
+		return err
+	}
+	// The driver may run as root, while docker-machine reads the
+	// configuration as the user owning it.
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		for _, p := range []string{path, path + machineConfigBackupSuffix} {
+			if err := os.Chown(p, int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// saveExistingConfig saves the driver configuration when config.json
+// exists: a machine being created has none yet, docker-machine saves its
+// driver afterwards.
+func (d *Driver) saveExistingConfig() error {
+	if _, err := os.Stat(d.ResolveStorePath(machineConfigFileName)); os.IsNotExist(err) {
+		return nil
+	}
+	return d.saveConfig()
+}
+
+// configSettings maps the settings accepted by SetConfigRaw to the Driver
+// fields they set.
+var configSettings = map[string]string{
+	"cpu-count": "CPU",
+	"memory":    "Memory",
+}
+
+// SetConfigRaw changes the setting key (e.g. "cpu-count" or "memory") of an
+// existing machine to value through UpdateConfig. The change takes effect on
+// the next start.
+func (d *Driver) SetConfigRaw(key, value string) error {
+	field, ok := configSettings[key]
+	if !ok {
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	var n int
+	var err error
+	if field == "Memory" {
+		n, err = parseMemorySize(value)
+	} else {
+		n, err = strconv.Atoi(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	patch, err := json.Marshal(map[string]int{field: n})
+	if err != nil {
+		return err
+	}
+	return d.UpdateConfig(patch)
+}
+
+// checkImmutableFields rejects changes of the fields baked into the machine
+// at creation time.
+func checkImmutableFields(old, updated *Driver) error {
+	fields := []struct {
+		name       string
+		old, value interface{}
+	}{
+		{"MachineName", old.MachineName, updated.MachineName},
+		{"StorePath", old.StorePath, updated.StorePath},
+		{"Boot2DockerURL", old.Boot2DockerURL, updated.Boot2DockerURL},
+		{"ImageURL", old.ImageURL, updated.ImageURL},
+		{"ImageType", old.ImageType, updated.ImageType},
+		{"DiskSize", old.DiskSize, updated.DiskSize},
+		{"DiskBackend", old.DiskBackend, updated.DiskBackend},
+		{"CustomKernel", old.CustomKernel, updated.CustomKernel},
+		{"CustomInitrd", old.CustomInitrd, updated.CustomInitrd},
+		{"GuestUser", old.GuestUser, updated.GuestUser},
+	}
+	for _, f := range fields {
+		if f.old != f.value {
+			return fmt.Errorf("%s cannot be changed after the machine has been created", f.name)
+		}
+	}
+	return nil
+}
+
+// clone returns a deep copy of d.
+func (d *Driver) clone() (*Driver, error) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	c := NewDriver("", "")
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadDriver loads the driver of the machine stored in machineDir from the
+// docker-machine configuration. When the driver runs setuid root, the
+// machine must belong to the invoking user.
+func LoadDriver(machineDir string) (*Driver, error) {
+	if realuser.Setuid() {
+		if err := realuser.CheckOwned(filepath.Clean(machineDir)); err != nil {
+			return nil, errors.Wrap(err, "loading the machine")
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(machineDir, machineConfigFileName))
+	if err != nil {
+		return nil, err
+	}
+	d := NewDriver("", "")
+	config := struct {
+		Driver *Driver
+	}{d}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, errors.Wrap(err, "parsing machine configuration")
+	}
+	d.configureLogging()
+	return d, nil
+}
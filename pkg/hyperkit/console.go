@@ -0,0 +1,127 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/console"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/machine/libmachine/state"
+	hyperkit "github.com/moby/hyperkit/go"
+	"github.com/pkg/errors"
+)
+
+// Console modes
+const (
+	// consoleModeFile logs the console to console-ring, as hyperkit.ConsoleFile.
+	consoleModeFile = "file"
+	// consoleModeTTY additionally exposes an interactive tty.
+	consoleModeTTY = "tty"
+	// consoleModeSocket bridges the interactive tty to a unix socket.
+	consoleModeSocket = "socket"
+
+	consoleSocketFileName = "console.sock"
+	consoleSocketName     = "console-socket"
+)
+
+func validateConsoleMode(mode string) error {
+	switch mode {
+	case "", consoleModeFile, consoleModeTTY, consoleModeSocket:
+		return nil
+	}
+	return fmt.Errorf("invalid console mode %q: must be %q, %q or %q", mode, consoleModeFile, consoleModeTTY, consoleModeSocket)
+}
+
+// configureConsole sets up the serial console of h.
+func (d *Driver) configureConsole(h *hyperkit.HyperKit) {
+	switch d.ConsoleMode {
+	case consoleModeTTY, consoleModeSocket:
+		h.Serials = []hyperkit.Serial{{
+			InteractiveConsole: hyperkit.TTYInteractiveConsole,
+			LogToRingBuffer:    true,
+		}}
+	default:
+		h.Console = hyperkit.ConsoleFile
+	}
+}
+
+// consoleTTYPath returns the tty created by hyperkit for the console.
+func (d *Driver) consoleTTYPath() string {
+	switch d.ConsoleMode {
+	case consoleModeTTY, consoleModeSocket:
+		return d.ResolveStorePath("tty1")
+	}
+	return d.ResolveStorePath("tty")
+}
+
+// consolePath returns where to attach to the console.
+func (d *Driver) consolePath() string {
+	if d.ConsoleMode == consoleModeSocket {
+		return d.ResolveStorePath(consoleSocketFileName)
+	}
+	return d.consoleTTYPath()
+}
+
+// startConsoleSocket bridges the console tty to a unix socket in socket mode.
+func (d *Driver) startConsoleSocket() error {
+	d.stopConsoleSocket()
+	if d.ConsoleMode != consoleModeSocket {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, "console-socket", d.consoleTTYPath(), d.consolePath())
+	if err := d.startManagedProcess(consoleSocketName, cmd); err != nil {
+		return errors.Wrap(err, "starting console socket")
+	}
+	log.Infof("Console available with: nc -U %s", d.consolePath())
+	return nil
+}
+
+func (d *Driver) stopConsoleSocket() {
+	d.stopManagedProcesses(consoleSocketName)
+}
+
+// AttachConsole connects in and out to the serial console of the VM until
+// either side is closed.
+func (d *Driver) AttachConsole(in io.Reader, out io.Writer) error {
+	return console.Attach(d.consolePath(), in, out)
+}
+
+// SendKeys types keys on the serial console of the running VM, e.g. to
+// pick a boot menu entry, see console.ParseKeys for the syntax.
+func (d *Driver) SendKeys(keys string) error {
+	if d.ConsoleMode != consoleModeTTY && d.ConsoleMode != consoleModeSocket {
+		return fmt.Errorf("the console of %s doesn't take input, it needs the %q or %q console mode", d.MachineName, consoleModeTTY, consoleModeSocket)
+	}
+	s, err := d.processState()
+	if err != nil {
+		return err
+	}
+	if s != state.Running {
+		return fmt.Errorf("%s is not running", d.MachineName)
+	}
+	return console.SendKeys(d.consolePath(), keys)
+}
@@ -0,0 +1,124 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/console"
+	"github.com/pkg/errors"
+)
+
+// A "console-log" process of the driver binary, managed alongside the VM
+// from before hyperkit starts, follows the console ring and appends it to
+// console.log, in the scratch directory if any. Unlike the ring, which
+// wraps after 64 KiB, the file keeps the whole output of the boot, and the
+// previous boot is kept in console.log.1. Callers on the other side of the
+// plugin boundary tail the file, see MachineMetadata.ConsoleLog.
+const (
+	consoleLogName     = "console-log"
+	consoleLogFile     = "console.log"
+	consoleLogPrevious = consoleLogFile + ".1"
+	// consolePollInterval is the interval between two reads of the console
+	// ring, or of console.log when streaming it.
+	consolePollInterval = 200 * time.Millisecond
+)
+
+// startConsoleLog empties the console ring and starts following it, before
+// hyperkit starts writing it.
+func (d *Driver) startConsoleLog() error {
+	d.stopConsoleLog()
+	if err := os.Truncate(d.ResolveStorePath(consoleRingFile), 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	logPath := d.scratchPath(consoleLogFile)
+	if err := os.Rename(logPath, d.scratchPath(consoleLogPrevious)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := ioutil.WriteFile(logPath, nil, 0644); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, consoleLogName, d.ResolveStorePath(""))
+	if err := d.startManagedProcess(consoleLogName, cmd); err != nil {
+		return errors.Wrap(err, "starting console log")
+	}
+	return nil
+}
+
+// stopConsoleLog terminates the console ring follower.
+func (d *Driver) stopConsoleLog() {
+	d.stopManagedProcesses(consoleLogName)
+}
+
+// LogConsole appends the console of the machine stored in machineDir to its
+// console.log, until the process is terminated.
+func LogConsole(machineDir string) error {
+	d, err := LoadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(d.scratchPath(consoleLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return console.FollowRing(d.ResolveStorePath(consoleRingFile), f, consolePollInterval)
+}
+
+// StreamConsole copies the console output of the current boot to w. With
+// follow, it keeps copying the new output until the machine stops.
+func (d *Driver) StreamConsole(w io.Writer, follow bool) error {
+	path := d.scratchPath(consoleLogFile)
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening the console log")
+	}
+	defer func() { f.Close() }()
+	for {
+		n, err := io.Copy(w, f)
+		if err != nil || !follow {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		// A restart moves the log of the previous boot away.
+		if fi, err := os.Stat(path); err == nil {
+			if cur, err := f.Stat(); err == nil && !os.SameFile(fi, cur) {
+				f.Close()
+				if f, err = os.Open(path); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !d.managedProcessRunning(consoleLogName) {
+			return nil
+		}
+		time.Sleep(consolePollInterval)
+	}
+}
@@ -0,0 +1,53 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// hyperkit only takes a vCPU count and passes the host CPUID through, with
+// every vCPU in a package of its own: the topology can't be configured, but
+// the guest kernel can be told to ignore CPU features with clearcpuid, for
+// workloads picking code paths from them.
+
+// cpuFeatureRegexp matches a CPU feature as named in /proc/cpuinfo, or a
+// CPUID bit number.
+var cpuFeatureRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// validateCPUHideFeatures checks the --hyperkit-cpu-hide-feature values.
+func validateCPUHideFeatures(features []string) error {
+	for _, f := range features {
+		if !cpuFeatureRegexp.MatchString(f) {
+			return fmt.Errorf("invalid CPU feature %q: must be a feature named as in /proc/cpuinfo or a CPUID bit number", f)
+		}
+	}
+	return nil
+}
+
+// cpuHideOption returns the kernel parameter hiding CPUHideFeatures from
+// the guest, empty if none.
+func (d *Driver) cpuHideOption() string {
+	if len(d.CPUHideFeatures) == 0 {
+		return ""
+	}
+	return "clearcpuid=" + strings.Join(d.CPUHideFeatures, ",")
+}
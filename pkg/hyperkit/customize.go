@@ -0,0 +1,218 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/cloudinit"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/cpio"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+	"github.com/leoh0/machine/libmachine/mcnutils"
+	"github.com/pkg/errors"
+)
+
+// Customizations bake files and commands into every machine, e.g. CA
+// certificates or internal tools. For boot2docker, the files are appended
+// to a copy of the initrd as a cpio archive, which the kernel unpacks over
+// the root filesystem before anything runs, and the commands are run like
+// the guest user script. Cloud images get both through cloud-init.
+const (
+	customInitrdFileName       = "initrd-custom"
+	boot2dockerCustomizeScript = "/var/lib/boot2docker/customize.sh"
+	cloudCustomizeScript       = "/var/lib/hyperkit/customize.sh"
+)
+
+// customizeFile is a host file copied into the guest.
+type customizeFile struct {
+	Host  string
+	Guest string
+}
+
+// parseCustomizeFile parses a "hostPath:guestPath" customization file.
+func parseCustomizeFile(spec string) (customizeFile, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || !path.IsAbs(parts[0]) || !path.IsAbs(parts[1]) || path.Clean(parts[1]) == "/" {
+		return customizeFile{}, fmt.Errorf("invalid customization file %q: must be hostPath:guestPath, both absolute", spec)
+	}
+	return customizeFile{Host: parts[0], Guest: path.Clean(parts[1])}, nil
+}
+
+// validateCustomizeFiles checks the format of specs.
+func validateCustomizeFiles(specs []string) error {
+	for _, spec := range specs {
+		if _, err := parseCustomizeFile(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCustomizeFiles calls fn with the guest path, permissions and content
+// of each of CustomizeFiles. The files are read with the privileges of the
+// invoking user.
+func (d *Driver) readCustomizeFiles(fn func(guest string, perm os.FileMode, content []byte) error) error {
+	for _, spec := range d.CustomizeFiles {
+		f, err := parseCustomizeFile(spec)
+		if err != nil {
+			return err
+		}
+		var fi os.FileInfo
+		var content []byte
+		err = realuser.Do(func() error {
+			if fi, err = os.Stat(f.Host); err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return fmt.Errorf("customization file %s is not a regular file", f.Host)
+			}
+			content, err = ioutil.ReadFile(f.Host)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := fn(f.Guest, fi.Mode().Perm(), content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initrdPaths returns the paths of the files and directories of the initrd
+// at path, listed with the libarchive tar of macOS, which reads compressed
+// cpio archives. Only the first archive of an initrd made of several is
+// listed.
+func initrdPaths(initrd string) ([]string, error) {
+	out, err := exec.Command("tar", "-tf", initrd).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %v", initrd, err)
+	}
+	var paths []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if p := strings.TrimPrefix(path.Clean("/"+strings.TrimSpace(line)), "/"); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// customizeDirPerm returns the permissions of a parent directory of the
+// customization files missing from the initrd. The directories of the
+// initrd aren't added again, as the cpio archive would reset their owner
+// and permissions, but when it can't be listed, this keeps the sticky
+// temporary ones right.
+func customizeDirPerm(dir string) os.FileMode {
+	switch "/" + dir {
+	case "/tmp", "/var/tmp":
+		return 0777 | os.ModeSticky
+	}
+	return 0755
+}
+
+// customizedInitrd writes the initrd followed by a cpio archive of the
+// CustomizeFiles into the machine directory, and returns its path.
+func (d *Driver) customizedInitrd() (string, error) {
+	dst := d.ResolveStorePath(customInitrdFileName)
+	if err := mcnutils.CopyFile(d.bootPath(d.Initrd), dst); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	// The kernel looks for the next archive at a 4 bytes boundary.
+	if pad := (4 - fi.Size()%4) % 4; pad > 0 {
+		if _, err := f.Write(make([]byte, pad)); err != nil {
+			return "", err
+		}
+	}
+
+	var archive bytes.Buffer
+	w := cpio.NewWriter(&archive)
+	if paths, err := initrdPaths(d.bootPath(d.Initrd)); err != nil {
+		log.Warnf("The owner and permissions of the guest directories of the customization files may be reset: %v", err)
+	} else {
+		for _, p := range paths {
+			w.MarkExisting(p)
+		}
+	}
+	err = d.readCustomizeFiles(func(guest string, perm os.FileMode, content []byte) error {
+		log.Debugf("Adding %s to the initrd", guest)
+		return w.WriteFile(guest, perm, content, customizeDirPerm)
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if _, err := f.Write(archive.Bytes()); err != nil {
+		return "", err
+	}
+	return dst, f.Close()
+}
+
+// customizeScript returns the script running CustomizeCommands.
+func (d *Driver) customizeScript() []byte {
+	return []byte("#!/bin/sh\n# Generated by docker-machine-driver-hyperkit\nset -e\n" +
+		strings.Join(d.CustomizeCommands, "\n") + "\n")
+}
+
+// runCustomizeCommands runs the CustomizeCommands in a boot2docker guest,
+// and on every later boot.
+func (d *Driver) runCustomizeCommands() error {
+	if len(d.CustomizeCommands) == 0 || d.isCloudImage() {
+		return nil
+	}
+	log.Info("Running the customization commands")
+	if err := d.runBoot2DockerBootScript(boot2dockerCustomizeScript, d.customizeScript()); err != nil {
+		return errors.Wrap(err, "running the customization commands")
+	}
+	return nil
+}
+
+// addCloudCustomizations adds the customization files and commands to the
+// cloud-init configuration of a cloud image.
+func (d *Driver) addCloudCustomizations(config *cloudinit.Config) error {
+	err := d.readCustomizeFiles(func(guest string, perm os.FileMode, content []byte) error {
+		config.Files = append(config.Files, cloudinit.File{Path: guest, Content: content, Permissions: fmt.Sprintf("%04o", perm)})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(d.CustomizeCommands) > 0 {
+		config.Files = append(config.Files, cloudinit.File{Path: cloudCustomizeScript, Content: d.customizeScript(), Permissions: "0755"})
+		config.RunCmd = append(config.RunCmd, "sh "+cloudCustomizeScript)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+	hyperkit "github.com/moby/hyperkit/go"
+)
+
+// hyperkit always attaches a virtio-rnd entropy device, and has no memory
+// balloon device. What can be toggled is the virtio-vsock device and whether
+// the guest kernel trusts the CPU random number generator, which together
+// with virtio-rnd keeps guests from stalling on low entropy early at boot.
+const trustCPURNGOption = "random.trust_cpu=on"
+
+// parseVSockPorts parses the --hyperkit-vsock-port values.
+func parseVSockPorts(values []string) ([]int, error) {
+	var ports []int
+	for _, v := range values {
+		port, err := strconv.Atoi(v)
+		if err != nil || port <= 0 {
+			return nil, fmt.Errorf("invalid vsock port %q", v)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// configureDevices attaches the optional devices to h.
+func (d *Driver) configureDevices(h *hyperkit.HyperKit) {
+	if d.VSock {
+		h.VSock = true
+		h.VSockPorts = d.VSockPorts
+	}
+}
+
+// absolutePaths makes paths absolute relative to the working directory.
+func absolutePaths(paths []string) ([]string, error) {
+	var abs []string
+	for _, p := range paths {
+		a, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		abs = append(abs, a)
+	}
+	return abs, nil
+}
+
+// validateAttachedISOs checks the extra ISO images are absolute paths.
+func validateAttachedISOs(isos []string) error {
+	for _, iso := range isos {
+		if !filepath.IsAbs(iso) {
+			return fmt.Errorf("invalid ISO image %q: must be an absolute path", iso)
+		}
+	}
+	return nil
+}
+
+// attachISOs attaches the extra ISO images to h as CD-ROMs, after the boot
+// or cloud-init one. hyperkit may open them as root, so the invoking user
+// must be able to read them.
+func (d *Driver) attachISOs(h *hyperkit.HyperKit) error {
+	for _, iso := range d.AttachISOs {
+		if _, err := os.Stat(iso); err != nil {
+			return fmt.Errorf("attaching ISO image: %v", err)
+		}
+		if err := realuser.CheckReadable(iso); err != nil {
+			return fmt.Errorf("attaching ISO image: %v", err)
+		}
+		h.ISOImages = append(h.ISOImages, iso)
+	}
+	return nil
+}
+
+// bootCmdline returns the kernel command line the VM is started with.
+func (d *Driver) bootCmdline() (string, error) {
+	cmdline, err := d.expandCmdline()
+	if err != nil {
+		return "", err
+	}
+	if d.TrustCPURNG && !strings.Contains(cmdline, "random.trust_cpu=") {
+		cmdline = strings.TrimSpace(cmdline + " " + trustCPURNGOption)
+	}
+	if opt := d.cpuHideOption(); opt != "" {
+		cmdline = mergeCmdline(append(cmdlineParams(cmdline, false), cmdlineParam{text: opt, override: true}))
+	}
+	return cmdline, nil
+}
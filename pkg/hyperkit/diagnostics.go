@@ -0,0 +1,54 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/diagnostics"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// collectDiagnostics bundles what is needed to debug a failed start into a
+// tarball in the machine directory and returns startErr annotated with its
+// path.
+func (d *Driver) collectDiagnostics(startErr error) error {
+	c := diagnostics.New()
+	c.AddContent("error.txt", []byte(startErr.Error()+"\n"))
+	c.AddContent("cmdline.txt", []byte(d.Cmdline+"\n"))
+	c.AddFile(consoleRingFile, d.scratchPath(consoleRingFile))
+	c.AddFile(consoleLogFile, d.scratchPath(consoleLogFile))
+	c.AddFile("hyperkit.json", d.ResolveStorePath(machineFileName))
+	c.AddFile("machine.json", d.ResolveStorePath(metadataFileName))
+	c.AddFile(driverLogFile, d.scratchPath(driverLogFile))
+	c.AddFile("dhcpd_leases", DHCPLeasesFile)
+	c.AddFile(ipDiscoveryLogFile, d.scratchPath(ipDiscoveryLogFile))
+	c.AddCommand("vmnet.txt", "defaults", "read", CONFIG_PLIST)
+	c.AddCommand("ps.txt", "ps", "auxww")
+	c.AddCommand("ifconfig.txt", "ifconfig", "-a")
+	c.AddCommand("arp.txt", "arp", "-an")
+
+	path := d.ResolveStorePath(fmt.Sprintf("diagnostics-%s.tar.gz", time.Now().Format("20060102-150405")))
+	if err := c.WriteTarball(path); err != nil {
+		log.Warnf("Failed to collect diagnostics: %v", err)
+		return startErr
+	}
+	return fmt.Errorf("%v (diagnostics collected in %s)", startErr, path)
+}
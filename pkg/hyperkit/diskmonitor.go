@@ -0,0 +1,223 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/schema"
+	"github.com/pkg/errors"
+)
+
+// The guest disk usage is checked over SSH by a "disk-monitor" process of the
+// driver binary managed alongside the VM. Each check is recorded in the
+// machine metadata, filesystems above DiskWarnThreshold are reported in
+// disk-monitor.log and, if DiskPruneThreshold is set, the Docker data
+// filesystem is reclaimed with "docker system prune" once it gets above it.
+const (
+	diskMonitorName = "disk-monitor"
+	// defaultDiskWarnThreshold is the default usage percentage above which
+	// a filesystem is under pressure.
+	defaultDiskWarnThreshold = 90
+	dockerDataPath           = "/var/lib/docker"
+)
+
+// diskMonitorPaths are the guest paths whose filesystems are monitored.
+var diskMonitorPaths = []string{"/", dockerDataPath}
+
+// DiskUsage is the result of the last guest disk usage check.
+type DiskUsage = schema.DiskUsage
+
+// FilesystemUsage is the usage of the guest filesystem holding Path.
+type FilesystemUsage = schema.FilesystemUsage
+
+// PruneRecord is an automatic "docker system prune" run.
+type PruneRecord = schema.PruneRecord
+
+func validateDiskThreshold(name string, threshold int) error {
+	if threshold < 0 || threshold > 100 {
+		return errors.Errorf("--%s must be a percentage between 0 and 100", name)
+	}
+	return nil
+}
+
+func (d *Driver) diskWarnThreshold() int {
+	if d.DiskWarnThreshold <= 0 {
+		return defaultDiskWarnThreshold
+	}
+	return d.DiskWarnThreshold
+}
+
+// startDiskMonitor starts the disk monitor if DiskMonitorInterval is set.
+func (d *Driver) startDiskMonitor() error {
+	d.stopDiskMonitor()
+	if d.DiskMonitorInterval <= 0 {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, diskMonitorName, d.ResolveStorePath(""))
+	if err := d.startManagedProcess(diskMonitorName, cmd); err != nil {
+		return errors.Wrap(err, "starting disk monitor")
+	}
+	return nil
+}
+
+// stopDiskMonitor terminates the disk monitor.
+func (d *Driver) stopDiskMonitor() {
+	d.stopManagedProcesses(diskMonitorName)
+}
+
+// DiskPressure returns the guest filesystems which were above the warning
+// threshold on the last disk usage check.
+func (d *Driver) DiskPressure() ([]FilesystemUsage, error) {
+	m, err := d.readMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if m.DiskUsage == nil {
+		return nil, nil
+	}
+	var pressure []FilesystemUsage
+	for _, fs := range m.DiskUsage.Filesystems {
+		if fs.Pressure {
+			pressure = append(pressure, fs)
+		}
+	}
+	return pressure, nil
+}
+
+// MonitorDisk checks the guest disk usage of the machine stored in machineDir
+// every DiskMonitorInterval, until the process is terminated.
+func MonitorDisk(machineDir string) error {
+	d, err := LoadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	if d.DiskMonitorInterval <= 0 {
+		return errors.New("disk monitoring is disabled for this machine")
+	}
+	for {
+		if err := d.checkDiskUsage(); err != nil {
+			log.Warnf("Checking disk usage: %v", err)
+		}
+		time.Sleep(d.DiskMonitorInterval)
+	}
+}
+
+// checkDiskUsage runs one disk usage check.
+func (d *Driver) checkDiskUsage() error {
+	usage, err := d.guestDiskUsage()
+	if err != nil {
+		return err
+	}
+
+	threshold := d.diskWarnThreshold()
+	var prune bool
+	for i := range usage.Filesystems {
+		fs := &usage.Filesystems[i]
+		fs.Pressure = fs.UsedPercent >= threshold
+		if fs.Pressure {
+			log.Warnf("Filesystem %s (%s) is %d%% full", fs.Mount, fs.Path, fs.UsedPercent)
+		}
+		if fs.Path == dockerDataPath && d.DiskPruneThreshold > 0 && fs.UsedPercent >= d.DiskPruneThreshold {
+			prune = true
+		}
+	}
+
+	if prune {
+		log.Infof("Docker data filesystem is above %d%%, pruning", d.DiskPruneThreshold)
+		output, err := d.runSSHCommand("sudo docker system prune -f")
+		if err != nil {
+			log.Warnf("Pruning Docker data: %v", err)
+		} else {
+			usage.LastPrune = &PruneRecord{At: time.Now(), Output: strings.TrimSpace(output)}
+		}
+	}
+
+	return d.updateMetadata(func(m *MachineMetadata) {
+		if usage.LastPrune == nil && m.DiskUsage != nil {
+			usage.LastPrune = m.DiskUsage.LastPrune
+		}
+		m.DiskUsage = usage
+	})
+}
+
+// guestDiskUsage runs df in the guest for each of diskMonitorPaths which
+// exists.
+func (d *Driver) guestDiskUsage() (*DiskUsage, error) {
+	var script strings.Builder
+	for _, p := range diskMonitorPaths {
+		fmt.Fprintf(&script, "[ -d %[1]s ] && echo %[1]s $(df -P %[1]s | tail -n 1); ", p)
+	}
+	script.WriteString("true")
+
+	output, err := d.runSSHCommand(script.String())
+	if err != nil {
+		return nil, err
+	}
+	usage := &DiskUsage{CheckedAt: time.Now()}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if line == "" {
+			continue
+		}
+		fs, err := parseDFLine(line)
+		if err != nil {
+			return nil, err
+		}
+		usage.Filesystems = append(usage.Filesystems, fs)
+	}
+	return usage, nil
+}
+
+// parseDFLine parses a "path filesystem blocks used available capacity mount"
+// line, blocks being 1024 bytes as printed by df -P.
+func parseDFLine(line string) (FilesystemUsage, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 7 {
+		return FilesystemUsage{}, errors.Errorf("unexpected df output %q", line)
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return FilesystemUsage{}, errors.Wrapf(err, "parsing df output %q", line)
+	}
+	used, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return FilesystemUsage{}, errors.Wrapf(err, "parsing df output %q", line)
+	}
+	percent, err := strconv.Atoi(strings.TrimSuffix(fields[5], "%"))
+	if err != nil {
+		return FilesystemUsage{}, errors.Wrapf(err, "parsing df output %q", line)
+	}
+	return FilesystemUsage{
+		Path:        fields[0],
+		Mount:       strings.Join(fields[6:], " "),
+		SizeKB:      size,
+		UsedKB:      used,
+		UsedPercent: percent,
+	}, nil
+}
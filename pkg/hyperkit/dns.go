@@ -0,0 +1,129 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// The guest gets its DNS configuration from the vmnet DHCP server, which
+// hands out the host as its resolver. With DNS or DNSSearch, a resolv.conf
+// is generated instead and bind mounted read-only over /etc/resolv.conf on
+// every boot, so that DHCP renewals don't overwrite it: through bootsync.sh
+// for boot2docker and a bootcmd of cloud-init for cloud images.
+const (
+	boot2dockerDNSScript = "/var/lib/boot2docker/dns.sh"
+	guestResolvConf      = "/etc/resolv.conf.hyperkit"
+)
+
+// dnsScript installs the resolv.conf given as its first argument.
+const dnsScript = `#!/bin/sh
+# Generated by docker-machine-driver-hyperkit
+printf '%%s' %s > %s
+umount /etc/resolv.conf 2>/dev/null
+mount --bind %[2]s /etc/resolv.conf && mount -o remount,ro,bind /etc/resolv.conf
+`
+
+var searchDomainRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.?$`)
+
+// validateDNS checks servers are IP addresses and domains DNS domains.
+func validateDNS(servers, domains []string) error {
+	for _, server := range servers {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("invalid DNS server %q: must be an IP address", server)
+		}
+	}
+	for _, domain := range domains {
+		if !searchDomainRegexp.MatchString(domain) {
+			return fmt.Errorf("invalid DNS search domain %q", domain)
+		}
+	}
+	return nil
+}
+
+// hasCustomDNS tells whether the guest DNS configuration is generated.
+func (d *Driver) hasCustomDNS() bool {
+	return len(d.DNS) > 0 || len(d.DNSSearch) > 0
+}
+
+// resolvConf returns the guest resolv.conf. Without DNS servers the host
+// stays the resolver, as handed out by vmnet.
+func (d *Driver) resolvConf() (string, error) {
+	servers := d.DNS
+	if len(servers) == 0 {
+		hostIP, err := GetNetAddr()
+		if err != nil {
+			return "", errors.Wrapf(err, "looking up the vmnet resolver, set --%s", flagDNS)
+		}
+		servers = []string{hostIP.String()}
+	}
+	var b strings.Builder
+	b.WriteString("# Generated by docker-machine-driver-hyperkit\n")
+	for _, server := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(d.DNSSearch) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(d.DNSSearch, " "))
+	}
+	return b.String(), nil
+}
+
+// dnsScriptContent returns the guest script installing the generated
+// resolv.conf.
+func (d *Driver) dnsScriptContent() ([]byte, error) {
+	conf, err := d.resolvConf()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf(dnsScript, shellQuote(conf), guestResolvConf)), nil
+}
+
+// dnsBootCmd returns the cloud-init bootcmd installing the generated
+// resolv.conf.
+func (d *Driver) dnsBootCmd() (string, error) {
+	script, err := d.dnsScriptContent()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("echo %s | base64 -d | sh", base64.StdEncoding.EncodeToString(script)), nil
+}
+
+// configureGuestDNS installs the generated resolv.conf in a boot2docker
+// guest, now and on every boot.
+func (d *Driver) configureGuestDNS() error {
+	if !d.hasCustomDNS() || d.isCloudImage() {
+		return nil
+	}
+	script, err := d.dnsScriptContent()
+	if err != nil {
+		return err
+	}
+	log.Infof("Configuring the guest DNS")
+	if err := d.runBoot2DockerBootScript(boot2dockerDNSScript, script); err != nil {
+		return errors.Wrap(err, "configuring the guest DNS")
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// The guest docker daemon options are applied on every start like the
+// proxy settings, merged into /etc/docker/daemon.json, which docker-machine
+// doesn't write when provisioning. The storage driver of boot2docker, which
+// docker-machine passes on the daemon command line, goes into a block of
+// /var/lib/boot2docker/profile instead, sourced by the docker init script
+// after the docker-machine settings. The daemon is only restarted when they
+// changed.
+const (
+	dockerdBlockBegin = "# BEGIN docker-machine-driver-hyperkit dockerd"
+	dockerdBlockEnd   = "# END docker-machine-driver-hyperkit dockerd"
+	dockerDaemonJSON  = "/etc/docker/daemon.json"
+
+	cgroupDriverCgroupfs = "cgroupfs"
+	cgroupDriverSystemd  = "systemd"
+)
+
+// dockerdValueRegexp matches the values written unquoted into the
+// daemon command line: registries, CIDRs, mirror URLs and driver names.
+var dockerdValueRegexp = regexp.MustCompile(`^[A-Za-z0-9._:/\[\]-]+$`)
+
+// validateDockerdOptions checks the guest docker daemon options.
+func (d *Driver) validateDockerdOptions() error {
+	for _, registry := range d.DockerInsecureRegistries {
+		if !dockerdValueRegexp.MatchString(registry) {
+			return fmt.Errorf("invalid insecure registry %q: must be a host[:port] or a CIDR", registry)
+		}
+	}
+	for _, mirror := range d.DockerRegistryMirrors {
+		u, err := url.Parse(mirror)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || !dockerdValueRegexp.MatchString(mirror) {
+			return fmt.Errorf("invalid registry mirror %q: must be a URL like https://mirror.example.com", mirror)
+		}
+	}
+	if d.DockerStorageDriver != "" {
+		if !dockerdValueRegexp.MatchString(d.DockerStorageDriver) {
+			return fmt.Errorf("invalid storage driver %q", d.DockerStorageDriver)
+		}
+		// The docker-machine provisioner passes --storage-driver to
+		// the daemon of cloud images, which conflicts with daemon.json.
+		if d.isCloudImage() {
+			return fmt.Errorf("--%s is not supported for cloud images, use --engine-storage-driver", flagDockerStorageDriver)
+		}
+	}
+	switch d.DockerCgroupDriver {
+	case "", cgroupDriverCgroupfs:
+	case cgroupDriverSystemd:
+		if !d.isCloudImage() {
+			return fmt.Errorf("the %q cgroup driver requires a cloud image, boot2docker has no systemd", cgroupDriverSystemd)
+		}
+	default:
+		return fmt.Errorf("invalid cgroup driver %q: must be %q or %q", d.DockerCgroupDriver, cgroupDriverCgroupfs, cgroupDriverSystemd)
+	}
+	return nil
+}
+
+// dockerDaemonJSONScript replaces daemon.json by the configuration given as
+// its first argument, and runs the command given as its third argument
+// when it changed.
+const dockerDaemonJSONScript = `conf=%s
+old=$(cat %[2]s 2>/dev/null)
+[ "$old" = "$conf" ] && exit 0
+mkdir -p $(dirname %[2]s) && printf '%%s\n' "$conf" > %[2]s
+%[3]s
+`
+
+// dockerDaemonConfig returns the daemon.json settings of the options.
+func (d *Driver) dockerDaemonConfig() map[string]interface{} {
+	config := make(map[string]interface{})
+	if len(d.DockerInsecureRegistries) > 0 {
+		config["insecure-registries"] = d.DockerInsecureRegistries
+	}
+	if len(d.DockerRegistryMirrors) > 0 {
+		config["registry-mirrors"] = d.DockerRegistryMirrors
+	}
+	if d.DockerCgroupDriver != "" {
+		config["exec-opts"] = []string{"native.cgroupdriver=" + d.DockerCgroupDriver}
+	}
+	return config
+}
+
+// mergeDaemonJSON sets the settings of config in the daemon.json existing,
+// keeping its other settings.
+func mergeDaemonJSON(existing []byte, config map[string]interface{}) ([]byte, error) {
+	merged := make(map[string]json.RawMessage)
+	if len(bytes.TrimSpace(existing)) > 0 {
+		if err := json.Unmarshal(existing, &merged); err != nil {
+			return nil, fmt.Errorf("parsing the guest %s: %v", dockerDaemonJSON, err)
+		}
+	}
+	for key, value := range config {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		merged[key] = raw
+	}
+	return json.MarshalIndent(merged, "", "  ")
+}
+
+// dockerDaemonJSONScript returns the guest script merging the options into
+// daemon.json, empty if there is nothing to do. daemon.json may hold
+// settings of the user, so it is left alone without options.
+func (d *Driver) dockerDaemonJSONScript() (string, error) {
+	config := d.dockerDaemonConfig()
+	if len(config) == 0 {
+		return "", nil
+	}
+	existing, err := d.runSSHCommand(fmt.Sprintf("sudo cat %s 2>/dev/null || true", dockerDaemonJSON))
+	if err != nil {
+		return "", err
+	}
+	merged, err := mergeDaemonJSON([]byte(existing), config)
+	if err != nil {
+		return "", err
+	}
+	restart := "/etc/init.d/docker restart"
+	if d.isCloudImage() {
+		restart = "systemctl try-restart docker"
+	}
+	return fmt.Sprintf(dockerDaemonJSONScript, shellQuote(string(merged)), dockerDaemonJSON, restart), nil
+}
+
+// dockerdProfileScript returns the guest script installing the storage
+// driver of boot2docker into its profile, or removing the one of an
+// earlier start.
+func (d *Driver) dockerdProfileScript() string {
+	var block string
+	if d.DockerStorageDriver != "" {
+		block = fmt.Sprintf("%s\nDOCKER_STORAGE=%s\n%s", dockerdBlockBegin, d.DockerStorageDriver, dockerdBlockEnd)
+	}
+	return fmt.Sprintf(boot2dockerProxyScript, shellQuote(block), boot2dockerProfile, dockerdBlockBegin, dockerdBlockEnd)
+}
+
+// configureGuestDockerd hands the options to the guest docker daemon, or
+// removes the storage driver of an earlier start.
+func (d *Driver) configureGuestDockerd() error {
+	if len(d.dockerDaemonConfig()) > 0 || d.DockerStorageDriver != "" {
+		log.Infof("Configuring the guest docker daemon")
+	}
+	script, err := d.dockerDaemonJSONScript()
+	if err != nil {
+		return err
+	}
+	// Both scripts exit early when their file is unchanged.
+	if script != "" {
+		script = "(\n" + script + ")\n"
+	}
+	if !d.isCloudImage() {
+		script += "(\n" + d.dockerdProfileScript() + ")\n"
+	}
+	if script == "" {
+		return nil
+	}
+	_, err = d.runSSHCommand(fmt.Sprintf("sudo sh -c %s", shellQuote(script)))
+	return err
+}
@@ -33,15 +33,20 @@ import (
 
 	"regexp"
 
-	nfsexports "github.com/johanneswuerbach/nfsexports"
+	"github.com/johanneswuerbach/nfsexports"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/disk"
 	pkgdrivers "github.com/leoh0/docker-machine-driver-hyperkit/pkg/drivers"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/helper"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/hooks"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/schema"
 	"github.com/leoh0/machine/libmachine/drivers"
-	"github.com/leoh0/machine/libmachine/log"
 	"github.com/leoh0/machine/libmachine/mcnutils"
 	"github.com/leoh0/machine/libmachine/state"
 	ps "github.com/mitchellh/go-ps"
 	hyperkit "github.com/moby/hyperkit/go"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 	"k8s.io/apimachinery/pkg/util/uuid"
 )
 
@@ -49,16 +54,39 @@ const (
 	isoFilename     = "boot2docker.iso"
 	isoMountPath    = "b2d-image"
 	pidFileName     = "hyperkit.pid"
-	machineFileName = "hyperkit.json"
+	machineFileName = schema.HyperKitStateFile
 	permErr         = "%s needs to run with elevated permissions. " +
 		"Please run the following command, then try again: " +
 		"sudo chown root:wheel %s && sudo chmod u+s %s"
 	defaultSSHUser = "docker"
+	defaultSSHPort = 22
+	defaultCPUs    = 2
+	defaultMemory  = 6000
+	// defaultDiskSize is the disk size in MB.
+	defaultDiskSize = 20000
+
+	// defaultIPPollInterval is how long to sleep between two lookups of the
+	// dhcpd leases file while waiting for the VM to get an IP address.
+	defaultIPPollInterval = 2 * time.Second
+	// defaultIPWaitTimeout is the time budget for the VM to show up in the
+	// dhcpd leases file after hyperkit has been started.
+	defaultIPWaitTimeout = 120 * time.Second
+	// maxIPBackoff caps the delay between two lookups of the exponential
+	// IP backoff.
+	maxIPBackoff = 15 * time.Second
+	// ipBackoffJitter randomizes the exponential IP backoff delays.
+	ipBackoffJitter = 0.2
+	// ipProgressInterval is how often a still running IP lookup is reported.
+	ipProgressInterval = 10 * time.Second
+
+	ipBackoffConstant    = "constant"
+	ipBackoffExponential = "exponential"
 )
 
 var (
 	kernelRegexp       = regexp.MustCompile(`(vmlinu[xz]|bzImage)[\d]*`)
 	kernelOptionRegexp = regexp.MustCompile(`(?:\t|\s{2})append\s+([[:print:]]+)`)
+	uuidRegexp         = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
 )
 
 type Driver struct {
@@ -69,13 +97,281 @@ type Driver struct {
 	CPU            int
 	Memory         int
 	Cmdline        string
-	NFSShares      []string
-	NFSSharesRoot  string
-	UUID           string
-	BootKernel string
-	BootInitrd string
-	Initrd     string
-	Vmlinuz    string
+	// CmdlineFromISO is set when Cmdline was read from the ISO rather than
+	// given with --hyperkit-cmdline, to be read again from a changed ISO.
+	CmdlineFromISO bool
+	// CmdlineExtra is a template adjusting Cmdline, see cmdlineData.
+	CmdlineExtra  string
+	NFSShares     []string
+	NFSSharesRoot string
+	// NFSMaps are the "<share>=mapall|maproot:<user>[:<group>]" identities
+	// the guest accesses to the shares are mapped to, see nfsMapping.
+	NFSMaps []string
+	// SudoAskpass is the SUDO_ASKPASS program of the sudo editing
+	// /etc/exports when the driver doesn't run as root, see runPrivileged.
+	SudoAskpass string
+	// HomeShare is the share of NFSShares mounted at its own path rather
+	// than below NFSSharesRoot, see homeShare.
+	HomeShare string
+	// NFSExportScope is "ip", "subnet" or a CIDR the shares are exported to.
+	NFSExportScope string
+	// NFSExportTemplate is the text/template of the /etc/exports line of
+	// a share, see nfsExport.
+	NFSExportTemplate string
+	// DNS and DNSSearch replace the resolvers and search domains handed
+	// out by DHCP in the guest, see resolvConf.
+	DNS       []string
+	DNSSearch []string
+	// HyperKitBinaryPath is the hyperkit binary the machine runs with.
+	// HyperKitBinaryURL instead downloads it into the store, pinned to
+	// HyperKitBinarySHA256, see hyperKitBinary.
+	HyperKitBinaryPath   string
+	HyperKitBinaryURL    string
+	HyperKitBinarySHA256 string
+	// Supervise restarts the machine when hyperkit dies, up to
+	// SuperviseMaxRestarts times in a row, see Supervise.
+	Supervise            bool
+	SuperviseMaxRestarts int
+	// HookURL and HookCommand receive the lifecycle events of the
+	// machine, see fireHooks.
+	HookURL     string
+	HookCommand string
+	// DockerInsecureRegistries, DockerRegistryMirrors, DockerStorageDriver
+	// and DockerCgroupDriver configure the guest docker daemon on every
+	// start, see configureGuestDockerd.
+	DockerInsecureRegistries []string
+	DockerRegistryMirrors    []string
+	DockerStorageDriver      string
+	DockerCgroupDriver       string
+	// AutoResources sizes CPU, Memory and DiskSize from the host on
+	// creation, see autoSizeResources.
+	AutoResources bool
+	// CPUHideFeatures are hidden from the guest kernel, see cpuHideOption.
+	CPUHideFeatures []string
+	// TimeSync ("run-once" or "periodic") sets the guest clock from the
+	// host, every TimeSyncInterval when periodic, see SyncTime.
+	TimeSync         string
+	TimeSyncInterval time.Duration
+	// CustomizeFiles ("hostPath:guestPath") and CustomizeCommands are
+	// baked into the guest before its first boot, see customizedInitrd.
+	CustomizeFiles    []string
+	CustomizeCommands []string
+	// WakeWatch reconciles the guest with the host after host sleeps, see
+	// WatchWake.
+	WakeWatch bool
+	// DiskBackend manages the disk image, see package disk. Machines
+	// created before it existed have none, which is disk.Default.
+	DiskBackend string
+	// StatusAddress serves MachineStatus while the machine runs, see
+	// ServeStatus.
+	StatusAddress string
+	// Firewall restricts the Docker and SSH ports of the guest to the
+	// host and FirewallAllow, see configureGuestFirewall.
+	Firewall      bool
+	FirewallAllow []string
+	// RegistryAuth and RegistryAuthFile select the registry credentials
+	// copied into the guest on start, see registryAuths.
+	RegistryAuth     []string
+	RegistryAuthFile string
+	// AttachISOs are the absolute paths of ISO images attached besides
+	// the boot one, see attachISOs.
+	AttachISOs []string
+	// ExtraArgs are hyperkit options appended to its command line, see
+	// startWithExtraArgs.
+	ExtraArgs []string
+	// VMNetSubnet is "auto", "off" or the CIDR of the vmnet shared
+	// network, see selectVMNetSubnet.
+	VMNetSubnet string
+	// ProvisionScripts run in the guest once it is created, see
+	// RunProvisionScripts.
+	ProvisionScripts []string
+	ProvisionOnError string
+	// HTTPProxy, HTTPSProxy and NoProxy are handed to the guest docker
+	// daemon, with SystemProxy filled in from the host, see proxySettings.
+	HTTPProxy   string
+	HTTPSProxy  string
+	NoProxy     []string
+	SystemProxy bool
+	// ScratchDir receives the console ring and the logs of the machine,
+	// see scratchPath.
+	ScratchDir string
+	// ShareMode is "nfs" (default, falling back to sshfs when /etc/exports
+	// can't be modified) or "sshfs".
+	ShareMode string
+	// NFSMountOwner ("owner[:group]") and NFSMountMode (octal) are given to
+	// the guest mount point directories of the shares.
+	NFSMountOwner string
+	NFSMountMode  string
+	UUID          string
+	// CustomKernel and CustomInitrd are the kernel and initrd given with
+	// --hyperkit-kernel and --hyperkit-initrd. BootKernel and BootInitrd
+	// are the files the booted kernel and initrd were copied from, in the
+	// mounted ISO unless a custom kernel is booted.
+	CustomKernel string
+	CustomInitrd string
+	BootKernel   string
+	BootInitrd   string
+	Initrd       string
+	Vmlinuz      string
+	// KernelName picks the kernel booted among those of the ISO, by file
+	// name or path in the ISO, see selectKernel.
+	KernelName string
+
+	// StartupGracePeriod is slept once after hyperkit has been started and
+	// before the first IP lookup, giving slow guests time to reach DHCP.
+	StartupGracePeriod time.Duration
+	// IPPollInterval is the delay between two IP lookups, or the initial
+	// delay with the "exponential" IPBackoff.
+	IPPollInterval time.Duration
+	// IPWaitTimeout is the time budget for the VM to get an IP address.
+	IPWaitTimeout time.Duration
+	// IPBackoff is "constant" (default) or "exponential".
+	IPBackoff string
+	// ARPProbe probes the vmnet subnet before falling back to the ARP
+	// cache, see ARPResolver.
+	ARPProbe bool
+	// IPCommand is a shell command printing the VM IP address, tried
+	// before the other lookups, see CommandResolver.
+	IPCommand string
+
+	// ImageURL optionally points at a boot ISO or a raw cloud disk image.
+	// Cloud images are booted with ImageKernel and ImageInitrd and
+	// provisioned through cloud-init.
+	ImageURL    string
+	ImageKernel string
+	ImageInitrd string
+	// ImageType is detected from ImageURL at creation time.
+	ImageType string
+
+	// BootMode is "kernel" (default) or "uefi". UEFI boots through Bootrom
+	// and skips the kernel extraction.
+	BootMode string
+	Bootrom  string
+
+	// BootSlot is the active boot slot, see Upgrade.
+	BootSlot string
+
+	// PrivilegedHelper delegates the operations requiring root to the
+	// privileged helper so that the driver can run unprivileged.
+	PrivilegedHelper bool
+
+	// PortForwards are "hostPort:guestPort[/tcp|udp]" forwards from
+	// localhost to the VM.
+	PortForwards []string
+
+	// ResolverDomain is resolved by the VM through an /etc/resolver entry
+	// while the machine is running.
+	ResolverDomain string
+
+	// Companions are host commands started after the VM is up and
+	// terminated on Stop, Kill and Remove.
+	Companions []string
+
+	// ConsoleMode is "file" (default), "tty" or "socket".
+	ConsoleMode string
+
+	// DiskMonitorInterval enables the guest disk usage monitor, see
+	// MonitorDisk.
+	DiskMonitorInterval time.Duration
+	DiskWarnThreshold   int
+	DiskPruneThreshold  int
+
+	// KernelMonitorInterval enables the guest kernel log monitor, see
+	// MonitorKernel.
+	KernelMonitorInterval time.Duration
+
+	// CPUPriority is "normal" (default), "low" or "background", see
+	// package cpupriority.
+	CPUPriority string
+
+	// GuestUser is an additional guest user mirroring the host user, see
+	// personalizeGuest. It is authorized the keys of GuestAuthorizedKeys,
+	// or else the machine key.
+	GuestUser           string
+	GuestUID            int
+	GuestGroup          string
+	GuestGID            int
+	GuestAuthorizedKeys string
+
+	// VSock attaches a virtio-vsock device exposing VSockPorts as unix
+	// sockets in the machine directory.
+	VSock      bool
+	VSockPorts []int
+	// TrustCPURNG lets the guest kernel seed its entropy pool from the CPU.
+	TrustCPURNG bool
+
+	// VPNKit attaches a vpnkit network interface: "auto" (Docker Desktop),
+	// "managed" (run by the driver with VPNKitBinary) or a socket path.
+	VPNKit       string
+	VPNKitBinary string
+	// Networks are the network interfaces requested with the network flag,
+	// see setNetworks.
+	Networks []string
+
+	// MACAddress is the MAC address of the VM, recorded on start or pinned
+	// with MACPinned, see macAddress.
+	MACAddress string
+	MACPinned  bool
+
+	// StopWait is how long Stop waits for a busy guest to settle, see
+	// settleGuest.
+	StopWait time.Duration
+
+	// Notify posts Notification Center notifications when long operations
+	// finish or the VM crashes.
+	Notify bool
+
+	// MetricsAddress is where the metrics listener serves the machine
+	// stats, see ServeMetrics.
+	MetricsAddress string
+
+	// ReuseArtifacts keeps the ISO and kernel of the machine when it is
+	// removed, and with ReuseDisk its disk, for a re-creation with the same
+	// parameters, see keepArtifacts.
+	ReuseArtifacts bool
+	ReuseDisk      bool
+
+	// TelemetryFile and TelemetryCommand receive the timing events of
+	// the machine operations, see package telemetry.
+	TelemetryFile    string
+	TelemetryCommand string
+
+	// LogLevel and LogFormat configure the driver log, see
+	// configureLogging.
+	LogLevel  string
+	LogFormat string
+
+	// SSHPasswordLogin keeps the default password of the boot2docker SSH
+	// user usable, see lockGuestPassword.
+	SSHPasswordLogin bool
+
+	// SelfTest checks the reachability of the Docker endpoint after Start,
+	// see CheckReachability.
+	SelfTest bool
+
+	// privilegeScope is the driver operation privileged operations are
+	// performed for, see enterPrivilegeScope.
+	privilegeScope string
+	// ipDiscoveryTrace is the open ipDiscoveryLogFile.
+	ipDiscoveryTrace *log.RotatingFile
+	// vmnetSubnetChanged is set when this start switched the vmnet shared
+	// network.
+	vmnetSubnetChanged bool
+	// ipResolvedAt is the last resolution of IPAddress, see GetIP.
+	ipResolvedAt time.Time
+	// earlyInitrds are the initrd segments found by extractKernel which
+	// copyKernel concatenates in front of BootInitrd.
+	earlyInitrds []string
+	// grubCmdline is set by extractKernel when Cmdline was read from the
+	// default GRUB menuentry, which goes with its kernel.
+	grubCmdline bool
+	// guestSample caches the guest usage in the metrics process, see
+	// ServeMetrics.
+	guestSample *guestStatsCache
+	// sshClient is the SSH connection to sshAddr shared by the guest
+	// commands, see sharedSSHClient.
+	sshClient *ssh.Client
+	sshAddr   string
 }
 
 // Return the state of the hyperkit pid
@@ -104,11 +400,12 @@ func NewDriver(hostName, storePath string) *Driver {
 		BaseDriver: &drivers.BaseDriver{
 			SSHUser: defaultSSHUser,
 		},
-		CPU: 2,
-		Memory: 6000,
-		DiskSize: 20000,
-		UUID: string(uuid.NewUUID()),
-		CommonDriver: &pkgdrivers.CommonDriver{},
+		CPU:            defaultCPUs,
+		Memory:         defaultMemory,
+		DiskSize:       defaultDiskSize,
+		UUID:           string(uuid.NewUUID()),
+		IPPollInterval: defaultIPPollInterval,
+		CommonDriver:   &pkgdrivers.CommonDriver{},
 	}
 }
 
@@ -122,30 +419,116 @@ func (d *Driver) GetSSHUsername() string {
 
 // PreCreateCheck is called to enforce pre-creation steps
 func (d *Driver) PreCreateCheck() error {
-	exe, err := os.Executable()
+	if d.AutoResources {
+		d.autoSizeResources()
+	}
+	checks, err := d.CheckHost()
+	for _, c := range checks {
+		if c.Status == HostCheckWarning {
+			log.Warnf("Host check %s", c)
+		}
+	}
 	if err != nil {
 		return err
 	}
+	if err := d.checkHostResources(); err != nil {
+		return err
+	}
+	return d.checkStoreVolume()
+}
+
+func (d *Driver) Create() error {
+	d.ImageType = detectImageType(d.ImageURL)
+	if d.isCloudImage() {
+		if err := d.createFromCloudImage(); err != nil {
+			return err
+		}
+	} else {
+		if d.ImageURL != "" {
+			d.Boot2DockerURL = d.ImageURL
+		}
+
+		restored, err := d.restoreArtifacts()
+		if err != nil {
+			return errors.Wrap(err, "restoring kept artifacts")
+		}
+
+		backend, err := disk.New(d.DiskBackend)
+		if err != nil {
+			return err
+		}
+		err = d.timed(eventDownload, func() error {
+			return pkgdrivers.MakeDiskImage(d.BaseDriver, d.Boot2DockerURL, d.DiskSize, backend)
+		})
+		if err != nil {
+			return errors.Wrap(err, "making disk image")
+		}
+
+		if d.isUEFIBoot() {
+			if _, err := d.bootromPath(); err != nil {
+				return err
+			}
+		} else if d.hasCustomKernel() {
+			if err := d.copyCustomKernel(d.ResolveStorePath(isoFilename)); err != nil {
+				return err
+			}
+		} else if !restored {
+			isoPath := d.ResolveStorePath(isoFilename)
+			if err := d.extractKernel(isoPath); err != nil {
+				return err
+			}
+		}
+
+		if err := d.updateISOChecksum(); err != nil {
+			return errors.Wrap(err, "recording ISO checksum")
+		}
+	}
+
+	// A recreated machine has a fresh disk and thus new SSH host keys.
+	if err := d.forgetSSHHostKey(); err != nil {
+		return errors.Wrap(err, "removing stale ssh host key")
+	}
 
-	if syscall.Geteuid() != 0 {
-		return fmt.Errorf(permErr, filepath.Base(exe), exe, exe)
+	if err := d.Start(); err != nil {
+		return err
 	}
 
+	d.setPhase(phaseProvisioning)
+	if err := d.provisionGuest(); err != nil {
+		d.setPhase(phaseError)
+		d.notify("Creating machine %s failed", d.MachineName)
+		d.fireHooks(hooks.Error, err)
+		return err
+	}
+	d.setPhase(phaseRunning)
+	d.notify("Machine %s is created", d.MachineName)
+	d.fireHooks(hooks.Created, nil)
 	return nil
 }
 
-func (d *Driver) Create() error {
-	// TODO: handle different disk types.
-	if err := pkgdrivers.MakeDiskImage(d.BaseDriver, d.Boot2DockerURL, d.DiskSize); err != nil {
-		return errors.Wrap(err, "making disk image")
+// provisionGuest sets up the guest of a freshly created machine.
+func (d *Driver) provisionGuest() error {
+	if err := d.recordSSHHostKey(); err != nil {
+		return err
+	}
+
+	if err := d.lockGuestPassword(); err != nil {
+		return err
+	}
+
+	if err := d.configureGuestDNS(); err != nil {
+		return err
+	}
+
+	if err := d.personalizeGuest(); err != nil {
+		return err
 	}
 
-	isoPath := d.ResolveStorePath(isoFilename)
-	if err := d.extractKernel(isoPath); err != nil {
+	if err := d.runCustomizeCommands(); err != nil {
 		return err
 	}
 
-	return d.Start()
+	return d.RunProvisionScripts()
 }
 
 // DriverName returns the name of the driver
@@ -155,7 +538,7 @@ func (d *Driver) DriverName() string {
 
 // GetSSHHostname returns hostname for use with ssh
 func (d *Driver) GetSSHHostname() (string, error) {
-	return d.IPAddress, nil
+	return d.GetIP()
 }
 
 // GetURL returns a Docker compatible host URL for connecting to this host
@@ -168,8 +551,9 @@ func (d *Driver) GetURL() (string, error) {
 	return fmt.Sprintf("tcp://%s:2376", ip), nil
 }
 
-// GetState returns the state that the host is in (running, stopped, etc)
-func (d *Driver) GetState() (state.State, error) {
+// processState returns the state of the hyperkit process: running or
+// stopped.
+func (d *Driver) processState() (state.State, error) {
 	pid := d.getPid()
 	if pid == 0 {
 		return state.Stopped, nil
@@ -180,7 +564,9 @@ func (d *Driver) GetState() (state.State, error) {
 	}
 
 	// Sending a signal of 0 can be used to check the existence of a process.
-	if err := p.Signal(syscall.Signal(0)); err != nil {
+	// A hyperkit started by the privileged helper is owned by root, which
+	// makes the check fail with EPERM although the process exists.
+	if err := p.Signal(syscall.Signal(0)); err != nil && !errors.Is(err, syscall.EPERM) {
 		return state.Stopped, nil
 	}
 	if p == nil {
@@ -191,12 +577,35 @@ func (d *Driver) GetState() (state.State, error) {
 
 // Kill stops a host forcefully
 func (d *Driver) Kill() error {
-	return d.sendSignal(syscall.SIGKILL)
+	defer d.enterPrivilegeScope(helper.ScopeKill)()
+	d.setShouldRun(false)
+	d.setPhase(phaseStopping)
+	d.stopCrashWatch()
+	d.stopDiskMonitor()
+	d.stopKernelMonitor()
+	d.stopMetrics()
+	d.stopStatusServer()
+	d.stopWakeWatch()
+	d.stopTimeSync()
+	d.stopCompanions()
+	d.stopSSHFSShares()
+	d.stopPortForwards()
+	d.stopVPNKit()
+	d.stopConsoleSocket()
+	d.stopConsoleLog()
+	d.closeSSH()
+	d.unregisterResolver()
+	if err := d.sendSignal(syscall.SIGKILL); err != nil {
+		return err
+	}
+	d.fireHooks(hooks.Stopped, nil)
+	return nil
 }
 
 // Remove a host
 func (d *Driver) Remove() error {
-	s, err := d.GetState()
+	defer d.enterPrivilegeScope(helper.ScopeRemove)()
+	s, err := d.processState()
 	if err != nil || s == state.Error {
 		log.Infof("Error checking machine status: %s, assuming it has been removed already", err)
 	}
@@ -205,6 +614,29 @@ func (d *Driver) Remove() error {
 			return err
 		}
 	}
+	d.stopCrashWatch()
+	d.stopDiskMonitor()
+	d.stopKernelMonitor()
+	d.stopMetrics()
+	d.stopStatusServer()
+	d.stopWakeWatch()
+	d.stopTimeSync()
+	d.stopCompanions()
+	d.stopSSHFSShares()
+	d.stopPortForwards()
+	d.stopVPNKit()
+	d.stopConsoleSocket()
+	d.stopConsoleLog()
+	d.closeSSH()
+	d.unregisterResolver()
+	if err := d.keepArtifacts(); err != nil {
+		log.Warnf("Keeping the artifacts of %s: %v", d.MachineName, err)
+	}
+	if err := d.uninstallSupervisor(); err != nil {
+		log.Warnf("Failed to remove the supervisor agent of %s: %v", d.MachineName, err)
+	}
+	d.removeScratchDir()
+	d.fireHooks(hooks.Removed, nil)
 	return nil
 }
 
@@ -214,131 +646,403 @@ func (d *Driver) Restart() error {
 
 // Start a host
 func (d *Driver) Start() error {
+	d.configureLogging()
+	if err := d.timed(eventStart, d.start); err != nil {
+		d.fireHooks(hooks.Error, err)
+		return err
+	}
+	return nil
+}
+
+func (d *Driver) start() error {
+	defer d.enterPrivilegeScope(helper.ScopeStart)()
+	if err := d.migrateLayout(); err != nil {
+		return errors.Wrap(err, "upgrading the machine directory")
+	}
+	if err := d.refreshKernel(); err != nil {
+		return err
+	}
 	if err := d.recoverFromUncleanShutdown(); err != nil {
 		return err
 	}
+	if err := d.reapOrphans(); err != nil {
+		return err
+	}
+	d.setPhase(phaseStarting)
 
+	hyperKitPath, err := d.hyperKitBinary()
+	if err != nil {
+		return err
+	}
 	stateDir := filepath.Join(d.StorePath, "machines", d.MachineName)
-	h, err := hyperkit.New("", "", stateDir)
+	h, err := hyperkit.New(hyperKitPath, "", stateDir)
 	if err != nil {
 		return err
 	}
 
 	// TODO: handle the rest of our settings.
-	h.Kernel = d.ResolveStorePath(d.Vmlinuz)
-	h.Initrd = d.ResolveStorePath(d.Initrd)
+	if err := d.configureBoot(h); err != nil {
+		return err
+	}
+	if err := d.selectVMNetSubnet(); err != nil {
+		return err
+	}
 	h.VMNet = true
-	h.ISOImages = []string{d.ResolveStorePath(isoFilename)}
-	h.Console = hyperkit.ConsoleFile
+	if d.isCloudImage() {
+		h.ISOImages = []string{d.ResolveStorePath(cloudInitSeedFileName)}
+	} else {
+		h.ISOImages = []string{d.bootPath(isoFilename)}
+	}
+	if err := d.attachISOs(h); err != nil {
+		return err
+	}
+	if err := d.startVPNKit(); err != nil {
+		return err
+	}
+	h.VPNKitSock = d.vpnkitSocket()
+	h.VPNKitUUID = d.UUID
+	if err := d.linkConsoleRing(); err != nil {
+		return err
+	}
+	d.configureConsole(h)
+	d.configureDevices(h)
 	h.CPUs = d.CPU
 	h.Memory = d.Memory
 	h.UUID = d.UUID
 
-	h.Disks = []hyperkit.Disk{
-		&hyperkit.RawDisk{
-			Path: pkgdrivers.GetDiskPath(d.BaseDriver),
-			Size: d.DiskSize,
-			Trim: true,
-		},
+	backend, err := disk.New(d.DiskBackend)
+	if err != nil {
+		return err
 	}
+	h.Disks = []hyperkit.Disk{backend.Attach(pkgdrivers.GetDiskPath(d.BaseDriver), d.DiskSize)}
 
 	log.Infof("Using UUID %s", h.UUID)
-	mac, err := GetMACAddressFromUUID(h.UUID)
+	mac, err := d.macAddress()
 	if err != nil {
 		return err
 	}
-
-	// Need to strip 0's
-	mac = trimMacAddress(mac)
 	log.Infof("Generated MAC %s", mac)
 	log.Infof("Starting with cmdline: %s", d.Cmdline)
-	if _, err := h.Start(d.Cmdline); err != nil {
+	if err := d.startConsoleLog(); err != nil {
+		return err
+	}
+	if err := d.startHyperKit(h); err != nil {
+		d.stopConsoleLog()
 		return err
 	}
+	d.recordBoot()
 
+	if err := d.finishStart(mac); err != nil {
+		d.setPhase(phaseError)
+		d.notify("Starting machine %s failed", d.MachineName)
+		return d.collectDiagnostics(err)
+	}
+	d.setPhase(phaseRunning)
+	d.setShouldRun(true)
+	if err := d.installSupervisor(); err != nil {
+		log.Warnf("Failed to install the supervisor agent of %s: %v", d.MachineName, err)
+	}
+	d.fireHooks(hooks.Started, nil)
+	return nil
+}
+
+// finishStart waits for the freshly started VM to get an IP and sets up the
+// host side integrations.
+func (d *Driver) finishStart(mac string) error {
+	// hyperkit has just been started.
+	booted := time.Now()
+
+	if err := d.startConsoleSocket(); err != nil {
+		return err
+	}
+
+	if d.StartupGracePeriod > 0 {
+		log.Debugf("Waiting %s before looking up the IP address", d.StartupGracePeriod)
+		time.Sleep(d.StartupGracePeriod)
+	}
+
+	attempts := 0
+	progress := d.newBootProgress()
+	var bootErr error
 	getIP := func() error {
+		attempts++
+		if bootErr = progress.check(); bootErr != nil {
+			return bootErr
+		}
 		var err error
-		d.IPAddress, err = GetIPAddressByMACAddress(mac)
+		d.IPAddress, err = d.ipResolver().Resolve(mac)
 		if err != nil {
 			return &RetriableError{Err: err}
 		}
 		return nil
 	}
 
-	if err := RetryAfter(30, getIP, 2*time.Second); err != nil {
+	err := Retry(d.ipRetryPolicy(), getIP)
+	d.emit(eventBootToIP, booted, attempts, err)
+	if bootErr != nil {
+		return bootErr
+	}
+	if err != nil {
 		return fmt.Errorf("IP address never found in dhcp leases file %v", err)
 	}
+	d.emitSSHReady(booted)
+
+	d.notify("Machine %s is up at %s", d.MachineName, d.IPAddress)
+	d.fireHooks(hooks.GotIP, nil)
+
+	if err := d.updateMetadata(func(m *MachineMetadata) {
+		m.MACAddress = mac
+		recordIP(m, d.IPAddress, time.Now())
+	}); err != nil {
+		log.Warnf("Failed to update machine metadata: %v", err)
+	}
+
+	d.recordInterfaces()
+
+	if err := d.configureGuestProxy(); err != nil {
+		log.Warnf("Failed to configure the guest proxy: %v", err)
+	}
+	if err := d.configureGuestDockerd(); err != nil {
+		log.Warnf("Failed to configure the guest docker daemon: %v", err)
+	}
+	if err := d.ensureServerCert(); err != nil {
+		log.Warnf("Failed to issue the docker certificate for %s again, run docker-machine regenerate-certs %s: %v", d.IPAddress, d.MachineName, err)
+	}
+	if err := d.configureGuestFirewall(); err != nil {
+		return err
+	}
+	if err := d.configureRegistryAuth(); err != nil {
+		log.Warnf("Failed to copy the registry credentials into the guest: %v", err)
+	}
+	if err := d.refreshGuestDNS(); err != nil {
+		log.Warnf("Failed to refresh the guest DNS: %v", err)
+	}
+
+	d.syncTimeOnStart()
+
+	if err := d.reconcileNFSShares(); err != nil {
+		log.Warnf("Failed to clean up the NFS shares no longer configured: %v", err)
+	}
 
 	if len(d.NFSShares) > 0 {
 		log.Info("Setting up NFS mounts")
+		sharesStart := time.Now()
 
 		// takes some time here for ssh / nfsd to work properly
-		err = d.waitForIP()
+		err := d.waitForIP()
 		if err != nil {
 			log.Errorf("Failed to get IP address for VM: %s", err.Error())
 			return err
 		}
 
-		err = d.setupNFSShare()
+		if d.ShareMode == shareModeSSHFS {
+			err = d.setupSSHFSShares()
+		} else if exportsImmutable() {
+			log.Warnf("%s is immutable, sharing folders over sshfs instead of NFS", exportsFile)
+			err = d.setupSSHFSShares()
+		} else if err = d.setupNFSShare(); isExportsPermissionError(err) {
+			log.Warnf("Modifying %s is not permitted (%v), sharing folders over sshfs instead of NFS", exportsFile, err)
+			err = d.setupSSHFSShares()
+		}
+		d.emit(eventShareSetup, sharesStart, 0, err)
 		if err != nil {
 			log.Errorf("NFS setup failed: %s", err.Error())
 			return err
 		}
 	}
 
+	if err := d.registerResolver(); err != nil {
+		return err
+	}
+
+	if err := d.startPortForwards(); err != nil {
+		return err
+	}
+
+	if err := d.startCompanions(); err != nil {
+		return err
+	}
+
+	if err := d.startDiskMonitor(); err != nil {
+		return err
+	}
+
+	if err := d.startKernelMonitor(); err != nil {
+		return err
+	}
+
+	if err := d.startMetrics(); err != nil {
+		return err
+	}
+
+	if err := d.startStatusServer(); err != nil {
+		return err
+	}
+
+	if err := d.startWakeWatch(); err != nil {
+		return err
+	}
+
+	if err := d.startTimeSync(); err != nil {
+		return err
+	}
+
+	if err := d.startCrashWatch(); err != nil {
+		return err
+	}
+
+	if d.SelfTest {
+		d.selfTest()
+	}
 	return nil
 }
 
 // Stop a host gracefully
 func (d *Driver) Stop() error {
+	return d.timed(eventStop, d.stop)
+}
+
+func (d *Driver) stop() error {
+	defer d.enterPrivilegeScope(helper.ScopeStop)()
+	d.setShouldRun(false)
+	d.setPhase(phaseStopping)
+	d.settleGuest()
 	d.cleanupNfsExports()
-	return d.sendSignal(syscall.SIGTERM)
+	d.stopCrashWatch()
+	d.stopDiskMonitor()
+	d.stopKernelMonitor()
+	d.stopMetrics()
+	d.stopStatusServer()
+	d.stopWakeWatch()
+	d.stopTimeSync()
+	d.stopCompanions()
+	d.stopPortForwards()
+	d.stopVPNKit()
+	d.stopConsoleSocket()
+	d.stopConsoleLog()
+	d.closeSSH()
+	d.unregisterResolver()
+	if err := d.sendSignal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	d.fireHooks(hooks.Stopped, nil)
+	return nil
 }
 
-func (d *Driver) extractKernel(isoPath string) error {
-	log.Debugf("Mounting %s", isoFilename)
+// mountISO mounts isoPath at isoMountPath in the machine directory, or
+// copies its boot files there when hdiutil can't mount it. unmount undoes
+// either.
+func (d *Driver) mountISO(isoPath string) (unmount func(), err error) {
+	log.Debugf("Mounting %s", isoPath)
+
+	volumeRootDir := d.ResolveStorePath(isoMountPath)
+	if err := hdiutil("attach", isoPath, "-mountpoint", volumeRootDir); err != nil {
+		// hdiutil fails to mount some layouts, e.g. EFI-only ISOs.
+		log.Warnf("Mounting %s failed (%v), reading its boot files without hdiutil", isoPath, err)
+		if err := extractBootFiles(isoPath, volumeRootDir); err != nil {
+			return nil, errors.Wrapf(err, "reading %s", isoPath)
+		}
+		return func() { os.RemoveAll(volumeRootDir) }, nil
+	}
+	return func() {
+		log.Debugf("Unmounting %s", isoPath)
+		if err := hdiutil("detach", volumeRootDir); err != nil {
+			log.Debugf("Unmounting %s: %v", isoPath, err)
+		}
+	}, nil
+}
 
+func (d *Driver) extractKernel(isoPath string) error {
 	volumeRootDir := d.ResolveStorePath(isoMountPath)
-	err := hdiutil("attach", d.ResolveStorePath(isoFilename), "-mountpoint", volumeRootDir)
+	d.earlyInitrds, d.grubCmdline = nil, false
+	unmount, err := d.mountISO(isoPath)
 	if err != nil {
 		return err
 	}
-	defer func() error {
-		log.Debugf("Unmounting %s", isoFilename)
-		return hdiutil("detach", volumeRootDir)
-	}()
+	defer unmount()
 
 	log.Debugf("Extracting Kernel Options...")
 	if err := d.extractKernelOptions(); err != nil {
 		return err
 	}
 
+	// The kernel of the GRUB configuration is only booted when it is the
+	// one asked for.
+	if d.KernelName != "" && d.BootKernel != "" {
+		if _, err := selectKernel(volumeRootDir, []string{d.BootKernel}, d.KernelName); err != nil {
+			d.BootKernel, d.BootInitrd, d.earlyInitrds = "", "", nil
+			if d.grubCmdline {
+				d.Cmdline = ""
+			}
+		}
+	}
+
 	if d.BootKernel == "" && d.BootInitrd == "" {
+		var kernels, initrds, microcode []string
 		filepath.Walk(volumeRootDir, func(path string, f os.FileInfo, err error) error {
+			if err != nil || f.IsDir() {
+				return nil
+			}
 			if kernelRegexp.MatchString(path) {
-				d.BootKernel = path
-				_, d.Vmlinuz = filepath.Split(path)
+				kernels = append(kernels, path)
 			}
-			if strings.Contains(path, "initrd") {
-				d.BootInitrd = path
-				_, d.Initrd = filepath.Split(path)
+			if isMicrocodeInitrd(path) {
+				microcode = append(microcode, path)
+			} else if strings.Contains(path, "initrd") || strings.Contains(path, "initramfs") {
+				initrds = append(initrds, path)
 			}
 			return nil
 		})
+		kernel, err := selectKernel(volumeRootDir, kernels, d.KernelName)
+		if err != nil {
+			return err
+		}
+		if kernel != "" {
+			d.BootKernel, d.Vmlinuz = kernel, filepath.Base(kernel)
+			if len(kernels) > 1 {
+				log.Infof("Booting %s of the kernels %s", d.Vmlinuz, kernelNames(volumeRootDir, kernels))
+			}
+		}
+		if initrd := selectInitrd(kernel, initrds); initrd != "" {
+			d.BootInitrd, d.Initrd = initrd, filepath.Base(initrd)
+		}
+		if d.Cmdline == "" && kernel != "" {
+			// The command line of the default GRUB menuentry went with
+			// the kernel not picked.
+			if d.Cmdline = grubCmdlineOf(volumeRootDir, kernel); d.Cmdline == "" {
+				return fmt.Errorf("no GRUB menuentry boots %s, pass its command line with --%s", d.Vmlinuz, flagCmdline)
+			}
+		}
+		// The initrd= option of isolinux lists the segments in boot
+		// order, otherwise the microcode goes first.
+		if !d.setBootInitrds(volumeRootDir, isolinuxInitrds(d.Cmdline)) && d.BootInitrd != "" {
+			d.earlyInitrds = microcode
+		}
 	}
-	
-	if  d.BootKernel == "" || d.BootInitrd == "" {
+
+	if d.BootKernel == "" || d.BootInitrd == "" {
 		err := fmt.Errorf("==== Can't extract Kernel and Ramdisk file ====")
 		return err
-		}
+	}
 
-	dest := d.ResolveStorePath(d.Vmlinuz)
+	return d.copyKernel()
+}
+
+// copyKernel copies BootKernel and BootInitrd, preceded by the early initrd
+// segments if any, into the active boot slot.
+func (d *Driver) copyKernel() error {
+	dest := d.bootPath(d.Vmlinuz)
 	log.Debugf("Extracting %s into %s", d.BootKernel, dest)
 	if err := mcnutils.CopyFile(d.BootKernel, dest); err != nil {
 		return err
 	}
 
-	dest = d.ResolveStorePath(d.Initrd)
+	dest = d.bootPath(d.Initrd)
+	if len(d.earlyInitrds) > 0 {
+		initrds := append(append([]string{}, d.earlyInitrds...), d.BootInitrd)
+		log.Infof("Concatenating the initrd segments %s into %s", strings.Join(initrds, ", "), dest)
+		return concatFiles(dest, initrds)
+	}
 	log.Debugf("Extracting %s into %s", d.BootInitrd, dest)
 	if err := mcnutils.CopyFile(d.BootInitrd, dest); err != nil {
 		return err
@@ -358,38 +1062,71 @@ func (d *Driver) setupNFSShare() error {
 		return err
 	}
 
-	mountCommands := fmt.Sprintf("#/bin/bash\\n")
-	log.Info(d.IPAddress)
+	exportTarget, err := d.nfsExportTarget()
+	if err != nil {
+		return err
+	}
+
+	exportTemplate, err := parseNFSExportTemplate(d.NFSExportTemplate)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Exporting the shares to %s", exportTarget)
+	// A failing share is reported and skipped, the others are still shared.
+	var failed MultiError
+	var exported []string
 
 	for _, share := range d.NFSShares {
 		if !path.IsAbs(share) {
 			share = d.ResolveStorePath(share)
 		}
-		nfsConfig := fmt.Sprintf("%s %s -alldirs -mapall=%s", share, d.IPAddress, user.Username)
+		nfsConfig, err := renderNFSExport(exportTemplate, nfsExport{
+			Share:  share,
+			Target: exportTarget,
+			IP:     d.IPAddress,
+			User:   user.Username,
+			UID:    user.Uid,
+			GID:    user.Gid,
+			Map:    d.nfsMapping(share, user).exportOption(),
+		})
+		if err != nil {
+			failed.Collect(&shareError{Share: share, Err: err})
+			continue
+		}
 
-		if _, err := nfsexports.Add("", d.nfsExportIdentifier(share), nfsConfig); err != nil {
+		if err := d.addNFSExport(d.nfsExportIdentifier(share), share, nfsConfig); err != nil {
 			if strings.Contains(err.Error(), "conflicts with existing export") {
-				log.Info("Conflicting NFS Share not setup and ignored:", err)
+				log.Warnf("Conflicting NFS share %s not set up and ignored: %v", share, err)
 				continue
 			}
-			return err
+			if isExportsPermissionError(err) {
+				return err
+			}
+			failed.Collect(&shareError{Share: share, Err: errors.Wrap(err, "exporting")})
+			continue
 		}
-
-		root := d.NFSSharesRoot
-		mountCommands += fmt.Sprintf("sudo mkdir -p %s/%s\\n", root, share)
-		mountCommands += fmt.Sprintf("sudo mount -t nfs -o noacl,async %s:%s %s/%s\\n", hostIP, share, root, share)
+		exported = append(exported, share)
 	}
 
-	if err := nfsexports.ReloadDaemon(); err != nil {
-		return err
+	if len(exported) > 0 {
+		if err := d.reloadNFS(); err != nil {
+			return err
+		}
 	}
+	d.recordExportedShares(exported)
+	mountErrs := d.mountNFSShares(hostIP, exported)
+	failed.Errors = append(failed.Errors, mountErrs...)
 
-	writeScriptCmd := fmt.Sprintf("echo -e \"%s\" | sh", mountCommands)
-
-	if _, err := drivers.RunSSHCommandFromDriver(d, writeScriptCmd); err != nil {
-		return err
+	if len(failed.Errors) == 0 {
+		return nil
+	}
+	if len(exported) == len(mountErrs) {
+		return errors.Wrap(failed.ToError(), "no NFS share could be set up")
+	}
+	for _, err := range failed.Errors {
+		log.Warnf("NFS share %v", err)
 	}
-
 	return nil
 }
 
@@ -436,21 +1173,41 @@ func (d *Driver) recoverFromUncleanShutdown() error {
 	if err := os.Remove(pidFile); err != nil {
 		return errors.Wrap(err, fmt.Sprintf("removing pidFile %s", pidFile))
 	}
+	if err := d.updateMetadata(func(m *MachineMetadata) {
+		m.UncleanShutdowns++
+	}); err != nil {
+		log.Warnf("Failed to update machine metadata: %v", err)
+	}
 	return nil
 }
 
+// nfsExportIdentifier identifies the /etc/exports entry of the share path
+// by the user adding it and the machine directory, see
+// helper.ExportIdentifier.
 func (d *Driver) nfsExportIdentifier(path string) string {
-	return fmt.Sprintf("minikube-hyperkit %s-%s", d.MachineName, path)
+	return helper.ExportIdentifier(os.Getuid(), d.ResolveStorePath("."), path)
 }
 
-func (d *Driver) sendSignal(s os.Signal) error {
-	pid := d.getPid()
-	proc, err := os.FindProcess(pid)
-	if err != nil {
-		return err
+// legacyNFSExportIdentifier is the identifier older drivers gave the
+// /etc/exports entry of the share path.
+func (d *Driver) legacyNFSExportIdentifier(path string) string {
+	return fmt.Sprintf("%s%s-%s", helper.ExportIdentifierPrefix, d.MachineName, path)
+}
+
+// removeShareExport removes the /etc/exports entry of the share path, also
+// when an older driver added it.
+func (d *Driver) removeShareExport(path string) error {
+	err := d.removeNFSExport(d.nfsExportIdentifier(path))
+	if err != nil && strings.Contains(err.Error(), "find export") {
+		if exists, _ := nfsexports.Exists(exportsFile, d.legacyNFSExportIdentifier(path)); exists {
+			return d.removeNFSExport(d.legacyNFSExportIdentifier(path))
+		}
 	}
+	return err
+}
 
-	return proc.Signal(s)
+func (d *Driver) sendSignal(s syscall.Signal) error {
+	return d.signalHyperKit(d.getPid(), s)
 }
 
 func (d *Driver) getPid() int {
@@ -475,16 +1232,34 @@ func (d *Driver) getPid() int {
 	return config.Pid
 }
 
+// registerResolver sends the DNS queries of ResolverDomain to the VM.
+func (d *Driver) registerResolver() error {
+	if d.ResolverDomain == "" {
+		return nil
+	}
+	log.Infof("Resolving %s through %s", d.ResolverDomain, d.IPAddress)
+	return d.writeResolver(d.ResolverDomain, d.IPAddress)
+}
+
+func (d *Driver) unregisterResolver() {
+	if d.ResolverDomain == "" {
+		return
+	}
+	if err := d.removeResolver(d.ResolverDomain); err != nil {
+		log.Errorf("failed removing resolver entry (%s): %s", d.ResolverDomain, err.Error())
+	}
+}
+
 func (d *Driver) cleanupNfsExports() {
-	if len(d.NFSShares) > 0 {
-		log.Infof("You must be root to remove NFS shared folders. Please type root password.")
+	d.stopSSHFSShares()
+	if len(d.NFSShares) > 0 && d.ShareMode != shareModeSSHFS && !exportsImmutable() {
 		for _, share := range d.NFSShares {
-			if _, err := nfsexports.Remove("", d.nfsExportIdentifier(share)); err != nil {
+			if err := d.removeShareExport(share); err != nil {
 				log.Errorf("failed removing nfs share (%s): %s", share, err.Error())
 			}
 		}
 
-		if err := nfsexports.ReloadDaemon(); err != nil {
+		if err := d.reloadNFS(); err != nil {
 			log.Errorf("failed to reload the nfs daemon: %s", err.Error())
 		}
 	}
@@ -503,12 +1278,20 @@ func (d *Driver) extractKernelOptions() error {
 			return nil
 		})
 		if err != nil {
-			return err
+			log.Debugf("Parsing isolinux.cfg: %v", err)
+		}
+
+		// Hybrid ISOs may only ship a GRUB configuration.
+		if d.Cmdline == "" {
+			if err := d.extractGrubOptions(volumeRootDir); err != nil {
+				log.Debugf("Parsing grub.cfg: %v", err)
+			}
 		}
 
 		if d.Cmdline == "" {
-			return errors.New("Not able to parse isolinux.cfg")
+			return errors.New("Not able to parse isolinux.cfg or grub.cfg")
 		}
+		d.CmdlineFromISO = true
 	}
 
 	log.Debugf("Extracted Options %q", d.Cmdline)
@@ -516,34 +1299,26 @@ func (d *Driver) extractKernelOptions() error {
 }
 
 func (d *Driver) waitForIP() error {
-	var ip string
-	var err error
-	mac, err := GetMACAddressFromUUID(d.UUID)
+	mac, err := d.macAddress()
 	if err != nil {
 		return err
 	}
 
-	log.Infof("Waiting for VM to come online...")
-	for i := 1; i <= 60; i++ {
-
-		ip, err = GetIPAddressByMACAddress(mac)
+	getIP := func() error {
+		ip, err := d.ipResolver().Resolve(mac)
 		if err != nil {
-			log.Debugf("Not there yet %d/%d, error: %s", i, 60, err)
-			time.Sleep(2 * time.Second)
-			continue
-		}
-
-		if ip != "" {
-			log.Debugf("Got an ip: %s", ip)
-			d.IPAddress = ip
-
-			break
+			return &RetriableError{Err: err}
 		}
+		d.IPAddress = ip
+		d.ipResolvedAt = time.Now()
+		return nil
 	}
 
-	if ip == "" {
-		return fmt.Errorf("Machine didn't return an IP after 120 seconds, aborting")
+	log.Infof("Waiting for VM to come online...")
+	if err := Retry(d.ipRetryPolicy(), getIP); err != nil {
+		return fmt.Errorf("Machine didn't return an IP after %s, aborting", d.ipWaitTimeout())
 	}
+	log.Debugf("Got an ip: %s", d.IPAddress)
 
 	// Wait for SSH over NAT to be available before returning to user
 	if err := drivers.WaitForSSH(d); err != nil {
@@ -552,3 +1327,73 @@ func (d *Driver) waitForIP() error {
 
 	return nil
 }
+
+// ipPollInterval returns the configured IP poll interval, falling back to the
+// default for machines created before it was configurable.
+func (d *Driver) ipPollInterval() time.Duration {
+	if d.IPPollInterval <= 0 {
+		return defaultIPPollInterval
+	}
+	return d.IPPollInterval
+}
+
+// ipResolver returns the chain of IP lookups, the leases file coming first
+// unless IPCommand is set.
+func (d *Driver) ipResolver() IPResolver {
+	chain := ChainResolver{
+		LeaseFileResolver{Path: DHCPLeasesFile, Trace: d.ipDiscoveryLog()},
+		ARPResolver{Probe: d.ARPProbe},
+	}
+	if d.IPCommand != "" {
+		chain = append(ChainResolver{d.commandResolver()}, chain...)
+	}
+	return chain
+}
+
+// commandResolver returns the resolver running IPCommand.
+func (d *Driver) commandResolver() CommandResolver {
+	return CommandResolver{Command: d.IPCommand, MachineName: d.MachineName, UUID: d.UUID}
+}
+
+// ipWaitTimeout returns the configured IP wait timeout, falling back to the
+// default for machines created before it was configurable.
+func (d *Driver) ipWaitTimeout() time.Duration {
+	if d.IPWaitTimeout <= 0 {
+		return defaultIPWaitTimeout
+	}
+	return d.IPWaitTimeout
+}
+
+// ipRetryPolicy returns the policy of the IP lookup loops. Progress is logged
+// at debug level on every attempt and at info level every
+// ipProgressInterval, so that slow networks are visibly making progress.
+func (d *Driver) ipRetryPolicy() RetryPolicy {
+	interval := d.ipPollInterval()
+	backoff := ConstantBackoff(interval)
+	if d.IPBackoff == ipBackoffExponential {
+		backoff = ExponentialBackoff(interval, maxIPBackoff, ipBackoffJitter)
+	}
+
+	timeout := d.ipWaitTimeout()
+	var reported time.Duration
+	return RetryPolicy{
+		Timeout: timeout,
+		Backoff: backoff,
+		Progress: func(attempt int, elapsed time.Duration, err error) {
+			log.Debugf("Not there yet, attempt %d after %s: %s", attempt, elapsed.Round(time.Second), err)
+			if elapsed-reported >= ipProgressInterval {
+				reported = elapsed
+				log.Infof("Still waiting for the VM IP address (%s of %s elapsed)", elapsed.Round(time.Second), timeout)
+			}
+		},
+	}
+}
+
+// validateIPBackoff checks the value of the --hyperkit-ip-backoff flag.
+func validateIPBackoff(backoff string) error {
+	switch backoff {
+	case "", ipBackoffConstant, ipBackoffExponential:
+		return nil
+	}
+	return fmt.Errorf("unknown IP backoff %q, expected %q or %q", backoff, ipBackoffConstant, ipBackoffExponential)
+}
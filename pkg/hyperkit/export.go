@@ -0,0 +1,364 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// An export is a gzipped tarball of the machine directory of a stopped
+// machine (disk, boot artifacts, keys and docker-machine configuration)
+// without its runtime state, starting with an export.json manifest. Imported
+// machines get a new UUID, and thus MAC address and IP, so that they can run
+// next to the machine they were exported from.
+const (
+	exportManifestFileName = "export.json"
+	// exportVersion is bumped on incompatible changes of the export format.
+	exportVersion = 1
+)
+
+// exportManifest describes an export.
+type exportManifest struct {
+	Version       int       `json:"version"`
+	DriverVersion string    `json:"driver_version"`
+	MachineName   string    `json:"machine_name"`
+	StorePath     string    `json:"store_path"`
+	ExportedAt    time.Time `json:"exported_at"`
+}
+
+// exportExcluded tells whether the machine directory entry at rel is runtime
+// state which is not exported.
+func exportExcluded(rel string) bool {
+	base := filepath.Base(rel)
+	switch {
+	case rel == snapshotsDir,
+		rel == machineFileName,
+		rel == metadataFileName,
+		rel == machineConfigFileName+machineConfigBackupSuffix,
+		rel == "console-ring":
+		return true
+	case strings.HasPrefix(base, "diagnostics-"),
+		strings.HasSuffix(base, ".pid"),
+		strings.HasSuffix(base, ".log"),
+		strings.HasSuffix(base, ".lock"),
+		strings.HasSuffix(base, ".tmp"),
+		strings.HasPrefix(base, "."+metadataFileName+"."):
+		return true
+	}
+	return false
+}
+
+// Export writes the stopped machine to the tarball at path.
+func (d *Driver) Export(path string) error {
+	if err := d.checkStopped(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := d.writeExport(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	log.Infof("Exported %s to %s", d.MachineName, path)
+	return nil
+}
+
+func (d *Driver) writeExport(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest, err := json.MarshalIndent(&exportManifest{
+		Version:       exportVersion,
+		DriverVersion: Version,
+		MachineName:   d.MachineName,
+		StorePath:     d.StorePath,
+		ExportedAt:    time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    exportManifestFileName,
+		Mode:    0644,
+		Size:    int64(len(manifest)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+
+	root := d.ResolveStorePath("")
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if exportExcluded(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Sockets and the console tty links are runtime state too.
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		log.Debugf("Exporting %s", rel)
+		return addExportEntry(tw, path, filepath.ToSlash(rel), info)
+	})
+	if err != nil {
+		return errors.Wrap(err, "writing export")
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func addExportEntry(tw *tar.Writer, path, name string, info os.FileInfo) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// ImportMachine registers the machine exported to the tarball at path as
+// machine name of the docker-machine store at storePath. The imported
+// machine gets a new UUID and MAC address.
+func ImportMachine(path, storePath, name string) (*Driver, error) {
+	machineDir := filepath.Join(storePath, "machines", name)
+	if _, err := os.Stat(machineDir); err == nil {
+		return nil, fmt.Errorf("machine %s already exists", name)
+	}
+	if err := os.MkdirAll(machineDir, 0700); err != nil {
+		return nil, err
+	}
+	d, err := importMachine(path, storePath, name, machineDir)
+	if err != nil {
+		os.RemoveAll(machineDir)
+		return nil, err
+	}
+	log.Infof("Imported %s as %s", path, name)
+	return d, nil
+}
+
+func importMachine(path, storePath, name, machineDir string) (*Driver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := extractExport(f, machineDir); err != nil {
+		return nil, errors.Wrap(err, "extracting export")
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(machineDir, exportManifestFileName))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading export manifest")
+	}
+	manifest := &exportManifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", exportManifestFileName)
+	}
+	if manifest.Version > exportVersion {
+		return nil, fmt.Errorf("export version %d is newer than the supported version %d", manifest.Version, exportVersion)
+	}
+	if err := os.Remove(filepath.Join(machineDir, exportManifestFileName)); err != nil {
+		return nil, err
+	}
+
+	// The configuration holds absolute paths of the exporting store (SSH
+	// key, certificates), which are moved to the importing one.
+	configPath := filepath.Join(machineDir, machineConfigFileName)
+	b, err = ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading machine configuration")
+	}
+	oldMachineDir := filepath.Join(manifest.StorePath, "machines", manifest.MachineName)
+	b = replaceJSONString(b, oldMachineDir, machineDir)
+	b = replaceJSONString(b, manifest.StorePath, storePath)
+
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, errors.Wrap(err, "parsing machine configuration")
+	}
+	d := NewDriver("", "")
+	if err := json.Unmarshal(config["Driver"], d); err != nil {
+		return nil, errors.Wrap(err, "parsing driver configuration")
+	}
+	d.MachineName = name
+	d.StorePath = storePath
+	d.UUID = string(uuid.NewUUID())
+	d.MACAddress = ""
+	d.MACPinned = false
+	d.IPAddress = ""
+
+	if config["Name"], err = json.Marshal(name); err != nil {
+		return nil, err
+	}
+	if config["Driver"], err = json.Marshal(d); err != nil {
+		return nil, err
+	}
+	out, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(configPath, out, 0600); err != nil {
+		return nil, err
+	}
+	return d, d.updateMetadata(nil)
+}
+
+// extractExport extracts the export read from r into dir.
+func extractExport(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid entry %q", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, os.FileMode(hdr.Mode).Perm()|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := extractFile(tr, path, os.FileMode(hdr.Mode).Perm()); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported entry %q", hdr.Name)
+		}
+	}
+}
+
+func extractFile(r io.Reader, path string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if err := copySparse(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// copySparse copies r to f, skipping the blocks of zeros so that the raw
+// disk image stays sparse.
+func copySparse(f *os.File, r io.Reader) error {
+	buf := make([]byte, 1<<20)
+	var size int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if isZero(buf[:n]) {
+				if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return f.Truncate(size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceJSONString replaces old by new in the strings of the JSON document
+// b.
+func replaceJSONString(b []byte, old, new string) []byte {
+	if old == "" {
+		return b
+	}
+	quoted := func(s string) string {
+		q, _ := json.Marshal(s)
+		return string(q[1 : len(q)-1])
+	}
+	return []byte(strings.Replace(string(b), quoted(old), quoted(new), -1))
+}
@@ -0,0 +1,196 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/schema"
+	hyperkit "github.com/moby/hyperkit/go"
+)
+
+// ExtraArgs are hyperkit options the driver doesn't model, appended to the
+// command line built by the hyperkit library, see startWithExtraArgs.
+const (
+	// extraSlotFirst and extraSlotLast bound the PCI slots left to the
+	// devices added with ExtraArgs: the driver numbers its devices from
+	// slot 1 and the LPC bridge is at 31.
+	extraSlotFirst = 20
+	extraSlotLast  = 30
+)
+
+// extraOptions are the hyperkit options allowed in ExtraArgs, and whether
+// they take a value. The options set by the driver, e.g. -c, -m or -f, are
+// left out so the command line can't contradict the machine configuration.
+var extraOptions = map[string]bool{
+	"-s": true,  // PCI device
+	"-l": true,  // LPC device, only com2
+	"-g": true,  // gdb port
+	"-C": false, // include guest memory in core files
+	"-e": false, // exit on unhandled I/O access
+	"-H": false, // vmexit from the guest on hlt
+	"-P": false, // vmexit from the guest on pause
+	"-W": false, // force virtio to use single-vector MSI
+	"-w": false, // ignore unimplemented MSRs
+	"-x": false, // use x2APIC mode
+	"-Y": false, // don't create an MP table
+}
+
+var extraSlotRegexp = regexp.MustCompile(`^(\d+)(:\d+)?,`)
+
+// parseExtraArgs splits the ExtraArgs entries, each an option optionally
+// followed by a space and its value, into hyperkit arguments.
+func parseExtraArgs(entries []string) ([]string, error) {
+	var args []string
+	for _, entry := range entries {
+		fields := strings.SplitN(strings.TrimSpace(entry), " ", 2)
+		option := fields[0]
+		takesValue, ok := extraOptions[option]
+		if !ok {
+			return nil, fmt.Errorf("invalid extra argument %q: hyperkit option %s is not allowed", entry, option)
+		}
+		if !takesValue {
+			if len(fields) > 1 {
+				return nil, fmt.Errorf("invalid extra argument %q: %s takes no value", entry, option)
+			}
+			args = append(args, option)
+			continue
+		}
+		if len(fields) == 1 || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("invalid extra argument %q: %s requires a value", entry, option)
+		}
+		value := strings.TrimSpace(fields[1])
+		if err := validateExtraValue(option, value); err != nil {
+			return nil, fmt.Errorf("invalid extra argument %q: %v", entry, err)
+		}
+		args = append(args, option, value)
+	}
+	return args, nil
+}
+
+// validateExtraValue checks the value of an extra option doesn't take the
+// place of a device of the driver.
+func validateExtraValue(option, value string) error {
+	switch option {
+	case "-s":
+		m := extraSlotRegexp.FindStringSubmatch(value)
+		if m == nil {
+			return fmt.Errorf("must be slot[:function],device[,options]")
+		}
+		slot, err := strconv.Atoi(m[1])
+		if err != nil || slot < extraSlotFirst || slot > extraSlotLast {
+			return fmt.Errorf("slot must be between %d and %d", extraSlotFirst, extraSlotLast)
+		}
+	case "-l":
+		if !strings.HasPrefix(value, "com2,") {
+			return fmt.Errorf("only com2 can be configured, com1 is the console")
+		}
+	case "-g":
+		if port, err := strconv.Atoi(value); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("must be a TCP port")
+		}
+	}
+	return nil
+}
+
+// extraArgs validates ExtraArgs against the devices of h and returns them
+// as hyperkit arguments. The devices they add are opened by hyperkit with
+// the privileges of the driver, so they are refused when it runs setuid
+// root on behalf of another user.
+func (d *Driver) extraArgs(h *hyperkit.HyperKit) ([]string, error) {
+	if d.PrivilegedHelper {
+		return nil, fmt.Errorf("--%s is not supported by the privileged helper", flagExtraArgs)
+	}
+	if os.Geteuid() != os.Getuid() {
+		return nil, fmt.Errorf("--%s is not supported when the driver is installed setuid root", flagExtraArgs)
+	}
+	args, err := parseExtraArgs(d.ExtraArgs)
+	if err != nil {
+		return nil, err
+	}
+	if used := driverSlots(h); used >= extraSlotFirst {
+		return nil, fmt.Errorf("the devices of the driver use %d PCI slots, which overlaps the slots of --%s", used, flagExtraArgs)
+	}
+	return args, nil
+}
+
+// driverSlots returns the number of PCI slots, counted from slot 1, the
+// hyperkit library assigns to the devices of h.
+func driverSlots(h *hyperkit.HyperKit) int {
+	used := 1 + len(h.Disks) + len(h.ISOImages) + len(h.Sockets9P)
+	if h.VPNKitSock != "" {
+		used++
+	}
+	if h.VMNet {
+		used++
+	}
+	if h.VSock {
+		used++
+	}
+	return used
+}
+
+// startWithExtraArgs starts h like HyperKit.Start, with ExtraArgs appended
+// to its arguments. HyperKit.Start builds the arguments itself and offers
+// no way to add any: it is run first with a hyperkit binary that doesn't
+// exist, which fails once the arguments are built, and hyperkit is then
+// executed with them and its state file written as HyperKit.Start does.
+func (d *Driver) startWithExtraArgs(h *hyperkit.HyperKit, cmdline string) error {
+	extra, err := d.extraArgs(h)
+	if err != nil {
+		return err
+	}
+	binary := h.HyperKit
+	h.HyperKit = d.ResolveStorePath("hyperkit-args-probe")
+	_, err = h.Start(cmdline)
+	h.HyperKit = binary
+	if err == nil || len(h.Arguments) == 0 {
+		return fmt.Errorf("building the hyperkit arguments: %v", err)
+	}
+
+	log.Warnf("Passing arguments not modeled by the driver to hyperkit: %s", strings.Join(extra, " "))
+	h.Arguments = append(h.Arguments, extra...)
+	h.CmdLine = h.HyperKit + " " + strings.Join(h.Arguments, " ")
+	cmd := exec.Command(h.HyperKit, h.Arguments...)
+	cmd.Env = os.Environ()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	h.Pid = cmd.Process.Pid
+	state, err := json.Marshal(h)
+	if err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(h.StateDir, schema.HyperKitStateFile), state, 0644); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// With Firewall, the Docker and SSH ports of the guest only accept
+// connections from its gateways, that is the host through vmnet or vpnkit,
+// and the FirewallAllow sources. The rules are applied on every start, and
+// on every boot of boot2docker through bootsync.sh; as the network isn't up
+// yet then, they are applied once a default route shows up. No host address
+// is baked in, so that they survive a switch of the vmnet network.
+const (
+	boot2dockerFirewallScript = "/var/lib/boot2docker/firewall.sh"
+	firewallChain             = "HYPERKIT-FIREWALL"
+)
+
+// firewallScript applies the rules, allowing the sources given as its
+// first argument besides the gateways.
+const firewallScript = `#!/bin/sh
+# Generated by docker-machine-driver-hyperkit
+apply() {
+	gateways=$(ip route | awk '$1 == "default" { print $3 }')
+	[ -n "$gateways" ] || return 1
+	iptables -N %[1]s 2>/dev/null || iptables -F %[1]s
+	iptables -A %[1]s -i lo -j RETURN
+	for source in $gateways %[2]s; do
+		iptables -A %[1]s -s "$source" -j RETURN
+	done
+	iptables -A %[1]s -j DROP
+	for port in %[3]s; do
+		iptables -C INPUT -p tcp --dport $port -j %[1]s 2>/dev/null || iptables -I INPUT -p tcp --dport $port -j %[1]s
+	done
+}
+apply && exit 0
+(for i in $(seq 120); do sleep 1; apply && exit 0; done) >/dev/null 2>&1 &
+`
+
+// validateFirewallAllow checks the sources are IP addresses or CIDRs.
+func validateFirewallAllow(sources []string) error {
+	for _, source := range sources {
+		if net.ParseIP(source) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(source); err != nil {
+			return fmt.Errorf("invalid firewall source %q: must be an IP address or a CIDR", source)
+		}
+	}
+	return nil
+}
+
+// firewallScriptContent returns the guest script applying the rules.
+func (d *Driver) firewallScriptContent() []byte {
+	sshPort, err := d.GetSSHPort()
+	if err != nil {
+		sshPort = defaultSSHPort
+	}
+	ports := fmt.Sprintf("%d %d", sshPort, dockerPort)
+	return []byte(fmt.Sprintf(firewallScript, firewallChain, strings.Join(d.FirewallAllow, " "), ports))
+}
+
+// configureGuestFirewall applies the firewall rules in the guest.
+func (d *Driver) configureGuestFirewall() error {
+	if !d.Firewall {
+		return nil
+	}
+	log.Infof("Restricting the Docker and SSH ports of the guest to the host")
+	script := d.firewallScriptContent()
+	var err error
+	if d.isCloudImage() {
+		_, err = d.runSSHCommand("sudo sh -c " + shellQuote(string(script)))
+	} else {
+		err = d.runBoot2DockerBootScript(boot2dockerFirewallScript, script)
+	}
+	return errors.Wrap(err, "configuring the guest firewall")
+}
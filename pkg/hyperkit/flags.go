@@ -0,0 +1,794 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/cpupriority"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/disk"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/machine/libmachine/drivers"
+	"github.com/leoh0/machine/libmachine/mcnflag"
+	"github.com/pkg/errors"
+)
+
+const (
+	flagStartupGracePeriod     = "hyperkit-startup-grace-period"
+	flagIPPollInterval         = "hyperkit-ip-poll-interval"
+	flagWaitTimeout            = "hyperkit-wait-timeout"
+	flagIPBackoff              = "hyperkit-ip-backoff"
+	flagARPProbe               = "hyperkit-arp-probe"
+	flagImage                  = "hyperkit-image"
+	flagImageKernel            = "hyperkit-image-kernel"
+	flagImageInitrd            = "hyperkit-image-initrd"
+	flagNFSExportScope         = "hyperkit-nfs-export-scope"
+	flagNFSExportTemplate      = "hyperkit-nfs-export-template"
+	flagShareMode              = "hyperkit-share-mode"
+	flagDNS                    = "hyperkit-dns"
+	flagDNSSearch              = "hyperkit-dns-search"
+	flagScratchDir             = "hyperkit-scratch-dir"
+	flagHTTPProxy              = "hyperkit-http-proxy"
+	flagHTTPSProxy             = "hyperkit-https-proxy"
+	flagNoProxy                = "hyperkit-no-proxy"
+	flagSystemProxy            = "hyperkit-system-proxy"
+	flagProvisionScript        = "hyperkit-provision-script"
+	flagProvisionOnError       = "hyperkit-provision-on-error"
+	flagVMNetSubnet            = "hyperkit-vmnet-subnet"
+	flagAttachISO              = "hyperkit-attach-iso"
+	flagExtraArgs              = "hyperkit-extra-args"
+	flagRegistryAuth           = "hyperkit-registry-auth"
+	flagRegistryAuthFile       = "hyperkit-registry-auth-file"
+	flagFirewall               = "hyperkit-firewall"
+	flagFirewallAllow          = "hyperkit-firewall-allow"
+	flagStatusAddress          = "hyperkit-status-address"
+	flagDiskBackend            = "hyperkit-disk-backend"
+	flagIPCommand              = "hyperkit-ip-command"
+	flagWakeWatch              = "hyperkit-wake-watch"
+	flagCustomizeFile          = "hyperkit-customize-file"
+	flagCustomizeCommand       = "hyperkit-customize-command"
+	flagTimeSync               = "hyperkit-time-sync"
+	flagTimeSyncInterval       = "hyperkit-time-sync-interval"
+	flagCPUHideFeature         = "hyperkit-cpu-hide-feature"
+	flagAutoResources          = "hyperkit-auto-resources"
+	flagDockerInsecureRegistry = "hyperkit-docker-insecure-registry"
+	flagDockerRegistryMirror   = "hyperkit-docker-registry-mirror"
+	flagDockerStorageDriver    = "hyperkit-docker-storage-driver"
+	flagDockerCgroupDriver     = "hyperkit-docker-cgroup-driver"
+	flagHookURL                = "hyperkit-hook-url"
+	flagHookCommand            = "hyperkit-hook-command"
+	flagSupervise              = "hyperkit-supervise"
+	flagSuperviseMaxRestarts   = "hyperkit-supervise-max-restarts"
+	flagHyperKitBinaryPath     = "hyperkit-binary-path"
+	flagHyperKitBinaryURL      = "hyperkit-binary-url"
+	flagHyperKitBinarySHA256   = "hyperkit-binary-sha256"
+	flagMountHome              = "hyperkit-mount-home"
+	flagNFSMap                 = "hyperkit-nfs-map"
+	flagSudoAskpass            = "hyperkit-sudo-askpass"
+	flagSSHUser                = "hyperkit-ssh-user"
+	flagSSHPort                = "hyperkit-ssh-port"
+	flagNFSMountOwner          = "hyperkit-nfs-mount-owner"
+	flagNFSMountMode           = "hyperkit-nfs-mount-mode"
+	flagBootMode               = "hyperkit-boot-mode"
+	flagBootrom                = "hyperkit-bootrom"
+	flagPrivilegedHelper       = "hyperkit-privileged-helper"
+	flagUUID                   = "hyperkit-uuid"
+	flagMACAddress             = "hyperkit-mac-address"
+	flagStopWait               = "hyperkit-stop-wait"
+	flagNotify                 = "hyperkit-notify"
+	flagReuseArtifacts         = "hyperkit-reuse-artifacts"
+	flagReuseDisk              = "hyperkit-reuse-disk"
+	flagTelemetryFile          = "hyperkit-telemetry-file"
+	flagTelemetryCommand       = "hyperkit-telemetry-command"
+	flagLogLevel               = "hyperkit-log-level"
+	flagMetricsAddress         = "hyperkit-metrics-address"
+	flagLogFormat              = "hyperkit-log-format"
+	flagPortForward            = "hyperkit-port-forward"
+	flagResolverDomain         = "hyperkit-resolver-domain"
+	flagCompanion              = "hyperkit-companion"
+	flagConsole                = "hyperkit-console"
+	flagDiskMonitor            = "hyperkit-disk-monitor-interval"
+	flagDiskWarnThreshold      = "hyperkit-disk-warn-threshold"
+	flagDiskPruneThreshold     = "hyperkit-disk-prune-threshold"
+	flagKernelMonitor          = "hyperkit-kernel-monitor-interval"
+	flagCPUPriority            = "hyperkit-cpu-priority"
+	flagKernel                 = "hyperkit-kernel"
+	flagInitrd                 = "hyperkit-initrd"
+	flagKernelName             = "hyperkit-kernel-name"
+	flagCmdline                = "hyperkit-cmdline"
+	flagCmdlineExtra           = "hyperkit-cmdline-extra"
+	flagHostUser               = "hyperkit-host-user"
+	flagGuestUserKeys          = "hyperkit-guest-user-keys"
+	flagVSock                  = "hyperkit-vsock"
+	flagVSockPort              = "hyperkit-vsock-port"
+	flagTrustCPURNG            = "hyperkit-trust-cpu-rng"
+	flagCPUCount               = "hyperkit-cpu-count"
+	flagMemory                 = "hyperkit-memory"
+	flagSelfTest               = "hyperkit-self-test"
+	flagSSHPasswordLogin       = "hyperkit-ssh-password-login"
+	flagVPNKit                 = "hyperkit-vpnkit"
+	flagVPNKitBinary           = "hyperkit-vpnkit-binary"
+	flagNetwork                = "hyperkit-network"
+)
+
+// GetCreateFlags returns the flags accepted by "docker-machine create"
+func (d *Driver) GetCreateFlags() []mcnflag.Flag {
+	return []mcnflag.Flag{
+		mcnflag.IntFlag{
+			Name:   flagCPUCount,
+			Usage:  "Number of vCPUs of the VM",
+			EnvVar: "HYPERKIT_CPU_COUNT",
+			Value:  defaultCPUs,
+		},
+		mcnflag.StringFlag{
+			Name:   flagMemory,
+			Usage:  "Memory of the VM in MB, or with a unit (e.g. 4096m or 4g)",
+			EnvVar: "HYPERKIT_MEMORY",
+			Value:  strconv.Itoa(defaultMemory),
+		},
+		mcnflag.StringFlag{
+			Name:   flagStartupGracePeriod,
+			Usage:  "Time to wait after starting hyperkit before looking up the VM IP (e.g. 5s)",
+			EnvVar: "HYPERKIT_STARTUP_GRACE_PERIOD",
+		},
+		mcnflag.StringFlag{
+			Name:   flagIPPollInterval,
+			Usage:  "Interval between two lookups of the VM IP (e.g. 500ms)",
+			EnvVar: "HYPERKIT_IP_POLL_INTERVAL",
+			Value:  defaultIPPollInterval.String(),
+		},
+		mcnflag.StringFlag{
+			Name:   flagWaitTimeout,
+			Usage:  "Time budget for the VM to get an IP address (e.g. 3m)",
+			EnvVar: "HYPERKIT_WAIT_TIMEOUT",
+			Value:  defaultIPWaitTimeout.String(),
+		},
+		mcnflag.StringFlag{
+			Name:   flagIPBackoff,
+			Usage:  "Delay between IP lookups: \"constant\" or \"exponential\" with jitter, starting from the poll interval",
+			EnvVar: "HYPERKIT_IP_BACKOFF",
+			Value:  ipBackoffConstant,
+		},
+		mcnflag.BoolFlag{
+			Name:   flagARPProbe,
+			Usage:  "Probe the vmnet subnet to find the VM in the ARP cache when the dhcpd leases file doesn't have it",
+			EnvVar: "HYPERKIT_ARP_PROBE",
+		},
+		mcnflag.StringFlag{
+			Name:   flagImage,
+			Usage:  "Boot ISO or raw Linux cloud image (e.g. Ubuntu, Fedora) to create the machine from",
+			EnvVar: "HYPERKIT_IMAGE",
+		},
+		mcnflag.StringFlag{
+			Name:   flagImageKernel,
+			Usage:  "Kernel used to boot a cloud image",
+			EnvVar: "HYPERKIT_IMAGE_KERNEL",
+		},
+		mcnflag.StringFlag{
+			Name:   flagImageInitrd,
+			Usage:  "Initrd used to boot a cloud image",
+			EnvVar: "HYPERKIT_IMAGE_INITRD",
+		},
+		mcnflag.StringFlag{
+			Name:   flagNFSExportScope,
+			Usage:  "Export NFS shares to the VM \"ip\", the vmnet \"subnet\" or a CIDR, the latter two surviving IP changes",
+			EnvVar: "HYPERKIT_NFS_EXPORT_SCOPE",
+			Value:  nfsExportScopeIP,
+		},
+		mcnflag.StringFlag{
+			Name:   flagNFSExportTemplate,
+			Usage:  "Go template of the /etc/exports line of a share, with .Share, .Target (VM IP or -network/-mask of the scope), .IP, .User, .UID, .GID and .Map (-mapall or -maproot option)",
+			EnvVar: "HYPERKIT_NFS_EXPORT_TEMPLATE",
+			Value:  defaultNFSExportTemplate,
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagDNS,
+			Usage:  "DNS server of the guest instead of the host resolver handed out by vmnet. Repeatable",
+			EnvVar: "HYPERKIT_DNS",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagDNSSearch,
+			Usage:  "DNS search domain of the guest. Repeatable",
+			EnvVar: "HYPERKIT_DNS_SEARCH",
+		},
+		mcnflag.StringFlag{
+			Name:   flagScratchDir,
+			Usage:  "Directory, e.g. on a RAM disk, for the console log and the logs of the machine",
+			EnvVar: "HYPERKIT_SCRATCH_DIR",
+		},
+		mcnflag.StringFlag{
+			Name:   flagHTTPProxy,
+			Usage:  "HTTP_PROXY of the guest docker daemon",
+			EnvVar: "HYPERKIT_HTTP_PROXY",
+		},
+		mcnflag.StringFlag{
+			Name:   flagHTTPSProxy,
+			Usage:  "HTTPS_PROXY of the guest docker daemon",
+			EnvVar: "HYPERKIT_HTTPS_PROXY",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagNoProxy,
+			Usage:  "Host excluded from the guest proxy, besides the VM itself. Repeatable",
+			EnvVar: "HYPERKIT_NO_PROXY",
+		},
+		mcnflag.BoolFlag{
+			Name:   flagSystemProxy,
+			Usage:  "Take the guest proxy from the proxy environment or the macOS system proxy on every start",
+			EnvVar: "HYPERKIT_SYSTEM_PROXY",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagProvisionScript,
+			Usage:  "Script file or inline shell commands run in the guest once it is created, in order. Repeatable",
+			EnvVar: "HYPERKIT_PROVISION_SCRIPT",
+		},
+		mcnflag.StringFlag{
+			Name:   flagProvisionOnError,
+			Usage:  "On a failing provisioning script, \"fail\" the creation or \"continue\" with the next one",
+			EnvVar: "HYPERKIT_PROVISION_ON_ERROR",
+			Value:  provisionOnErrFail,
+		},
+		mcnflag.StringFlag{
+			Name:   flagVMNetSubnet,
+			Usage:  "vmnet shared network: \"auto\" to move it off networks routed by the host, \"off\" or a CIDR like 192.168.100.0/24",
+			EnvVar: "HYPERKIT_VMNET_SUBNET",
+			Value:  vmnetSubnetAuto,
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagAttachISO,
+			Usage:  "ISO image attached as an additional CD-ROM, e.g. a config drive or an offline package repository. Repeatable",
+			EnvVar: "HYPERKIT_ATTACH_ISO",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagExtraArgs,
+			Usage:  "hyperkit option, followed by a space and its value if any, appended to the hyperkit command line, e.g. \"-s 20,virtio-9p,path=/tmp/9p.sock,tag=data\". Repeatable",
+			EnvVar: "HYPERKIT_EXTRA_ARGS",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagRegistryAuth,
+			Usage:  "Registry whose credentials in the host Docker configuration are copied into the guest on start, or \"host\" for all. Repeatable",
+			EnvVar: "HYPERKIT_REGISTRY_AUTH",
+		},
+		mcnflag.StringFlag{
+			Name:   flagRegistryAuthFile,
+			Usage:  "Docker configuration whose registry credentials are copied into the guest on start",
+			EnvVar: "HYPERKIT_REGISTRY_AUTH_FILE",
+		},
+		mcnflag.BoolFlag{
+			Name:   flagFirewall,
+			Usage:  "Only accept connections to the Docker and SSH ports of the guest from the host",
+			EnvVar: "HYPERKIT_FIREWALL",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagFirewallAllow,
+			Usage:  "IP address or CIDR also allowed through the guest firewall. Repeatable",
+			EnvVar: "HYPERKIT_FIREWALL_ALLOW",
+		},
+		mcnflag.StringFlag{
+			Name:   flagStatusAddress,
+			Usage:  "Serve the machine status as JSON on this loopback address, e.g. 127.0.0.1:9102, or on status.sock in the machine directory with \"socket\"",
+			EnvVar: "HYPERKIT_STATUS_ADDRESS",
+		},
+		mcnflag.StringFlag{
+			Name:   flagDiskBackend,
+			Usage:  "Disk image backend: \"sparse\" only allocates the blocks the guest writes, \"raw\" allocates the whole disk on creation",
+			EnvVar: "HYPERKIT_DISK_BACKEND",
+			Value:  disk.Default,
+		},
+		mcnflag.StringFlag{
+			Name:   flagIPCommand,
+			Usage:  "Shell command printing the VM IP address, tried before the DHCP leases and the ARP cache. MACHINE_NAME, MACHINE_MAC and MACHINE_UUID are set",
+			EnvVar: "HYPERKIT_IP_COMMAND",
+		},
+		mcnflag.BoolFlag{
+			Name:   flagWakeWatch,
+			Usage:  "After each host sleep, set the guest clock, look the VM address up and remount the NFS shares again",
+			EnvVar: "HYPERKIT_WAKE_WATCH",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagCustomizeFile,
+			Usage:  "Host file copied into the guest before it boots, as hostPath:guestPath (e.g. a CA certificate). Repeatable",
+			EnvVar: "HYPERKIT_CUSTOMIZE_FILE",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagCustomizeCommand,
+			Usage:  "Shell command run as root in the guest on its first boot, and on every boot for boot2docker. Repeatable",
+			EnvVar: "HYPERKIT_CUSTOMIZE_COMMAND",
+		},
+		mcnflag.StringFlag{
+			Name:   flagTimeSync,
+			Usage:  "Set the guest clock from the host on every start (\"run-once\") or also on an interval (\"periodic\")",
+			EnvVar: "HYPERKIT_TIME_SYNC",
+		},
+		mcnflag.StringFlag{
+			Name:   flagTimeSyncInterval,
+			Usage:  "Interval between two guest clock checks of the periodic time sync (e.g. 5m)",
+			EnvVar: "HYPERKIT_TIME_SYNC_INTERVAL",
+			Value:  defaultTimeSyncInterval.String(),
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagCPUHideFeature,
+			Usage:  "CPU feature hidden from the guest kernel with clearcpuid, named as in /proc/cpuinfo (e.g. avx512f). Repeatable",
+			EnvVar: "HYPERKIT_CPU_HIDE_FEATURE",
+		},
+		mcnflag.BoolFlag{
+			Name:   flagAutoResources,
+			Usage:  "Size the CPU count, memory and disk from the host: half the CPUs, half the memory up to 8g and a quarter of the free space of the store up to 64g. Values other than the defaults are kept",
+			EnvVar: "HYPERKIT_AUTO_RESOURCES",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagDockerInsecureRegistry,
+			Usage:  "Registry the guest docker daemon reaches without TLS verification, as host[:port] or a CIDR. Repeatable",
+			EnvVar: "HYPERKIT_DOCKER_INSECURE_REGISTRY",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagDockerRegistryMirror,
+			Usage:  "Docker Hub mirror of the guest docker daemon (e.g. https://mirror.example.com). Repeatable",
+			EnvVar: "HYPERKIT_DOCKER_REGISTRY_MIRROR",
+		},
+		mcnflag.StringFlag{
+			Name:   flagDockerStorageDriver,
+			Usage:  "Storage driver of the guest docker daemon (e.g. overlay2), boot2docker only",
+			EnvVar: "HYPERKIT_DOCKER_STORAGE_DRIVER",
+		},
+		mcnflag.StringFlag{
+			Name:   flagDockerCgroupDriver,
+			Usage:  "Cgroup driver of the guest docker daemon: \"cgroupfs\", or \"systemd\" for cloud images",
+			EnvVar: "HYPERKIT_DOCKER_CGROUP_DRIVER",
+		},
+		mcnflag.StringFlag{
+			Name:   flagHookURL,
+			Usage:  "URL receiving the lifecycle events of the machine (created, started, got_ip, stopped, removed, error) as JSON POST requests",
+			EnvVar: "HYPERKIT_HOOK_URL",
+		},
+		mcnflag.StringFlag{
+			Name:   flagHookCommand,
+			Usage:  "Shell command run on each lifecycle event of the machine, with the event as JSON on its standard input and HOOK_EVENT and HOOK_MACHINE set",
+			EnvVar: "HYPERKIT_HOOK_COMMAND",
+		},
+		mcnflag.BoolFlag{
+			Name:   flagSupervise,
+			Usage:  "Install a launchd agent restarting the machine when hyperkit dies while it should run",
+			EnvVar: "HYPERKIT_SUPERVISE",
+		},
+		mcnflag.IntFlag{
+			Name:   flagSuperviseMaxRestarts,
+			Usage:  "Restarts in a row after which the supervisor gives up",
+			EnvVar: "HYPERKIT_SUPERVISE_MAX_RESTARTS",
+			Value:  defaultSuperviseMaxRestarts,
+		},
+		mcnflag.StringFlag{
+			Name:   flagHyperKitBinaryPath,
+			Usage:  "hyperkit binary the machine runs with, looked up in $PATH and Docker Desktop if empty",
+			EnvVar: "HYPERKIT_BINARY_PATH",
+		},
+		mcnflag.StringFlag{
+			Name:   flagHyperKitBinaryURL,
+			Usage:  "URL of a hyperkit binary downloaded into the store and verified against --hyperkit-binary-sha256",
+			EnvVar: "HYPERKIT_BINARY_URL",
+		},
+		mcnflag.StringFlag{
+			Name:   flagHyperKitBinarySHA256,
+			Usage:  "sha256 the binary downloaded from --hyperkit-binary-url is pinned to",
+			EnvVar: "HYPERKIT_BINARY_SHA256",
+		},
+		mcnflag.StringFlag{
+			Name:   flagMountHome,
+			Usage:  "Share the host user's \"home\" or all of \"users\" (/Users) at the same path in the guest",
+			EnvVar: "HYPERKIT_MOUNT_HOME",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagNFSMap,
+			Usage:  "Identity the guest accesses to a share are mapped to on the host, \"<share>=mapall|maproot:<user>[:<group>]\" with \"*\" for all shares. Repeatable",
+			EnvVar: "HYPERKIT_NFS_MAP",
+		},
+		mcnflag.StringFlag{
+			Name:   flagSudoAskpass,
+			Usage:  "Program printing the password sudo asks for when the driver edits /etc/exports without root nor the privileged helper",
+			EnvVar: "HYPERKIT_SUDO_ASKPASS",
+		},
+		mcnflag.StringFlag{
+			Name:   flagSSHUser,
+			Usage:  "Guest user the driver and docker-machine log in as over SSH",
+			EnvVar: "HYPERKIT_SSH_USER",
+			Value:  defaultSSHUser,
+		},
+		mcnflag.IntFlag{
+			Name:   flagSSHPort,
+			Usage:  "Guest port sshd listens on",
+			EnvVar: "HYPERKIT_SSH_PORT",
+			Value:  defaultSSHPort,
+		},
+		mcnflag.StringFlag{
+			Name:   flagShareMode,
+			Usage:  "Share folders over \"nfs\", falling back to sshfs when /etc/exports can't be modified, or always over \"sshfs\"",
+			EnvVar: "HYPERKIT_SHARE_MODE",
+			Value:  shareModeNFS,
+		},
+		mcnflag.StringFlag{
+			Name:   flagNFSMountOwner,
+			Usage:  "Guest owner[:group] of the share mount point directories",
+			EnvVar: "HYPERKIT_NFS_MOUNT_OWNER",
+		},
+		mcnflag.StringFlag{
+			Name:   flagNFSMountMode,
+			Usage:  "Octal mode of the share mount point directories, e.g. 0777",
+			EnvVar: "HYPERKIT_NFS_MOUNT_MODE",
+		},
+		mcnflag.StringFlag{
+			Name:   flagBootMode,
+			Usage:  "Boot the extracted \"kernel\" or through a \"uefi\" firmware",
+			EnvVar: "HYPERKIT_BOOT_MODE",
+			Value:  bootModeKernel,
+		},
+		mcnflag.StringFlag{
+			Name:   flagBootrom,
+			Usage:  "UEFI firmware used by the uefi boot mode",
+			EnvVar: "HYPERKIT_BOOTROM",
+			Value:  defaultBootrom,
+		},
+		mcnflag.BoolFlag{
+			Name:   flagPrivilegedHelper,
+			Usage:  "Run unprivileged and delegate vmnet and NFS export operations to the privileged helper",
+			EnvVar: "HYPERKIT_PRIVILEGED_HELPER",
+		},
+		mcnflag.StringFlag{
+			Name:   flagUUID,
+			Usage:  "SMBIOS system UUID of the VM, random if empty. Also determines the VM MAC address",
+			EnvVar: "HYPERKIT_UUID",
+		},
+		mcnflag.StringFlag{
+			Name:   flagMACAddress,
+			Usage:  "Expected MAC address of the VM: vmnet derives it from the UUID, starts fail if they don't match",
+			EnvVar: "HYPERKIT_MAC_ADDRESS",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  flagPortForward,
+			Usage: "Forward a localhost port to the VM, as hostPort:guestPort[/tcp|udp] (repeatable)",
+		},
+		mcnflag.StringFlag{
+			Name:   flagResolverDomain,
+			Usage:  "Domain (e.g. default.test) resolved by a DNS server in the VM through an /etc/resolver entry",
+			EnvVar: "HYPERKIT_RESOLVER_DOMAIN",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  flagCompanion,
+			Usage: "Host command started once the VM is up and stopped with it, MACHINE_NAME and MACHINE_IP are set (repeatable)",
+		},
+		mcnflag.StringFlag{
+			Name:   flagConsole,
+			Usage:  "Serial console mode: \"file\" (log only), \"tty\" (interactive tty) or \"socket\" (tty bridged to a unix socket)",
+			EnvVar: "HYPERKIT_CONSOLE",
+			Value:  consoleModeFile,
+		},
+		mcnflag.StringFlag{
+			Name:   flagDiskMonitor,
+			Usage:  "Interval between two checks of the guest disk usage (e.g. 5m), disabled if empty",
+			EnvVar: "HYPERKIT_DISK_MONITOR_INTERVAL",
+		},
+		mcnflag.StringFlag{
+			Name:   flagKernelMonitor,
+			Usage:  "Interval between two reads of the guest kernel log looking for OOM kills and other notable events (e.g. 1m), disabled if empty",
+			EnvVar: "HYPERKIT_KERNEL_MONITOR_INTERVAL",
+		},
+		mcnflag.IntFlag{
+			Name:   flagDiskWarnThreshold,
+			Usage:  "Guest filesystem usage percentage above which a warning is reported",
+			EnvVar: "HYPERKIT_DISK_WARN_THRESHOLD",
+			Value:  defaultDiskWarnThreshold,
+		},
+		mcnflag.IntFlag{
+			Name:   flagDiskPruneThreshold,
+			Usage:  "Docker data filesystem usage percentage above which \"docker system prune\" is run, disabled if 0",
+			EnvVar: "HYPERKIT_DISK_PRUNE_THRESHOLD",
+		},
+		mcnflag.StringFlag{
+			Name:   flagCPUPriority,
+			Usage:  "CPU priority of hyperkit: \"normal\", \"low\" (nice 10) or \"background\" (background QoS band)",
+			EnvVar: "HYPERKIT_CPU_PRIORITY",
+			Value:  cpupriority.Normal,
+		},
+		mcnflag.StringFlag{
+			Name:   flagKernel,
+			Usage:  "Kernel (bzImage) to boot instead of the one of the ISO, requires --hyperkit-initrd",
+			EnvVar: "HYPERKIT_KERNEL",
+		},
+		mcnflag.StringFlag{
+			Name:   flagInitrd,
+			Usage:  "Initrd to boot instead of the one of the ISO, requires --hyperkit-kernel",
+			EnvVar: "HYPERKIT_INITRD",
+		},
+		mcnflag.StringFlag{
+			Name:   flagKernelName,
+			Usage:  "File name or path in the ISO of the kernel to boot when the ISO has several, the highest version being booted if empty",
+			EnvVar: "HYPERKIT_KERNEL_NAME",
+		},
+		mcnflag.StringFlag{
+			Name:   flagCmdline,
+			Usage:  "Kernel command line, read from the ISO if empty",
+			EnvVar: "HYPERKIT_CMDLINE",
+		},
+		mcnflag.StringFlag{
+			Name:   flagCmdlineExtra,
+			Usage:  "Template adjusting the kernel command line, e.g. \"{{.ExtractedCmdline}} swap=off -quiet\", appended to it without {{.ExtractedCmdline}}",
+			EnvVar: "HYPERKIT_CMDLINE_EXTRA",
+		},
+		mcnflag.BoolFlag{
+			Name:   flagHostUser,
+			Usage:  "Create a guest user with the name, uid and gid of the host user, member of the docker group",
+			EnvVar: "HYPERKIT_HOST_USER",
+		},
+		mcnflag.StringFlag{
+			Name:   flagGuestUserKeys,
+			Usage:  "authorized_keys file of the guest user created by --hyperkit-host-user, the machine key if empty",
+			EnvVar: "HYPERKIT_GUEST_USER_KEYS",
+		},
+		mcnflag.BoolFlag{
+			Name:   flagVSock,
+			Usage:  "Attach a virtio-vsock device",
+			EnvVar: "HYPERKIT_VSOCK",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  flagVSockPort,
+			Usage: "Guest vsock port exposed as a unix socket in the machine directory, requires --hyperkit-vsock (repeatable)",
+		},
+		mcnflag.BoolFlag{
+			Name:   flagTrustCPURNG,
+			Usage:  "Let the guest kernel seed its entropy pool from the CPU (random.trust_cpu=on) in addition to the virtio-rnd device",
+			EnvVar: "HYPERKIT_TRUST_CPU_RNG",
+		},
+		mcnflag.BoolFlag{
+			Name:   flagSelfTest,
+			Usage:  "Check the route, TCP and TLS reachability of the Docker endpoint and the port forwards after each start",
+			EnvVar: "HYPERKIT_SELF_TEST",
+		},
+		mcnflag.StringFlag{
+			Name:   flagStopWait,
+			Usage:  "How long a stop waits for files open on the shares to be closed and disk writes to settle, e.g. 30s",
+			EnvVar: "HYPERKIT_STOP_WAIT",
+		},
+		mcnflag.BoolFlag{
+			Name:   flagNotify,
+			Usage:  "Post macOS notifications when the machine is created, gets its IP or stops unexpectedly",
+			EnvVar: "HYPERKIT_NOTIFY",
+		},
+		mcnflag.StringFlag{
+			Name:   flagMetricsAddress,
+			Usage:  "Serve the VM resource usage in the Prometheus format on this address, e.g. 127.0.0.1:9101",
+			EnvVar: "HYPERKIT_METRICS_ADDRESS",
+		},
+		mcnflag.BoolFlag{
+			Name:   flagReuseArtifacts,
+			Usage:  "Keep the ISO and the extracted kernel when the machine is removed, and reuse them when it is re-created with the same ISO and disk size",
+			EnvVar: "HYPERKIT_REUSE_ARTIFACTS",
+		},
+		mcnflag.BoolFlag{
+			Name:   flagReuseDisk,
+			Usage:  "With --hyperkit-reuse-artifacts, also keep and reuse the disk image, and so the data of the machine",
+			EnvVar: "HYPERKIT_REUSE_DISK",
+		},
+		mcnflag.StringFlag{
+			Name:   flagTelemetryFile,
+			Usage:  "Append timing events of the machine operations (download, boot to IP, SSH ready, share setup...) as JSON lines to this file",
+			EnvVar: "HYPERKIT_TELEMETRY_FILE",
+		},
+		mcnflag.StringFlag{
+			Name:   flagTelemetryCommand,
+			Usage:  "Shell command run for each timing event, with the event as JSON on its standard input",
+			EnvVar: "HYPERKIT_TELEMETRY_COMMAND",
+		},
+		mcnflag.StringFlag{
+			Name:   flagLogLevel,
+			Usage:  "Level of the driver log entries: debug, info, warn or error",
+			EnvVar: "HYPERKIT_LOG_LEVEL",
+			Value:  "info",
+		},
+		mcnflag.StringFlag{
+			Name:   flagLogFormat,
+			Usage:  "Format of the driver log entries: text or json",
+			EnvVar: "HYPERKIT_LOG_FORMAT",
+			Value:  log.FormatText,
+		},
+		mcnflag.BoolFlag{
+			Name:   flagSSHPasswordLogin,
+			Usage:  "Keep the default password of the boot2docker docker user instead of only allowing the machine SSH key",
+			EnvVar: "HYPERKIT_SSH_PASSWORD_LOGIN",
+		},
+		mcnflag.StringFlag{
+			Name:   flagVPNKit,
+			Usage:  "Attach a vpnkit network interface in addition to vmnet: \"auto\" (Docker Desktop), \"managed\" (run by the driver) or a vpnkit socket",
+			EnvVar: "HYPERKIT_VPNKIT",
+		},
+		mcnflag.StringFlag{
+			Name:   flagVPNKitBinary,
+			Usage:  "vpnkit binary run by --hyperkit-vpnkit=managed, looked up in $PATH and Docker Desktop if empty",
+			EnvVar: "HYPERKIT_VPNKIT_BINARY",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   flagNetwork,
+			Usage:  "Network interface of the VM: \"vmnet\", always attached, or \"vpnkit[:auto|managed|<socket>]\". Repeatable, at most one of each kind",
+			EnvVar: "HYPERKIT_NETWORK",
+		},
+	}
+}
+
+// SetConfigFromFlags configures the driver from the "docker-machine create" flags
+func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
+	var err error
+	d.CPU = flags.Int(flagCPUCount)
+	if d.Memory, err = parseMemorySize(flags.String(flagMemory)); err != nil {
+		return errors.Wrapf(err, "parsing --%s", flagMemory)
+	}
+	if d.StartupGracePeriod, err = parseDurationFlag(flags, flagStartupGracePeriod); err != nil {
+		return err
+	}
+	if d.IPPollInterval, err = parseDurationFlag(flags, flagIPPollInterval); err != nil {
+		return err
+	}
+	if d.IPWaitTimeout, err = parseDurationFlag(flags, flagWaitTimeout); err != nil {
+		return err
+	}
+	d.IPBackoff = flags.String(flagIPBackoff)
+	d.ARPProbe = flags.Bool(flagARPProbe)
+	d.ImageURL = flags.String(flagImage)
+	d.ImageKernel = flags.String(flagImageKernel)
+	d.ImageInitrd = flags.String(flagImageInitrd)
+	d.NFSExportScope = flags.String(flagNFSExportScope)
+	d.NFSExportTemplate = flags.String(flagNFSExportTemplate)
+	d.NFSMaps = flags.StringSlice(flagNFSMap)
+	d.SudoAskpass = flags.String(flagSudoAskpass)
+	d.SSHUser = flags.String(flagSSHUser)
+	d.SSHPort = flags.Int(flagSSHPort)
+	d.DNS = flags.StringSlice(flagDNS)
+	d.DNSSearch = flags.StringSlice(flagDNSSearch)
+	d.ScratchDir = flags.String(flagScratchDir)
+	d.HTTPProxy = flags.String(flagHTTPProxy)
+	d.HTTPSProxy = flags.String(flagHTTPSProxy)
+	d.NoProxy = flags.StringSlice(flagNoProxy)
+	d.SystemProxy = flags.Bool(flagSystemProxy)
+	if d.ProvisionScripts, err = resolveProvisionScripts(flags.StringSlice(flagProvisionScript)); err != nil {
+		return err
+	}
+	d.ProvisionOnError = flags.String(flagProvisionOnError)
+	d.VMNetSubnet = flags.String(flagVMNetSubnet)
+	d.ExtraArgs = flags.StringSlice(flagExtraArgs)
+	if d.AttachISOs, err = absolutePaths(flags.StringSlice(flagAttachISO)); err != nil {
+		return err
+	}
+	d.RegistryAuth = flags.StringSlice(flagRegistryAuth)
+	d.Firewall = flags.Bool(flagFirewall)
+	d.FirewallAllow = flags.StringSlice(flagFirewallAllow)
+	d.StatusAddress = flags.String(flagStatusAddress)
+	d.DiskBackend = flags.String(flagDiskBackend)
+	d.IPCommand = flags.String(flagIPCommand)
+	d.WakeWatch = flags.Bool(flagWakeWatch)
+	d.CustomizeFiles = flags.StringSlice(flagCustomizeFile)
+	d.CustomizeCommands = flags.StringSlice(flagCustomizeCommand)
+	d.TimeSync = flags.String(flagTimeSync)
+	d.CPUHideFeatures = flags.StringSlice(flagCPUHideFeature)
+	d.AutoResources = flags.Bool(flagAutoResources)
+	d.DockerInsecureRegistries = flags.StringSlice(flagDockerInsecureRegistry)
+	d.DockerRegistryMirrors = flags.StringSlice(flagDockerRegistryMirror)
+	d.DockerStorageDriver = flags.String(flagDockerStorageDriver)
+	d.DockerCgroupDriver = flags.String(flagDockerCgroupDriver)
+	d.HookURL = flags.String(flagHookURL)
+	d.HookCommand = flags.String(flagHookCommand)
+	d.Supervise = flags.Bool(flagSupervise)
+	d.SuperviseMaxRestarts = flags.Int(flagSuperviseMaxRestarts)
+	d.HyperKitBinaryPath = flags.String(flagHyperKitBinaryPath)
+	d.HyperKitBinaryURL = flags.String(flagHyperKitBinaryURL)
+	d.HyperKitBinarySHA256 = strings.ToLower(flags.String(flagHyperKitBinarySHA256))
+	if authFile := flags.String(flagRegistryAuthFile); authFile != "" {
+		if d.RegistryAuthFile, err = filepath.Abs(authFile); err != nil {
+			return err
+		}
+	}
+	d.ShareMode = flags.String(flagShareMode)
+	if err := d.setHomeShare(flags.String(flagMountHome)); err != nil {
+		return err
+	}
+	d.NFSMountOwner = flags.String(flagNFSMountOwner)
+	d.NFSMountMode = flags.String(flagNFSMountMode)
+	d.BootMode = flags.String(flagBootMode)
+	d.Bootrom = flags.String(flagBootrom)
+	d.PrivilegedHelper = flags.Bool(flagPrivilegedHelper)
+	if id := flags.String(flagUUID); id != "" {
+		d.UUID = strings.ToLower(id)
+	}
+	if mac := flags.String(flagMACAddress); mac != "" {
+		d.MACAddress = normalizeMACAddress(mac)
+		d.MACPinned = true
+	}
+	d.PortForwards = flags.StringSlice(flagPortForward)
+	d.ResolverDomain = flags.String(flagResolverDomain)
+	d.Companions = flags.StringSlice(flagCompanion)
+	d.ConsoleMode = flags.String(flagConsole)
+	if d.TimeSyncInterval, err = parseDurationFlag(flags, flagTimeSyncInterval); err != nil {
+		return err
+	}
+	if d.DiskMonitorInterval, err = parseDurationFlag(flags, flagDiskMonitor); err != nil {
+		return err
+	}
+	if d.KernelMonitorInterval, err = parseDurationFlag(flags, flagKernelMonitor); err != nil {
+		return err
+	}
+	d.DiskWarnThreshold = flags.Int(flagDiskWarnThreshold)
+	d.DiskPruneThreshold = flags.Int(flagDiskPruneThreshold)
+	d.CPUPriority = flags.String(flagCPUPriority)
+	d.CustomKernel = flags.String(flagKernel)
+	d.CustomInitrd = flags.String(flagInitrd)
+	d.KernelName = flags.String(flagKernelName)
+	if d.KernelName != "" && d.CustomKernel != "" {
+		return errors.Errorf("--%s and --%s are mutually exclusive", flagKernelName, flagKernel)
+	}
+	d.Cmdline = flags.String(flagCmdline)
+	d.CmdlineExtra = flags.String(flagCmdlineExtra)
+	d.VSock = flags.Bool(flagVSock)
+	if d.VSockPorts, err = parseVSockPorts(flags.StringSlice(flagVSockPort)); err != nil {
+		return err
+	}
+	d.TrustCPURNG = flags.Bool(flagTrustCPURNG)
+	d.SelfTest = flags.Bool(flagSelfTest)
+	d.Notify = flags.Bool(flagNotify)
+	d.MetricsAddress = flags.String(flagMetricsAddress)
+	d.ReuseArtifacts = flags.Bool(flagReuseArtifacts)
+	d.ReuseDisk = flags.Bool(flagReuseDisk)
+	d.TelemetryFile = flags.String(flagTelemetryFile)
+	d.TelemetryCommand = flags.String(flagTelemetryCommand)
+	d.LogLevel = flags.String(flagLogLevel)
+	d.LogFormat = flags.String(flagLogFormat)
+	if d.StopWait, err = parseDurationFlag(flags, flagStopWait); err != nil {
+		return err
+	}
+	d.SSHPasswordLogin = flags.Bool(flagSSHPasswordLogin)
+	d.VPNKit = flags.String(flagVPNKit)
+	d.VPNKitBinary = flags.String(flagVPNKitBinary)
+	if err := d.setNetworks(flags.StringSlice(flagNetwork)); err != nil {
+		return err
+	}
+	if flags.Bool(flagHostUser) {
+		if err := d.setHostUser(); err != nil {
+			return err
+		}
+		d.GuestAuthorizedKeys = flags.String(flagGuestUserKeys)
+	}
+	if err := d.validate(); err != nil {
+		return err
+	}
+	d.configureLogging()
+	return nil
+}
+
+// parseDurationFlag parses a duration flag, an empty value meaning zero.
+func parseDurationFlag(flags drivers.DriverOptions, name string) (time.Duration, error) {
+	v := flags.String(name)
+	if v == "" {
+		return 0, nil
+	}
+	dur, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing --%s", name)
+	}
+	if dur < 0 {
+		return 0, errors.Errorf("--%s must not be negative", name)
+	}
+	return dur, nil
+}
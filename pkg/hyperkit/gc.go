@@ -0,0 +1,97 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/johanneswuerbach/nfsexports"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/helper"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// OrphanedExport is an /etc/exports entry of the caller whose machine
+// directory no longer exists, e.g. because it was deleted by hand or its
+// removal failed before cleaning the exports up.
+type OrphanedExport struct {
+	Identifier string `json:"identifier"`
+	MachineDir string `json:"machine_dir"`
+	Share      string `json:"share"`
+}
+
+// OrphanedExports returns the share exports of /etc/exports added by the
+// calling user whose machine directory is gone. The entries of older
+// drivers don't record their machine directory and are never reported.
+func OrphanedExports() ([]OrphanedExport, error) {
+	exports, err := nfsexports.List(exportsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var orphans []OrphanedExport
+	for identifier := range exports {
+		identifier = strings.TrimSpace(identifier)
+		o, ok := helper.ParseExportIdentifier(identifier)
+		if !ok || o.UID != os.Getuid() || !filepath.IsAbs(o.MachineDir) {
+			continue
+		}
+		if _, err := os.Lstat(o.MachineDir); !os.IsNotExist(err) {
+			continue
+		}
+		orphans = append(orphans, OrphanedExport{Identifier: identifier, MachineDir: o.MachineDir, Share: o.Share})
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Identifier < orphans[j].Identifier })
+	return orphans, nil
+}
+
+// GCExports removes the orphaned exports, see OrphanedExports, through the
+// privileged helper when privilegedHelper is set, and returns them.
+func GCExports(privilegedHelper bool) ([]OrphanedExport, error) {
+	orphans, err := OrphanedExports()
+	if err != nil || len(orphans) == 0 {
+		return orphans, err
+	}
+	if exportsImmutable() {
+		return nil, fmt.Errorf("%s is immutable, the orphaned exports can't be removed", exportsFile)
+	}
+	d := NewDriver("", "")
+	d.PrivilegedHelper = privilegedHelper
+	defer d.enterPrivilegeScope(helper.ScopeGC)()
+
+	var removed []OrphanedExport
+	var failed MultiError
+	for _, o := range orphans {
+		if err := d.removeNFSExport(o.Identifier); err != nil {
+			failed.Collect(fmt.Errorf("removing the export of %s for %s: %v", o.Share, o.MachineDir, err))
+			continue
+		}
+		log.Infof("Removed the export of %s for the removed machine %s", o.Share, o.MachineDir)
+		removed = append(removed, o)
+	}
+	if len(removed) > 0 {
+		failed.Collect(d.reloadNFS())
+	}
+	return removed, failed.ToError()
+}
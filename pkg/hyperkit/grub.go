@@ -0,0 +1,183 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// grubConfigPaths are where hybrid ISOs without isolinux ship their GRUB
+// configuration, relative to the ISO root.
+var grubConfigPaths = []string{
+	"boot/grub/grub.cfg",
+	"boot/grub2/grub.cfg",
+	"EFI/BOOT/grub.cfg",
+	"EFI/boot/grub.cfg",
+	"grub/grub.cfg",
+}
+
+// grubEntry is the kernel, initrds and command line of a GRUB menuentry.
+type grubEntry struct {
+	Title  string
+	Kernel string
+	// Initrds are in boot order, e.g. microcode first, the last one
+	// being the root filesystem.
+	Initrds []string
+	Cmdline string
+}
+
+// parseGrubConfig returns the menuentries of a GRUB configuration, including
+// those of submenus, and the index of the default one.
+func parseGrubConfig(r io.Reader) ([]grubEntry, int, error) {
+	var (
+		entries []grubEntry
+		entry   *grubEntry
+		def     int
+		depth   int
+		// entryDepth is the brace depth inside the current menuentry.
+		entryDepth int
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch {
+		case fields[0] == "menuentry":
+			entries = append(entries, grubEntry{Title: grubTitle(line)})
+			entry = &entries[len(entries)-1]
+			entryDepth = depth + 1
+		case entry != nil && (fields[0] == "linux" || fields[0] == "linux16" || fields[0] == "linuxefi") && len(fields) > 1:
+			entry.Kernel = fields[1]
+			entry.Cmdline = strings.Join(fields[2:], " ")
+		case entry != nil && (fields[0] == "initrd" || fields[0] == "initrd16" || fields[0] == "initrdefi") && len(fields) > 1:
+			entry.Initrds = fields[1:]
+		case depth == 0 && strings.HasPrefix(line, "set default="):
+			if n, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(line, "set default="), `"'`)); err == nil {
+				def = n
+			}
+		}
+		depth += strings.Count(line, "{") - strings.Count(line, "}")
+		if entry != nil && depth < entryDepth {
+			entry = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	if def < 0 || def >= len(entries) {
+		def = 0
+	}
+	return entries, def, nil
+}
+
+// grubTitle returns the quoted title of a menuentry line.
+func grubTitle(line string) string {
+	line = strings.TrimSpace(strings.TrimPrefix(line, "menuentry"))
+	if line == "" {
+		return ""
+	}
+	if line[0] != '\'' && line[0] != '"' {
+		return strings.Fields(line)[0]
+	}
+	if end := strings.IndexByte(line[1:], line[0]); end >= 0 {
+		return line[1 : end+1]
+	}
+	return line[1:]
+}
+
+// isoPath resolves a GRUB path, possibly prefixed with a device like
+// "(loop)", inside the ISO mounted at root, ignoring case as the ISO may
+// be mounted or extracted on a case-sensitive volume. The path is cleaned as
+// an absolute one so that ".." can't climb out of root.
+func isoPath(root, path string) string {
+	if strings.HasPrefix(path, "(") {
+		if i := strings.IndexByte(path, ')'); i >= 0 {
+			path = path[i+1:]
+		}
+	}
+	return lookupFold(filepath.Join(root, filepath.Clean("/"+path)))
+}
+
+// extractGrubOptions reads the command line, kernel and initrd of the
+// default GRUB menuentry of the ISO mounted at root, for the ones not set
+// yet.
+func (d *Driver) extractGrubOptions(root string) error {
+	for _, rel := range grubConfigPaths {
+		path := filepath.Join(root, rel)
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		entries, def, err := parseGrubConfig(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("parsing %s: %v", rel, err)
+		}
+		if len(entries) == 0 || entries[def].Kernel == "" {
+			log.Debugf("No menuentry booting a kernel in %s", rel)
+			continue
+		}
+		entry := entries[def]
+		log.Debugf("Booting the GRUB menuentry %q of %s", entry.Title, rel)
+		if d.Cmdline == "" {
+			d.Cmdline, d.grubCmdline = entry.Cmdline, true
+		}
+		if d.BootKernel == "" && d.BootInitrd == "" && len(entry.Initrds) > 0 {
+			kernel := isoPath(root, entry.Kernel)
+			if _, err := os.Stat(kernel); err == nil && d.setBootInitrds(root, entry.Initrds) {
+				d.BootKernel, d.Vmlinuz = kernel, filepath.Base(kernel)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("no GRUB configuration found")
+}
+
+// grubCmdlineOf returns the command line of the first GRUB menuentry of the
+// ISO mounted at root booting kernel, empty if none does.
+func grubCmdlineOf(root, kernel string) string {
+	for _, rel := range grubConfigPaths {
+		f, err := os.Open(filepath.Join(root, rel))
+		if err != nil {
+			continue
+		}
+		entries, _, err := parseGrubConfig(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.Kernel != "" && isoPath(root, entry.Kernel) == kernel {
+				return entry.Cmdline
+			}
+		}
+	}
+	return ""
+}
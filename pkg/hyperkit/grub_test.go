@@ -0,0 +1,141 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testGrubConfig = `
+set timeout=5
+set default="1"
+
+# Comments and blank lines are skipped.
+menuentry 'Live system' --class linux {
+	linux /live/vmlinuz boot=live quiet
+	initrd /live/initrd.img
+}
+submenu "Advanced options" {
+	menuentry "Live system (fail-safe)" {
+		set gfxpayload=text
+		linux16 /live/vmlinuz boot=live nomodeset
+		initrd16 /live/ucode.img /live/initrd.img
+	}
+}
+menuentry "UEFI" {
+	linuxefi (loop)/boot/vmlinuz-efi console=ttyS0
+	initrdefi (loop)/boot/initrd-efi
+}
+menuentry Memtest {
+	linux16 /boot/memtest
+}
+linux /outside/vmlinuz
+`
+
+func TestParseGrubConfig(t *testing.T) {
+	entries, def, err := parseGrubConfig(strings.NewReader(testGrubConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []grubEntry{
+		{Title: "Live system", Kernel: "/live/vmlinuz", Initrds: []string{"/live/initrd.img"}, Cmdline: "boot=live quiet"},
+		{Title: "Live system (fail-safe)", Kernel: "/live/vmlinuz", Initrds: []string{"/live/ucode.img", "/live/initrd.img"}, Cmdline: "boot=live nomodeset"},
+		{Title: "UEFI", Kernel: "(loop)/boot/vmlinuz-efi", Initrds: []string{"(loop)/boot/initrd-efi"}, Cmdline: "console=ttyS0"},
+		{Title: "Memtest", Kernel: "/boot/memtest"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %+v, want %+v", entries, want)
+	}
+	if def != 1 {
+		t.Errorf("default = %d, want 1", def)
+	}
+}
+
+func TestParseGrubConfigDefault(t *testing.T) {
+	const entries = "menuentry a {\n}\nmenuentry b {\n}\n"
+	for _, tt := range []struct {
+		set  string
+		want int
+	}{
+		{"", 0},
+		{"set default=1", 1},
+		{"set default='1'", 1},
+		{"set default=2", 0},
+		{"set default=-1", 0},
+		{"set default=saved", 0},
+		{"menuentry c {\n\tset default=1\n}", 0},
+	} {
+		_, def, err := parseGrubConfig(strings.NewReader(tt.set + "\n" + entries))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if def != tt.want {
+			t.Errorf("default with %q = %d, want %d", tt.set, def, tt.want)
+		}
+	}
+}
+
+func TestGrubTitle(t *testing.T) {
+	for _, tt := range []struct {
+		line, want string
+	}{
+		{`menuentry 'Live system' --class linux {`, "Live system"},
+		{`menuentry "Say 'hi'" {`, "Say 'hi'"},
+		{`menuentry Plain {`, "Plain"},
+		{`menuentry "Unterminated {`, "Unterminated {"},
+		{`menuentry`, ""},
+	} {
+		if got := grubTitle(tt.line); got != tt.want {
+			t.Errorf("grubTitle(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestISOPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "grub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "BOOT"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "BOOT", "VMLINUZ"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{"/boot/vmlinuz", "BOOT/VMLINUZ"},
+		{"(loop)/boot/vmlinuz", "BOOT/VMLINUZ"},
+		{"(hd0,msdos1)/BOOT/VMLINUZ", "BOOT/VMLINUZ"},
+		{"boot/initrd", "BOOT/initrd"},
+		{"/../../etc/passwd", "etc/passwd"},
+		{"(loop)/boot/../../../etc/passwd", "etc/passwd"},
+	} {
+		if got, want := isoPath(root, tt.path), filepath.Join(root, tt.want); got != want {
+			t.Errorf("isoPath(%q) = %q, want %q", tt.path, got, want)
+		}
+	}
+}
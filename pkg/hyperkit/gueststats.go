@@ -0,0 +1,208 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GuestStats is the resource usage of a machine, as seen from inside the
+// guest.
+type GuestStats struct {
+	CPUs   int     `json:"cpus"`
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+	// CPUPercent is the share of the guest CPU time spent busy over a one
+	// second sample, over all CPUs.
+	CPUPercent           float64           `json:"cpu_percent"`
+	MemoryTotalBytes     int64             `json:"memory_total_bytes"`
+	MemoryAvailableBytes int64             `json:"memory_available_bytes"`
+	SwapTotalBytes       int64             `json:"swap_total_bytes"`
+	SwapFreeBytes        int64             `json:"swap_free_bytes"`
+	Filesystems          []FilesystemUsage `json:"filesystems"`
+	// Docker is nil when the docker daemon doesn't answer.
+	Docker *DockerStats `json:"docker,omitempty"`
+}
+
+// DockerStats counts the objects of the docker daemon of the guest.
+type DockerStats struct {
+	ContainersRunning int `json:"containers_running"`
+	ContainersPaused  int `json:"containers_paused"`
+	ContainersStopped int `json:"containers_stopped"`
+	Containers        int `json:"containers"`
+	Images            int `json:"images"`
+}
+
+// guestStatsScript prints one "key values..." line per figure, sampling
+// /proc/stat one second apart for the CPU usage.
+const guestStatsScript = `echo cpus $(grep -c ^processor /proc/cpuinfo)
+echo loadavg $(cat /proc/loadavg)
+echo stat $(head -n 1 /proc/stat)
+grep -E '^(MemTotal|MemAvailable|SwapTotal|SwapFree):' /proc/meminfo | tr -d :
+info=$(sudo docker info --format '{{.ContainersRunning}} {{.ContainersPaused}} {{.ContainersStopped}} {{.Containers}} {{.Images}}' 2>/dev/null) && echo docker $info
+sleep 1
+echo stat $(head -n 1 /proc/stat)`
+
+// guestStatsMaxAge is how long the metrics process serves a guest sample
+// before collecting a new one, sparing the guest an SSH round trip, a one
+// second sample and a docker info on every scrape.
+const guestStatsMaxAge = 30 * time.Second
+
+// guestStatsCache is the last guest sample and when it was collected.
+// Failures are cached too, so that a guest not answering isn't asked again
+// on every scrape.
+type guestStatsCache struct {
+	mu          sync.Mutex
+	stats       *GuestStats
+	err         error
+	collectedAt time.Time
+}
+
+// cachedGuestStats returns the GuestStats collected at most guestStatsMaxAge
+// ago, or collects them without a cache.
+func (d *Driver) cachedGuestStats() (*GuestStats, error) {
+	c := d.guestSample
+	if c == nil {
+		return d.guestStats()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.collectedAt.IsZero() || time.Since(c.collectedAt) >= guestStatsMaxAge {
+		c.stats, c.err = d.guestStats()
+		c.collectedAt = time.Now()
+	}
+	return c.stats, c.err
+}
+
+// guestStats collects the GuestStats over SSH.
+func (d *Driver) guestStats() (*GuestStats, error) {
+	out, err := d.runSSHCommand(guestStatsScript)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := parseGuestStats(out)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := d.guestDiskUsage()
+	if err != nil {
+		return nil, err
+	}
+	stats.Filesystems = usage.Filesystems
+	return stats, nil
+}
+
+// parseGuestStats parses the output of guestStatsScript.
+func parseGuestStats(out string) (*GuestStats, error) {
+	stats := &GuestStats{}
+	meminfo := map[string]*int64{
+		"MemTotal":     &stats.MemoryTotalBytes,
+		"MemAvailable": &stats.MemoryAvailableBytes,
+		"SwapTotal":    &stats.SwapTotalBytes,
+		"SwapFree":     &stats.SwapFreeBytes,
+	}
+	var samples [][]int64
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		var err error
+		switch fields[0] {
+		case "cpus":
+			stats.CPUs, err = strconv.Atoi(fields[1])
+		case "loadavg":
+			if len(fields) < 4 {
+				return nil, errors.Errorf("unexpected /proc/loadavg %q", line)
+			}
+			for i, load := range []*float64{&stats.Load1, &stats.Load5, &stats.Load15} {
+				if *load, err = strconv.ParseFloat(fields[i+1], 64); err != nil {
+					break
+				}
+			}
+		case "stat":
+			var sample []int64
+			sample, err = parseInts(fields[2:])
+			samples = append(samples, sample)
+		case "MemTotal", "MemAvailable", "SwapTotal", "SwapFree":
+			var kb int64
+			kb, err = strconv.ParseInt(fields[1], 10, 64)
+			*meminfo[fields[0]] = kb * 1024
+		case "docker":
+			var counts []int64
+			if counts, err = parseInts(fields[1:]); err == nil && len(counts) != 5 {
+				err = fmt.Errorf("expected 5 counts")
+			}
+			if err == nil {
+				stats.Docker = &DockerStats{
+					ContainersRunning: int(counts[0]),
+					ContainersPaused:  int(counts[1]),
+					ContainersStopped: int(counts[2]),
+					Containers:        int(counts[3]),
+					Images:            int(counts[4]),
+				}
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing guest stats %q", line)
+		}
+	}
+	if len(samples) == 2 {
+		stats.CPUPercent = cpuBusyPercent(samples[0], samples[1])
+	}
+	return stats, nil
+}
+
+// parseInts parses decimal integers.
+func parseInts(fields []string) ([]int64, error) {
+	var ints []int64
+	for _, f := range fields {
+		n, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// cpuBusyPercent returns the busy share of the CPU time elapsed between two
+// samples of the /proc/stat cpu line: user nice system idle iowait irq
+// softirq steal, the guest times being included in user and nice.
+func cpuBusyPercent(before, after []int64) float64 {
+	var total, idle int64
+	for i := 0; i < 8 && i < len(before) && i < len(after); i++ {
+		delta := after[i] - before[i]
+		total += delta
+		if i == 3 || i == 4 {
+			idle += delta
+		}
+	}
+	if total <= 0 {
+		return 0
+	}
+	return float64(total-idle) * 100 / float64(total)
+}
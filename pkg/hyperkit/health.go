@@ -0,0 +1,161 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leoh0/machine/libmachine/state"
+	"github.com/pkg/errors"
+)
+
+// dockerPingCommand asks the guest docker daemon for its /_ping endpoint
+// over its unix socket, which answers "OK".
+const dockerPingCommand = "sudo curl -sS --max-time 5 --unix-socket /var/run/docker.sock http://localhost/_ping"
+
+// heartbeatTimeout bounds the guest SSH server check.
+const heartbeatTimeout = 2 * time.Second
+
+// HealthCheck is the result of one check of CheckHealth.
+type HealthCheck struct {
+	// Name is "process", "ssh", "docker" or "shares".
+	Name string `json:"name"`
+	// Error is empty if the check passed.
+	Error string `json:"error,omitempty"`
+}
+
+func (c HealthCheck) String() string {
+	if c.Error == "" {
+		return fmt.Sprintf("%s: ok", c.Name)
+	}
+	return fmt.Sprintf("%s: %s", c.Name, c.Error)
+}
+
+// CheckHealth checks, each relying on the previous one, that the hyperkit
+// process is alive, that the guest answers over SSH, that its docker
+// daemon responds and that the shares are mounted. It returns the checks
+// done and an error naming the first failing one.
+func (d *Driver) CheckHealth() ([]HealthCheck, error) {
+	var checks []HealthCheck
+	check := func(name string, err error) bool {
+		c := HealthCheck{Name: name}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		checks = append(checks, c)
+		return err == nil
+	}
+
+	if check("process", d.checkProcessAlive()) && check("ssh", d.checkSSH()) {
+		check("docker", d.checkDockerDaemon())
+		check("shares", d.checkShares())
+	}
+	for _, c := range checks {
+		if c.Error != "" {
+			return checks, fmt.Errorf("machine %s: %s", d.MachineName, c)
+		}
+	}
+	return checks, nil
+}
+
+// checkProcessAlive checks the hyperkit process runs.
+func (d *Driver) checkProcessAlive() error {
+	s, err := d.processState()
+	if err != nil {
+		return err
+	}
+	if s != state.Running {
+		return fmt.Errorf("hyperkit is not running (%s)", s)
+	}
+	return nil
+}
+
+// checkSSH checks the guest SSH server answers and runs commands.
+func (d *Driver) checkSSH() error {
+	if d.IPAddress == "" {
+		return fmt.Errorf("the machine has no IP address")
+	}
+	if err := d.heartbeat(); err != nil {
+		return err
+	}
+	_, err := d.runSSHCommand("true")
+	return err
+}
+
+// checkDockerDaemon checks the guest docker daemon answers on its socket.
+func (d *Driver) checkDockerDaemon() error {
+	out, err := d.runSSHCommand(dockerPingCommand)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(out) != "OK" {
+		return fmt.Errorf("unexpected answer %s from the docker daemon", strconv.Quote(strings.TrimSpace(out)))
+	}
+	return nil
+}
+
+// checkShares checks the shares are mounted in the guest.
+func (d *Driver) checkShares() error {
+	shares, err := d.shareStatus()
+	if err != nil {
+		return err
+	}
+	var unmounted []string
+	for _, share := range shares {
+		if !share.Mounted {
+			unmounted = append(unmounted, share.Share)
+		}
+	}
+	if len(unmounted) > 0 {
+		return fmt.Errorf("not mounted: %s", strings.Join(unmounted, ", "))
+	}
+	return nil
+}
+
+// heartbeat checks the guest SSH server answers with its banner.
+func (d *Driver) heartbeat() error {
+	if d.IPAddress == "" {
+		return nil
+	}
+	port, err := d.GetSSHPort()
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(d.IPAddress, strconv.Itoa(port)), heartbeatTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(heartbeatTimeout)); err != nil {
+		return err
+	}
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		return errors.Errorf("unexpected SSH banner %q", strings.TrimSpace(banner))
+	}
+	return nil
+}
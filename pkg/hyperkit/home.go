@@ -0,0 +1,105 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// The home share mounts the host user's home, or all of /Users, at the same
+// path in the guest whatever NFSSharesRoot is, like the xhyve and VirtualBox
+// drivers do, so that "docker run -v $PWD:..." works from anywhere below
+// it. It goes through the share mode of the other shares, which access the
+// host files as the host user. /Users holds the homes of every user, so only
+// root may share it; other users get their own home.
+const (
+	mountHomeHome  = "home"
+	mountHomeUsers = "users"
+	usersDir       = "/Users"
+)
+
+// homeShare returns the host directory shared for the --hyperkit-mount-home
+// mode, "" when off.
+func homeShare(mode string) (string, error) {
+	switch mode {
+	case "":
+		return "", nil
+	case mountHomeUsers:
+		if os.Getuid() == 0 {
+			return usersDir, nil
+		}
+		log.Warnf("Only root may share %s, sharing the home of the host user instead", usersDir)
+		fallthrough
+	case mountHomeHome:
+		u, err := user.Current()
+		if err != nil {
+			return "", errors.Wrap(err, "looking up the host user")
+		}
+		if !path.IsAbs(u.HomeDir) {
+			return "", fmt.Errorf("the home of %s, %q, is not an absolute path", u.Username, u.HomeDir)
+		}
+		return u.HomeDir, nil
+	}
+	return "", fmt.Errorf("invalid --%s %q: must be %q or %q", flagMountHome, mode, mountHomeHome, mountHomeUsers)
+}
+
+// setHomeShare adds the home share to the shares of the machine.
+func (d *Driver) setHomeShare(mode string) error {
+	share, err := homeShare(mode)
+	if err != nil || share == "" {
+		return err
+	}
+	d.HomeShare = share
+	for _, s := range d.NFSShares {
+		if s == share {
+			return nil
+		}
+	}
+	d.NFSShares = append(d.NFSShares, share)
+	return nil
+}
+
+// validateHomeShare checks no other share is nested in the home share or
+// contains it, as NFS can't export both.
+func (d *Driver) validateHomeShare() error {
+	if d.HomeShare == "" {
+		return nil
+	}
+	for _, share := range d.hostShares() {
+		if share == d.HomeShare {
+			continue
+		}
+		if pathWithin(share, d.HomeShare) || pathWithin(d.HomeShare, share) {
+			return fmt.Errorf("the share %s overlaps the home share %s of --%s, remove it", share, d.HomeShare, flagMountHome)
+		}
+	}
+	return nil
+}
+
+// pathWithin tells whether p is dir or below it.
+func pathWithin(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
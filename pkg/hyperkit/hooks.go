@@ -0,0 +1,76 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/hooks"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// validateHookURL checks url is empty or an http(s) URL.
+func validateHookURL(hookURL string) error {
+	if hookURL == "" {
+		return nil
+	}
+	u, err := url.Parse(hookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid hook URL %q: must be an http or https URL", hookURL)
+	}
+	return nil
+}
+
+// lifecycleHooks returns the hooks configured for the machine.
+func (d *Driver) lifecycleHooks() []hooks.Hook {
+	var hs []hooks.Hook
+	if d.HookURL != "" {
+		hs = append(hs, hooks.URLHook{URL: d.HookURL})
+	}
+	if d.HookCommand != "" {
+		hs = append(hs, hooks.CommandHook{Command: d.HookCommand})
+	}
+	return hs
+}
+
+// fireHooks hands the lifecycle event, failed with err for hooks.Error, to
+// the hooks, logging the failed deliveries.
+func (d *Driver) fireHooks(event string, err error) {
+	hs := d.lifecycleHooks()
+	if len(hs) == 0 {
+		return
+	}
+	e := hooks.Event{
+		Time:          time.Now(),
+		Machine:       d.MachineName,
+		Event:         event,
+		IP:            d.IPAddress,
+		DriverVersion: Version,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	for _, h := range hs {
+		if err := h.Fire(e); err != nil {
+			log.Warnf("Failed to deliver the %s event of %s to a hook: %v", event, d.MachineName, err)
+		}
+	}
+}
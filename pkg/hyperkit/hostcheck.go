@@ -0,0 +1,226 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/disk"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/telemetry"
+	ps "github.com/mitchellh/go-ps"
+	hyperkit "github.com/moby/hyperkit/go"
+)
+
+// Host check statuses
+const (
+	HostCheckOK      = "ok"
+	HostCheckWarning = "warning"
+	HostCheckError   = "error"
+)
+
+// minMacOSVersion is the oldest macOS with the Hypervisor and vmnet
+// frameworks hyperkit needs.
+var minMacOSVersion = []int{10, 11}
+
+// dockerDesktopVMProcesses are the processes of the Docker Desktop VM.
+var dockerDesktopVMProcesses = []string{"com.docker.hyperkit", "com.docker.virtualization", "qemu-system-aarch64"}
+
+// HostCheck is the result of checking one requirement of the host.
+type HostCheck struct {
+	// Name is "macos", "hypervisor", "hyperkit", "bootpd", "privileges",
+	// "docker-desktop" or "disk".
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+func (c HostCheck) String() string {
+	return fmt.Sprintf("%s: %s: %s", c.Name, c.Status, c.Message)
+}
+
+// CheckHost checks the host can run the machine: the macOS version, the
+// Hypervisor framework, the hyperkit binary, the DHCP server of vmnet, the
+// privileges vmnet needs, a running Docker Desktop VM and the free space
+// of the store. It returns the checks done and an error naming the first
+// failed one; warnings don't fail.
+func (d *Driver) CheckHost() ([]HostCheck, error) {
+	checks := []HostCheck{
+		checkMacOSVersion(),
+		checkHypervisor(),
+		d.checkHyperKitBinary(),
+		checkBootpd(),
+		d.checkPrivilegesStatus(),
+		checkDockerDesktop(),
+		d.checkStoreSpace(),
+	}
+	for _, c := range checks {
+		if c.Status == HostCheckError {
+			return checks, fmt.Errorf("%s: %s", c.Name, c.Message)
+		}
+	}
+	return checks, nil
+}
+
+// parseVersion parses the numbers of a dotted version.
+func parseVersion(v string) []int {
+	var nums []int
+	for _, part := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		nums = append(nums, n)
+	}
+	return nums
+}
+
+// versionLess tells whether version a is older than b.
+func versionLess(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+func checkMacOSVersion() HostCheck {
+	c := HostCheck{Name: "macos"}
+	v := telemetry.MacOSVersion()
+	switch {
+	case v == "":
+		c.Status, c.Message = HostCheckWarning, "cannot read the macOS version"
+	case versionLess(parseVersion(v), minMacOSVersion):
+		c.Status, c.Message = HostCheckError, fmt.Sprintf("macOS %s is too old, hyperkit needs 10.11 or later", v)
+	default:
+		c.Status, c.Message = HostCheckOK, "macOS "+v
+	}
+	return c
+}
+
+func checkHypervisor() HostCheck {
+	c := HostCheck{Name: "hypervisor"}
+	hv, err := hostSysctl("kern.hv_support")
+	switch {
+	case err != nil:
+		c.Status, c.Message = HostCheckWarning, fmt.Sprintf("cannot read kern.hv_support: %v", err)
+	case hv != 1:
+		c.Status, c.Message = HostCheckError, "the Hypervisor framework is not available (kern.hv_support is 0): the CPU lacks VT-x with EPT, or macOS runs in a VM without nested virtualization"
+	default:
+		c.Status, c.Message = HostCheckOK, "the Hypervisor framework is available"
+	}
+	return c
+}
+
+func (d *Driver) checkHyperKitBinary() HostCheck {
+	c := HostCheck{Name: "hyperkit"}
+	path, err := d.hyperKitBinary()
+	if err != nil {
+		c.Status, c.Message = HostCheckError, err.Error()
+		return c
+	}
+	h, err := hyperkit.New(path, "", "")
+	if err != nil {
+		c.Status, c.Message = HostCheckError, fmt.Sprintf("hyperkit not found: %v", err)
+		return c
+	}
+	out, err := exec.Command(h.HyperKit, "-v").CombinedOutput()
+	if err != nil {
+		c.Status, c.Message = HostCheckError, fmt.Sprintf("%s doesn't run: %v", h.HyperKit, err)
+		return c
+	}
+	version := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	c.Status, c.Message = HostCheckOK, fmt.Sprintf("%s (%s)", h.HyperKit, version)
+	return c
+}
+
+// checkBootpd checks the DHCP server handing addresses to vmnet guests is
+// not disabled in launchd, e.g. by a management profile.
+func checkBootpd() HostCheck {
+	c := HostCheck{Name: "bootpd"}
+	out, err := exec.Command("launchctl", "print-disabled", "system").Output()
+	if err != nil {
+		c.Status, c.Message = HostCheckWarning, fmt.Sprintf("cannot read the disabled launchd services: %v", err)
+		return c
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.Contains(line, `"com.apple.bootpd"`) && (strings.Contains(line, "=> true") || strings.Contains(line, "=> disabled")) {
+			c.Status, c.Message = HostCheckError, "bootpd, the DHCP server of vmnet, is disabled: run sudo launchctl enable system/com.apple.bootpd"
+			return c
+		}
+	}
+	c.Status, c.Message = HostCheckOK, "bootpd is enabled"
+	return c
+}
+
+// checkPrivilegesStatus checks the driver can use vmnet, which requires
+// root or the privileged helper.
+func (d *Driver) checkPrivilegesStatus() HostCheck {
+	c := HostCheck{Name: "privileges"}
+	if err := d.checkPrivileges(); err != nil {
+		c.Status, c.Message = HostCheckError, err.Error()
+		return c
+	}
+	c.Status, c.Message = HostCheckOK, "vmnet can be used"
+	return c
+}
+
+func checkDockerDesktop() HostCheck {
+	c := HostCheck{Name: "docker-desktop"}
+	procs, err := ps.Processes()
+	if err != nil {
+		c.Status, c.Message = HostCheckWarning, fmt.Sprintf("cannot list the processes: %v", err)
+		return c
+	}
+	for _, p := range procs {
+		for _, name := range dockerDesktopVMProcesses {
+			if p.Executable() == name {
+				c.Status, c.Message = HostCheckWarning, fmt.Sprintf("the Docker Desktop VM is running (%s, pid %d): it competes for CPU and memory, and its docker context may be in use instead of this machine", name, p.Pid())
+				return c
+			}
+		}
+	}
+	c.Status, c.Message = HostCheckOK, "no Docker Desktop VM is running"
+	return c
+}
+
+// checkStoreSpace checks the disk image fits in the free space of the
+// store: sparse images only warn, as they grow with the guest usage.
+func (d *Driver) checkStoreSpace() HostCheck {
+	c := HostCheck{Name: "disk"}
+	v, err := probeStoreVolume(d.StorePath)
+	if err != nil {
+		c.Status, c.Message = HostCheckWarning, fmt.Sprintf("cannot read the free space of %s: %v", d.StorePath, err)
+		return c
+	}
+	free := v.Free / 1000000
+	switch {
+	case free >= uint64(d.DiskSize):
+		c.Status = HostCheckOK
+	case d.DiskBackend == disk.Raw || !v.Sparse():
+		c.Status = HostCheckError
+	default:
+		c.Status = HostCheckWarning
+	}
+	c.Message = fmt.Sprintf("%d MB free in %s for a %d MB disk", free, d.StorePath, d.DiskSize)
+	return c
+}
@@ -0,0 +1,105 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// Some ISOs split their initrd in several segments loaded one after the
+// other by the boot loader, typically an uncompressed early cpio holding the
+// CPU microcode followed by the compressed initramfs. hyperkit loads a single
+// initrd, so the segments are concatenated in boot order into it, which the
+// kernel unpacks as consecutive cpio archives.
+
+// microcodeRegexp matches the file names of microcode initrd segments, e.g.
+// intel-ucode.img, amd-ucode.img or early_ucode.cpio.
+var microcodeRegexp = regexp.MustCompile(`(?i)(ucode|microcode)[^/]*\.(img|cpio)$`)
+
+// isMicrocodeInitrd tells whether the ISO path p is a microcode segment.
+func isMicrocodeInitrd(p string) bool {
+	return microcodeRegexp.MatchString(path.Base(p))
+}
+
+// isolinuxInitrds returns the initrd segments of the initrd= option of an
+// isolinux append line, in boot order.
+func isolinuxInitrds(cmdline string) []string {
+	for _, field := range strings.Fields(cmdline) {
+		if strings.HasPrefix(field, "initrd=") {
+			var initrds []string
+			for _, p := range strings.Split(strings.TrimPrefix(field, "initrd="), ",") {
+				if p != "" {
+					initrds = append(initrds, p)
+				}
+			}
+			return initrds
+		}
+	}
+	return nil
+}
+
+// setBootInitrds makes the last of initrds, paths in the ISO mounted at
+// root, the initrd and the previous ones the segments loaded before it. It
+// returns false, leaving d unchanged, when one of them is missing.
+func (d *Driver) setBootInitrds(root string, initrds []string) bool {
+	var paths []string
+	for _, initrd := range initrds {
+		p := isoPath(root, initrd)
+		if _, err := os.Stat(p); err != nil {
+			log.Debugf("initrd segment %s not found: %v", initrd, err)
+			return false
+		}
+		paths = append(paths, p)
+	}
+	if len(paths) == 0 {
+		return false
+	}
+	d.BootInitrd = paths[len(paths)-1]
+	d.Initrd = path.Base(d.BootInitrd)
+	d.earlyInitrds = paths[:len(paths)-1]
+	return true
+}
+
+// concatFiles writes the concatenation of srcs to dst.
+func concatFiles(dst string, srcs []string) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	for _, src := range srcs {
+		in, err := os.Open(src)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
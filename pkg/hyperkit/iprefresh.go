@@ -0,0 +1,124 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/helper"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/hooks"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/machine/libmachine/state"
+)
+
+// ipCacheTTL is how long GetIP trusts the last resolution of the VM IP.
+const ipCacheTTL = 5 * time.Second
+
+// GetIP returns the IP address of the VM. The address recorded on start
+// goes stale when the lease changes, e.g. after the host slept past its
+// expiry, so it is resolved again from the VM MAC address at most every
+// ipCacheTTL while the VM runs, see refreshIP.
+func (d *Driver) GetIP() (string, error) {
+	if d.IPAddress != "" && d.MACAddress != "" && time.Since(d.ipResolvedAt) >= ipCacheTTL {
+		d.refreshIP()
+	}
+	return d.BaseDriver.GetIP()
+}
+
+// refreshIP resolves the IP address of the running VM and handles its
+// change, keeping the recorded address when the lookup fails.
+func (d *Driver) refreshIP() {
+	if s, err := d.processState(); err != nil || s != state.Running {
+		return
+	}
+	d.ipResolvedAt = time.Now()
+	var resolver IPResolver = LeaseFileResolver{Path: DHCPLeasesFile}
+	if d.IPCommand != "" {
+		resolver = d.commandResolver()
+	}
+	ip, err := resolver.Resolve(d.MACAddress)
+	if err != nil {
+		log.Debugf("Resolving the IP address of %s: %v", d.MachineName, err)
+		return
+	}
+	if ip == d.IPAddress {
+		return
+	}
+	if d.privilegeScope != "" {
+		// Start and Stop handle the address themselves.
+		log.Debugf("The IP address of %s changed to %s during %s", d.MachineName, ip, d.privilegeScope)
+		return
+	}
+	if err := d.changeIP(ip); err != nil {
+		log.Warnf("Failed to follow the IP address change of %s: %v", d.MachineName, err)
+	}
+}
+
+// changeIP records ip as the new address of the VM in the configuration and
+// the metadata, and points the host state depending on it at ip: NFS
+// exports, port forwards and the resolver entry.
+func (d *Driver) changeIP(ip string) error {
+	log.Infof("The IP address of %s changed from %s to %s", d.MachineName, d.IPAddress, ip)
+	patch, err := json.Marshal(map[string]string{"IPAddress": ip})
+	if err != nil {
+		return err
+	}
+	resolvedAt := d.ipResolvedAt
+	if err := d.UpdateConfig(patch); err != nil {
+		d.IPAddress = ip
+		return err
+	}
+	d.ipResolvedAt = resolvedAt
+	if err := d.updateMetadata(func(m *MachineMetadata) {
+		recordIP(m, ip, time.Now())
+	}); err != nil {
+		log.Warnf("Failed to update machine metadata: %v", err)
+	}
+
+	d.fireHooks(hooks.GotIP, nil)
+	if err := d.ensureServerCert(); err != nil {
+		log.Warnf("Failed to issue the docker certificate for %s again, run docker-machine regenerate-certs %s: %v", ip, d.MachineName, err)
+	}
+
+	defer d.enterPrivilegeScope(helper.ScopeIPChange)()
+	var failed MultiError
+	failed.Collect(d.reexportNFSShares())
+	failed.Collect(d.startPortForwards())
+	failed.Collect(d.registerResolver())
+	return failed.ToError()
+}
+
+// reexportNFSShares exports the NFS shares again, so that exports limited
+// to the VM address follow it.
+func (d *Driver) reexportNFSShares() error {
+	m, err := d.readMetadata()
+	if err != nil {
+		return err
+	}
+	if len(m.ExportedShares) == 0 {
+		return nil
+	}
+	for _, share := range m.ExportedShares {
+		if err := d.removeShareExport(share); err != nil {
+			log.Debugf("Removing the NFS export of %s: %v", share, err)
+		}
+	}
+	return d.setupNFSShare()
+}
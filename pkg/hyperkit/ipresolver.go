@@ -0,0 +1,224 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+)
+
+// IPResolver looks up the IP address of a VM from its MAC address, in the
+// trimmed format of the dhcpd leases file (e.g. 2a:4c:e:7f:9b:1).
+type IPResolver interface {
+	Name() string
+	Resolve(mac string) (string, error)
+}
+
+// LeaseFileResolver reads the IP address from the bootpd leases file. The
+// entries it considers, and why it rejects or chooses each, are recorded to
+// Trace if set.
+type LeaseFileResolver struct {
+	Path  string
+	Trace io.Writer
+}
+
+func (r LeaseFileResolver) Name() string {
+	return "dhcpd leases"
+}
+
+func (r LeaseFileResolver) Resolve(mac string) (string, error) {
+	return getIpAddressFromFile(mac, r.Path, &leaseTrace{w: r.Trace})
+}
+
+// CommandResolver runs Command with /bin/sh, which prints the IP address of
+// the VM, for network setups the other resolvers can't handle, e.g. a
+// custom DHCP server. MACHINE_NAME, MACHINE_MAC and MACHINE_UUID are set in
+// its environment.
+type CommandResolver struct {
+	Command     string
+	MachineName string
+	UUID        string
+}
+
+// ipCommandTimeout bounds a run of the command of a CommandResolver.
+const ipCommandTimeout = 10 * time.Second
+
+func (r CommandResolver) Name() string {
+	return "ip command"
+}
+
+func (r CommandResolver) Resolve(mac string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ipCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", r.Command)
+	cmd.Env = append(os.Environ(),
+		"MACHINE_NAME="+r.MachineName,
+		"MACHINE_MAC="+mac,
+		"MACHINE_UUID="+r.UUID,
+	)
+	// The driver binary may be setuid root: run the command as the
+	// invoking user.
+	cmd.SysProcAttr = realuser.SysProcAttr()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v: %s", r.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	ip := strings.TrimSpace(string(out))
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("%s printed %q instead of an IP address", r.Command, ip)
+	}
+	return ip, nil
+}
+
+// ARPResolver reads the IP address from the host ARP cache, which works when
+// the leases file is stale or bootpd doesn't hand out leases. With Probe set,
+// every address of the vmnet subnet is sent a packet first so that the VM
+// shows up in the cache even if it hasn't talked to the host yet.
+type ARPResolver struct {
+	Probe bool
+}
+
+func (r ARPResolver) Name() string {
+	return "arp cache"
+}
+
+func (r ARPResolver) Resolve(mac string) (string, error) {
+	if r.Probe {
+		if err := probeSubnet(); err != nil {
+			log.Debugf("Probing the vmnet subnet: %v", err)
+		}
+	}
+	out, err := exec.Command("arp", "-an").Output()
+	if err != nil {
+		return "", err
+	}
+	return parseARPTable(out, mac)
+}
+
+// parseARPTable finds mac in the output of "arp -an", whose lines look like
+// "? (192.168.64.3) at 2a:4c:e:7f:9b:1 on bridge100 ifscope [ethernet]".
+func parseARPTable(out []byte, mac string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] != "at" || fields[3] != mac {
+			continue
+		}
+		ip := strings.Trim(fields[1], "()")
+		if net.ParseIP(ip) != nil {
+			return ip, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("Could not find %s in the arp cache", mac)
+}
+
+// probeSubnet sends an empty UDP datagram to every host address of the vmnet
+// subnet. The kernel resolves each address through ARP before sending, which
+// fills the ARP cache without spawning a ping per address.
+func probeSubnet() error {
+	subnet, err := GetSubnet()
+	if err != nil {
+		return err
+	}
+	ip := subnet.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("vmnet subnet %s is not IPv4", subnet)
+	}
+	ones, bits := subnet.Mask.Size()
+	hosts := 1<<uint(bits-ones) - 2
+	if hosts < 1 {
+		return nil
+	}
+
+	base := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+	for i := 1; i <= hosts; i++ {
+		n := base + uint32(i)
+		addr := net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: addr, Port: 9})
+		if err != nil {
+			continue
+		}
+		conn.Write(nil)
+		conn.Close()
+	}
+	// Leave the ARP requests some time to be answered.
+	time.Sleep(500 * time.Millisecond)
+	return nil
+}
+
+// ChainResolver tries its resolvers in order and returns the first address
+// found.
+type ChainResolver []IPResolver
+
+func (c ChainResolver) Name() string {
+	names := make([]string, len(c))
+	for i, r := range c {
+		names[i] = r.Name()
+	}
+	return strings.Join(names, ", ")
+}
+
+func (c ChainResolver) Resolve(mac string) (string, error) {
+	m := MultiError{}
+	for _, r := range c {
+		ip, err := r.Resolve(mac)
+		if err != nil {
+			m.Collect(fmt.Errorf("%s: %v", r.Name(), err))
+			continue
+		}
+		log.Debugf("Found IP %s of %s in the %s", ip, mac, r.Name())
+		return ip, nil
+	}
+	return "", m.ToError()
+}
+
+// ipDiscoveryLogFile records the decisions of the lookups in the leases
+// file, rotated at ipDiscoveryLogMaxSize.
+const (
+	ipDiscoveryLogFile    = "ip-discovery.log"
+	ipDiscoveryLogMaxSize = 1 << 20
+)
+
+// ipDiscoveryLog returns the log of the lookups in the leases file.
+func (d *Driver) ipDiscoveryLog() io.Writer {
+	if d.ipDiscoveryTrace == nil {
+		d.ipDiscoveryTrace = &log.RotatingFile{
+			Path:    d.scratchPath(ipDiscoveryLogFile),
+			MaxSize: ipDiscoveryLogMaxSize,
+			Backups: 1,
+		}
+	}
+	return d.ipDiscoveryTrace
+}
@@ -0,0 +1,46 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"path"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/iso9660"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// isBootFile tells whether the file at the ISO path p may be needed to
+// boot: an isolinux or GRUB configuration, a kernel or an initrd segment.
+func isBootFile(p string) bool {
+	name := path.Base(p)
+	return strings.HasSuffix(name, ".cfg") || kernelRegexp.MatchString(name) || strings.Contains(name, "initrd") ||
+		strings.Contains(name, "initramfs") || isMicrocodeInitrd(name)
+}
+
+// extractBootFiles copies the boot files of the ISO at isoPath into dir,
+// under their path in the ISO, as a replacement for mounting it there.
+func extractBootFiles(isoPath, dir string) error {
+	files, err := iso9660.Extract(isoPath, dir, isBootFile)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Extracted %d boot files of %s", len(files), isoPath)
+	return nil
+}
@@ -0,0 +1,184 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/schema"
+	"github.com/pkg/errors"
+)
+
+// The guest kernel log is read over SSH by a "kernel-monitor" process of the
+// driver binary managed alongside the VM, like the disk monitor. Notable
+// lines, OOM kills first, are recorded in the machine metadata, reported in
+// kernel-monitor.log and, with Notify, posted as notifications, so that
+// processes dying in the guest can be attributed to memory pressure.
+const (
+	kernelMonitorName = "kernel-monitor"
+	// maxKernelEvents bounds the events kept in the metadata.
+	maxKernelEvents = 100
+)
+
+// KernelLog is the state of the guest kernel log monitor.
+type KernelLog = schema.KernelLog
+
+// KernelEvent is a notable guest kernel log line.
+type KernelEvent = schema.KernelEvent
+
+// dmesgLineRegexp matches a kernel log line with its timestamp.
+var dmesgLineRegexp = regexp.MustCompile(`^\[\s*([0-9]+\.[0-9]+)\]\s?(.*)$`)
+
+// kernelEventPatterns tell the kinds of notable kernel log lines.
+var kernelEventPatterns = []struct {
+	kind    string
+	pattern *regexp.Regexp
+}{
+	{"oom", regexp.MustCompile(`Out of memory: Kill|Memory cgroup out of memory|oom-kill:|invoked oom-killer`)},
+	{"hung_task", regexp.MustCompile(`blocked for more than [0-9]+ seconds`)},
+	{"lockup", regexp.MustCompile(`soft lockup|hard LOCKUP|rcu_sched detected stall`)},
+	{"bug", regexp.MustCompile(`^BUG: |general protection fault|^Oops`)},
+}
+
+// startKernelMonitor starts the kernel log monitor if KernelMonitorInterval
+// is set.
+func (d *Driver) startKernelMonitor() error {
+	d.stopKernelMonitor()
+	if d.KernelMonitorInterval <= 0 {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, kernelMonitorName, d.ResolveStorePath(""))
+	if err := d.startManagedProcess(kernelMonitorName, cmd); err != nil {
+		return errors.Wrap(err, "starting kernel monitor")
+	}
+	return nil
+}
+
+// stopKernelMonitor terminates the kernel log monitor.
+func (d *Driver) stopKernelMonitor() {
+	d.stopManagedProcesses(kernelMonitorName)
+}
+
+// KernelEvents returns the notable guest kernel events recorded so far.
+func (d *Driver) KernelEvents() ([]KernelEvent, error) {
+	m, err := d.readMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if m.KernelLog == nil {
+		return nil, nil
+	}
+	return m.KernelLog.Events, nil
+}
+
+// MonitorKernel reads the guest kernel log of the machine stored in
+// machineDir every KernelMonitorInterval, until the process is terminated.
+func MonitorKernel(machineDir string) error {
+	d, err := LoadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	if d.KernelMonitorInterval <= 0 {
+		return errors.New("kernel monitoring is disabled for this machine")
+	}
+	for {
+		if err := d.checkKernelLog(); err != nil {
+			log.Warnf("Checking the kernel log: %v", err)
+		}
+		time.Sleep(d.KernelMonitorInterval)
+	}
+}
+
+// checkKernelLog reads the kernel log lines written since the last check
+// and records the notable ones.
+func (d *Driver) checkKernelLog() error {
+	m, err := d.readMetadata()
+	if err != nil {
+		return err
+	}
+	state := KernelLog{Boot: m.BootCount}
+	if m.KernelLog != nil {
+		state = *m.KernelLog
+	}
+	if state.Boot != m.BootCount {
+		// The kernel timestamps restarted with the guest.
+		state.Boot, state.Cursor = m.BootCount, 0
+	}
+
+	out, err := d.runSSHCommand("sudo dmesg")
+	if err != nil {
+		return err
+	}
+	events, cursor := parseKernelLog(out, state.Cursor, m.StartedAt)
+	for _, e := range events {
+		log.Warnf("Guest kernel %s event: %s", e.Kind, e.Message)
+		if e.Kind == "oom" {
+			d.notify("Machine %s ran out of memory: %s", d.MachineName, e.Message)
+		}
+	}
+	state.Cursor = cursor
+	state.CheckedAt = time.Now()
+	state.Events = append(state.Events, events...)
+	if len(state.Events) > maxKernelEvents {
+		state.Events = state.Events[len(state.Events)-maxKernelEvents:]
+	}
+
+	return d.updateMetadata(func(m *MachineMetadata) {
+		m.KernelLog = &state
+	})
+}
+
+// parseKernelLog returns the notable lines of the dmesg output out logged
+// after cursor, dated from the boot time booted, and the timestamp of its
+// last line.
+func parseKernelLog(out string, cursor float64, booted time.Time) ([]KernelEvent, float64) {
+	var events []KernelEvent
+	for _, line := range strings.Split(out, "\n") {
+		match := dmesgLineRegexp.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		ts, err := strconv.ParseFloat(match[1], 64)
+		if err != nil || ts <= cursor {
+			continue
+		}
+		cursor = ts
+		for _, p := range kernelEventPatterns {
+			if p.pattern.MatchString(match[2]) {
+				events = append(events, KernelEvent{
+					Time:    booted.Add(time.Duration(ts * float64(time.Second))),
+					Kind:    p.kind,
+					Message: match[2],
+				})
+				break
+			}
+		}
+	}
+	return events, cursor
+}
@@ -0,0 +1,87 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"os"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// refreshKernel extracts the kernel and initrd again when the boot ISO
+// changed since they were, e.g. replaced by a newer minikube ISO, so that
+// the machine doesn't boot a stale kernel with a new root filesystem. The
+// checksum of the ISO the kernel comes from is the iso_checksum of the
+// machine metadata. A command line read from the ISO is read from the new
+// one, while one given with --hyperkit-cmdline is kept.
+func (d *Driver) refreshKernel() error {
+	if d.isCloudImage() || d.isUEFIBoot() || d.hasCustomKernel() {
+		return nil
+	}
+	m, err := d.readMetadata()
+	if err != nil {
+		return err
+	}
+	if m.ISOChecksum == "" && d.Cmdline != "" {
+		// Machines older than the checksum only get it recorded.
+		return d.updateISOChecksum()
+	}
+	unchanged, err := d.isoUnchanged(m)
+	if err != nil {
+		return err
+	}
+	if unchanged && d.Cmdline != "" {
+		if m.ISOModTime == nil {
+			// Machines older than the size and time get them recorded.
+			return d.updateISOChecksum()
+		}
+		return nil
+	}
+
+	log.Infof("Extracting the kernel of the boot ISO of %s again", d.MachineName)
+	isoPath := d.bootPath(isoFilename)
+	previous := []string{d.Vmlinuz, d.Initrd}
+	if d.CmdlineFromISO {
+		d.Cmdline = ""
+	}
+	d.BootKernel, d.BootInitrd = "", ""
+	if err := d.extractKernel(isoPath); err != nil {
+		return errors.Wrap(err, "extracting the kernel of the changed ISO")
+	}
+	for _, file := range previous {
+		if file != "" && file != d.Vmlinuz && file != d.Initrd {
+			os.Remove(d.bootPath(file))
+		}
+	}
+	if d.BootSlot != "" {
+		info, err := d.readBootSlot(d.BootSlot)
+		if err != nil {
+			return err
+		}
+		info.Vmlinuz, info.Initrd = d.Vmlinuz, d.Initrd
+		if err := d.writeBootSlot(d.BootSlot, info); err != nil {
+			return err
+		}
+	}
+	if err := d.saveExistingConfig(); err != nil {
+		return err
+	}
+	return d.updateISOChecksum()
+}
@@ -0,0 +1,120 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ISOs may ship several kernels, e.g. an LTS and a current one, or a debug
+// build. The kernel named by KernelName is booted, otherwise the one with
+// the highest version in its file name.
+
+var versionNumberRegexp = regexp.MustCompile(`\d+`)
+
+// kernelVersion returns the numbers of the file name of a kernel, e.g.
+// [5 10 57] for vmlinuz-5.10.57-lts.
+func kernelVersion(name string) []int {
+	var version []int
+	for _, n := range versionNumberRegexp.FindAllString(name, -1) {
+		if v, err := strconv.Atoi(n); err == nil {
+			version = append(version, v)
+		}
+	}
+	return version
+}
+
+// compareVersions compares two kernelVersion results number by number, the
+// longer one being higher when one is a prefix of the other.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// selectKernel picks the kernel to boot among the paths found in the ISO:
+// the one whose file name or path in the ISO mounted at root is name, or
+// the highest version.
+func selectKernel(root string, kernels []string, name string) (string, error) {
+	if name != "" {
+		for _, k := range kernels {
+			rel, _ := filepath.Rel(root, k)
+			if filepath.Base(k) == name || rel == strings.TrimPrefix(name, "/") {
+				return k, nil
+			}
+		}
+		return "", fmt.Errorf("kernel %q not found in the ISO, which has %s", name, kernelNames(root, kernels))
+	}
+	if len(kernels) == 0 {
+		return "", nil
+	}
+	sorted := append([]string{}, kernels...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		c := compareVersions(kernelVersion(filepath.Base(sorted[i])), kernelVersion(filepath.Base(sorted[j])))
+		if c == 0 {
+			return sorted[i] < sorted[j]
+		}
+		return c < 0
+	})
+	return sorted[len(sorted)-1], nil
+}
+
+// kernelNames lists the paths of kernels in the ISO mounted at root.
+func kernelNames(root string, kernels []string) string {
+	if len(kernels) == 0 {
+		return "no kernel"
+	}
+	var names []string
+	for _, k := range kernels {
+		rel, _ := filepath.Rel(root, k)
+		names = append(names, "/"+rel)
+	}
+	return strings.Join(names, ", ")
+}
+
+// selectInitrd picks the initrd of kernel among the paths found in the ISO:
+// the last one whose file name holds the version of the kernel, e.g.
+// initramfs-5.10.57-lts.img for vmlinuz-5.10.57-lts, or else the last one.
+func selectInitrd(kernel string, initrds []string) string {
+	if len(initrds) == 0 {
+		return ""
+	}
+	name := filepath.Base(kernel)
+	if m := kernelRegexp.FindStringIndex(name); m != nil {
+		if suffix := strings.Trim(name[m[1]:], "-_."); suffix != "" {
+			for i := len(initrds) - 1; i >= 0; i-- {
+				if strings.Contains(filepath.Base(initrds[i]), suffix) {
+					return initrds[i]
+				}
+			}
+		}
+	}
+	return initrds[len(initrds)-1]
+}
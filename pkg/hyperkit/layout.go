@@ -0,0 +1,134 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/schema"
+	"github.com/pkg/errors"
+)
+
+// The layout of a machine directory is versioned in layout.json. Changes to
+// the layout, e.g. new file names or configuration split into several files,
+// bump schema.LayoutVersion and add a migration below, which start applies
+// in place to the machines created by older drivers. New machines are
+// upgraded by their first start too.
+const layoutFileName = schema.LayoutFile
+
+// layoutMigration upgrades a machine directory to version.
+type layoutMigration struct {
+	version     int
+	description string
+	// migrate upgrades the machine directory from the previous version.
+	// The driver configuration is saved afterwards when it changed.
+	migrate func(d *Driver) error
+}
+
+// layoutMigrations are ordered by version, one per version from 1 to
+// schema.LayoutVersion.
+var layoutMigrations = []layoutMigration{
+	{1, "moving the boot artifacts into boot slots", migrateBootSlotLayout},
+	{2, "recording the custom kernel apart from the extracted one", migrateCustomKernel},
+}
+
+// migrateLayout upgrades the machine directory to the current layout
+// version. Each migration is recorded as it completes, so an interrupted
+// upgrade resumes where it stopped.
+func (d *Driver) migrateLayout() error {
+	layout, err := schema.ReadLayout(d.ResolveStorePath("."))
+	if err != nil {
+		return err
+	}
+	for _, m := range layoutMigrations {
+		if m.version <= layout.Version {
+			continue
+		}
+		log.Infof("Upgrading the layout of %s to version %d: %s", d.MachineName, m.version, m.description)
+		before, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		if err := m.migrate(d); err != nil {
+			return errors.Wrapf(err, "upgrading the layout to version %d", m.version)
+		}
+		after, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		if string(before) != string(after) {
+			if err := d.saveExistingConfig(); err != nil {
+				return errors.Wrapf(err, "saving the configuration upgraded to layout version %d", m.version)
+			}
+		}
+		if err := d.writeLayout(m.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLayout records version as the layout version of the machine
+// directory.
+func (d *Driver) writeLayout(version int) error {
+	b, err := json.MarshalIndent(&schema.Layout{
+		Version:       version,
+		DriverVersion: Version,
+		UpdatedAt:     time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.ResolveStorePath(layoutFileName), b, 0644)
+}
+
+// migrateBootSlotLayout moves the boot artifacts kept at the root of the
+// machine directory into boot slot a. Cloud images boot from their disk and
+// have no boot artifacts to move.
+func migrateBootSlotLayout(d *Driver) error {
+	if d.isCloudImage() || d.BootSlot != "" {
+		return nil
+	}
+	// Without an ISO at the root, there is nothing to move.
+	if _, err := os.Stat(d.ResolveStorePath(isoFilename)); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return d.migrateLegacyBootSlot()
+}
+
+// migrateCustomKernel records the kernel and initrd given by the user, kept
+// in BootKernel and BootInitrd by older drivers, in CustomKernel and
+// CustomInitrd. Kernels extracted from the ISO were found under its mount
+// point.
+func migrateCustomKernel(d *Driver) error {
+	if d.CustomKernel != "" || d.BootKernel == "" || d.BootInitrd == "" {
+		return nil
+	}
+	if strings.HasPrefix(d.BootKernel, d.ResolveStorePath(isoMountPath)) {
+		return nil
+	}
+	d.CustomKernel, d.CustomInitrd = d.BootKernel, d.BootInitrd
+	return nil
+}
@@ -0,0 +1,138 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/schema"
+	"github.com/leoh0/machine/libmachine/state"
+)
+
+// The lifecycle phase of the machine is recorded in its metadata, so that
+// GetState can tell a machine being started or stopped, or stuck doing so,
+// from one which is up. Whether the guest answers is left to CheckHealth, so
+// that GetState only costs a look at the process and the metadata.
+const (
+	phaseStarting     = schema.PhaseStarting
+	phaseBooting      = schema.PhaseBooting
+	phaseProvisioning = schema.PhaseProvisioning
+	phaseRunning      = schema.PhaseRunning
+	phaseStopping     = schema.PhaseStopping
+	phaseError        = schema.PhaseError
+
+	// phaseGrace is added to the IP wait timeout to get the time after
+	// which a machine still starting is considered stuck.
+	phaseGrace = 3 * time.Minute
+)
+
+// setPhase records the lifecycle phase of the machine.
+func (d *Driver) setPhase(phase string) {
+	err := d.updateMetadata(func(m *MachineMetadata) {
+		m.Phase = phase
+		m.PhaseChangedAt = time.Now()
+	})
+	if err != nil {
+		log.Warnf("Failed to record the %s phase: %v", phase, err)
+	}
+}
+
+// recordBoot records a start of hyperkit, which boots the guest.
+func (d *Driver) recordBoot() {
+	err := d.updateMetadata(func(m *MachineMetadata) {
+		now := time.Now()
+		m.Phase = phaseBooting
+		m.PhaseChangedAt = now
+		m.BootCount++
+		m.StartedAt = now
+	})
+	if err != nil {
+		log.Warnf("Failed to record the boot: %v", err)
+	}
+}
+
+// Status summarizes the state and lifecycle of a machine, e.g. for fleet
+// tools looking for crash-looping machines.
+type Status struct {
+	State            string    `json:"state"`
+	Phase            string    `json:"phase,omitempty"`
+	IP               string    `json:"ip,omitempty"`
+	StartedAt        time.Time `json:"started_at"`
+	UptimeSeconds    int64     `json:"uptime_seconds"`
+	BootCount        int       `json:"boot_count"`
+	UncleanShutdowns int       `json:"unclean_shutdowns"`
+}
+
+// Status returns the state of the machine along with its uptime and boot
+// counters.
+func (d *Driver) Status() (*Status, error) {
+	s, err := d.GetState()
+	if err != nil {
+		return nil, err
+	}
+	m, err := d.readMetadata()
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{
+		State:            s.String(),
+		Phase:            m.Phase,
+		IP:               d.IPAddress,
+		StartedAt:        m.StartedAt,
+		BootCount:        m.BootCount,
+		UncleanShutdowns: m.UncleanShutdowns,
+	}
+	if s != state.Stopped && !m.StartedAt.IsZero() {
+		status.UptimeSeconds = int64(time.Since(m.StartedAt) / time.Second)
+	}
+	return status, nil
+}
+
+// GetState returns the state that the host is in: Stopped without hyperkit
+// process, Starting or Stopping while changing state, Timeout when stuck
+// doing so, Error when a start failed, and Running otherwise.
+func (d *Driver) GetState() (state.State, error) {
+	s, err := d.processState()
+	if err != nil || s != state.Running {
+		return s, err
+	}
+	m, err := d.readMetadata()
+	if err != nil {
+		log.Debugf("Reading the machine phase: %v", err)
+		return state.Running, nil
+	}
+
+	stuck := time.Since(m.PhaseChangedAt) > d.ipWaitTimeout()+phaseGrace
+	switch m.Phase {
+	case phaseStarting, phaseBooting, phaseProvisioning:
+		if stuck {
+			return state.Timeout, nil
+		}
+		return state.Starting, nil
+	case phaseStopping:
+		if stuck {
+			return state.Timeout, nil
+		}
+		return state.Stopping, nil
+	case phaseError:
+		return state.Error, nil
+	}
+	return state.Running, nil
+}
@@ -0,0 +1,43 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// driverLogFile is the driver log in the machine directory, which keeps
+// what the driver plugin logged after docker-machine has exited.
+const driverLogFile = "driver.log"
+
+// configureLogging applies LogLevel and LogFormat and sends the entries
+// to the driver log once the machine directory is known. It is called when
+// the flags are set, on start and by LoadDriver, rather than each time
+// docker-machine sends the driver to the plugin.
+func (d *Driver) configureLogging() {
+	level, err := log.ParseLevel(d.LogLevel)
+	if err != nil {
+		level = log.LevelInfo
+	}
+	c := log.Config{Level: level, Format: d.LogFormat, Machine: d.MachineName}
+	if d.StorePath != "" && d.MachineName != "" {
+		c.File = d.scratchPath(driverLogFile)
+	}
+	log.Configure(c)
+}
@@ -0,0 +1,74 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// vmnet assigns the VM a MAC address derived from its UUID, which can't be
+// chosen otherwise. The derived address is persisted in Driver.MACAddress so
+// that a change of the derivation is noticed, and so that the IP can still
+// be looked up when the derivation isn't available (e.g. cgo-less builds).
+// With MACPinned, a change fails the start instead.
+
+var macAddressRegexp = regexp.MustCompile(`^([0-9a-f]{1,2}:){5}[0-9a-f]{1,2}$`)
+
+// normalizeMACAddress returns mac in the format of the dhcpd leases file,
+// lowercase without leading zeros.
+func normalizeMACAddress(mac string) string {
+	return trimMacAddress(strings.ToLower(mac))
+}
+
+// validateMACAddress checks mac is empty or a MAC address.
+func validateMACAddress(mac string) error {
+	if mac != "" && !macAddressRegexp.MatchString(normalizeMACAddress(mac)) {
+		return fmt.Errorf("%q is not a valid MAC address", mac)
+	}
+	return nil
+}
+
+// macAddress returns the MAC address vmnet gives the VM, recording it in
+// MACAddress.
+func (d *Driver) macAddress() (string, error) {
+	raw, err := GetMACAddressFromUUID(d.UUID)
+	if err != nil {
+		if d.MACAddress != "" {
+			log.Debugf("Using the recorded MAC %s: %v", d.MACAddress, err)
+			return d.MACAddress, nil
+		}
+		return "", err
+	}
+	mac := normalizeMACAddress(raw)
+	switch {
+	case d.MACAddress == "" || d.MACAddress == mac:
+	case d.MACPinned:
+		return "", fmt.Errorf("vmnet assigns %s to UUID %s instead of the pinned MAC %s, "+
+			"pass the UUID the MAC was derived from with --%s", mac, d.UUID, d.MACAddress, flagUUID)
+	default:
+		log.Warnf("The MAC address of %s changed from %s to %s, DHCP reservations and firewall rules need updating",
+			d.MachineName, d.MACAddress, mac)
+	}
+	d.MACAddress = mac
+	return mac, nil
+}
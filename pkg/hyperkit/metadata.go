@@ -0,0 +1,181 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	pkgdrivers "github.com/leoh0/docker-machine-driver-hyperkit/pkg/drivers"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/lock"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/schema"
+	"github.com/pkg/errors"
+)
+
+const (
+	metadataFileName = schema.MachineMetadataFile
+	metadataVersion  = schema.MachineMetadataVersion
+	// maxIPHistory bounds the number of IP addresses remembered.
+	maxIPHistory = 20
+)
+
+// MachineMetadata describes a machine for external tools. It is persisted in
+// the machine directory and returned by Inspect.
+type MachineMetadata = schema.MachineMetadata
+
+// IPRecord is an IP address the VM had.
+type IPRecord = schema.IPRecord
+
+// DiskMetadata is a disk attached to the VM.
+type DiskMetadata = schema.DiskMetadata
+
+// NetworkInterface is a network interface of the guest.
+type NetworkInterface = schema.NetworkInterface
+
+func (d *Driver) readMetadata() (*MachineMetadata, error) {
+	m := &MachineMetadata{}
+	b, err := ioutil.ReadFile(d.ResolveStorePath(metadataFileName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", metadataFileName)
+	}
+	return m, nil
+}
+
+// updateMetadata refreshes the machine metadata from the driver
+// configuration, letting update record additional information. The driver
+// processes of the machine, e.g. its watchers, update it in turn.
+func (d *Driver) updateMetadata(update func(m *MachineMetadata)) error {
+	return lock.With(d.ResolveStorePath(metadataFileName+".lock"), func() error {
+		return d.writeMetadata(update)
+	})
+}
+
+// writeMetadata does updateMetadata holding the lock of the metadata.
+func (d *Driver) writeMetadata(update func(m *MachineMetadata)) error {
+	m, err := d.readMetadata()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	m.Version = metadataVersion
+	m.DriverVersion = Version
+	m.MachineName = d.MachineName
+	m.UUID = d.UUID
+	m.Cmdline = d.Cmdline
+	m.CPUs = d.CPU
+	m.Memory = d.Memory
+	m.Disks = []DiskMetadata{{Path: pkgdrivers.GetDiskPath(d.BaseDriver), Size: d.DiskSize}}
+	m.NFSShares = d.NFSShares
+	m.ConsoleLog = d.scratchPath(consoleLogFile)
+	if update != nil {
+		update(m)
+	}
+	m.UpdatedAt = now
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.ResolveStorePath(metadataFileName), b, 0644)
+}
+
+// recordIP adds ip to the IP history of m.
+func recordIP(m *MachineMetadata, ip string, now time.Time) {
+	if n := len(m.IPHistory); n > 0 && m.IPHistory[n-1].IP == ip {
+		m.IPHistory[n-1].LastSeen = now
+		return
+	}
+	m.IPHistory = append(m.IPHistory, IPRecord{IP: ip, FirstSeen: now, LastSeen: now})
+	if len(m.IPHistory) > maxIPHistory {
+		m.IPHistory = m.IPHistory[len(m.IPHistory)-maxIPHistory:]
+	}
+}
+
+// updateISOChecksum records the checksum, size and modification time of
+// the boot ISO.
+func (d *Driver) updateISOChecksum() error {
+	isoPath := d.bootPath(isoFilename)
+	fi, err := os.Stat(isoPath)
+	if err != nil {
+		return err
+	}
+	checksum, err := fileChecksum(isoPath)
+	if err != nil {
+		return err
+	}
+	modTime := fi.ModTime()
+	return d.updateMetadata(func(m *MachineMetadata) {
+		m.ISOChecksum, m.ISOSize, m.ISOModTime = checksum, fi.Size(), &modTime
+	})
+}
+
+// isoUnchanged tells whether the boot ISO is still the one of the checksum
+// recorded in m. The ISO is only hashed again when its size or modification
+// time changed.
+func (d *Driver) isoUnchanged(m *MachineMetadata) (bool, error) {
+	isoPath := d.bootPath(isoFilename)
+	fi, err := os.Stat(isoPath)
+	if err != nil {
+		return false, err
+	}
+	if m.ISOModTime != nil && fi.Size() == m.ISOSize && fi.ModTime().Equal(*m.ISOModTime) {
+		return true, nil
+	}
+	checksum, err := fileChecksum(isoPath)
+	if err != nil {
+		return false, err
+	}
+	return checksum == m.ISOChecksum, nil
+}
+
+// Inspect returns the machine metadata as JSON.
+func (d *Driver) Inspect() ([]byte, error) {
+	m, err := d.readMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// fileChecksum returns the hex encoded sha256 of the file at path.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,295 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	pkgdrivers "github.com/leoh0/docker-machine-driver-hyperkit/pkg/drivers"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/machine/libmachine/state"
+	"github.com/pkg/errors"
+)
+
+// metricsName is the managed process serving the metrics of a machine.
+const metricsName = "metrics"
+
+// Stats is the resource usage of a machine, as seen from the host.
+type Stats struct {
+	*Status
+	CPUSeconds         float64       `json:"cpu_seconds"`
+	CPUPercent         float64       `json:"cpu_percent"`
+	RSSBytes           int64         `json:"rss_bytes"`
+	DiskSizeBytes      int64         `json:"disk_size_bytes"`
+	DiskAllocatedBytes int64         `json:"disk_allocated_bytes"`
+	Shares             []ShareStatus `json:"shares,omitempty"`
+	// Guest is the resource usage seen from inside the guest, only known
+	// while it answers over SSH.
+	Guest *GuestStats `json:"guest,omitempty"`
+}
+
+// ShareStatus tells whether a shared folder is mounted in the guest.
+type ShareStatus struct {
+	Share      string `json:"share"`
+	MountPoint string `json:"mount_point"`
+	Mounted    bool   `json:"mounted"`
+}
+
+// validateMetricsAddress checks addr is empty or a loopback host:port, the
+// listener having no authentication.
+func validateMetricsAddress(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid metrics address %q: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("invalid metrics address %q: must be a loopback address", addr)
+	}
+	return nil
+}
+
+// Stats returns the status of the machine along with the CPU and memory
+// used by hyperkit, the size of the disk image, and the state of the shares
+// and the resource usage inside the guest, which are only known while the
+// guest answers over SSH.
+func (d *Driver) Stats() (*Stats, error) {
+	status, err := d.Status()
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{Status: status}
+
+	disk := pkgdrivers.GetDiskPath(d.BaseDriver)
+	if fi, err := os.Stat(disk); err == nil {
+		stats.DiskSizeBytes = fi.Size()
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			stats.DiskAllocatedBytes = st.Blocks * 512
+		}
+	}
+
+	if s, err := d.processState(); err != nil || s != state.Running {
+		return stats, nil
+	}
+	if stats.CPUPercent, stats.RSSBytes, stats.CPUSeconds, err = processUsage(d.getPid()); err != nil {
+		log.Debugf("Reading the resource usage of hyperkit: %v", err)
+	}
+	if stats.Shares, err = d.shareStatus(); err != nil {
+		log.Debugf("Reading the mounted shares: %v", err)
+	}
+	if stats.Guest, err = d.cachedGuestStats(); err != nil {
+		log.Debugf("Reading the guest resource usage: %v", err)
+	}
+	return stats, nil
+}
+
+// processUsage returns the CPU percentage, resident memory and CPU time of
+// process pid.
+func processUsage(pid int) (cpuPercent float64, rss int64, cpuSeconds float64, err error) {
+	out, err := exec.Command("ps", "-o", "%cpu=,rss=,time=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return 0, 0, 0, errors.Wrap(err, "ps")
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 3 {
+		return 0, 0, 0, fmt.Errorf("unexpected ps output %q", out)
+	}
+	if cpuPercent, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return 0, 0, 0, err
+	}
+	kb, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if cpuSeconds, err = parseCPUTime(fields[2]); err != nil {
+		return 0, 0, 0, err
+	}
+	return cpuPercent, kb * 1024, cpuSeconds, nil
+}
+
+// parseCPUTime parses a ps time, [[dd-]hh:]mm:ss.cc.
+func parseCPUTime(s string) (float64, error) {
+	var days float64
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid CPU time %q", s)
+		}
+		days, s = float64(n), s[i+1:]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid CPU time %q", s)
+	}
+	seconds := days * 86400
+	unit := 1.0
+	for i := len(parts) - 1; i >= 0; i-- {
+		n, err := strconv.ParseFloat(parts[i], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid CPU time %q", s)
+		}
+		seconds += n * unit
+		unit *= 60
+	}
+	return seconds, nil
+}
+
+// shareStatus returns whether each share is mounted, over NFS or sshfs, in
+// the guest.
+func (d *Driver) shareStatus() ([]ShareStatus, error) {
+	if len(d.NFSShares) == 0 {
+		return nil, nil
+	}
+	out, err := d.runSSHCommand(`awk '$3 ~ /^nfs|^fuse\.sshfs$/ { print $2 }' /proc/mounts`)
+	if err != nil {
+		return nil, err
+	}
+	// /proc/mounts escapes the blanks of the mount points.
+	unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\134`, `\`)
+	mounted := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		mounted[unescape.Replace(line)] = true
+	}
+	var shares []ShareStatus
+	for _, share := range d.NFSShares {
+		if !path.IsAbs(share) {
+			share = d.ResolveStorePath(share)
+		}
+		mountPoint := d.nfsMountPoint(share)
+		shares = append(shares, ShareStatus{Share: share, MountPoint: mountPoint, Mounted: mounted[mountPoint]})
+	}
+	return shares, nil
+}
+
+// writeMetrics writes stats in the Prometheus text format.
+func writeMetrics(w io.Writer, machine string, stats *Stats) {
+	label := fmt.Sprintf(`machine="%s"`, escapeLabel(machine))
+	metric := func(name, typ, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %g\n", name, help, name, typ, name, label, value)
+	}
+	up := 0.0
+	if stats.State != state.Stopped.String() {
+		up = 1
+	}
+	metric("hyperkit_up", "gauge", "Whether the hyperkit process of the machine is running.", up)
+	metric("hyperkit_uptime_seconds", "gauge", "Time since the machine was started.", float64(stats.UptimeSeconds))
+	metric("hyperkit_boots_total", "counter", "Number of times the machine was started.", float64(stats.BootCount))
+	metric("hyperkit_unclean_shutdowns_total", "counter", "Number of times hyperkit was found dead without being stopped.", float64(stats.UncleanShutdowns))
+	metric("hyperkit_cpu_seconds_total", "counter", "CPU time used by the hyperkit process.", stats.CPUSeconds)
+	metric("hyperkit_cpu_percent", "gauge", "CPU usage of the hyperkit process, as reported by ps.", stats.CPUPercent)
+	metric("hyperkit_resident_memory_bytes", "gauge", "Resident memory of the hyperkit process.", float64(stats.RSSBytes))
+	metric("hyperkit_disk_size_bytes", "gauge", "Apparent size of the disk image.", float64(stats.DiskSizeBytes))
+	metric("hyperkit_disk_allocated_bytes", "gauge", "Host storage allocated to the sparse disk image.", float64(stats.DiskAllocatedBytes))
+	if len(stats.Shares) > 0 {
+		fmt.Fprintf(w, "# HELP hyperkit_share_mounted Whether the shared folder is mounted in the guest.\n# TYPE hyperkit_share_mounted gauge\n")
+		for _, share := range stats.Shares {
+			mounted := 0
+			if share.Mounted {
+				mounted = 1
+			}
+			fmt.Fprintf(w, "hyperkit_share_mounted{%s,share=\"%s\"} %d\n", label, escapeLabel(share.Share), mounted)
+		}
+	}
+	if g := stats.Guest; g != nil {
+		metric("hyperkit_guest_cpu_percent", "gauge", "Busy share of the guest CPU time over all CPUs.", g.CPUPercent)
+		metric("hyperkit_guest_load1", "gauge", "One minute load average of the guest.", g.Load1)
+		metric("hyperkit_guest_memory_total_bytes", "gauge", "Memory of the guest.", float64(g.MemoryTotalBytes))
+		metric("hyperkit_guest_memory_available_bytes", "gauge", "Memory available to new processes in the guest.", float64(g.MemoryAvailableBytes))
+		if g.Docker != nil {
+			metric("hyperkit_guest_containers_running", "gauge", "Running containers of the guest docker daemon.", float64(g.Docker.ContainersRunning))
+			metric("hyperkit_guest_containers", "gauge", "Containers of the guest docker daemon.", float64(g.Docker.Containers))
+			metric("hyperkit_guest_images", "gauge", "Images of the guest docker daemon.", float64(g.Docker.Images))
+		}
+	}
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// startMetrics starts the metrics listener if MetricsAddress is set.
+func (d *Driver) startMetrics() error {
+	d.stopMetrics()
+	if d.MetricsAddress == "" {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, metricsName, d.ResolveStorePath(""))
+	if err := d.startManagedProcess(metricsName, cmd); err != nil {
+		return errors.Wrap(err, "starting metrics listener")
+	}
+	log.Infof("Metrics available at http://%s/metrics", d.MetricsAddress)
+	return nil
+}
+
+// stopMetrics terminates the metrics listener.
+func (d *Driver) stopMetrics() {
+	d.stopManagedProcesses(metricsName)
+}
+
+// ServeMetrics serves the stats of the machine stored in machineDir on its
+// MetricsAddress: /metrics in the Prometheus text format and /stats as
+// JSON.
+func ServeMetrics(machineDir string) error {
+	d, err := LoadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	if d.MetricsAddress == "" {
+		return errors.New("metrics are disabled for this machine")
+	}
+	d.guestSample = &guestStatsCache{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := d.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, d.MachineName, stats)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := d.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stats)
+	})
+	log.Infof("Serving the metrics of %s on %s", d.MachineName, d.MetricsAddress)
+	return http.ListenAndServe(d.MetricsAddress, mux)
+}
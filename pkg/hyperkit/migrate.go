@@ -0,0 +1,345 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/disk"
+	pkgdrivers "github.com/leoh0/docker-machine-driver-hyperkit/pkg/drivers"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/machine/libmachine/drivers"
+	"github.com/leoh0/machine/libmachine/mcnflag"
+	"github.com/pkg/errors"
+)
+
+// The boot2docker machines of the deprecated xhyve and VirtualBox drivers
+// are migrated by converting their disk to a raw image, which keeps the
+// boot2docker-data partition and thus the images, containers and volumes,
+// and by carrying over their ISO, SSH key and certificates.
+const (
+	driverNameXhyve      = "xhyve"
+	driverNameVirtualBox = "virtualbox"
+	// migratedDir is the directory of the store a migrated machine is kept
+	// in when the hyperkit machine replaces it under the same name.
+	migratedDir = "migrated"
+)
+
+// migratedFiles are carried over from the migrated machine directory.
+var migratedFiles = []string{
+	isoFilename,
+	"id_rsa",
+	"id_rsa.pub",
+	"ca.pem",
+	"cert.pem",
+	"key.pem",
+	"server.pem",
+	"server-key.pem",
+}
+
+// migrationSource is the part of the configuration of an xhyve or VirtualBox
+// machine that is carried over.
+type migrationSource struct {
+	CPU            int
+	Memory         int
+	DiskSize       int
+	Boot2DockerURL string
+	SSHUser        string
+	// Qcow2 is set by the xhyve driver when the disk is a qcow2 image.
+	Qcow2 bool
+}
+
+// MigrateMachine converts the stopped xhyve or VirtualBox machine source of
+// the docker-machine store at storePath into the hyperkit machine name.
+// When name is source, the migrated machine is moved to the migrated
+// directory of the store.
+func MigrateMachine(storePath, source, name string) (*Driver, error) {
+	srcDir := filepath.Join(storePath, "machines", source)
+	b, err := ioutil.ReadFile(filepath.Join(srcDir, machineConfigFileName))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading the configuration of %s", source)
+	}
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, errors.Wrapf(err, "parsing the configuration of %s", source)
+	}
+	var driverName string
+	if err := json.Unmarshal(config["DriverName"], &driverName); err != nil {
+		return nil, errors.Wrapf(err, "parsing the driver name of %s", source)
+	}
+	if driverName != driverNameXhyve && driverName != driverNameVirtualBox {
+		return nil, fmt.Errorf("%s uses the %q driver, only %q and %q machines can be migrated", source, driverName, driverNameXhyve, driverNameVirtualBox)
+	}
+	src := &migrationSource{}
+	if err := json.Unmarshal(config["Driver"], src); err != nil {
+		return nil, errors.Wrapf(err, "parsing the driver configuration of %s", source)
+	}
+	if err := checkMigrationSourceStopped(driverName, source, srcDir); err != nil {
+		return nil, err
+	}
+	srcDisk, err := migrationSourceDisk(driverName, source, srcDir, src)
+	if err != nil {
+		return nil, err
+	}
+
+	machineDir := filepath.Join(storePath, "machines", name)
+	if name == source {
+		backup := filepath.Join(storePath, migratedDir, fmt.Sprintf("%s-%s-%s", source, driverName, time.Now().Format("20060102150405")))
+		if err := os.MkdirAll(filepath.Dir(backup), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(srcDir, backup); err != nil {
+			return nil, err
+		}
+		log.Infof("Moved %s to %s", srcDir, backup)
+		srcDisk = filepath.Join(backup, filepath.Base(srcDisk))
+		srcDir = backup
+	} else if _, err := os.Stat(machineDir); err == nil {
+		return nil, fmt.Errorf("machine %s already exists", name)
+	}
+	if err := os.MkdirAll(machineDir, 0700); err != nil {
+		return nil, err
+	}
+	d, err := migrateMachine(config, src, storePath, name, srcDir, srcDisk)
+	if err != nil {
+		os.RemoveAll(machineDir)
+		if name == source {
+			if rerr := os.Rename(srcDir, machineDir); rerr != nil {
+				log.Warnf("Moving %s back to %s: %v", srcDir, machineDir, rerr)
+			}
+		}
+		return nil, err
+	}
+	log.Infof("Migrated the %s machine %s to the hyperkit machine %s", driverName, source, name)
+	return d, nil
+}
+
+func migrateMachine(config map[string]json.RawMessage, src *migrationSource, storePath, name, srcDir, srcDisk string) (*Driver, error) {
+	d := NewDriver(name, storePath)
+	if err := d.SetConfigFromFlags(defaultDriverOptions(d.GetCreateFlags())); err != nil {
+		return nil, err
+	}
+	d.MachineName = name
+	d.StorePath = storePath
+	d.SSHKeyPath = d.ResolveStorePath("id_rsa")
+	d.Boot2DockerURL = src.Boot2DockerURL
+	if src.CPU > 0 {
+		d.CPU = src.CPU
+	}
+	if src.Memory > 0 {
+		d.Memory = src.Memory
+	}
+	if src.SSHUser != "" {
+		d.SSHUser = src.SSHUser
+	}
+	// The hyperkit disks are raw images whether the blocks are allocated or
+	// not, a sparse copy is the cheapest.
+	d.DiskBackend = disk.Default
+
+	for _, file := range migratedFiles {
+		if err := copyMigratedFile(filepath.Join(srcDir, file), d.ResolveStorePath(file)); err != nil {
+			return nil, errors.Wrapf(err, "copying %s", file)
+		}
+	}
+
+	diskPath := pkgdrivers.GetDiskPath(d.BaseDriver)
+	log.Infof("Converting %s to a raw disk image...", srcDisk)
+	if err := convertDiskImage(srcDisk, diskPath); err != nil {
+		return nil, errors.Wrapf(err, "converting %s", srcDisk)
+	}
+	fi, err := os.Stat(diskPath)
+	if err != nil {
+		return nil, err
+	}
+	d.DiskSize = int(fi.Size() / 1000000)
+	if src.DiskSize > d.DiskSize {
+		d.DiskSize = src.DiskSize
+	}
+
+	if err := d.extractKernel(d.ResolveStorePath(isoFilename)); err != nil {
+		return nil, err
+	}
+	if err := d.updateISOChecksum(); err != nil {
+		return nil, errors.Wrap(err, "recording ISO checksum")
+	}
+
+	// The certificates paths of the host options point to the migrated
+	// machine directory. The server certificate is issued again for the new
+	// address on the first start, see ensureServerCert.
+	machineDir := d.ResolveStorePath(".")
+	for key, value := range config {
+		config[key] = replaceJSONString(value, srcDir, machineDir)
+	}
+	if config["DriverName"], err = json.Marshal("hyperkit"); err != nil {
+		return nil, err
+	}
+	if config["Name"], err = json.Marshal(name); err != nil {
+		return nil, err
+	}
+	if config["Driver"], err = json.Marshal(d); err != nil {
+		return nil, err
+	}
+	out, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(machineDir, machineConfigFileName), out, 0600); err != nil {
+		return nil, err
+	}
+	return d, d.updateMetadata(nil)
+}
+
+// checkMigrationSourceStopped fails if the machine to migrate runs, as its
+// disk would be copied while being written.
+func checkMigrationSourceStopped(driverName, source, srcDir string) error {
+	if driverName == driverNameVirtualBox {
+		out, err := exec.Command("VBoxManage", "showvminfo", source, "--machinereadable").Output()
+		if err != nil {
+			return errors.Wrapf(err, "reading the state of %s with VBoxManage", source)
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "VMState=") {
+				state := strings.Trim(strings.TrimPrefix(line, "VMState="), "\"")
+				if state != "poweroff" && state != "aborted" {
+					return fmt.Errorf("%s is %s, stop it first", source, state)
+				}
+			}
+		}
+		return nil
+	}
+	// xhyve runs the machine with its disk and ISO paths on the command
+	// line.
+	out, err := exec.Command("ps", "-axww", "-o", "args=").Output()
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.Contains(line, srcDir+string(filepath.Separator)) {
+			return fmt.Errorf("%s is running, stop it first", source)
+		}
+	}
+	return nil
+}
+
+// migrationSourceDisk returns the disk image of the machine to migrate.
+func migrationSourceDisk(driverName, source, srcDir string, src *migrationSource) (string, error) {
+	var path string
+	switch {
+	case driverName == driverNameVirtualBox:
+		path = filepath.Join(srcDir, "disk.vmdk")
+	case src.Qcow2:
+		path = filepath.Join(srcDir, source+".qcow2")
+	default:
+		path = filepath.Join(srcDir, source+".rawdisk")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", errors.Wrapf(err, "finding the disk of %s", source)
+	}
+	return path, nil
+}
+
+// convertDiskImage writes the disk image at src as the raw image dst, with
+// qemu-img or, for VMDK images, VBoxManage. Raw images are copied sparsely.
+func convertDiskImage(src, dst string) error {
+	format, err := pkgdrivers.DetectImageFormat(src)
+	if err != nil {
+		return err
+	}
+	if format == pkgdrivers.ImageFormatRaw && !strings.HasSuffix(src, ".vmdk") {
+		return copyMigratedFile(src, dst)
+	}
+	if qemuImg, err := exec.LookPath("qemu-img"); err == nil {
+		return runConversion(exec.Command(qemuImg, "convert", "-O", "raw", src, dst))
+	}
+	if strings.HasSuffix(src, ".vmdk") {
+		if vboxManage, err := exec.LookPath("VBoxManage"); err == nil {
+			return runConversion(exec.Command(vboxManage, "clonemedium", "disk", src, dst, "--format", "RAW"))
+		}
+	}
+	return fmt.Errorf("converting a %s image requires qemu-img (brew install qemu)", filepath.Ext(src))
+}
+
+func runConversion(cmd *exec.Cmd) error {
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// copyMigratedFile copies src to dst with its permissions, sparsely.
+func copyMigratedFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := copySparse(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// flagDefaults are driver options holding the defaults of the create flags,
+// to configure a machine the way "docker-machine create" would without
+// flags.
+type flagDefaults map[string]interface{}
+
+func defaultDriverOptions(flags []mcnflag.Flag) drivers.DriverOptions {
+	defaults := flagDefaults{}
+	for _, f := range flags {
+		defaults[f.String()] = f.Default()
+	}
+	return defaults
+}
+
+func (f flagDefaults) String(key string) string {
+	s, _ := f[key].(string)
+	return s
+}
+
+func (f flagDefaults) StringSlice(key string) []string {
+	s, _ := f[key].([]string)
+	return s
+}
+
+func (f flagDefaults) Int(key string) int {
+	i, _ := f[key].(int)
+	return i
+}
+
+func (f flagDefaults) Bool(key string) bool {
+	b, _ := f[key].(bool)
+	return b
+}
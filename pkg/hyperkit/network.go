@@ -24,13 +24,16 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	DHCPLeasesFile = "/var/db/dhcpd_leases"
 	CONFIG_PLIST   = "/Library/Preferences/SystemConfiguration/com.apple.vmnet"
 	NET_ADDR_KEY   = "Shared_Net_Address"
+	NET_MASK_KEY   = "Shared_Net_Mask"
 )
 
 type DHCPEntry struct {
@@ -41,43 +44,85 @@ type DHCPEntry struct {
 	Lease     string
 }
 
+// leaseTrace writes timestamped lines to w, if any.
+type leaseTrace struct {
+	w io.Writer
+}
+
+func (t *leaseTrace) printf(format string, args ...interface{}) {
+	if t == nil || t.w == nil {
+		return
+	}
+	fmt.Fprintf(t.w, "%s %s\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
+
 func GetIPAddressByMACAddress(mac string) (string, error) {
-	return getIpAddressFromFile(mac, DHCPLeasesFile)
+	return getIpAddressFromFile(mac, DHCPLeasesFile, nil)
 }
 
-func getIpAddressFromFile(mac, path string) (string, error) {
+// getIpAddressFromFile looks mac up in the leases file at path, and records
+// its decisions to trace.
+func getIpAddressFromFile(mac, path string, trace *leaseTrace) (string, error) {
+	trace.printf("looking up %s in %s", mac, path)
 	file, err := os.Open(path)
 	if err != nil {
+		trace.printf("%v", err)
 		return "", err
 	}
 	defer file.Close()
 
-	dhcpEntries, err := parseDHCPdLeasesFile(file)
+	dhcpEntries, err := parseDHCPdLeasesFile(file, trace)
 	if err != nil {
+		trace.printf("%v", err)
 		return "", err
 	}
 	for _, dhcpEntry := range dhcpEntries {
-		if dhcpEntry.HWAddress == mac {
-			return dhcpEntry.IPAddress, nil
+		if dhcpEntry.HWAddress != mac {
+			trace.printf("rejected %s (%s %s): MAC mismatch", dhcpEntry.IPAddress, dhcpEntry.Name, dhcpEntry.HWAddress)
+			continue
 		}
+		if end, ok := leaseEnd(dhcpEntry.Lease); ok && end.Before(time.Now()) {
+			trace.printf("chose %s (%s), whose lease expired at %s", dhcpEntry.IPAddress, dhcpEntry.Name, end.Format(time.RFC3339))
+		} else {
+			trace.printf("chose %s (%s)", dhcpEntry.IPAddress, dhcpEntry.Name)
+		}
+		return dhcpEntry.IPAddress, nil
 	}
+	trace.printf("no entry for %s among %d", mac, len(dhcpEntries))
 	return "", fmt.Errorf("Could not find an IP address for %s", mac)
 }
 
-func parseDHCPdLeasesFile(file io.Reader) ([]DHCPEntry, error) {
+// leaseEnd parses the hexadecimal end time of a lease, e.g. 0x5f3d8b1a.
+func leaseEnd(lease string) (time.Time, bool) {
+	n, err := strconv.ParseInt(strings.TrimPrefix(lease, "0x"), 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(n, 0), true
+}
+
+func parseDHCPdLeasesFile(file io.Reader, trace *leaseTrace) ([]DHCPEntry, error) {
 	var (
 		dhcpEntry   *DHCPEntry
 		dhcpEntries []DHCPEntry
 	)
 
 	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
+	for n := 1; scanner.Scan(); n++ {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "{" {
 			dhcpEntry = new(DHCPEntry)
 			continue
 		} else if line == "}" {
-			dhcpEntries = append(dhcpEntries, *dhcpEntry)
+			if dhcpEntry != nil {
+				dhcpEntries = append(dhcpEntries, *dhcpEntry)
+			}
+			dhcpEntry = nil
+			continue
+		}
+		// bootpd may be rewriting the file: skip a truncated entry.
+		if dhcpEntry == nil {
+			trace.printf("skipped line %d %q outside of an entry", n, line)
 			continue
 		}
 
@@ -93,6 +138,9 @@ func parseDHCPdLeasesFile(file io.Reader) ([]DHCPEntry, error) {
 			dhcpEntry.IPAddress = val
 		case "hw_address":
 			// The mac addresses have a '1,' at the start.
+			if len(val) < 2 {
+				return nil, fmt.Errorf("invalid line in dhcp leases file: %s", line)
+			}
 			dhcpEntry.HWAddress = val[2:]
 		case "identifier":
 			dhcpEntry.ID = val
@@ -129,3 +177,25 @@ func GetNetAddr() (net.IP, error) {
 	}
 	return ip, nil
 }
+
+// GetNetMask returns the netmask of the vmnet shared network, defaulting to
+// 255.255.255.0 when vmnet doesn't record one.
+func GetNetMask() net.IPMask {
+	out, err := exec.Command("defaults", "read", CONFIG_PLIST, NET_MASK_KEY).Output()
+	if err == nil {
+		if ip := net.ParseIP(strings.TrimSpace(string(out))).To4(); ip != nil {
+			return net.IPMask(ip)
+		}
+	}
+	return net.CIDRMask(24, 32)
+}
+
+// GetSubnet returns the vmnet shared network.
+func GetSubnet() (*net.IPNet, error) {
+	ip, err := GetNetAddr()
+	if err != nil {
+		return nil, err
+	}
+	mask := GetNetMask()
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
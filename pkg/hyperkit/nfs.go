@@ -0,0 +1,453 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/helper"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// NFS export scopes
+const (
+	// nfsExportScopeIP exports shares to the current VM IP only.
+	nfsExportScopeIP = "ip"
+	// nfsExportScopeSubnet exports shares to the whole vmnet subnet.
+	nfsExportScopeSubnet = "subnet"
+)
+
+const (
+	exportsFile = "/etc/exports"
+
+	// chflags(2) flags preventing modifications of a file.
+	ufImmutable = 0x00000002
+	ufAppend    = 0x00000004
+	sfImmutable = 0x00020000
+	sfAppend    = 0x00040000
+)
+
+const (
+	// nfsMountTimeout bounds the attempts to mount a share in the guest.
+	nfsMountTimeout = 30 * time.Second
+	nfsMountBackoff = 2 * time.Second
+	// maxParallelMounts bounds the shares mounted concurrently, each over
+	// its own SSH connection.
+	maxParallelMounts = 4
+)
+
+// defaultNFSExportTemplate is the /etc/exports line of a share, see
+// nfsExport.
+const defaultNFSExportTemplate = "{{.Share}} {{.Target}} -alldirs {{.Map}}"
+
+// mountOwnerRegexp matches "owner[:group]" with names or numeric ids.
+var mountOwnerRegexp = regexp.MustCompile(`^([0-9]+|[a-z_][a-z0-9_-]*)(:([0-9]+|[a-z_][a-z0-9_-]*))?$`)
+
+// exportsImmutable tells whether /etc/exports can't be modified, which is
+// the case on Macs whose management profile locked it with chflags.
+func exportsImmutable() bool {
+	var st syscall.Stat_t
+	if err := syscall.Stat(exportsFile, &st); err != nil {
+		return false
+	}
+	return st.Flags&(ufImmutable|ufAppend|sfImmutable|sfAppend) != 0
+}
+
+// isExportsPermissionError tells whether err is a failure to modify
+// /etc/exports although the driver is privileged, or because sudo needs a
+// password, see runPrivileged.
+func isExportsPermissionError(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), syscall.EPERM.Error()) || strings.Contains(err.Error(), "a password is required"))
+}
+
+// validateNFSExportScope checks scope is "ip", "subnet" or a CIDR.
+func validateNFSExportScope(scope string) error {
+	switch scope {
+	case "", nfsExportScopeIP, nfsExportScopeSubnet:
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(scope); err != nil {
+		return fmt.Errorf("invalid NFS export scope %q: must be %q, %q or a CIDR", scope, nfsExportScopeIP, nfsExportScopeSubnet)
+	}
+	return nil
+}
+
+// validateMountOwner checks owner is empty or "owner[:group]".
+func validateMountOwner(owner string) error {
+	if owner != "" && !mountOwnerRegexp.MatchString(owner) {
+		return fmt.Errorf("invalid mount point owner %q: must be owner[:group]", owner)
+	}
+	return nil
+}
+
+// validateMountMode checks mode is empty or an octal file mode.
+func validateMountMode(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	if m, err := strconv.ParseUint(mode, 8, 32); err != nil || m > 07777 {
+		return fmt.Errorf("invalid mount point mode %q: must be an octal mode such as 0775", mode)
+	}
+	return nil
+}
+
+// mountPointCommand returns the guest command creating mountPoint and
+// giving it, and the parents created below NFSSharesRoot, the configured
+// owner and mode.
+func (d *Driver) mountPointCommand(mountPoint string) string {
+	command := "sudo mkdir -p " + shellQuote(mountPoint)
+	if d.NFSMountOwner == "" && d.NFSMountMode == "" {
+		return command
+	}
+	var dirs []string
+	root := path.Clean(d.NFSSharesRoot)
+	for p := mountPoint; p != "/" && p != "." && p != root; p = path.Dir(p) {
+		dirs = append(dirs, shellQuote(p))
+	}
+	if d.NFSMountOwner != "" {
+		command += fmt.Sprintf(" && sudo chown %s %s", d.NFSMountOwner, strings.Join(dirs, " "))
+	}
+	if d.NFSMountMode != "" {
+		command += fmt.Sprintf(" && sudo chmod %s %s", d.NFSMountMode, strings.Join(dirs, " "))
+	}
+	return command
+}
+
+// nfsExport is the data of the /etc/exports line template.
+type nfsExport struct {
+	// Share is the exported host directory.
+	Share string
+	// Target is the client specification of the export scope, the VM IP
+	// or "-network <address> -mask <mask>".
+	Target string
+	// IP is the VM IP.
+	IP string
+	// User, UID and GID are the invoking host user.
+	User string
+	UID  string
+	GID  string
+	// Map is the -mapall or -maproot option of the share, see nfsMapping.
+	Map string
+}
+
+// parseNFSExportTemplate parses text, or the default template when empty.
+func parseNFSExportTemplate(text string) (*template.Template, error) {
+	if text == "" || text == legacyNFSExportTemplate {
+		text = defaultNFSExportTemplate
+	}
+	t, err := template.New("export").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NFS export template: %v", err)
+	}
+	return t, nil
+}
+
+// validateNFSExportTemplate checks text renders an export line for the
+// invoking user. Whether the mapping suits a share is only known once it is
+// exported, see renderNFSExport.
+func validateNFSExportTemplate(text string) error {
+	if text == "" {
+		return nil
+	}
+	t, err := parseNFSExportTemplate(text)
+	if err != nil {
+		return err
+	}
+	u, err := user.Current()
+	if err != nil {
+		return err
+	}
+	options, err := renderNFSExportOptions(t, nfsExport{Share: "/Users", Target: "192.168.64.2", IP: "192.168.64.2", User: u.Username, UID: u.Uid, GID: u.Gid, Map: "-mapall=" + u.Username})
+	if err != nil || os.Getuid() == 0 {
+		return err
+	}
+	for _, opt := range strings.Fields(options) {
+		if root, err := helper.MapsToRoot(opt); err != nil {
+			return fmt.Errorf("invalid NFS export template: %v", err)
+		} else if root {
+			return fmt.Errorf("invalid NFS export template: the option %s maps to root", opt)
+		}
+	}
+	return nil
+}
+
+// renderNFSExport renders the /etc/exports line of e with t, see
+// renderNFSExportOptions, and returns it with the share quoted. Unless the
+// driver runs as root, the rendered line must map every access to the
+// invoking user with -mapall or export a share entirely owned by them, as a
+// template can leave the mapping out, see helper.ExportLine.
+func renderNFSExport(t *template.Template, e nfsExport) (string, error) {
+	options, err := renderNFSExportOptions(t, e)
+	if err != nil {
+		return "", err
+	}
+	line, err := helper.ExportLine(e.Share, options, os.Getuid())
+	if err != nil {
+		return "", fmt.Errorf("invalid NFS export of %s: %v", e.Share, err)
+	}
+	return line, nil
+}
+
+// renderNFSExportOptions renders the /etc/exports line of e with t and
+// returns the options following the share. The line must start with the
+// share.
+func renderNFSExportOptions(t *template.Template, e nfsExport) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, e); err != nil {
+		return "", fmt.Errorf("invalid NFS export template: %v", err)
+	}
+	line := strings.TrimSpace(b.String())
+	if line == "" || strings.ContainsAny(line, "\r\n") {
+		return "", fmt.Errorf("invalid NFS export template: it must render a single line, got %q", line)
+	}
+	options, err := exportOptions(e.Share, line)
+	if err != nil {
+		return "", fmt.Errorf("invalid NFS export template: %v", err)
+	}
+	return options, nil
+}
+
+// exportOptions returns the options following share in the export line.
+func exportOptions(share, line string) (string, error) {
+	for _, prefix := range []string{`"` + share + `"`, share} {
+		rest := strings.TrimPrefix(line, prefix)
+		if rest != line && (rest == "" || rest[0] == ' ' || rest[0] == '\t') {
+			return strings.TrimSpace(rest), nil
+		}
+	}
+	return "", fmt.Errorf("the NFS export line %q doesn't start with the share %s", line, share)
+}
+
+// nfsExportTarget returns the /etc/exports client specification for the
+// configured export scope.
+func (d *Driver) nfsExportTarget() (string, error) {
+	var network *net.IPNet
+	switch d.NFSExportScope {
+	case "", nfsExportScopeIP:
+		return d.IPAddress, nil
+	case nfsExportScopeSubnet:
+		subnet, err := GetSubnet()
+		if err != nil {
+			return "", err
+		}
+		network = subnet
+	default:
+		_, cidr, err := net.ParseCIDR(d.NFSExportScope)
+		if err != nil {
+			return "", err
+		}
+		network = cidr
+	}
+	if !network.Contains(net.ParseIP(d.IPAddress)) {
+		return "", fmt.Errorf("VM IP %s is outside of the NFS export network %s", d.IPAddress, network)
+	}
+	return fmt.Sprintf("-network %s -mask %s", network.IP, net.IP(network.Mask)), nil
+}
+
+// nfsMountPoint returns the guest mount point of the host directory share,
+// over NFS or sshfs.
+func (d *Driver) nfsMountPoint(share string) string {
+	if share == d.HomeShare {
+		return share
+	}
+	return path.Join(d.NFSSharesRoot, share)
+}
+
+// nfsMounted tells whether an NFS filesystem is mounted at mountPoint in the
+// guest.
+func (d *Driver) nfsMounted(mountPoint string) (bool, error) {
+	out, err := d.runSSHCommand(fmt.Sprintf(`awk -v p=%s '$2 == p && $3 ~ /^nfs/ { print "mounted" }' /proc/mounts`, shellQuote(mountPoint)))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) == "mounted", nil
+}
+
+// shareError is the failure to set up one share.
+type shareError struct {
+	Share string
+	Err   error
+}
+
+func (e *shareError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Share, e.Err)
+}
+
+// mountNFSShares mounts the exported shares missing in the guest, at most
+// maxParallelMounts at a time, and returns a shareError for each share that
+// couldn't be mounted.
+func (d *Driver) mountNFSShares(hostIP net.IP, shares []string) []error {
+	errs := make([]error, len(shares))
+	sem := make(chan struct{}, maxParallelMounts)
+	var wg sync.WaitGroup
+	for i, share := range shares {
+		wg.Add(1)
+		go func(i int, share string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := d.ensureNFSMount(hostIP, share); err != nil {
+				errs[i] = &shareError{Share: share, Err: err}
+			}
+		}(i, share)
+	}
+	wg.Wait()
+
+	var failed MultiError
+	for _, err := range errs {
+		failed.Collect(err)
+	}
+	return failed.Errors
+}
+
+// ensureNFSMount verifies the exported share is mounted in the guest and
+// mounts it otherwise, retrying for up to nfsMountTimeout.
+func (d *Driver) ensureNFSMount(hostIP net.IP, share string) error {
+	mountPoint := d.nfsMountPoint(share)
+	mount := func() error {
+		mounted, err := d.nfsMounted(mountPoint)
+		if err != nil {
+			return &RetriableError{Err: err}
+		}
+		if mounted {
+			return nil
+		}
+		log.Infof("Mounting %s at %s", share, mountPoint)
+		_, err = d.runSSHCommand(fmt.Sprintf("%s && sudo mount -t nfs -o noacl,async %s %s",
+			d.mountPointCommand(mountPoint), shellQuote(fmt.Sprintf("%s:%s", hostIP, share)), shellQuote(mountPoint)))
+		if err != nil {
+			return &RetriableError{Err: err}
+		}
+		if mounted, err = d.nfsMounted(mountPoint); err != nil || !mounted {
+			return &RetriableError{Err: fmt.Errorf("%s is not mounted", mountPoint)}
+		}
+		return nil
+	}
+	policy := RetryPolicy{Timeout: nfsMountTimeout, Backoff: ConstantBackoff(nfsMountBackoff)}
+	if err := Retry(policy, mount); err != nil {
+		return fmt.Errorf("mounting at %s: %v", mountPoint, err)
+	}
+	return nil
+}
+
+// RemountShares mounts the NFS shares missing in the running guest, e.g.
+// after it rebooted on its own.
+func (d *Driver) RemountShares() error {
+	if len(d.NFSShares) == 0 {
+		return nil
+	}
+	if pidFiles, _ := filepath.Glob(d.ResolveStorePath(sshfsPrefix + "*.pid")); len(pidFiles) > 0 {
+		return fmt.Errorf("the shares of %s are served over sshfs, restart the machine to remount them", d.MachineName)
+	}
+	hostIP, err := GetNetAddr()
+	if err != nil {
+		return err
+	}
+	var failed MultiError
+	failed.Errors = d.mountNFSShares(hostIP, d.hostShares())
+	return failed.ToError()
+}
+
+// hostShares returns the host directories of NFSShares, the relative ones
+// being resolved in the machine store.
+func (d *Driver) hostShares() []string {
+	var shares []string
+	for _, share := range d.NFSShares {
+		if !path.IsAbs(share) {
+			share = d.ResolveStorePath(share)
+		}
+		shares = append(shares, share)
+	}
+	return shares
+}
+
+// recordExportedShares records the shares exported over NFS, see
+// reconcileNFSShares.
+func (d *Driver) recordExportedShares(shares []string) {
+	if err := d.updateMetadata(func(m *MachineMetadata) {
+		m.ExportedShares = shares
+	}); err != nil {
+		log.Warnf("Failed to record the exported NFS shares: %v", err)
+	}
+}
+
+// reconcileNFSShares cleans up the shares exported by an earlier start that
+// are no longer configured, e.g. renamed ones: their exports are removed,
+// unless a clean stop already did, and their mount points unmounted and
+// removed in the guest when empty.
+func (d *Driver) reconcileNFSShares() error {
+	m, err := d.readMetadata()
+	if err != nil {
+		return err
+	}
+	configured := map[string]bool{}
+	for _, share := range d.hostShares() {
+		configured[share] = true
+	}
+	var kept, stale []string
+	for _, share := range m.ExportedShares {
+		if configured[share] {
+			kept = append(kept, share)
+		} else {
+			stale = append(stale, share)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	var failed MultiError
+	removed := false
+	for _, share := range stale {
+		log.Infof("Removing the NFS share %s, no longer configured", share)
+		if !exportsImmutable() {
+			err := d.removeShareExport(share)
+			switch {
+			case err == nil:
+				removed = true
+			case !strings.Contains(err.Error(), "find export"):
+				failed.Collect(&shareError{Share: share, Err: errors.Wrap(err, "removing the export")})
+			}
+		}
+		mountPoint := shellQuote(d.nfsMountPoint(share))
+		if _, err := d.runSSHCommand(fmt.Sprintf("sudo umount -f %s 2>/dev/null; sudo rmdir %s 2>/dev/null; true", mountPoint, mountPoint)); err != nil {
+			failed.Collect(&shareError{Share: share, Err: errors.Wrap(err, "unmounting")})
+		}
+	}
+	if removed {
+		if err := d.reloadNFS(); err != nil {
+			failed.Collect(err)
+		}
+	}
+	d.recordExportedShares(kept)
+	return failed.ToError()
+}
@@ -0,0 +1,164 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/helper"
+)
+
+// An NFS mapping chooses the host identity guest accesses to a share are
+// done as. By default every access is mapped to the invoking host user
+// (mapall); maproot only maps the guest root, e.g. to keep the ownership of
+// files written by non-root guest users. NFS passes the other guest uids
+// through, so unless the driver runs as root, a share not mapped to the host
+// user with mapall must entirely belong to them, see helper.ExportLine.
+const (
+	nfsMapAll  = "mapall"
+	nfsMapRoot = "maproot"
+	// nfsMapAnyShare is the share of the mapping applying to the shares
+	// without their own.
+	nfsMapAnyShare = "*"
+	// legacyNFSExportTemplate was the default template before .Map, stored
+	// in the configuration of the machines created then.
+	legacyNFSExportTemplate = "{{.Share}} {{.Target}} -alldirs -mapall={{.User}}"
+)
+
+// nfsMapEntryRegexp matches "<share>=mapall|maproot:<user>[:<group>]".
+var nfsMapEntryRegexp = regexp.MustCompile(`^(.+)=(mapall|maproot):([0-9]+|[A-Za-z_][A-Za-z0-9_.-]*)(:([0-9]+|[A-Za-z_][A-Za-z0-9_.-]*))?$`)
+
+// nfsMapping is the identity guest accesses to a share are mapped to.
+type nfsMapping struct {
+	Option string
+	User   string
+	Group  string
+}
+
+// exportOption returns the /etc/exports option of m.
+func (m nfsMapping) exportOption() string {
+	if m.Group == "" {
+		return fmt.Sprintf("-%s=%s", m.Option, m.User)
+	}
+	return fmt.Sprintf("-%s=%s:%s", m.Option, m.User, m.Group)
+}
+
+// parseNFSMap parses a "<share>=mapall|maproot:<user>[:<group>]" entry of
+// NFSMaps.
+func parseNFSMap(entry string) (string, nfsMapping, error) {
+	m := nfsMapEntryRegexp.FindStringSubmatch(entry)
+	if m == nil {
+		return "", nfsMapping{}, fmt.Errorf("invalid NFS mapping %q: must be <share>=mapall|maproot:<user>[:<group>]", entry)
+	}
+	mapping := nfsMapping{Option: m[2], User: m[3], Group: m[5]}
+	// Mapping the guest to root would let it write host files as root.
+	if os.Getuid() != 0 {
+		root, err := helper.MapsToRoot(mapping.exportOption())
+		if err != nil {
+			return "", nfsMapping{}, fmt.Errorf("invalid NFS mapping %q: %v", entry, err)
+		}
+		if root {
+			return "", nfsMapping{}, fmt.Errorf("invalid NFS mapping %q: only root may map to root or the wheel or admin groups", entry)
+		}
+	}
+	return m[1], mapping, nil
+}
+
+// validateNFSMaps checks the NFS mappings parse, are unique per share and
+// are rendered by the export template.
+func (d *Driver) validateNFSMaps() error {
+	if len(d.NFSMaps) == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, entry := range d.NFSMaps {
+		share, _, err := parseNFSMap(entry)
+		if err != nil {
+			return err
+		}
+		if seen[share] {
+			return fmt.Errorf("more than one NFS mapping for %s", share)
+		}
+		seen[share] = true
+	}
+	if t := d.NFSExportTemplate; t != "" && t != legacyNFSExportTemplate && !strings.Contains(t, ".Map") {
+		return fmt.Errorf("--%s requires an export template with {{.Map}}", flagNFSMap)
+	}
+	return nil
+}
+
+// nfsMapping returns the mapping of the host directory share: its own, the
+// one of all shares or the invoking host user u.
+func (d *Driver) nfsMapping(share string, u *user.User) nfsMapping {
+	mapping := nfsMapping{Option: nfsMapAll, User: u.Username}
+	for _, entry := range d.NFSMaps {
+		s, m, err := parseNFSMap(entry)
+		if err != nil {
+			continue
+		}
+		if s != nfsMapAnyShare && !path.IsAbs(s) {
+			s = d.ResolveStorePath(s)
+		}
+		switch s {
+		case share:
+			return m
+		case nfsMapAnyShare:
+			mapping = m
+		}
+	}
+	return mapping
+}
+
+// sshfsOwnerOptions returns the sshfs options showing the files of share
+// owned by its mapall identity in the guest. sshfs always writes them as
+// the host user, so maproot has no equivalent.
+func (d *Driver) sshfsOwnerOptions(share string) string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	m := d.nfsMapping(share, u)
+	if m.Option != nfsMapAll || m.User == u.Username {
+		return ""
+	}
+	uid, gid := m.User, m.Group
+	if mu, err := user.Lookup(uid); err == nil {
+		uid = mu.Uid
+		if gid == "" {
+			gid = mu.Gid
+		}
+	}
+	if g, err := user.LookupGroup(gid); err == nil {
+		gid = g.Gid
+	}
+	if _, err := strconv.Atoi(uid); err != nil {
+		return ""
+	}
+	options := ",uid=" + uid
+	if _, err := strconv.Atoi(gid); err == nil {
+		options += ",gid=" + gid
+	}
+	return options
+}
@@ -0,0 +1,140 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// The VM always has a vmnet interface, through which the host reaches it
+// and looks up its IP. A vpnkit interface can be added, see vpnkit.go.
+// hyperkit attaches at most one interface of each kind: the vpnkit one
+// comes first on the PCI bus, so that it is eth0 and the vmnet one eth1.
+
+// Network interface kinds
+const (
+	networkVMNet  = "vmnet"
+	networkVPNKit = "vpnkit"
+)
+
+// interfacesTimeout bounds the wait for the guest to answer over SSH when
+// listing its interfaces.
+const interfacesTimeout = 30 * time.Second
+
+// guestInterfacesScript prints the name, MAC and IPv4 of each ethernet
+// interface of the guest.
+const guestInterfacesScript = `for i in /sys/class/net/eth*; do
+n=${i##*/}
+printf '%s %s %s\n' "$n" "$(cat $i/address)" "$(ip -o -4 addr show dev $n | awk '{ sub("/.*", "", $4); print $4; exit }')"
+done`
+
+// setNetworks configures the network interfaces given as "vmnet" or
+// "vpnkit[:auto|managed|<socket>]", vmnet being attached anyway.
+func (d *Driver) setNetworks(networks []string) error {
+	var vmnet, vpnkit int
+	for _, network := range networks {
+		kind, arg := network, ""
+		if i := strings.IndexByte(network, ':'); i >= 0 {
+			kind, arg = network[:i], network[i+1:]
+		}
+		switch kind {
+		case networkVMNet:
+			if arg != "" {
+				return fmt.Errorf("invalid network %q: vmnet takes no argument", network)
+			}
+			vmnet++
+		case networkVPNKit:
+			if arg == "" {
+				arg = vpnkitAuto
+			}
+			if d.VPNKit != "" && d.VPNKit != arg {
+				return fmt.Errorf("network %q conflicts with --%s=%s", network, flagVPNKit, d.VPNKit)
+			}
+			d.VPNKit = arg
+			vpnkit++
+		default:
+			return fmt.Errorf("invalid network %q: must be %q or %q", network, networkVMNet, networkVPNKit+"[:auto|managed|<socket>]")
+		}
+	}
+	if vmnet > 1 || vpnkit > 1 {
+		return fmt.Errorf("hyperkit attaches at most one %s and one %s network interface", networkVMNet, networkVPNKit)
+	}
+	d.Networks = networks
+	return nil
+}
+
+// guestInterfaces lists the ethernet interfaces of the guest, telling the
+// vmnet one by its MAC address.
+func (d *Driver) guestInterfaces() ([]NetworkInterface, error) {
+	out, err := d.runSSHCommand(guestInterfacesScript)
+	if err != nil {
+		return nil, err
+	}
+	var interfaces []NetworkInterface
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		nic := NetworkInterface{Name: fields[0], MAC: fields[1]}
+		if len(fields) > 2 {
+			nic.IPv4 = fields[2]
+		}
+		switch {
+		case normalizeMACAddress(nic.MAC) == d.MACAddress:
+			nic.Network = networkVMNet
+		case d.VPNKit != "":
+			nic.Network = networkVPNKit
+		}
+		interfaces = append(interfaces, nic)
+	}
+	return interfaces, nil
+}
+
+// recordInterfaces records the interfaces of a multi-homed guest in the
+// machine metadata once it answers over SSH.
+func (d *Driver) recordInterfaces() {
+	if d.VPNKit == "" {
+		return
+	}
+	var interfaces []NetworkInterface
+	list := func() error {
+		var err error
+		if interfaces, err = d.guestInterfaces(); err != nil {
+			return &RetriableError{Err: err}
+		}
+		return nil
+	}
+	if err := Retry(RetryPolicy{Timeout: interfacesTimeout, Backoff: ConstantBackoff(2 * time.Second)}, list); err != nil {
+		log.Warnf("Listing the network interfaces of %s: %v", d.MachineName, err)
+		return
+	}
+	for _, nic := range interfaces {
+		log.Infof("Interface %s (%s) has MAC %s and IP %s", nic.Name, nic.Network, nic.MAC, nic.IPv4)
+	}
+	if err := d.updateMetadata(func(m *MachineMetadata) {
+		m.Interfaces = interfaces
+	}); err != nil {
+		log.Warnf("Failed to update machine metadata: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/notify"
+	"github.com/leoh0/machine/libmachine/state"
+	"github.com/pkg/errors"
+)
+
+// With Notify, the end of long operations (create, IP lookup) is posted to
+// the Notification Center, and a "crash-watch" process of the driver binary
+// managed alongside the VM notifies when hyperkit goes away without being
+// stopped.
+const (
+	notificationTitle  = "docker-machine"
+	crashWatchName     = "crash-watch"
+	crashWatchInterval = 2 * time.Second
+)
+
+// notify posts a notification about the machine if Notify is set.
+func (d *Driver) notify(format string, args ...interface{}) {
+	if !d.Notify {
+		return
+	}
+	if err := notify.Post(notificationTitle, fmt.Sprintf(format, args...)); err != nil {
+		log.Debugf("Posting notification: %v", err)
+	}
+}
+
+// startCrashWatch starts the crash watcher if Notify is set.
+func (d *Driver) startCrashWatch() error {
+	d.stopCrashWatch()
+	if !d.Notify {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, crashWatchName, d.ResolveStorePath(""))
+	if err := d.startManagedProcess(crashWatchName, cmd); err != nil {
+		return errors.Wrap(err, "starting crash watcher")
+	}
+	return nil
+}
+
+func (d *Driver) stopCrashWatch() {
+	d.stopManagedProcesses(crashWatchName)
+}
+
+// WatchCrash waits for the hyperkit of the machine stored in machineDir to
+// exit, and notifies if it wasn't being stopped.
+func WatchCrash(machineDir string) error {
+	d, err := LoadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	for {
+		s, err := d.processState()
+		if err != nil {
+			return err
+		}
+		if s == state.Stopped {
+			break
+		}
+		time.Sleep(crashWatchInterval)
+	}
+	m, err := d.readMetadata()
+	if err != nil {
+		return err
+	}
+	if m.Phase != phaseStopping {
+		log.Warnf("hyperkit of %s exited unexpectedly", d.MachineName)
+		d.notify("Machine %s stopped unexpectedly", d.MachineName)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// The guest user mirrors the host user (name, uid and primary gid) so that
+// files created through shares and exec sessions map cleanly to the host
+// identity. It is created by a script which cloud-init runs on first boot for
+// cloud images. boot2docker keeps its root filesystem in memory, so there the
+// script is run over SSH and hooked into bootsync.sh to recreate the user on
+// every boot.
+const (
+	boot2dockerGuestUserScript = "/var/lib/boot2docker/guest-user.sh"
+	boot2dockerBootSync        = "/var/lib/boot2docker/bootsync.sh"
+	cloudGuestUserScript       = "/var/lib/hyperkit/guest-user.sh"
+)
+
+var guestNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// guestUserScript works with both the busybox and the shadow-utils tools.
+var guestUserScript = template.Must(template.New("guest-user").Parse(`#!/bin/sh
+# Generated by docker-machine-driver-hyperkit
+set -e
+group=$(awk -F: '$3 == {{.GID}} { print $1 }' /etc/group | head -n 1)
+if [ -z "$group" ]; then
+	group={{.Group}}
+	groupadd -g {{.GID}} "$group" 2>/dev/null || addgroup -g {{.GID}} "$group"
+fi
+if ! grep -q '^{{.User}}:' /etc/passwd; then
+	useradd -m -u {{.UID}} -g "$group" -s /bin/sh {{.User}} 2>/dev/null || adduser -D -u {{.UID}} -G "$group" -s /bin/sh {{.User}}
+fi
+if grep -q '^docker:' /etc/group; then
+	usermod -aG docker {{.User}} 2>/dev/null || addgroup {{.User}} docker
+fi
+home=$(awk -F: '$1 == "{{.User}}" { print $6 }' /etc/passwd)
+mkdir -p "$home/.ssh"
+cat > "$home/.ssh/authorized_keys" <<'AUTHORIZED_KEYS'
+{{.AuthorizedKeys}}
+AUTHORIZED_KEYS
+chown -R {{.UID}}:{{.GID}} "$home/.ssh"
+chmod 700 "$home/.ssh"
+chmod 600 "$home/.ssh/authorized_keys"
+`))
+
+// setHostUser configures the guest user after the current host user.
+func (d *Driver) setHostUser() error {
+	u, err := user.Current()
+	if err != nil {
+		return errors.Wrap(err, "looking up the host user")
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		return errors.Wrap(err, "looking up the host group")
+	}
+	d.GuestUser = u.Username
+	d.GuestGroup = g.Name
+	if d.GuestUID, err = strconv.Atoi(u.Uid); err != nil {
+		return err
+	}
+	if d.GuestGID, err = strconv.Atoi(u.Gid); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateGuestUser checks the guest user can safely be put in a script.
+func (d *Driver) validateGuestUser() error {
+	if d.GuestUser == "" {
+		return nil
+	}
+	for _, name := range []string{d.GuestUser, d.GuestGroup} {
+		if !guestNameRegexp.MatchString(name) {
+			return fmt.Errorf("%q is not a valid guest user or group name", name)
+		}
+	}
+	if d.GuestUser == d.GetSSHUsername() || d.GuestUser == "root" {
+		return fmt.Errorf("the guest user %s already exists in the guest", d.GuestUser)
+	}
+	if d.GuestUID <= 0 || d.GuestGID <= 0 {
+		return fmt.Errorf("invalid guest user ids %d:%d", d.GuestUID, d.GuestGID)
+	}
+	return nil
+}
+
+// guestUserScriptContent returns the script creating the guest user, which
+// is authorized GuestAuthorizedKeys or else the machine SSH key.
+func (d *Driver) guestUserScriptContent() ([]byte, error) {
+	keysFile := d.GuestAuthorizedKeys
+	if keysFile == "" {
+		keysFile = d.GetSSHKeyPath() + ".pub"
+	}
+	keys, err := ioutil.ReadFile(keysFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the guest user authorized keys")
+	}
+
+	var b bytes.Buffer
+	err = guestUserScript.Execute(&b, map[string]interface{}{
+		"User":           d.GuestUser,
+		"UID":            d.GuestUID,
+		"Group":          d.GuestGroup,
+		"GID":            d.GuestGID,
+		"AuthorizedKeys": strings.TrimSpace(string(keys)),
+	})
+	return b.Bytes(), err
+}
+
+// personalizeGuest creates the guest user of a boot2docker machine and hooks
+// its creation into the following boots.
+func (d *Driver) personalizeGuest() error {
+	if d.GuestUser == "" || d.isCloudImage() {
+		return nil
+	}
+	script, err := d.guestUserScriptContent()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Creating guest user %s (%d:%d)", d.GuestUser, d.GuestUID, d.GuestGID)
+	if err := d.runBoot2DockerBootScript(boot2dockerGuestUserScript, script); err != nil {
+		return errors.Wrap(err, "creating the guest user")
+	}
+	return nil
+}
+
+// runBoot2DockerBootScript writes script to path in the guest, runs it and
+// hooks it into bootsync.sh so that it runs again on every boot.
+func (d *Driver) runBoot2DockerBootScript(path string, script []byte) error {
+	command := fmt.Sprintf("echo %s | base64 -d | sudo tee %s >/dev/null && "+
+		"(grep -qs %[2]s %[3]s || echo 'sh %[2]s' | sudo tee -a %[3]s >/dev/null) && "+
+		"sudo sh %[2]s",
+		base64.StdEncoding.EncodeToString(script), path, boot2dockerBootSync)
+	_, err := d.runSSHCommand(command)
+	return err
+}
@@ -0,0 +1,282 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/disk"
+	pkgdrivers "github.com/leoh0/docker-machine-driver-hyperkit/pkg/drivers"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/resolver"
+	hyperkit "github.com/moby/hyperkit/go"
+)
+
+// Plan is what a start of the machine would do, resolved from its
+// configuration without starting or changing anything, for debugging and
+// reviewing configuration changes.
+type Plan struct {
+	HyperKit   string   `json:"hyperkit"`
+	Kernel     string   `json:"kernel,omitempty"`
+	Initrd     string   `json:"initrd,omitempty"`
+	Bootrom    string   `json:"bootrom,omitempty"`
+	Cmdline    string   `json:"cmdline,omitempty"`
+	CPUs       int      `json:"cpus"`
+	Memory     int      `json:"memory"`
+	UUID       string   `json:"uuid"`
+	MACAddress string   `json:"mac_address,omitempty"`
+	Disks      []string `json:"disks"`
+	ISOImages  []string `json:"iso_images"`
+	// NICs are the network interfaces, "vmnet" or "vpnkit <socket>".
+	NICs       []string `json:"nics"`
+	VSockPorts []int    `json:"vsock_ports,omitempty"`
+	Console    string   `json:"console"`
+	ExtraArgs  []string `json:"extra_args,omitempty"`
+	// Exports are the /etc/exports entries added, by identifier.
+	Exports map[string]string `json:"exports,omitempty"`
+	// Processes are the managed processes started besides hyperkit.
+	Processes []string `json:"processes,omitempty"`
+	// Files are the host files written outside of the machine directory.
+	Files []string `json:"files,omitempty"`
+	// Notes are what the plan can't resolve before the start.
+	Notes []string `json:"notes,omitempty"`
+}
+
+// planVMIP stands for the IP address of a VM that never got one.
+const planVMIP = "<vm ip>"
+
+// Plan resolves what Start would do. Nothing is downloaded, extracted,
+// started or written.
+func (d *Driver) Plan() (*Plan, error) {
+	h, err := hyperkit.New(d.configuredHyperKit(), "", d.ResolveStorePath(""))
+	if err != nil && d.HyperKitBinaryURL == "" {
+		return nil, err
+	}
+	cmdline, err := d.bootCmdline()
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{
+		HyperKit:   d.configuredHyperKit(),
+		CPUs:       d.CPU,
+		Memory:     d.Memory,
+		UUID:       d.UUID,
+		MACAddress: d.MACAddress,
+		Console:    d.ConsoleMode,
+		NICs:       []string{"vmnet"},
+		ExtraArgs:  d.ExtraArgs,
+	}
+	if h != nil {
+		p.HyperKit = h.HyperKit
+	}
+	if _, err := os.Stat(p.HyperKit); d.HyperKitBinaryURL != "" && os.IsNotExist(err) {
+		p.Notes = append(p.Notes, fmt.Sprintf("hyperkit is downloaded from %s", d.HyperKitBinaryURL))
+	}
+	if p.Console == "" {
+		p.Console = consoleModeFile
+	}
+	if p.MACAddress == "" {
+		p.MACAddress = "derived from the UUID by vmnet"
+	}
+
+	if d.isUEFIBoot() {
+		if p.Bootrom, err = d.bootromPath(); err != nil {
+			return nil, err
+		}
+	} else {
+		p.Kernel, p.Initrd, p.Cmdline = d.bootPath(d.Vmlinuz), d.bootPath(d.Initrd), cmdline
+		if len(d.CustomizeFiles) > 0 && !d.isCloudImage() {
+			p.Initrd = d.ResolveStorePath(customInitrdFileName)
+			p.Notes = append(p.Notes, "the customized initrd is rebuilt")
+		}
+		if !d.hasCustomKernel() && !d.isCloudImage() {
+			p.Notes = append(p.Notes, "the kernel is extracted again if the boot ISO changed")
+		}
+	}
+
+	backend, err := disk.New(d.DiskBackend)
+	if err != nil {
+		return nil, err
+	}
+	p.Disks = []string{backend.Attach(pkgdrivers.GetDiskPath(d.BaseDriver), d.DiskSize).AsArgument()}
+	if d.isCloudImage() {
+		p.ISOImages = []string{d.ResolveStorePath(cloudInitSeedFileName)}
+	} else {
+		p.ISOImages = []string{d.bootPath(isoFilename)}
+	}
+	p.ISOImages = append(p.ISOImages, d.AttachISOs...)
+	if sock := d.vpnkitSocket(); sock != "" {
+		p.NICs = append(p.NICs, "vpnkit "+sock)
+	}
+	if d.VSock {
+		p.VSockPorts = d.VSockPorts
+	}
+
+	if err := d.planShares(p); err != nil {
+		return nil, err
+	}
+	if err := d.planProcesses(p); err != nil {
+		return nil, err
+	}
+	if d.ResolverDomain != "" {
+		p.Files = append(p.Files, filepath.Join(resolver.Dir, d.ResolverDomain))
+	}
+	if d.Supervise {
+		if agent, err := d.superviseAgentPath(); err == nil {
+			p.Files = append(p.Files, agent)
+		}
+	}
+	if d.VMNetSubnet != "" && d.VMNetSubnet != vmnetSubnetOff {
+		p.Notes = append(p.Notes, fmt.Sprintf("the vmnet network may be changed to %s when no VM uses it", d.VMNetSubnet))
+	}
+	return p, nil
+}
+
+// planShares adds the NFS exports, or the sshfs processes, of the shares
+// to p. The VM IP address is the last one known.
+func (d *Driver) planShares(p *Plan) error {
+	if len(d.NFSShares) == 0 {
+		return nil
+	}
+	if d.ShareMode == shareModeSSHFS {
+		for i := range d.NFSShares {
+			p.Processes = append(p.Processes, fmt.Sprintf("%s%d", sshfsPrefix, i))
+		}
+		return nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return err
+	}
+	t, err := parseNFSExportTemplate(d.NFSExportTemplate)
+	if err != nil {
+		return err
+	}
+	target, ip := planVMIP, d.IPAddress
+	if ip == "" {
+		ip = planVMIP
+		p.Notes = append(p.Notes, "the NFS exports name the IP address the VM gets")
+	}
+	if d.IPAddress != "" || (d.NFSExportScope != "" && d.NFSExportScope != nfsExportScopeIP) {
+		if target, err = d.nfsExportTarget(); err != nil {
+			return err
+		}
+	}
+	p.Exports = map[string]string{}
+	for _, share := range d.NFSShares {
+		if !path.IsAbs(share) {
+			share = d.ResolveStorePath(share)
+		}
+		entry, err := renderNFSExport(t, nfsExport{
+			Share:  share,
+			Target: target,
+			IP:     ip,
+			User:   u.Username,
+			UID:    u.Uid,
+			GID:    u.Gid,
+			Map:    d.nfsMapping(share, u).exportOption(),
+		})
+		if err != nil {
+			return err
+		}
+		p.Exports[d.nfsExportIdentifier(share)] = entry
+	}
+	p.Notes = append(p.Notes, "nfsd is reloaded, falling back to sshfs when /etc/exports can't be edited")
+	return nil
+}
+
+// planProcesses adds the managed processes a start runs to p.
+func (d *Driver) planProcesses(p *Plan) error {
+	add := func(enabled bool, name string) {
+		if enabled {
+			p.Processes = append(p.Processes, name)
+		}
+	}
+	add(d.VPNKit == vpnkitManaged, vpnkitName)
+	add(true, consoleLogName)
+	add(d.ConsoleMode == consoleModeSocket, consoleSocketName)
+	forwards, err := d.portForwards()
+	if err != nil {
+		return err
+	}
+	for _, f := range forwards {
+		add(true, portForwardName(f))
+	}
+	for i := range d.Companions {
+		add(true, companionName(i))
+	}
+	add(d.DiskMonitorInterval > 0, diskMonitorName)
+	add(d.KernelMonitorInterval > 0, kernelMonitorName)
+	add(d.MetricsAddress != "", metricsName)
+	add(d.StatusAddress != "", statusServerName)
+	add(d.WakeWatch, wakeWatchName)
+	add(d.TimeSync == timeSyncPeriodic, timeSyncName)
+	add(d.Notify, crashWatchName)
+	return nil
+}
+
+// Write prints p for humans.
+func (p *Plan) Write(w io.Writer) {
+	line := func(name string, value interface{}) {
+		fmt.Fprintf(w, "%-12s %v\n", name+":", value)
+	}
+	list := func(name string, values []string) {
+		if len(values) > 0 {
+			line(name, strings.Join(values, "\n             "))
+		}
+	}
+	line("hyperkit", p.HyperKit)
+	if p.Bootrom != "" {
+		line("bootrom", p.Bootrom)
+	} else {
+		line("kernel", p.Kernel)
+		line("initrd", p.Initrd)
+		line("cmdline", p.Cmdline)
+	}
+	line("cpus", p.CPUs)
+	line("memory", fmt.Sprintf("%dM", p.Memory))
+	line("uuid", p.UUID)
+	line("mac", p.MACAddress)
+	list("disks", p.Disks)
+	list("isos", p.ISOImages)
+	list("nics", p.NICs)
+	if len(p.VSockPorts) > 0 {
+		line("vsock", p.VSockPorts)
+	}
+	line("console", p.Console)
+	list("extra args", p.ExtraArgs)
+	var ids, exports []string
+	for id := range p.Exports {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		exports = append(exports, fmt.Sprintf("# %s\n             %s", id, p.Exports[id]))
+	}
+	list("exports", exports)
+	list("processes", p.Processes)
+	list("files", p.Files)
+	list("notes", p.Notes)
+}
@@ -0,0 +1,96 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/portforward"
+	"github.com/pkg/errors"
+)
+
+// Port forwards are served by "port-forward" processes of the driver binary
+// managed alongside the VM.
+const portForwardPrefix = "port-forward-"
+
+func validatePortForwards(specs []string) error {
+	hostPorts := map[string]string{}
+	for _, spec := range specs {
+		f, err := portforward.Parse(spec)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%d/%s", f.HostPort, f.Proto)
+		if other, ok := hostPorts[key]; ok {
+			return fmt.Errorf("port forwards %s and %s use the same host port", other, spec)
+		}
+		hostPorts[key] = spec
+	}
+	return nil
+}
+
+func portForwardName(f portforward.Forward) string {
+	return fmt.Sprintf("%s%d-%s", portForwardPrefix, f.HostPort, f.Proto)
+}
+
+// portForwards returns the configured port forwards, as started by
+// startPortForwards and listed by Plan.
+func (d *Driver) portForwards() ([]portforward.Forward, error) {
+	forwards := make([]portforward.Forward, 0, len(d.PortForwards))
+	for _, spec := range d.PortForwards {
+		f, err := portforward.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
+}
+
+// startPortForwards starts a proxy for each configured port forward to the
+// current VM IP.
+func (d *Driver) startPortForwards() error {
+	// Forwards left behind by a crash would keep the host ports busy.
+	d.stopPortForwards()
+	forwards, err := d.portForwards()
+	if err != nil || len(forwards) == 0 {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range forwards {
+		cmd := exec.Command(exe, "port-forward", f.String(), d.IPAddress)
+		if err := d.startManagedProcess(portForwardName(f), cmd); err != nil {
+			return errors.Wrapf(err, "starting port forward %s", f)
+		}
+		log.Infof("Forwarding localhost:%d to %s:%d/%s", f.HostPort, d.IPAddress, f.GuestPort, f.Proto)
+	}
+	return nil
+}
+
+// stopPortForwards terminates the running port forward proxies.
+func (d *Driver) stopPortForwards() {
+	d.stopManagedProcesses(portForwardPrefix)
+}
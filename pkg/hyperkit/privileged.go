@@ -0,0 +1,250 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/cpupriority"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/helper"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/lock"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/resolver"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/vmnetconf"
+	hyperkit "github.com/moby/hyperkit/go"
+)
+
+const helperInstallHint = "the privileged helper is not reachable on %s: %v. " +
+	"Install it with: sudo %s helper install"
+
+// exportsLock serializes the edits of /etc/exports and the nfsd reloads of
+// concurrent driver processes, see lock.HostPath.
+const exportsLock = "exports"
+
+// The privileged operations below are either performed directly, which
+// requires the driver to run as root, or delegated to the privileged helper
+// when the driver runs unprivileged.
+//
+// Each privileged operation must be allowed for the driver operation it is
+// performed for, see helper.Authorize. This guards against the driver doing
+// more than it should; the scope sent to the helper is claimed by the
+// client, so the helper relies on the peer credentials instead.
+
+func (d *Driver) helperClient() *helper.Client {
+	client := helper.NewClient("")
+	client.Scope = d.privilegeScope
+	return client
+}
+
+// enterPrivilegeScope makes scope the driver operation privileged operations
+// are performed for, until the returned function restores the previous one.
+func (d *Driver) enterPrivilegeScope(scope string) func() {
+	previous := d.privilegeScope
+	d.privilegeScope = scope
+	return func() {
+		d.privilegeScope = previous
+	}
+}
+
+// authorize rejects the privileged operation op unless the current driver
+// operation may perform it.
+func (d *Driver) authorize(op string) error {
+	if err := helper.Authorize(d.privilegeScope, op); err != nil {
+		log.Errorf("Rejecting privileged operation: %v", err)
+		return err
+	}
+	return nil
+}
+
+// checkPrivileges makes sure the driver can perform privileged operations.
+func (d *Driver) checkPrivileges() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	if d.PrivilegedHelper {
+		client := d.helperClient()
+		if err := client.Ping(); err != nil {
+			return fmt.Errorf(helperInstallHint, client.SocketPath, err, exe)
+		}
+		return nil
+	}
+
+	if syscall.Geteuid() != 0 {
+		return fmt.Errorf(permErr, filepath.Base(exe), exe, exe)
+	}
+	return nil
+}
+
+// startHyperKit starts the configured VM.
+func (d *Driver) startHyperKit(h *hyperkit.HyperKit) error {
+	if err := d.authorize(helper.OpStartVM); err != nil {
+		return err
+	}
+	cmdline, err := d.bootCmdline()
+	if err != nil {
+		return err
+	}
+	if !d.PrivilegedHelper {
+		// Setuid, the binary would be chosen by the user.
+		if realuser.Setuid() {
+			if err := helper.TrustedBinary(h.HyperKit); err != nil {
+				return err
+			}
+		}
+		if len(d.ExtraArgs) > 0 {
+			err = d.startWithExtraArgs(h, cmdline)
+		} else {
+			_, err = h.Start(cmdline)
+		}
+		if err != nil {
+			return err
+		}
+		if err := cpupriority.Apply(h.Pid, d.CPUPriority); err != nil {
+			log.Warnf("Setting the CPU priority of hyperkit: %v", err)
+		}
+		return nil
+	}
+
+	start := &helper.StartRequest{
+		HyperKit:    h.HyperKit,
+		StateDir:    h.StateDir,
+		Kernel:      h.Kernel,
+		Initrd:      h.Initrd,
+		Bootrom:     h.Bootrom,
+		Cmdline:     cmdline,
+		CPUs:        h.CPUs,
+		Memory:      h.Memory,
+		UUID:        h.UUID,
+		ISOImages:   h.ISOImages,
+		Serials:     h.Serials,
+		VSock:       h.VSock,
+		VSockPorts:  h.VSockPorts,
+		VPNKitSock:  h.VPNKitSock,
+		VPNKitUUID:  h.VPNKitUUID,
+		CPUPriority: d.CPUPriority,
+	}
+	for _, disk := range h.Disks {
+		raw, ok := disk.(*hyperkit.RawDisk)
+		if !ok {
+			return fmt.Errorf("disk %s is not supported by the privileged helper", disk)
+		}
+		start.Disks = append(start.Disks, helper.Disk{Path: raw.Path, Size: raw.Size, Trim: raw.Trim})
+	}
+
+	pid, err := d.helperClient().StartVM(start)
+	if err != nil {
+		return err
+	}
+	h.Pid = pid
+	return nil
+}
+
+func (d *Driver) signalHyperKit(pid int, s syscall.Signal) error {
+	if err := d.authorize(helper.OpSignal); err != nil {
+		return err
+	}
+	if d.PrivilegedHelper {
+		return d.helperClient().Signal(pid, s)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(s)
+}
+
+// addNFSExport adds the export line of share under identifier. The line is
+// built again from the share and the options following it, by the helper or
+// with its checks, see helper.AddExport.
+func (d *Driver) addNFSExport(identifier, share, export string) error {
+	if err := d.authorize(helper.OpAddExport); err != nil {
+		return err
+	}
+	options, err := exportOptions(share, export)
+	if err != nil {
+		return err
+	}
+	return lock.With(lock.HostPath(exportsLock), func() error {
+		if d.PrivilegedHelper {
+			return d.helperClient().AddExport(identifier, share, options)
+		}
+		return d.addExportEntry(identifier, share, options)
+	})
+}
+
+func (d *Driver) removeNFSExport(identifier string) error {
+	if err := d.authorize(helper.OpRemoveExport); err != nil {
+		return err
+	}
+	return lock.With(lock.HostPath(exportsLock), func() error {
+		if d.PrivilegedHelper {
+			return d.helperClient().RemoveExport(identifier)
+		}
+		return d.removeExportEntry(identifier)
+	})
+}
+
+func (d *Driver) reloadNFS() error {
+	if err := d.authorize(helper.OpReloadNFS); err != nil {
+		return err
+	}
+	return lock.With(lock.HostPath(exportsLock), func() error {
+		if d.PrivilegedHelper {
+			return d.helperClient().ReloadNFS()
+		}
+		return d.reloadNFSD()
+	})
+}
+
+func (d *Driver) writeResolver(domain, ip string) error {
+	if err := d.authorize(helper.OpWriteResolver); err != nil {
+		return err
+	}
+	if d.PrivilegedHelper {
+		return d.helperClient().WriteResolver(domain, ip)
+	}
+	return resolver.Write(domain, ip, os.Getuid())
+}
+
+func (d *Driver) removeResolver(domain string) error {
+	if err := d.authorize(helper.OpRemoveResolver); err != nil {
+		return err
+	}
+	if d.PrivilegedHelper {
+		return d.helperClient().RemoveResolver(domain)
+	}
+	return resolver.Remove(domain, os.Getuid())
+}
+
+func (d *Driver) setVMNetSubnet(subnet *net.IPNet) error {
+	if err := d.authorize(helper.OpSetVMNetSubnet); err != nil {
+		return err
+	}
+	if d.PrivilegedHelper {
+		return d.helperClient().SetVMNetSubnet(subnet.String())
+	}
+	return vmnetconf.Write(subnet)
+}
@@ -0,0 +1,132 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	ps "github.com/mitchellh/go-ps"
+)
+
+// Host processes managed alongside the VM (port forwards, companions) are
+// started detached in their own session, since the driver plugin only lives
+// for the duration of a docker-machine command. Their pids and executables
+// are tracked in <name>.pid files of the machine directory, so that a pid
+// reused by another process is left alone, and their output is appended to
+// <name>.log, in the scratch directory if any.
+
+// processStopTimeout is how long a managed process gets to exit after
+// SIGTERM before being killed.
+const processStopTimeout = 5 * time.Second
+
+// startManagedProcess starts cmd detached and records it under name. The
+// attributes of cmd, e.g. the credentials of realuser.Command, are kept.
+func (d *Driver) startManagedProcess(name string, cmd *exec.Cmd) error {
+	logFile, err := os.OpenFile(d.scratchPath(name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer cmd.Process.Release()
+
+	record := fmt.Sprintf("%d\n%s\n", cmd.Process.Pid, filepath.Base(cmd.Path))
+	return ioutil.WriteFile(d.ResolveStorePath(name+".pid"), []byte(record), 0644)
+}
+
+// managedProcessPid returns the pid recorded in pidFile, if the process
+// still runs the recorded executable.
+func managedProcessPid(pidFile string) (int, bool) {
+	b, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.SplitN(strings.TrimSpace(string(b)), "\n", 2)
+	if len(fields) != 2 {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	p, err := ps.FindProcess(pid)
+	if err != nil || p == nil {
+		return 0, false
+	}
+	// The process name may be truncated.
+	if p.Executable() == "" || !strings.HasPrefix(fields[1], p.Executable()) {
+		log.Debugf("Process %d runs %s, not the managed %s", pid, p.Executable(), fields[1])
+		return 0, false
+	}
+	return pid, true
+}
+
+// stopManagedProcesses terminates the process groups of the managed
+// processes whose name starts with prefix.
+func (d *Driver) stopManagedProcesses(prefix string) {
+	pidFiles, _ := filepath.Glob(d.ResolveStorePath(prefix + "*.pid"))
+	for _, pidFile := range pidFiles {
+		if pid, ok := managedProcessPid(pidFile); ok {
+			log.Debugf("Stopping %s (pid %d)", strings.TrimSuffix(filepath.Base(pidFile), ".pid"), pid)
+			stopProcessGroup(pid)
+		}
+		os.Remove(pidFile)
+	}
+}
+
+// managedProcessRunning tells whether the managed process name is running.
+func (d *Driver) managedProcessRunning(name string) bool {
+	_, ok := managedProcessPid(d.ResolveStorePath(name + ".pid"))
+	return ok
+}
+
+// stopProcessGroup sends SIGTERM to the process group led by pid, and
+// SIGKILL if it is still around after processStopTimeout.
+func stopProcessGroup(pid int) {
+	if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil {
+		return
+	}
+	deadline := time.Now().Add(processStopTimeout)
+	for time.Now().Before(deadline) {
+		if err := syscall.Kill(-pid, 0); err != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Warnf("Process group %d didn't exit after %s, killing it", pid, processStopTimeout)
+	syscall.Kill(-pid, syscall.SIGKILL)
+}
@@ -0,0 +1,167 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+	"github.com/pkg/errors"
+)
+
+// Provisioning scripts customize the guest once it is created, in their
+// order on the command line. Each is a local file, or else inline shell
+// commands, and runs with sh as the SSH user. Their output is kept in
+// provision/<n>-<name>.log of the machine directory.
+const (
+	provisionDir           = "provision"
+	provisionOnErrFail     = "fail"
+	provisionOnErrContinue = "continue"
+)
+
+var unsafeLogNameRegexp = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// validateProvisionOnError checks the failure handling of the provisioning
+// scripts.
+func validateProvisionOnError(onError string) error {
+	switch onError {
+	case "", provisionOnErrFail, provisionOnErrContinue:
+		return nil
+	}
+	return fmt.Errorf("invalid provisioning failure handling %q: must be %q or %q", onError, provisionOnErrFail, provisionOnErrContinue)
+}
+
+// provisionGuestScript runs the script read from its standard input, with
+// the standard input of the script itself closed.
+const provisionGuestScript = `f=$(mktemp) && cat > "$f" && sh "$f" < /dev/null; status=$?; rm -f "$f"; exit $status`
+
+// looksLikePath tells whether script, when no such file exists, is still
+// meant as a script file rather than inline commands: a single word holding
+// a "/" or ending in ".sh".
+func looksLikePath(script string) bool {
+	return !strings.ContainsAny(script, " \t\r\n") && (strings.Contains(script, "/") || strings.HasSuffix(script, ".sh"))
+}
+
+// resolveProvisionScripts makes the paths of the script files absolute, so
+// that they still resolve from the directory of a later command. A script
+// looking like a path must be an existing file.
+func resolveProvisionScripts(scripts []string) ([]string, error) {
+	resolved := make([]string, len(scripts))
+	for i, script := range scripts {
+		resolved[i] = script
+		fi, err := os.Stat(script)
+		switch {
+		case err == nil && fi.Mode().IsRegular():
+			if abs, err := filepath.Abs(script); err == nil {
+				resolved[i] = abs
+			}
+		case looksLikePath(script):
+			if err == nil {
+				err = fmt.Errorf("%s is not a regular file", script)
+			}
+			return nil, fmt.Errorf("invalid --%s: %v", flagProvisionScript, err)
+		}
+	}
+	return resolved, nil
+}
+
+// provisionScript returns the name and content of a provisioning script.
+// Script files are read with the privileges of the invoking user.
+func provisionScript(script string) (string, []byte, error) {
+	var content []byte
+	inline := false
+	err := realuser.Do(func() error {
+		fi, err := os.Stat(script)
+		if err != nil || !fi.Mode().IsRegular() {
+			if looksLikePath(script) {
+				if err == nil {
+					err = fmt.Errorf("%s is not a regular file", script)
+				}
+				return err
+			}
+			inline = true
+			return nil
+		}
+		content, err = ioutil.ReadFile(script)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if inline {
+		return "inline", []byte(script), nil
+	}
+	return filepath.Base(script), content, nil
+}
+
+// RunProvisionScripts runs the provisioning scripts in the guest, stopping
+// at the first failure unless ProvisionOnError is "continue".
+func (d *Driver) RunProvisionScripts() error {
+	if len(d.ProvisionScripts) == 0 {
+		return nil
+	}
+	dir := d.ResolveStorePath(provisionDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var failed MultiError
+	for i, script := range d.ProvisionScripts {
+		err := d.runProvisionScript(dir, i+1, script)
+		if err != nil {
+			if d.ProvisionOnError != provisionOnErrContinue {
+				return err
+			}
+			log.Warn(err)
+		}
+		failed.Collect(err)
+	}
+	if err := failed.ToError(); err != nil {
+		log.Warnf("%d of %d provisioning scripts failed, see %s", len(failed.Errors), len(d.ProvisionScripts), dir)
+	}
+	return nil
+}
+
+// runProvisionScript runs the n-th provisioning script in the guest and
+// logs its output in dir.
+func (d *Driver) runProvisionScript(dir string, n int, script string) error {
+	name, content, err := provisionScript(script)
+	if err != nil {
+		return errors.Wrapf(err, "reading provisioning script %d", n)
+	}
+	logPath := filepath.Join(dir, fmt.Sprintf("%02d-%s.log", n, unsafeLogNameRegexp.ReplaceAllString(name, "_")))
+	log.Infof("Running provisioning script %d (%s)", n, name)
+
+	// The script goes over the standard input, which has no size limit
+	// unlike the command line.
+	output, runErr := d.runSSHCommandWithInput(provisionGuestScript, content)
+	if err := ioutil.WriteFile(logPath, []byte(output), 0644); err != nil {
+		log.Warnf("Writing %s: %v", logPath, err)
+	}
+	if runErr != nil {
+		lines := strings.Split(strings.TrimSpace(output), "\n")
+		return fmt.Errorf("provisioning script %d (%s) failed: %s, see %s", n, name, lines[len(lines)-1], logPath)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// The proxy settings are handed to the guest docker daemon on every start,
+// through a block of /var/lib/boot2docker/profile for boot2docker and a
+// systemd drop-in for cloud images. The daemon is only restarted when they
+// changed.
+const (
+	proxyBlockBegin    = "# BEGIN docker-machine-driver-hyperkit proxy"
+	proxyBlockEnd      = "# END docker-machine-driver-hyperkit proxy"
+	boot2dockerProfile = "/var/lib/boot2docker/profile"
+	dockerProxyDropIn  = "/etc/systemd/system/docker.service.d/hyperkit-proxy.conf"
+)
+
+// boot2dockerProxyScript replaces the proxy block of the profile by the
+// block given as its first argument.
+const boot2dockerProxyScript = `block=%s
+old=$(sed -n '/^%[3]s$/,/^%[4]s$/p' %[2]s 2>/dev/null)
+[ "$old" = "$block" ] && exit 0
+touch %[2]s
+sed -i '/^%[3]s$/,/^%[4]s$/d' %[2]s
+[ -n "$block" ] && printf '%%s\n' "$block" >> %[2]s
+/etc/init.d/docker restart
+`
+
+// dropInProxyScript replaces the systemd drop-in by the one given as its
+// first argument.
+const dropInProxyScript = `conf=%s
+old=$(cat %[2]s 2>/dev/null)
+[ "$old" = "$conf" ] && exit 0
+if [ -n "$conf" ]; then
+  mkdir -p $(dirname %[2]s) && printf '%%s\n' "$conf" > %[2]s
+else
+  rm -f %[2]s
+fi
+systemctl daemon-reload
+systemctl try-restart docker
+`
+
+// proxySettings are the proxy environment of the guest docker daemon.
+type proxySettings struct {
+	HTTP    string
+	HTTPS   string
+	NoProxy []string
+}
+
+// empty tells whether no proxy is set.
+func (p proxySettings) empty() bool {
+	return p.HTTP == "" && p.HTTPS == ""
+}
+
+// environment returns the variables of the settings, in a stable order.
+func (p proxySettings) environment() [][2]string {
+	if p.empty() {
+		return nil
+	}
+	var env [][2]string
+	if p.HTTP != "" {
+		env = append(env, [2]string{"HTTP_PROXY", p.HTTP})
+	}
+	if p.HTTPS != "" {
+		env = append(env, [2]string{"HTTPS_PROXY", p.HTTPS})
+	}
+	if len(p.NoProxy) > 0 {
+		env = append(env, [2]string{"NO_PROXY", strings.Join(p.NoProxy, ",")})
+	}
+	return env
+}
+
+// validateProxy checks proxy is empty or a URL with a host.
+func validateProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid proxy %q: must be a URL like http://proxy.example.com:3128", proxy)
+	}
+	return nil
+}
+
+// proxySettings returns the proxy settings of the guest: the flags, else
+// with SystemProxy the proxy environment of the driver or the macOS system
+// proxy. The guest itself is always excluded.
+func (d *Driver) proxySettings() proxySettings {
+	p := proxySettings{HTTP: d.HTTPProxy, HTTPS: d.HTTPSProxy}
+	noProxy := d.NoProxy
+	if d.SystemProxy {
+		sys := hostProxySettings()
+		if p.HTTP == "" {
+			p.HTTP = sys.HTTP
+		}
+		if p.HTTPS == "" {
+			p.HTTPS = sys.HTTPS
+		}
+		noProxy = append(noProxy, sys.NoProxy...)
+	}
+	if p.empty() {
+		return p
+	}
+	for _, proxy := range []string{p.HTTP, p.HTTPS} {
+		if u, err := url.Parse(proxy); err == nil && isLoopback(u.Hostname()) {
+			log.Warnf("Proxy %s is on the loopback interface of the host, which the guest can't reach", proxy)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, host := range append(noProxy, "localhost", "127.0.0.1", d.IPAddress) {
+		if host != "" && !seen[host] {
+			seen[host] = true
+			p.NoProxy = append(p.NoProxy, host)
+		}
+	}
+	return p
+}
+
+// isLoopback tells whether host names the loopback interface.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// hostProxySettings returns the proxy environment of the driver, or the
+// macOS system proxy without one.
+func hostProxySettings() proxySettings {
+	p := proxySettings{
+		HTTP:    getenvAny("HTTP_PROXY", "http_proxy"),
+		HTTPS:   getenvAny("HTTPS_PROXY", "https_proxy"),
+		NoProxy: splitNoProxy(getenvAny("NO_PROXY", "no_proxy")),
+	}
+	if !p.empty() {
+		return p
+	}
+	out, err := exec.Command("scutil", "--proxy").Output()
+	if err != nil {
+		log.Debugf("Reading the system proxy: %v", err)
+		return p
+	}
+	return parseSystemProxy(out)
+}
+
+// getenvAny returns the first of the environment variables set.
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// splitNoProxy splits a NO_PROXY list.
+func splitNoProxy(s string) []string {
+	var hosts []string
+	for _, host := range strings.Split(s, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// parseSystemProxy parses the output of scutil --proxy, e.g.
+//
+//	<dictionary> {
+//	  ExceptionsList : <array> {
+//	    0 : *.local
+//	  }
+//	  HTTPEnable : 1
+//	  HTTPPort : 3128
+//	  HTTPProxy : proxy.example.com
+//	}
+func parseSystemProxy(out []byte) proxySettings {
+	values := make(map[string]string)
+	var p proxySettings
+	inExceptions := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "}" {
+			inExceptions = false
+			continue
+		}
+		parts := strings.SplitN(line, " : ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch {
+		case inExceptions:
+			p.NoProxy = append(p.NoProxy, parts[1])
+		case parts[0] == "ExceptionsList":
+			inExceptions = true
+		default:
+			values[parts[0]] = parts[1]
+		}
+	}
+	proxy := func(kind string) string {
+		if values[kind+"Enable"] != "1" || values[kind+"Proxy"] == "" {
+			return ""
+		}
+		hostPort := values[kind+"Proxy"]
+		if port := values[kind+"Port"]; port != "" {
+			hostPort = net.JoinHostPort(hostPort, port)
+		}
+		return "http://" + hostPort
+	}
+	p.HTTP = proxy("HTTP")
+	p.HTTPS = proxy("HTTPS")
+	return p
+}
+
+// proxyScript returns the guest script installing the proxy settings p.
+func (d *Driver) proxyScript(p proxySettings) string {
+	var b strings.Builder
+	env := p.environment()
+	if d.isCloudImage() {
+		if len(env) > 0 {
+			b.WriteString("[Service]\n")
+			for _, kv := range env {
+				fmt.Fprintf(&b, "Environment=\"%s=%s\"\n", kv[0], kv[1])
+			}
+		}
+		return fmt.Sprintf(dropInProxyScript, shellQuote(strings.TrimSuffix(b.String(), "\n")), dockerProxyDropIn)
+	}
+	if len(env) > 0 {
+		b.WriteString(proxyBlockBegin + "\n")
+		for _, kv := range env {
+			fmt.Fprintf(&b, "export %s=%s\n", kv[0], shellQuote(kv[1]))
+		}
+		b.WriteString(proxyBlockEnd)
+	}
+	return fmt.Sprintf(boot2dockerProxyScript, shellQuote(b.String()), boot2dockerProfile, proxyBlockBegin, proxyBlockEnd)
+}
+
+// configureGuestProxy hands the proxy settings to the guest docker daemon,
+// or removes the ones of an earlier start.
+func (d *Driver) configureGuestProxy() error {
+	p := d.proxySettings()
+	if !p.empty() {
+		log.Infof("Configuring the guest proxy")
+	}
+	command := fmt.Sprintf("sudo sh -c %s", shellQuote(d.proxyScript(p)))
+	_, err := d.runSSHCommand(command)
+	return err
+}
@@ -0,0 +1,163 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/machine/libmachine/state"
+	"github.com/pkg/errors"
+)
+
+// A hyperkit left behind by a crashed driver, or whose pid file was lost,
+// keeps the UUID, and thus the vmnet interface, of the machine and makes the
+// next start fail. Such orphans are found by their command line, killed,
+// and the sockets and tty links they left in the machine directory removed
+// before a new hyperkit is started.
+
+// reapTimeout bounds the wait for a killed orphan to exit.
+const reapTimeout = 5 * time.Second
+
+// hyperKitProcess is a hyperkit process of the host.
+type hyperKitProcess struct {
+	Pid  int
+	Args []string
+}
+
+// listHyperKitProcesses returns the hyperkit processes of the host.
+func listHyperKitProcesses() ([]hyperKitProcess, error) {
+	out, err := exec.Command("ps", "-axww", "-o", "pid=,args=").Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing processes")
+	}
+	var procs []hyperKitProcess
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.Contains(filepath.Base(fields[1]), "hyperkit") {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		procs = append(procs, hyperKitProcess{Pid: pid, Args: fields[1:]})
+	}
+	return procs, nil
+}
+
+// belongsTo tells whether p runs the VM with uuid, or writes its pid file to
+// pidFile.
+func (p hyperKitProcess) belongsTo(uuid, pidFile string) bool {
+	for i := 0; i+1 < len(p.Args); i++ {
+		switch {
+		case p.Args[i] == "-U" && strings.EqualFold(p.Args[i+1], uuid):
+			return true
+		case p.Args[i] == "-F" && p.Args[i+1] == pidFile:
+			return true
+		}
+	}
+	return false
+}
+
+// reapOrphans kills the hyperkit processes of the machine other than the
+// one of its pid file, and removes the stale sockets and tty links once no
+// hyperkit of the machine is left.
+func (d *Driver) reapOrphans() error {
+	procs, err := listHyperKitProcesses()
+	if err != nil {
+		return err
+	}
+	current := d.getPid()
+	pidFile := d.ResolveStorePath(pidFileName)
+	for _, p := range procs {
+		if p.Pid == current || !p.belongsTo(d.UUID, pidFile) {
+			continue
+		}
+		log.Warnf("Killing orphaned hyperkit %d of %s", p.Pid, d.MachineName)
+		if err := d.signalHyperKit(p.Pid, syscall.SIGKILL); err != nil {
+			return errors.Wrapf(err, "killing orphaned hyperkit %d", p.Pid)
+		}
+		waitForExit(p.Pid, reapTimeout)
+	}
+
+	if current != 0 {
+		if s, err := d.processState(); err == nil && s != state.Stopped {
+			return nil
+		}
+	}
+	d.removeStaleFiles()
+	return nil
+}
+
+// waitForExit waits for up to timeout for process pid to exit.
+func waitForExit(pid int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Warnf("hyperkit %d didn't exit after %s", pid, timeout)
+}
+
+// removeStaleFiles removes the unix sockets and the console tty links left
+// in the machine directory by a hyperkit which is gone.
+func (d *Driver) removeStaleFiles() {
+	dir := d.ResolveStorePath("")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		stale := e.Mode()&os.ModeSocket != 0
+		if e.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Readlink(path); err == nil && strings.HasPrefix(target, "/dev/tty") {
+				stale = true
+			}
+		}
+		// The sockets of managed processes are theirs to remove.
+		if !stale || d.managedSocket(e.Name()) {
+			continue
+		}
+		log.Debugf("Removing stale %s", path)
+		os.Remove(path)
+	}
+}
+
+// managedSocket tells whether name is a socket served by a running managed
+// process.
+func (d *Driver) managedSocket(name string) bool {
+	switch name {
+	case consoleSocketFileName:
+		return d.managedProcessRunning(consoleSocketName)
+	case vpnkitEthernetSock, vpnkitPortSock:
+		return d.managedProcessRunning(vpnkitName)
+	}
+	return false
+}
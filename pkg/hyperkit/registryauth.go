@@ -0,0 +1,291 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+)
+
+// The registry credentials of the host, or of a given Docker client
+// configuration, can be copied into the guest on every start, so that pulls
+// from inside the guest work without a docker login there. Credentials kept
+// by a credential helper, e.g. the macOS Keychain, are looked up with it.
+// They are sent over the standard input of SSH and merged, readable by
+// their owner only, into the Docker configuration of the SSH user and root,
+// whose other registries and settings are kept.
+
+// registryAuthHost selects all the registries of the host configuration.
+const registryAuthHost = "host"
+
+// guestDockerConfigs are the Docker configurations of the guest the
+// credentials are merged into. read prints the configuration, if any, and
+// write installs the one read from its standard input.
+var guestDockerConfigs = []struct {
+	read, write string
+}{
+	{
+		read:  `cat ~/.docker/config.json 2>/dev/null || true`,
+		write: `umask 077 && mkdir -p ~/.docker && cat > ~/.docker/config.json.new && mv ~/.docker/config.json.new ~/.docker/config.json`,
+	},
+	{
+		read:  `sudo cat /root/.docker/config.json 2>/dev/null || true`,
+		write: `sudo sh -c 'umask 077 && mkdir -p /root/.docker && cat > /root/.docker/config.json.new && mv /root/.docker/config.json.new /root/.docker/config.json'`,
+	},
+}
+
+// dockerConfig is the subset of a Docker client configuration holding
+// registry credentials.
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
+}
+
+// dockerAuth are the credentials of a registry.
+type dockerAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// credentialHelperOutput is what "docker-credential-<helper> get" prints.
+type credentialHelperOutput struct {
+	Username string
+	Secret   string
+}
+
+// hostDockerConfigPath returns the Docker client configuration of the host
+// user.
+func hostDockerConfigPath() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker", "config.json"), nil
+}
+
+// readDockerConfig reads the Docker client configuration at path.
+func readDockerConfig(path string) (*dockerConfig, error) {
+	// The driver binary may be setuid root: read the file as the invoking
+	// user.
+	var b []byte
+	err := realuser.Do(func() (err error) {
+		b, err = ioutil.ReadFile(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	config := &dockerConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// resolve returns the credentials of the registries of config selected by
+// registries, all of them when nil, asking the credential helpers for
+// those they keep.
+func (c *dockerConfig) resolve(registries map[string]bool) map[string]dockerAuth {
+	names := make(map[string]bool)
+	for name := range c.Auths {
+		names[name] = true
+	}
+	for name := range c.CredHelpers {
+		names[name] = true
+	}
+
+	auths := make(map[string]dockerAuth)
+	for name := range names {
+		if registries != nil && !registries[name] {
+			continue
+		}
+		auth := c.Auths[name]
+		if auth.Auth == "" && auth.IdentityToken == "" {
+			helper := c.CredHelpers[name]
+			if helper == "" {
+				helper = c.CredsStore
+			}
+			if helper == "" {
+				continue
+			}
+			var err error
+			if auth, err = helperCredentials(helper, name); err != nil {
+				log.Warnf("Getting the credentials of %s from docker-credential-%s: %v", name, helper, err)
+				continue
+			}
+		}
+		auths[name] = auth
+	}
+	return auths
+}
+
+// helperCredentials asks the credential helper for those of registry.
+func helperCredentials(helper, registry string) (dockerAuth, error) {
+	// The driver binary may be setuid root: run the helper as the invoking
+	// user.
+	cmd := realuser.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = bytes.NewBufferString(registry)
+	out, err := cmd.Output()
+	if err != nil {
+		return dockerAuth{}, err
+	}
+	var creds credentialHelperOutput
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return dockerAuth{}, err
+	}
+	// Helpers return identity tokens with this user name.
+	if creds.Username == "<token>" {
+		return dockerAuth{IdentityToken: creds.Secret}, nil
+	}
+	return dockerAuth{Auth: base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Secret))}, nil
+}
+
+// registryAuths returns the registry credentials for the guest, those of
+// RegistryAuthFile taking precedence over the host ones.
+func (d *Driver) registryAuths() (map[string]dockerAuth, error) {
+	auths := make(map[string]dockerAuth)
+	if len(d.RegistryAuth) > 0 {
+		var registries map[string]bool
+		for _, name := range d.RegistryAuth {
+			if name == registryAuthHost {
+				registries = nil
+				break
+			}
+			if registries == nil {
+				registries = make(map[string]bool)
+			}
+			registries[name] = true
+		}
+		path, err := hostDockerConfigPath()
+		if err != nil {
+			return nil, err
+		}
+		config, err := readDockerConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		for name, auth := range config.resolve(registries) {
+			auths[name] = auth
+		}
+	}
+	if d.RegistryAuthFile != "" {
+		config, err := readDockerConfig(d.RegistryAuthFile)
+		if err != nil {
+			return nil, err
+		}
+		for name, auth := range config.resolve(nil) {
+			auths[name] = auth
+		}
+	}
+	return auths, nil
+}
+
+// configureRegistryAuth copies the registry credentials into the guest.
+func (d *Driver) configureRegistryAuth() error {
+	if len(d.RegistryAuth) == 0 && d.RegistryAuthFile == "" {
+		return nil
+	}
+	auths, err := d.registryAuths()
+	if err != nil {
+		return err
+	}
+	if len(auths) == 0 {
+		log.Warnf("No registry credentials found to copy into the guest")
+		return nil
+	}
+	names := make([]string, 0, len(auths))
+	for name := range auths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Infof("Copying the credentials of %v into the guest", names)
+
+	for _, c := range guestDockerConfigs {
+		existing, err := d.readGuestDockerConfig(c.read)
+		if err != nil {
+			return err
+		}
+		config, err := mergeDockerConfig(existing, auths)
+		if err != nil {
+			return err
+		}
+		if _, err := d.runSSHCommandWithInput(c.write, config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readGuestDockerConfig returns the guest Docker configuration printed by
+// command, without logging the credentials it holds.
+func (d *Driver) readGuestDockerConfig(command string) ([]byte, error) {
+	session, err := d.newSSHSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	out, err := session.Output(command)
+	if err != nil {
+		return nil, fmt.Errorf("reading the guest Docker configuration: %v", err)
+	}
+	return out, nil
+}
+
+// mergeDockerConfig sets the credentials of auths in the Docker
+// configuration existing, keeping its other registries and settings.
+func mergeDockerConfig(existing []byte, auths map[string]dockerAuth) ([]byte, error) {
+	config := make(map[string]json.RawMessage)
+	if len(bytes.TrimSpace(existing)) > 0 {
+		if err := json.Unmarshal(existing, &config); err != nil {
+			return nil, fmt.Errorf("parsing the guest Docker configuration: %v", err)
+		}
+	}
+	merged := make(map[string]json.RawMessage)
+	if raw, ok := config["auths"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &merged); err != nil {
+			return nil, fmt.Errorf("parsing the auths of the guest Docker configuration: %v", err)
+		}
+	}
+	for name, auth := range auths {
+		raw, err := json.Marshal(auth)
+		if err != nil {
+			return nil, err
+		}
+		merged[name] = raw
+	}
+	raw, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	config["auths"] = raw
+	return json.MarshalIndent(config, "", "\t")
+}
@@ -0,0 +1,176 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// maxCPUs is the vCPU limit of hyperkit (VM_MAXCPU).
+const maxCPUs = 16
+
+// memorySizeRegexp matches a memory size: a number of MB, or of GB with
+// a "g" suffix, e.g. "4096", "4096m" or "4g".
+var memorySizeRegexp = regexp.MustCompile(`^(\d+)\s*(|m|mb|mib|g|gb|gib)$`)
+
+// parseMemorySize parses a memory size in MB (1024 KB) as written in
+// --hyperkit-memory.
+func parseMemorySize(value string) (int, error) {
+	m := memorySizeRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(value)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid memory size %q: must be a number of MB, optionally suffixed with m or g (e.g. 4096m or 4g)", value)
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory size %q: %v", value, err)
+	}
+	if strings.HasPrefix(m[2], "g") {
+		n *= 1024
+	}
+	return n, nil
+}
+
+// hostSysctl returns the integer value of the sysctl name.
+func hostSysctl(name string) (uint64, error) {
+	out, err := exec.Command("sysctl", "-n", name).Output()
+	if err != nil {
+		return 0, fmt.Errorf("sysctl %s: %v", name, err)
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// hostAvailableMemory returns the memory the host can hand out without
+// swapping, in bytes: the free, inactive and speculative pages of vm_stat.
+func hostAvailableMemory() (uint64, error) {
+	out, err := exec.Command("vm_stat").Output()
+	if err != nil {
+		return 0, fmt.Errorf("vm_stat: %v", err)
+	}
+	pageSize := uint64(4096)
+	var pages uint64
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "page size of "); i >= 0 {
+			if n, err := strconv.ParseUint(strings.Fields(line[i+len("page size of "):])[0], 10, 64); err == nil {
+				pageSize = n
+			}
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "Pages free", "Pages inactive", "Pages speculative":
+			n, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(parts[1]), "."), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("unexpected vm_stat line %q", line)
+			}
+			pages += n
+		}
+	}
+	return pages * pageSize, nil
+}
+
+// checkHostResources rejects a CPU count or memory size the host can't
+// provide, before hyperkit fails on them, and warns when the memory would
+// push the host into swapping.
+func (d *Driver) checkHostResources() error {
+	if cpus, err := hostSysctl("hw.logicalcpu"); err != nil {
+		log.Warnf("Cannot read the CPU count of the host: %v", err)
+	} else if uint64(d.CPU) > cpus {
+		return fmt.Errorf("--%s=%d exceeds the %d CPUs of the host: lower it to %d or less", flagCPUCount, d.CPU, cpus, cpus)
+	}
+
+	memory := uint64(d.Memory) * 1024 * 1024
+	total, err := hostSysctl("hw.memsize")
+	if err != nil {
+		log.Warnf("Cannot read the memory size of the host: %v", err)
+		return nil
+	}
+	if memory >= total {
+		return fmt.Errorf("--%s=%dm exceeds the %dm of memory of the host: lower it, e.g. to %dm", flagMemory, d.Memory, total/1024/1024, total/1024/1024/2)
+	}
+	available, err := hostAvailableMemory()
+	if err != nil {
+		log.Warnf("Cannot read the available memory of the host: %v", err)
+		return nil
+	}
+	if memory > available {
+		log.Warnf("The %dm of memory of the VM exceed the %dm the host has available, the host may swap until other applications are closed", d.Memory, available/1024/1024)
+	}
+	return nil
+}
+
+const (
+	// autoMaxMemory caps the memory set by AutoResources, in MB.
+	autoMaxMemory = 8 * 1024
+	// autoMaxDiskSize caps the disk size set by AutoResources, in MB.
+	autoMaxDiskSize = 64 * 1000
+)
+
+// autoSizeResources sets the CPU count, memory and disk size left to their
+// defaults from the host: half its CPUs, half its memory up to
+// autoMaxMemory, and a quarter of the free space of the store up to
+// autoMaxDiskSize, never less than the defaults for the disk. As disk
+// images are sparse by default, the disk size is only a maximum.
+func (d *Driver) autoSizeResources() {
+	if d.CPU == defaultCPUs {
+		if cpus, err := hostSysctl("hw.logicalcpu"); err != nil {
+			log.Warnf("Cannot read the CPU count of the host, keeping %d CPUs: %v", d.CPU, err)
+		} else {
+			d.CPU = clampInt(int(cpus/2), 1, maxCPUs)
+		}
+	}
+	if d.Memory == defaultMemory {
+		if total, err := hostSysctl("hw.memsize"); err != nil {
+			log.Warnf("Cannot read the memory size of the host, keeping %dm: %v", d.Memory, err)
+		} else {
+			d.Memory = clampInt(int(total/1024/1024/2), 512, autoMaxMemory)
+		}
+	}
+	if d.DiskSize == defaultDiskSize {
+		if v, err := probeStoreVolume(d.StorePath); err != nil {
+			log.Warnf("Cannot read the free space of the machine store, keeping a %d MB disk: %v", d.DiskSize, err)
+		} else {
+			d.DiskSize = clampInt(int(v.Free/1000000/4), defaultDiskSize, autoMaxDiskSize)
+		}
+	}
+	log.Infof("Sized the machine from the host: %d CPUs, %dm of memory, a %d MB disk", d.CPU, d.Memory, d.DiskSize)
+}
+
+// clampInt returns n bounded by min and max.
+func clampInt(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
@@ -0,0 +1,160 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	pkgdrivers "github.com/leoh0/docker-machine-driver-hyperkit/pkg/drivers"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// artifactsCacheDir holds, below the docker-machine cache, the
+	// artifacts of removed machines kept for their re-creation.
+	artifactsCacheDir = "hyperkit-artifacts"
+	artifactsManifest = "artifacts.json"
+)
+
+// artifactsParams are the creation parameters a re-created machine must
+// share with the removed one to reuse its artifacts.
+type artifactsParams struct {
+	Boot2DockerURL string
+	DiskSize       int
+	Disk           bool
+}
+
+// artifacts describes the artifacts kept for a removed machine.
+type artifacts struct {
+	Params  artifactsParams
+	Cmdline string
+	// BootKernel and BootInitrd are where the kernel was found in the ISO,
+	// Vmlinuz and Initrd the names of its extracted copies.
+	BootKernel string
+	BootInitrd string
+	Vmlinuz    string
+	Initrd     string
+	Files      []string
+	KeptAt     time.Time
+}
+
+// artifactsDir is where the artifacts of the machine are kept once it is
+// removed.
+func (d *Driver) artifactsDir() string {
+	return filepath.Join(d.StorePath, "cache", artifactsCacheDir, d.MachineName)
+}
+
+// reusesArtifacts tells whether the artifacts of the machine are kept for
+// its re-creation: only those of the boot2docker ISO flow are.
+func (d *Driver) reusesArtifacts() bool {
+	return d.ReuseArtifacts && !d.isCloudImage() && !d.isUEFIBoot() && !d.hasCustomKernel()
+}
+
+func (d *Driver) artifactsParams() artifactsParams {
+	return artifactsParams{Boot2DockerURL: d.Boot2DockerURL, DiskSize: d.DiskSize, Disk: d.ReuseDisk}
+}
+
+// keepArtifacts moves the ISO and the extracted kernel, and with ReuseDisk
+// the disk image and the SSH key it authorizes, out of the machine
+// directory before docker-machine removes it.
+func (d *Driver) keepArtifacts() error {
+	if !d.reusesArtifacts() {
+		return nil
+	}
+	dir := d.artifactsDir()
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	a := artifacts{
+		Params:     d.artifactsParams(),
+		Cmdline:    d.Cmdline,
+		BootKernel: d.BootKernel,
+		BootInitrd: d.BootInitrd,
+		Vmlinuz:    d.Vmlinuz,
+		Initrd:     d.Initrd,
+		KeptAt:     time.Now(),
+	}
+	files := map[string]string{
+		isoFilename: d.bootPath(isoFilename),
+		d.Vmlinuz:   d.bootPath(d.Vmlinuz),
+		d.Initrd:    d.bootPath(d.Initrd),
+	}
+	if d.ReuseDisk {
+		disk := pkgdrivers.GetDiskPath(d.BaseDriver)
+		files[filepath.Base(disk)] = disk
+		files["id_rsa"] = d.GetSSHKeyPath()
+		files["id_rsa.pub"] = d.GetSSHKeyPath() + ".pub"
+	}
+	for name, path := range files {
+		if err := os.Rename(path, filepath.Join(dir, name)); err != nil {
+			os.RemoveAll(dir)
+			return errors.Wrapf(err, "keeping %s", name)
+		}
+		a.Files = append(a.Files, name)
+	}
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, artifactsManifest), b, 0644); err != nil {
+		return err
+	}
+	log.Infof("Kept the artifacts of %s in %s for its re-creation", d.MachineName, dir)
+	return nil
+}
+
+// restoreArtifacts moves back into the machine directory the artifacts kept
+// when a machine of the same name and creation parameters was removed, and
+// returns whether it did. Artifacts kept with other parameters are
+// discarded.
+func (d *Driver) restoreArtifacts() (bool, error) {
+	dir := d.artifactsDir()
+	b, err := ioutil.ReadFile(filepath.Join(dir, artifactsManifest))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	a := artifacts{}
+	if err := json.Unmarshal(b, &a); err != nil || !d.reusesArtifacts() || a.Params != d.artifactsParams() {
+		log.Infof("Discarding the artifacts kept for %s, created with other parameters", d.MachineName)
+		return false, os.RemoveAll(dir)
+	}
+	for _, name := range a.Files {
+		if err := os.Rename(filepath.Join(dir, name), d.ResolveStorePath(name)); err != nil {
+			return false, errors.Wrapf(err, "restoring %s", name)
+		}
+	}
+	if d.Cmdline == "" {
+		d.Cmdline = a.Cmdline
+	}
+	d.BootKernel, d.BootInitrd = a.BootKernel, a.BootInitrd
+	d.Vmlinuz, d.Initrd = a.Vmlinuz, a.Initrd
+	log.Infof("Reusing the artifacts of %s kept on %s", d.MachineName, a.KeptAt.Format(time.RFC1123))
+	return true, os.RemoveAll(dir)
+}
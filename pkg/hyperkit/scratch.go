@@ -0,0 +1,102 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// The files written continuously while the machine runs, the console ring
+// buffer and the logs, can be moved out of the machine directory to
+// ScratchDir, e.g. a RAM disk, to spare the SSD and keep the store small.
+// hyperkit always writes the console ring into the machine directory, where
+// it is linked to the scratch directory instead.
+
+// consoleRingFile is the console ring buffer written by hyperkit.
+const consoleRingFile = "console-ring"
+
+// validateScratchDir checks dir is empty or absolute.
+func validateScratchDir(dir string) error {
+	if dir != "" && !filepath.IsAbs(dir) {
+		return fmt.Errorf("invalid scratch directory %q: must be an absolute path", dir)
+	}
+	return nil
+}
+
+// scratchDir returns the scratch directory of the machine, or "" without
+// ScratchDir or when it is missing, e.g. an unmounted RAM disk.
+func (d *Driver) scratchDir() string {
+	if d.ScratchDir == "" {
+		return ""
+	}
+	if _, err := os.Stat(d.ScratchDir); err != nil {
+		return ""
+	}
+	dir := filepath.Join(d.ScratchDir, d.MachineName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return ""
+	}
+	return dir
+}
+
+// scratchPath returns where the scratch file name of the machine is
+// written.
+func (d *Driver) scratchPath(name string) string {
+	if dir := d.scratchDir(); dir != "" {
+		return filepath.Join(dir, name)
+	}
+	return d.ResolveStorePath(name)
+}
+
+// linkConsoleRing links the console ring of the machine directory to the
+// scratch directory, or removes such a link without one.
+func (d *Driver) linkConsoleRing() error {
+	link := d.ResolveStorePath(consoleRingFile)
+	target := d.scratchPath(consoleRingFile)
+	if target == link {
+		if d.ScratchDir != "" {
+			log.Warnf("Scratch directory %s is missing, writing the console and logs to the machine directory", d.ScratchDir)
+		}
+		if fi, err := os.Lstat(link); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return os.Remove(link)
+		}
+		return nil
+	}
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(target, link); err != nil {
+		// exFAT and FAT volumes have no symlinks.
+		log.Warnf("Cannot link %s to the console in the scratch directory, read it at %s: %v", link, target, err)
+	}
+	return nil
+}
+
+// removeScratchDir removes the scratch directory of the machine.
+func (d *Driver) removeScratchDir() {
+	if dir := d.scratchDir(); dir != "" {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnf("Removing %s: %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/portforward"
+)
+
+// The self-test checks the hops between the host and the Docker endpoint of
+// the guest one after the other, so that the first failing one tells why
+// "docker-machine env" works while docker commands hang.
+const (
+	dockerPort = 2376
+	// selfTestDockerWait bounds the wait for the Docker daemon to listen
+	// after the VM got its IP.
+	selfTestDockerWait  = 60 * time.Second
+	selfTestDialTimeout = 5 * time.Second
+)
+
+// ReachabilityCheck is the result of checking one hop.
+type ReachabilityCheck struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	// Error is empty if the check passed.
+	Error string `json:"error,omitempty"`
+}
+
+func (c ReachabilityCheck) String() string {
+	if c.Error == "" {
+		return fmt.Sprintf("%s (%s): ok", c.Name, c.Target)
+	}
+	return fmt.Sprintf("%s (%s): %s", c.Name, c.Target, c.Error)
+}
+
+// CheckReachability checks the route to the VM, the Docker endpoint over TCP
+// and TLS, and the TCP port forwards. It returns the checks done and an error
+// naming the first failing hop.
+func (d *Driver) CheckReachability() ([]ReachabilityCheck, error) {
+	if d.IPAddress == "" {
+		return nil, fmt.Errorf("machine %s has no IP address", d.MachineName)
+	}
+	var checks []ReachabilityCheck
+	check := func(name, target string, err error) {
+		c := ReachabilityCheck{Name: name, Target: target}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		checks = append(checks, c)
+	}
+
+	check("route", d.IPAddress, checkRoute(d.IPAddress))
+	endpoint := net.JoinHostPort(d.IPAddress, strconv.Itoa(dockerPort))
+	err := checkTCP(endpoint, selfTestDockerWait)
+	check("docker", endpoint, err)
+	if err == nil {
+		check("docker-tls", endpoint, d.checkDockerTLS(endpoint))
+	}
+	for _, spec := range d.PortForwards {
+		f, err := portforward.Parse(spec)
+		if err != nil || f.Proto != "tcp" {
+			continue
+		}
+		target := net.JoinHostPort("127.0.0.1", strconv.Itoa(f.HostPort))
+		check("port-forward "+f.String(), target, checkTCP(target, 0))
+	}
+
+	for _, c := range checks {
+		if c.Error != "" {
+			return checks, fmt.Errorf("%s", c)
+		}
+	}
+	return checks, nil
+}
+
+// selfTest runs CheckReachability after Start and logs the failing hop.
+// Machines which haven't been provisioned by docker-machine yet are skipped,
+// their Docker daemon isn't set up.
+func (d *Driver) selfTest() {
+	if _, err := os.Stat(d.ResolveStorePath("server.pem")); err != nil {
+		log.Debugf("Skipping the reachability self-test of the unprovisioned machine")
+		return
+	}
+	log.Infof("Checking the reachability of the Docker endpoint")
+	checks, err := d.CheckReachability()
+	for _, c := range checks {
+		log.Debugf("Reachability check %s", c)
+	}
+	if err != nil {
+		log.Warnf("Reachability self-test failed: %v", err)
+	}
+}
+
+// checkRoute makes sure ip is routed through a vmnet bridge rather than,
+// e.g., a VPN tunnel claiming the subnet.
+func checkRoute(ip string) error {
+	out, err := exec.Command("route", "-n", "get", ip).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("no route to the VM: %s", strings.TrimSpace(string(out)))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "interface:" {
+			if !strings.HasPrefix(fields[1], "bridge") {
+				return fmt.Errorf("the VM is routed through %s instead of the vmnet bridge, a VPN may be capturing its subnet", fields[1])
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no route to the VM")
+}
+
+// checkTCP connects to address, retrying refused connections for up to
+// wait.
+func checkTCP(address string, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		conn, err := net.DialTimeout("tcp", address, selfTestDialTimeout)
+		if err == nil {
+			return conn.Close()
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return fmt.Errorf("connection timed out, a firewall is dropping the traffic")
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("nothing is listening: %v", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// checkDockerTLS performs a TLS handshake with the Docker endpoint using the
+// client certificates of the docker-machine store.
+func (d *Driver) checkDockerTLS(address string) error {
+	certsDir := filepath.Join(d.StorePath, "certs")
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certsDir, "cert.pem"), filepath.Join(certsDir, "key.pem"))
+	if err != nil {
+		return fmt.Errorf("loading the client certificate: %v", err)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(certsDir, "ca.pem"))
+	if err != nil {
+		return fmt.Errorf("loading the CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	host, _, _ := net.SplitHostPort(address)
+	dialer := &net.Dialer{Timeout: selfTestDialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   host,
+	})
+	if err != nil {
+		if _, ok := err.(x509.HostnameError); ok {
+			return fmt.Errorf("%v, the IP address changed: run docker-machine regenerate-certs %s", err, d.MachineName)
+		}
+		return fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	return conn.Close()
+}
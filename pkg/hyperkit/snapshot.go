@@ -0,0 +1,180 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/disk"
+	pkgdrivers "github.com/leoh0/docker-machine-driver-hyperkit/pkg/drivers"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/schema"
+	"github.com/leoh0/machine/libmachine/state"
+	"github.com/pkg/errors"
+)
+
+// Snapshots are copies of the machine disk in snapshots/<name> of the
+// machine directory. On APFS they are clones sharing the unmodified blocks
+// with the disk, which makes taking them instant and cheap.
+const (
+	snapshotsDir         = "snapshots"
+	snapshotInfoFileName = schema.SnapshotFile
+)
+
+var snapshotNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// SnapshotInfo describes a snapshot.
+type SnapshotInfo = schema.Snapshot
+
+func (d *Driver) snapshotDir(name string) string {
+	return d.ResolveStorePath(filepath.Join(snapshotsDir, name))
+}
+
+// checkSnapshotable makes sure name is valid and the machine is stopped, so
+// that the disk is consistent.
+func (d *Driver) checkSnapshotable(name string) error {
+	if !snapshotNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return d.checkStopped()
+}
+
+// checkStopped makes sure the machine is stopped, so that its disk is
+// consistent.
+func (d *Driver) checkStopped() error {
+	s, err := d.GetState()
+	if err != nil {
+		return err
+	}
+	if s != state.Stopped {
+		return fmt.Errorf("machine %s has to be stopped, it is %s", d.MachineName, s)
+	}
+	return nil
+}
+
+// Snapshot saves the disk of the stopped machine as snapshot name.
+func (d *Driver) Snapshot(name string) error {
+	if err := d.checkSnapshotable(name); err != nil {
+		return err
+	}
+	dir := d.snapshotDir(name)
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("snapshot %s already exists", name)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	backend, err := disk.New(d.DiskBackend)
+	if err != nil {
+		return err
+	}
+	image := pkgdrivers.GetDiskPath(d.BaseDriver)
+	if err := backend.Clone(image, filepath.Join(dir, filepath.Base(image))); err != nil {
+		os.RemoveAll(dir)
+		return errors.Wrap(err, "copying disk")
+	}
+	info := &SnapshotInfo{Name: name, CreatedAt: time.Now(), DiskSize: d.DiskSize}
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, snapshotInfoFileName), b, 0644); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	log.Infof("Saved snapshot %s", name)
+	return nil
+}
+
+// RestoreSnapshot replaces the disk of the stopped machine by snapshot name.
+// The snapshot is kept.
+func (d *Driver) RestoreSnapshot(name string) error {
+	if err := d.checkSnapshotable(name); err != nil {
+		return err
+	}
+	backend, err := disk.New(d.DiskBackend)
+	if err != nil {
+		return err
+	}
+	image := pkgdrivers.GetDiskPath(d.BaseDriver)
+	src := filepath.Join(d.snapshotDir(name), filepath.Base(image))
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("snapshot %s not found", name)
+	}
+
+	tmp := image + ".restore"
+	backend.Delete(tmp)
+	if err := backend.Clone(src, tmp); err != nil {
+		backend.Delete(tmp)
+		return errors.Wrap(err, "copying disk")
+	}
+	if err := os.Rename(tmp, image); err != nil {
+		return err
+	}
+	log.Infof("Restored snapshot %s", name)
+	return nil
+}
+
+// DeleteSnapshot removes snapshot name.
+func (d *Driver) DeleteSnapshot(name string) error {
+	if !snapshotNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	dir := d.snapshotDir(name)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("snapshot %s not found", name)
+	}
+	return os.RemoveAll(dir)
+}
+
+// ListSnapshots returns the snapshots of the machine, oldest first.
+func (d *Driver) ListSnapshots() ([]SnapshotInfo, error) {
+	entries, err := ioutil.ReadDir(d.ResolveStorePath(snapshotsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []SnapshotInfo
+	for _, e := range entries {
+		b, err := ioutil.ReadFile(filepath.Join(d.snapshotDir(e.Name()), snapshotInfoFileName))
+		if err != nil {
+			continue
+		}
+		var info SnapshotInfo
+		if err := json.Unmarshal(b, &info); err != nil {
+			log.Warnf("Ignoring snapshot %s: %v", e.Name(), err)
+			continue
+		}
+		snapshots = append(snapshots, info)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
@@ -0,0 +1,266 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/schema"
+	"github.com/leoh0/machine/libmachine/drivers"
+	mcnssh "github.com/leoh0/machine/libmachine/ssh"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const sshHostKeyFileName = schema.SSHHostKeyFile
+
+// sshKeepAliveInterval is the interval between two keepalives on the shared
+// SSH connection, see keepSSHAlive.
+const sshKeepAliveInterval = 10 * time.Second
+
+// sshMu guards the shared SSH connection of the drivers, see
+// sharedSSHClient.
+var sshMu sync.Mutex
+
+// dialSSH opens an SSH connection to the guest. The guest host key is
+// recorded in the machine directory on the first connection and verified on
+// every following one.
+func (d *Driver) dialSSH() (*ssh.Client, error) {
+	return d.dialSSHWithKey(d.GetSSHKeyPath())
+}
+
+// dialSSHWithKey opens an SSH connection to the guest authenticating with
+// the private key at keyPath.
+func (d *Driver) dialSSHWithKey(keyPath string) (*ssh.Client, error) {
+	addr, err := d.sshAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := mcnssh.NewNativeConfig(d.GetSSHUsername(), &mcnssh.Auth{Keys: []string{keyPath}})
+	if err != nil {
+		return nil, errors.Wrap(err, "creating ssh config")
+	}
+	config.HostKeyCallback = d.verifySSHHostKey
+
+	return ssh.Dial("tcp", addr, &config)
+}
+
+// sshAddress returns the host:port address of the guest SSH server.
+func (d *Driver) sshAddress() (string, error) {
+	host, err := d.GetSSHHostname()
+	if err != nil {
+		return "", err
+	}
+	port, err := d.GetSSHPort()
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// sharedSSHClient returns the SSH connection shared by the commands the
+// driver runs in the guest, dialing it on first use or when the guest
+// address changed. Commands multiplexed over it avoid a handshake and an
+// authentication, logged by the guest, each.
+func (d *Driver) sharedSSHClient() (*ssh.Client, error) {
+	addr, err := d.sshAddress()
+	if err != nil {
+		return nil, err
+	}
+	sshMu.Lock()
+	defer sshMu.Unlock()
+	if d.sshClient != nil {
+		if d.sshAddr == addr {
+			return d.sshClient, nil
+		}
+		d.sshClient.Close()
+		d.sshClient = nil
+	}
+	client, err := d.dialSSH()
+	if err != nil {
+		return nil, err
+	}
+	d.sshClient, d.sshAddr = client, addr
+	go d.keepSSHAlive(client)
+	return client, nil
+}
+
+// keepSSHAlive sends keepalives over the shared SSH connection client and
+// closes it when the guest doesn't answer one in time, e.g. because it
+// went away, rather than letting the next command hang on it.
+func (d *Driver) keepSSHAlive(client *ssh.Client) {
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+	defer d.dropSSHClient(client)
+
+	ticker := time.NewTicker(sshKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			// OpenSSH rejects the request, which is an answer too.
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err == nil {
+				continue
+			}
+			log.Debugf("SSH keepalive failed: %v", err)
+		case <-time.After(sshKeepAliveInterval):
+			log.Debugf("SSH keepalive timed out")
+		}
+		client.Close()
+		return
+	}
+}
+
+// dropSSHClient stops sharing the SSH connection client.
+func (d *Driver) dropSSHClient(client *ssh.Client) {
+	sshMu.Lock()
+	defer sshMu.Unlock()
+	if d.sshClient == client {
+		d.sshClient = nil
+	}
+}
+
+// closeSSH closes the shared SSH connection, if any.
+func (d *Driver) closeSSH() {
+	sshMu.Lock()
+	defer sshMu.Unlock()
+	if d.sshClient != nil {
+		d.sshClient.Close()
+		d.sshClient = nil
+	}
+}
+
+// newSSHSession opens a session over the shared SSH connection, dialing a
+// new one when it broke since its last use, e.g. because the guest
+// rebooted.
+func (d *Driver) newSSHSession() (*ssh.Session, error) {
+	client, err := d.sharedSSHClient()
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+	log.Debugf("Redialing SSH: %v", err)
+	d.dropSSHClient(client)
+	client.Close()
+	if client, err = d.sharedSSHClient(); err != nil {
+		return nil, err
+	}
+	return client.NewSession()
+}
+
+// runSSHCommand runs command in the guest and returns its combined output.
+func (d *Driver) runSSHCommand(command string) (string, error) {
+	return d.runSSHCommandWithInput(command, nil)
+}
+
+// runSSHCommandWithInput runs command in the guest with input, which is not
+// logged, as its standard input. The output is returned on failure too.
+func (d *Driver) runSSHCommandWithInput(command string, input []byte) (string, error) {
+	session, err := d.newSSHSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	if input != nil {
+		session.Stdin = bytes.NewReader(input)
+	}
+
+	log.Debugf("About to run SSH command:\n%s", command)
+	output, err := session.CombinedOutput(command)
+	log.Debugf("SSH cmd err, output: %v: %s", err, output)
+	if err != nil {
+		return string(output), fmt.Errorf(`ssh command error:
+command : %s
+err     : %v
+output  : %s`, command, err, output)
+	}
+	return string(output), nil
+}
+
+// recordSSHHostKey waits for the guest SSH server and records its host key
+// if none is known yet.
+func (d *Driver) recordSSHHostKey() error {
+	if err := drivers.WaitForSSH(d); err != nil {
+		return err
+	}
+	client, err := d.dialSSH()
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+// forgetSSHHostKey removes the recorded guest host key, e.g. because the
+// machine is being recreated with a fresh disk.
+func (d *Driver) forgetSSHHostKey() error {
+	if err := os.Remove(d.ResolveStorePath(sshHostKeyFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// verifySSHHostKey is a ssh.HostKeyCallback trusting the first key it sees
+// and rejecting any other key afterwards.
+func (d *Driver) verifySSHHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	path := d.ResolveStorePath(sshHostKeyFileName)
+	known, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Infof("Recording SSH host key %s of %s", ssh.FingerprintSHA256(key), hostname)
+		return ioutil.WriteFile(path, ssh.MarshalAuthorizedKey(key), 0644)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "reading %s", path)
+	}
+
+	knownKey, _, _, _, err := ssh.ParseAuthorizedKey(known)
+	if err != nil {
+		return errors.Wrapf(err, "parsing %s", path)
+	}
+	if !bytes.Equal(knownKey.Marshal(), key.Marshal()) {
+		return fmt.Errorf("SSH host key of %s changed: expected %s, got %s. "+
+			"If the machine was recreated, remove %s and try again",
+			hostname, ssh.FingerprintSHA256(knownKey), ssh.FingerprintSHA256(key), path)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// Folder share modes.
+const (
+	shareModeNFS   = "nfs"
+	shareModeSSHFS = "sshfs"
+)
+
+// Without NFS, folders are shared by reverse sshfs mounts: for each share an
+// "sshfs-share" process of the driver binary runs the macOS sftp-server as
+// the invoking user and connects it to an sshfs running in passive mode in
+// the guest through the SSH connection. No host configuration nor privilege
+// is needed, but the guest needs sshfs installed.
+const (
+	sshfsPrefix    = "sshfs-"
+	sftpServerPath = "/usr/libexec/sftp-server"
+)
+
+// validateShareMode checks mode is empty, "nfs" or "sshfs".
+func validateShareMode(mode string) error {
+	switch mode {
+	case "", shareModeNFS, shareModeSSHFS:
+		return nil
+	}
+	return fmt.Errorf("invalid share mode %q: must be %q or %q", mode, shareModeNFS, shareModeSSHFS)
+}
+
+// setupSSHFSShares mounts the shares in the guest over sshfs.
+func (d *Driver) setupSSHFSShares() error {
+	d.stopSSHFSShares()
+	if _, err := d.runSSHCommand("command -v sshfs"); err != nil {
+		return fmt.Errorf("sshfs is not installed in the guest, the shared folders can't be mounted")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	for i, share := range d.NFSShares {
+		if !path.IsAbs(share) {
+			share = d.ResolveStorePath(share)
+		}
+		mountpoint := d.nfsMountPoint(share)
+		cmd := exec.Command(exe, "sshfs-share", d.ResolveStorePath(""), share, mountpoint)
+		if err := d.startManagedProcess(fmt.Sprintf("%s%d", sshfsPrefix, i), cmd); err != nil {
+			return errors.Wrapf(err, "sharing %s over sshfs", share)
+		}
+		log.Infof("Sharing %s at %s over sshfs", share, mountpoint)
+	}
+	return nil
+}
+
+// stopSSHFSShares terminates the sshfs shares.
+func (d *Driver) stopSSHFSShares() {
+	d.stopManagedProcesses(sshfsPrefix)
+}
+
+// ServeSSHFSShare serves hostDir to an sshfs mounting it at guestDir in the
+// guest of the machine stored in machineDir, until the mount or the SSH
+// connection goes away.
+func ServeSSHFSShare(machineDir, hostDir, guestDir string) error {
+	d, err := LoadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	client, err := d.dialSSH()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	// The driver binary may be setuid root: serve files as the invoking
+	// user only.
+	sftp := exec.Command(sftpServerPath)
+	if os.Geteuid() != os.Getuid() {
+		sftp.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid()), NoSetGroups: true},
+		}
+	}
+	sftp.Stderr = os.Stderr
+	if session.Stdin, err = sftp.StdoutPipe(); err != nil {
+		return err
+	}
+	if session.Stdout, err = sftp.StdinPipe(); err != nil {
+		return err
+	}
+	session.Stderr = os.Stderr
+	if err := sftp.Start(); err != nil {
+		return err
+	}
+	defer sftp.Process.Kill()
+
+	// sshfs 3.7 renamed the slave option to passive.
+	command := fmt.Sprintf("%s && "+
+		"if sshfs -h 2>&1 | grep -q passive; then mode=passive; else mode=slave; fi && "+
+		"exec sudo sshfs -f -o $mode,allow_other%s :%s %s",
+		d.mountPointCommand(guestDir), d.sshfsOwnerOptions(hostDir), shellQuote(hostDir), shellQuote(guestDir))
+	return session.Run(command)
+}
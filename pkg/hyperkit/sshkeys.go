@@ -0,0 +1,121 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	mcnssh "github.com/leoh0/machine/libmachine/ssh"
+	"github.com/pkg/errors"
+)
+
+// Each machine has its own SSH key pair, id_rsa in the machine directory,
+// generated at creation time. It is authorized through the userdata.tar
+// boot2docker extracts from the disk on every boot, or through cloud-init for
+// cloud images. boot2docker also accepts the well-known "tcuser" password of
+// the docker user, which is locked unless SSHPasswordLogin is set.
+const (
+	boot2dockerUserData       = "/var/lib/boot2docker/userdata.tar"
+	boot2dockerLockPassScript = "/var/lib/boot2docker/lock-password.sh"
+	rotatedKeySuffix          = ".new"
+)
+
+// lockPasswordScript locks the password of the SSH user, which boot2docker
+// resets on every boot.
+const lockPasswordScript = `#!/bin/sh
+# Generated by docker-machine-driver-hyperkit
+passwd -l %s >/dev/null
+`
+
+// lockGuestPassword locks the default password of a boot2docker guest so
+// that only the machine key gives access to it.
+func (d *Driver) lockGuestPassword() error {
+	if d.SSHPasswordLogin || d.isCloudImage() {
+		return nil
+	}
+	log.Infof("Locking the password of the guest %s user", d.GetSSHUsername())
+	script := fmt.Sprintf(lockPasswordScript, d.GetSSHUsername())
+	if err := d.runBoot2DockerBootScript(boot2dockerLockPassScript, []byte(script)); err != nil {
+		return errors.Wrap(err, "locking the guest password")
+	}
+	return nil
+}
+
+// RotateSSHKey replaces the SSH key pair of the running machine: the new key
+// is authorized in the guest, checked to work, and only then replaces the
+// previous one, which is no longer authorized.
+func (d *Driver) RotateSSHKey() error {
+	keyPath := d.GetSSHKeyPath()
+	newKeyPath := keyPath + rotatedKeySuffix
+	os.Remove(newKeyPath)
+	os.Remove(newKeyPath + ".pub")
+	if err := mcnssh.GenerateSSHKey(newKeyPath); err != nil {
+		return err
+	}
+	defer os.Remove(newKeyPath)
+	defer os.Remove(newKeyPath + ".pub")
+	pubKey, err := ioutil.ReadFile(newKeyPath + ".pub")
+	if err != nil {
+		return err
+	}
+
+	// Both keys are authorized until the new one is known to work.
+	oldPubKey, err := ioutil.ReadFile(keyPath + ".pub")
+	if err != nil {
+		return err
+	}
+	if err := d.authorizeSSHKeys(string(oldPubKey) + string(pubKey)); err != nil {
+		return errors.Wrap(err, "authorizing the new key")
+	}
+	client, err := d.dialSSHWithKey(newKeyPath)
+	if err != nil {
+		return errors.Wrap(err, "logging in with the new key")
+	}
+	client.Close()
+
+	for _, suffix := range []string{"", ".pub"} {
+		if err := os.Rename(newKeyPath+suffix, keyPath+suffix); err != nil {
+			return errors.Wrap(err, "replacing the key")
+		}
+	}
+	if err := d.authorizeSSHKeys(string(pubKey)); err != nil {
+		return errors.Wrap(err, "revoking the previous key")
+	}
+	log.Infof("Rotated the SSH key of %s", d.MachineName)
+	return nil
+}
+
+// authorizeSSHKeys replaces the authorized keys of the SSH user by keys. On
+// boot2docker the userdata.tar restoring them on boot is updated as well.
+func (d *Driver) authorizeSSHKeys(keys string) error {
+	command := fmt.Sprintf("printf '%%s\\n' %s > ~/.ssh/authorized_keys.new && "+
+		"chmod 600 ~/.ssh/authorized_keys.new && "+
+		"mv ~/.ssh/authorized_keys.new ~/.ssh/authorized_keys",
+		shellQuote(strings.TrimSpace(keys)))
+	if !d.isCloudImage() {
+		command += fmt.Sprintf(" && cp ~/.ssh/authorized_keys ~/.ssh/authorized_keys2 && "+
+			"sudo tar cf %s -C ~ .ssh", boot2dockerUserData)
+	}
+	_, err := d.runSSHCommand(command)
+	return err
+}
@@ -0,0 +1,238 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/machine/libmachine/state"
+	"github.com/pkg/errors"
+)
+
+const (
+	// statusServerName is the managed process serving the status endpoint
+	// of a machine.
+	statusServerName = "status-server"
+	// statusAddressSocket serves the status endpoint on
+	// statusSocketFileName in the machine directory.
+	statusAddressSocket  = "socket"
+	statusSocketFileName = "status.sock"
+	// maxStatusEvents bounds the events returned by the status endpoint.
+	maxStatusEvents = 20
+)
+
+// MachineStatus is the document served by the status endpoint.
+type MachineStatus struct {
+	*Status
+	Machine string        `json:"machine"`
+	Health  Health        `json:"health"`
+	Events  []StatusEvent `json:"events,omitempty"`
+}
+
+// Health sums up the checks of a running machine.
+type Health struct {
+	// Healthy is set when the machine runs and none of the checks below
+	// failed.
+	Healthy bool `json:"healthy"`
+	// SSH tells whether the guest SSH server answers.
+	SSH bool `json:"ssh"`
+	// Docker tells whether the guest docker daemon answers.
+	Docker bool `json:"docker"`
+	// DiskPressure are the guest filesystems above the warning threshold
+	// on the last check of the disk monitor.
+	DiskPressure []FilesystemUsage `json:"disk_pressure,omitempty"`
+	// UnmountedShares are the shares missing in the guest.
+	UnmountedShares []string `json:"unmounted_shares,omitempty"`
+}
+
+// StatusEvent is a notable event of the machine.
+type StatusEvent struct {
+	Time time.Time `json:"time"`
+	// Kind is "phase", "ip" or the kind of a guest kernel event.
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// validateStatusAddress checks addr is empty, "socket" or a loopback
+// host:port.
+func validateStatusAddress(addr string) error {
+	if addr == "" || addr == statusAddressSocket {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid status address %q: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("invalid status address %q: must be a loopback address", addr)
+	}
+	return nil
+}
+
+// MachineStatus returns the status of the machine with its health and
+// most recent events.
+func (d *Driver) MachineStatus() (*MachineStatus, error) {
+	status, err := d.Status()
+	if err != nil {
+		return nil, err
+	}
+	ms := &MachineStatus{Status: status, Machine: d.MachineName}
+	if status.State == state.Running.String() {
+		ms.Health = d.health()
+	}
+	if ms.Events, err = d.recentEvents(); err != nil {
+		log.Debugf("Reading the events of %s: %v", d.MachineName, err)
+	}
+	return ms, nil
+}
+
+// health runs the checks of a running machine.
+func (d *Driver) health() Health {
+	h := Health{SSH: d.heartbeat() == nil}
+	var err error
+	if h.DiskPressure, err = d.DiskPressure(); err != nil {
+		log.Debugf("Reading the disk pressure: %v", err)
+	}
+	if h.SSH {
+		h.Docker = d.checkDockerDaemon() == nil
+		shares, err := d.shareStatus()
+		if err != nil {
+			log.Debugf("Reading the mounted shares: %v", err)
+		}
+		for _, share := range shares {
+			if !share.Mounted {
+				h.UnmountedShares = append(h.UnmountedShares, share.Share)
+			}
+		}
+	}
+	h.Healthy = h.SSH && h.Docker && len(h.DiskPressure) == 0 && len(h.UnmountedShares) == 0
+	return h
+}
+
+// recentEvents returns the last maxStatusEvents phase changes, IP changes
+// and guest kernel events recorded in the machine metadata, newest first.
+func (d *Driver) recentEvents() ([]StatusEvent, error) {
+	m, err := d.readMetadata()
+	if err != nil {
+		return nil, err
+	}
+	var events []StatusEvent
+	if m.Phase != "" {
+		events = append(events, StatusEvent{Time: m.PhaseChangedAt, Kind: "phase", Message: m.Phase})
+	}
+	for _, ip := range m.IPHistory {
+		events = append(events, StatusEvent{Time: ip.FirstSeen, Kind: "ip", Message: ip.IP})
+	}
+	if m.KernelLog != nil {
+		for _, e := range m.KernelLog.Events {
+			events = append(events, StatusEvent{Time: e.Time, Kind: e.Kind, Message: e.Message})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+	if len(events) > maxStatusEvents {
+		events = events[:maxStatusEvents]
+	}
+	return events, nil
+}
+
+// startStatusServer starts the status endpoint if StatusAddress is set.
+func (d *Driver) startStatusServer() error {
+	d.stopStatusServer()
+	if d.StatusAddress == "" {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, statusServerName, d.ResolveStorePath(""))
+	if err := d.startManagedProcess(statusServerName, cmd); err != nil {
+		return errors.Wrap(err, "starting status endpoint")
+	}
+	if d.StatusAddress == statusAddressSocket {
+		log.Infof("Status available at %s", d.ResolveStorePath(statusSocketFileName))
+	} else {
+		log.Infof("Status available at http://%s/status", d.StatusAddress)
+	}
+	return nil
+}
+
+// stopStatusServer terminates the status endpoint.
+func (d *Driver) stopStatusServer() {
+	d.stopManagedProcesses(statusServerName)
+}
+
+// statusListener listens on StatusAddress.
+func (d *Driver) statusListener() (net.Listener, error) {
+	if d.StatusAddress != statusAddressSocket {
+		return net.Listen("tcp", d.StatusAddress)
+	}
+	path := d.ResolveStorePath(statusSocketFileName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Only the owner of the machine may connect.
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// ServeStatus serves the status of the machine stored in machineDir as
+// JSON on /status of its StatusAddress.
+func ServeStatus(machineDir string) error {
+	d, err := LoadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	if d.StatusAddress == "" {
+		return errors.New("the status endpoint is disabled for this machine")
+	}
+	l, err := d.statusListener()
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := d.MachineStatus()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+	})
+	log.Infof("Serving the status of %s on %s", d.MachineName, l.Addr())
+	return http.Serve(l, mux)
+}
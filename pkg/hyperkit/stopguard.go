@@ -0,0 +1,145 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/machine/libmachine/state"
+)
+
+// Stopping a machine in the middle of a build can leave half-written files
+// behind, on the disk as well as on the shares. Before stopping, the guest
+// is checked for files open on the shares and for disk writes. Activity is
+// reported, and the stop is delayed by up to StopWait for it to settle. The
+// guest filesystems are synced in any case.
+const (
+	// stopWriteThreshold is the disk write rate, in kB/s, above which the
+	// guest is considered busy.
+	stopWriteThreshold = 1024
+	stopPollInterval   = 2 * time.Second
+	// maxReportedFiles bounds the open files listed in the warning.
+	maxReportedFiles = 5
+)
+
+// guestActivityScript prints the files open under the given directories as
+// "open <pid> <command> <path>" and the disk write rate as "write <kB/s>".
+const guestActivityScript = `for p in /proc/[0-9]*; do
+	for f in $p/fd/*; do
+		t=$(readlink $f 2>/dev/null) || continue
+		for d in %s; do
+			case "$t" in "$d"/*) echo "open ${p#/proc/} $(cat $p/comm 2>/dev/null) $t";; esac
+		done
+	done
+done
+w() { awk '$3 ~ /^(vd|sd)[a-z]$/ { s += $10 } END { print s + 0 }' /proc/diskstats; }
+a=$(w); sleep 1; b=$(w)
+echo "write $(( (b - a) / 2 ))"`
+
+// guestActivity is the activity found in the guest.
+type guestActivity struct {
+	OpenFiles []string
+	WriteKBps int
+}
+
+func (a *guestActivity) busy() bool {
+	return len(a.OpenFiles) > 0 || a.WriteKBps > stopWriteThreshold
+}
+
+func (a *guestActivity) String() string {
+	var parts []string
+	if n := len(a.OpenFiles); n > 0 {
+		files := a.OpenFiles
+		if n > maxReportedFiles {
+			files = append(files[:maxReportedFiles:maxReportedFiles], fmt.Sprintf("and %d more", n-maxReportedFiles))
+		}
+		parts = append(parts, fmt.Sprintf("%d files open on shares (%s)", n, strings.Join(files, ", ")))
+	}
+	if a.WriteKBps > stopWriteThreshold {
+		parts = append(parts, fmt.Sprintf("writing %d kB/s to disk", a.WriteKBps))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// checkGuestActivity returns the current activity of the guest.
+func (d *Driver) checkGuestActivity() (*guestActivity, error) {
+	dirs := []string{"/nonexistent"}
+	for _, share := range d.NFSShares {
+		if !path.IsAbs(share) {
+			share = d.ResolveStorePath(share)
+		}
+		dirs = append(dirs, shellQuote(d.nfsMountPoint(share)))
+	}
+	script := fmt.Sprintf(guestActivityScript, strings.Join(dirs, " "))
+	out, err := d.runSSHCommand("sudo sh -c " + shellQuote(script))
+	if err != nil {
+		return nil, err
+	}
+
+	activity := &guestActivity{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 4 && fields[0] == "open":
+			activity.OpenFiles = append(activity.OpenFiles, fmt.Sprintf("%s by %s[%s]", strings.Join(fields[3:], " "), fields[2], fields[1]))
+		case len(fields) == 2 && fields[0] == "write":
+			activity.WriteKBps, _ = strconv.Atoi(fields[1])
+		}
+	}
+	return activity, nil
+}
+
+// settleGuest reports guest activity, waits for up to StopWait for it to
+// settle, and syncs the guest filesystems before a stop. Failures are only
+// logged, they must not prevent stopping.
+func (d *Driver) settleGuest() {
+	if d.IPAddress == "" {
+		return
+	}
+	if s, err := d.processState(); err != nil || s != state.Running {
+		return
+	}
+
+	deadline := time.Now().Add(d.StopWait)
+	for {
+		activity, err := d.checkGuestActivity()
+		if err != nil {
+			log.Debugf("Checking guest activity: %v", err)
+			break
+		}
+		if !activity.busy() {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Warnf("Stopping %s while it is busy: %s", d.MachineName, activity)
+			break
+		}
+		log.Infof("Waiting for %s to settle: %s", d.MachineName, activity)
+		time.Sleep(stopPollInterval)
+	}
+
+	if _, err := d.runSSHCommand("sync"); err != nil {
+		log.Debugf("Syncing the guest filesystems: %v", err)
+	}
+}
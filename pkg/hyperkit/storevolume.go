@@ -0,0 +1,177 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/disk"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// storeVolume describes the filesystem holding the machine store.
+type storeVolume struct {
+	// FSType is the filesystem type reported by statfs, e.g. "apfs".
+	FSType string
+	// Free is the space available to the user, in bytes.
+	Free uint64
+	// CaseSensitive tells whether names differing in case only are
+	// different files.
+	CaseSensitive bool
+}
+
+// networkFSTypes are the filesystems of network volumes, on which unix
+// sockets can't be created and flock is unreliable.
+var networkFSTypes = map[string]bool{
+	"smbfs":  true,
+	"nfs":    true,
+	"afpfs":  true,
+	"webdav": true,
+}
+
+// Network tells whether the volume is mounted over the network.
+func (v *storeVolume) Network() bool {
+	return networkFSTypes[v.FSType]
+}
+
+// Sparse tells whether the volume allocates the blocks of a file on write,
+// rather than when the file is truncated to its size.
+func (v *storeVolume) Sparse() bool {
+	return v.FSType != "exfat" && v.FSType != "msdos"
+}
+
+// probeStoreVolume describes the volume holding dir.
+func probeStoreVolume(dir string) (*storeVolume, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return nil, err
+	}
+	var name []byte
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	v := &storeVolume{
+		FSType: string(name),
+		Free:   st.Bavail * uint64(st.Bsize),
+	}
+	caseSensitive, err := probeCaseSensitive(dir)
+	if err != nil {
+		return nil, err
+	}
+	v.CaseSensitive = caseSensitive
+	return v, nil
+}
+
+// probeCaseSensitive tells whether the volume holding dir is case
+// sensitive, by looking a probe file up with its name in upper case.
+func probeCaseSensitive(dir string) (bool, error) {
+	f, err := ioutil.TempFile(dir, ".case-probe-")
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	_, err = os.Stat(filepath.Join(dir, strings.ToUpper(filepath.Base(f.Name()))))
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// checkStoreVolume rejects the combinations of options the volume holding
+// the machine store can't support, and warns about the ones it degrades,
+// before the disk image is created.
+func (d *Driver) checkStoreVolume() error {
+	v, err := probeStoreVolume(d.StorePath)
+	if err != nil {
+		log.Warnf("Cannot inspect the volume of the machine store %s: %v", d.StorePath, err)
+		return nil
+	}
+	log.Debugf("Machine store %s is on %s, case sensitive: %t", d.StorePath, v.FSType, v.CaseSensitive)
+
+	if v.Network() {
+		var sockets []string
+		if d.ConsoleMode == consoleModeSocket {
+			sockets = append(sockets, "--"+flagConsole+"="+consoleModeSocket)
+		}
+		if d.StatusAddress == statusAddressSocket {
+			sockets = append(sockets, "--"+flagStatusAddress+"="+statusAddressSocket)
+		}
+		if d.VPNKit == vpnkitManaged {
+			sockets = append(sockets, "--"+flagVPNKit+"="+vpnkitManaged)
+		}
+		if d.VSock {
+			sockets = append(sockets, "--"+flagVSock)
+		}
+		if len(sockets) > 0 {
+			return fmt.Errorf("the machine store %s is on a network volume (%s), where unix sockets can't be created: %s is not supported there, move the store to a local volume with --storage-path",
+				d.StorePath, v.FSType, strings.Join(sockets, ", "))
+		}
+		log.Warnf("The machine store %s is on a network volume (%s): disk I/O will be slow and locks are taken on the host instead", d.StorePath, v.FSType)
+	}
+
+	// Disk images are only allocated in full by the raw backend, or on
+	// volumes without sparse files.
+	if d.DiskBackend == disk.Raw || !v.Sparse() {
+		if !v.Sparse() {
+			log.Warnf("The %s volume of the machine store %s has no sparse files: the disk image takes its full %d MB at once", v.FSType, d.StorePath, d.DiskSize)
+		}
+		need := uint64(d.DiskSize) * 1000000
+		if v.Free < need {
+			return fmt.Errorf("the machine store %s has %d MB free, the %d MB disk image doesn't fit", d.StorePath, v.Free/1000000, d.DiskSize)
+		}
+	}
+
+	if v.CaseSensitive {
+		log.Infof("The machine store %s is case sensitive, ISO paths are matched ignoring case", d.StorePath)
+	}
+	return nil
+}
+
+// lookupFold returns path, or if missing the existing path that matches it
+// ignoring case, as ISO 9660 names are upper case while boot loaders name
+// them in any case.
+func lookupFold(path string) string {
+	if _, err := os.Lstat(path); err == nil {
+		return path
+	}
+	dir, name := filepath.Split(filepath.Clean(path))
+	if name == "" || dir == path {
+		return path
+	}
+	dir = lookupFold(filepath.Clean(dir))
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return path
+	}
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), name) {
+			return filepath.Join(dir, e.Name())
+		}
+	}
+	return filepath.Join(dir, name)
+}
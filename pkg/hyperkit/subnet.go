@@ -0,0 +1,111 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/lock"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/vmnetconf"
+)
+
+// A vmnet shared network overlapping the LAN or a VPN of the host leaves
+// the VM unreachable. Before starting, VMNetSubnet "auto" moves it to a free
+// one, or a given CIDR pins it, see package vmnetconf. The hyperkit API has
+// no way to pick the network of a single VM: the change applies to all vmnet
+// VMs and only while none is running.
+const (
+	vmnetSubnetAuto = "auto"
+	vmnetSubnetOff  = "off"
+)
+
+// validateVMNetSubnet checks subnet is "auto", "off" or a CIDR.
+func validateVMNetSubnet(subnet string) error {
+	switch subnet {
+	case "", vmnetSubnetAuto, vmnetSubnetOff:
+		return nil
+	}
+	_, err := vmnetconf.ParseSubnet(subnet)
+	return err
+}
+
+// selectVMNetSubnet changes the vmnet shared network as configured by
+// VMNetSubnet, when no VM uses it.
+func (d *Driver) selectVMNetSubnet() error {
+	if d.VMNetSubnet == "" || d.VMNetSubnet == vmnetSubnetOff {
+		return nil
+	}
+	return lock.With(lock.HostPath("vmnet"), d.switchVMNetSubnet)
+}
+
+// switchVMNetSubnet implements selectVMNetSubnet.
+func (d *Driver) switchVMNetSubnet() error {
+	current, err := GetSubnet()
+	if err != nil {
+		current = vmnetconf.Default
+	}
+	routes, err := vmnetconf.HostRoutes()
+	if err != nil {
+		log.Warnf("Reading the routes of the host: %v", err)
+	}
+
+	want := current
+	if d.VMNetSubnet == vmnetSubnetAuto {
+		route := vmnetconf.Overlaps(current, routes)
+		if route == nil {
+			return nil
+		}
+		log.Warnf("The vmnet network %s overlaps the host route to %s", current, route)
+		if want, err = vmnetconf.Free(routes); err != nil {
+			return err
+		}
+	} else {
+		if want, err = vmnetconf.ParseSubnet(d.VMNetSubnet); err != nil {
+			return err
+		}
+		if route := vmnetconf.Overlaps(want, routes); route != nil {
+			log.Warnf("The vmnet network %s overlaps the host route to %s", want, route)
+		}
+	}
+	if want.String() == current.String() {
+		return nil
+	}
+	if vmnetconf.InUse(current) {
+		log.Warnf("Not switching the vmnet network to %s while other VMs use %s", want, current)
+		return nil
+	}
+
+	log.Infof("Switching the vmnet network from %s to %s", current, want)
+	if err := d.setVMNetSubnet(want); err != nil {
+		return fmt.Errorf("switching the vmnet network to %s: %v", want, err)
+	}
+	d.vmnetSubnetChanged = true
+	return nil
+}
+
+// refreshGuestDNS installs the guest resolv.conf again once the vmnet
+// network changed, as it names the host by its vmnet address.
+func (d *Driver) refreshGuestDNS() error {
+	if !d.vmnetSubnetChanged || len(d.DNS) > 0 {
+		return nil
+	}
+	d.vmnetSubnetChanged = false
+	return d.configureGuestDNS()
+}
@@ -0,0 +1,142 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/helper"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/lock"
+)
+
+// Without the privileged helper nor the setuid bit, /etc/exports is edited
+// and nfsd reloaded through sudo, never prompting on the terminal so that
+// stop and rm can't hang: sudo either has cached credentials or a NOPASSWD
+// rule, or asks for the password with the SudoAskpass program. The exports
+// are edited by the "exports" command of the driver binary, which only
+// touches the entries of the user running sudo, see EditExport.
+const nfsdPath = "/sbin/nfsd"
+
+// Operations of EditExport
+const (
+	ExportAdd    = "add"
+	ExportRemove = "remove"
+)
+
+// sudoHint is appended to the failures of the privileged operations run
+// through sudo.
+const sudoHint = "running as root needs the privileged helper (--%s), the setuid bit, a sudo NOPASSWD rule or a password program (--%s)"
+
+// runPrivileged runs the command args as root: directly when the driver
+// runs as root, through a non-interactive sudo otherwise.
+func (d *Driver) runPrivileged(args ...string) error {
+	var cmd *exec.Cmd
+	switch {
+	case os.Geteuid() == 0:
+		cmd = exec.Command(args[0], args[1:]...)
+	case d.SudoAskpass != "":
+		cmd = exec.Command("sudo", append([]string{"-A"}, args...)...)
+		cmd.Env = append(os.Environ(), "SUDO_ASKPASS="+d.SudoAskpass)
+	default:
+		cmd = exec.Command("sudo", append([]string{"-n"}, args...)...)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := fmt.Sprintf("%s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+		if os.Geteuid() != 0 {
+			msg += "; " + fmt.Sprintf(sudoHint, flagPrivilegedHelper, flagSudoAskpass)
+		}
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// addExportEntry adds the export of share with options under identifier:
+// directly, with the checks of the privileged helper, when the driver runs as
+// root, else through sudo.
+func (d *Driver) addExportEntry(identifier, share, options string) error {
+	if os.Geteuid() == 0 {
+		return helper.AddExport(&helper.ExportRequest{Identifier: identifier, Share: share, Options: options}, os.Getuid())
+	}
+	return d.runExportsCommand(ExportAdd, identifier, share, options)
+}
+
+func (d *Driver) removeExportEntry(identifier string) error {
+	if os.Geteuid() == 0 {
+		return helper.RemoveExport(identifier, os.Getuid())
+	}
+	return d.runExportsCommand(ExportRemove, identifier)
+}
+
+// runExportsCommand runs the "exports" command of the driver binary through
+// sudo, see EditExport.
+func (d *Driver) runExportsCommand(args ...string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return d.runPrivileged(append([]string{exe, "exports"}, args...)...)
+}
+
+// EditExport adds, with share and options, or removes the /etc/exports entry
+// identifier for the user running the driver through sudo, or as root. It
+// applies the checks of the privileged helper, and takes the host-wide lock
+// of /etc/exports in the root-only lock.HostDir.
+func EditExport(op, identifier, share, options string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("editing %s requires root", exportsFile)
+	}
+	uid, err := sudoUID()
+	if err != nil {
+		return err
+	}
+	return lock.With(lock.HostPath(exportsLock), func() error {
+		switch op {
+		case ExportAdd:
+			return helper.AddExport(&helper.ExportRequest{Identifier: identifier, Share: share, Options: options}, uid)
+		case ExportRemove:
+			return helper.RemoveExport(identifier, uid)
+		}
+		return fmt.Errorf("unknown exports operation %q", op)
+	})
+}
+
+// sudoUID returns the user the driver runs for: the user running sudo when
+// sudo runs it as root, the invoking user otherwise, e.g. setuid.
+func sudoUID() (int, error) {
+	if os.Getuid() != 0 || os.Getenv("SUDO_UID") == "" {
+		return os.Getuid(), nil
+	}
+	uid, err := strconv.Atoi(os.Getenv("SUDO_UID"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid SUDO_UID %q", os.Getenv("SUDO_UID"))
+	}
+	return uid, nil
+}
+
+// reloadNFSD makes nfsd read /etc/exports again.
+func (d *Driver) reloadNFSD() error {
+	return d.runPrivileged(nfsdPath, "update")
+}
@@ -0,0 +1,255 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+	"github.com/leoh0/machine/libmachine/state"
+	"github.com/pkg/errors"
+)
+
+// With Supervise, a launchd agent of the user runs the "supervise" command
+// of the driver binary every superviseInterval. It restarts the machine
+// when its hyperkit died while the machine should run, i.e. between a
+// successful start and the next stop, backing off between restarts and
+// giving up after SuperviseMaxRestarts of them.
+const (
+	superviseName = "supervise"
+	// superviseLabelPrefix is followed by the machine name in the label
+	// of the launchd agent.
+	superviseLabelPrefix = "io.github.leoh0.docker-machine-driver-hyperkit.supervise."
+	superviseInterval    = 30 * time.Second
+	// superviseBackoff is the wait before the first restart, doubled for
+	// each next one up to maxSuperviseBackoff.
+	superviseBackoff    = 10 * time.Second
+	maxSuperviseBackoff = 5 * time.Minute
+	// superviseResetAfter is how long the machine has to run for its
+	// restarts to be forgotten.
+	superviseResetAfter = 10 * time.Minute
+	// defaultSuperviseMaxRestarts is the number of restarts in a row
+	// after which the supervisor gives up.
+	defaultSuperviseMaxRestarts = 5
+)
+
+const superviseAgentTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%s</string>
+		<string>supervise</string>
+		<string>%s</string>
+	</array>
+	<key>StartInterval</key>
+	<integer>%d</integer>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`
+
+// superviseLabel returns the launchd label of the agent of the machine.
+func (d *Driver) superviseLabel() string {
+	return superviseLabelPrefix + d.MachineName
+}
+
+// superviseAgentPath returns where the launchd agent of the machine is
+// installed.
+func (d *Driver) superviseAgentPath() (string, error) {
+	home, err := realuser.HomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", d.superviseLabel()+".plist"), nil
+}
+
+// installSupervisor installs and loads the launchd agent of the machine if
+// Supervise is set, or removes it.
+func (d *Driver) installSupervisor() error {
+	if !d.Supervise {
+		return d.uninstallSupervisor()
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	path, err := d.superviseAgentPath()
+	if err != nil {
+		return err
+	}
+	plist := []byte(fmt.Sprintf(superviseAgentTemplate, d.superviseLabel(), exe, d.ResolveStorePath(""),
+		int(superviseInterval/time.Second), d.scratchPath(superviseName+".log")))
+	// The driver may run setuid root, the agent belongs to the user.
+	changed := false
+	err = realuser.Do(func() error {
+		if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, plist) {
+			return nil
+		}
+		changed = true
+		return writeAgent(path, plist)
+	})
+	if err != nil || !changed {
+		return err
+	}
+	domain := fmt.Sprintf("gui/%d", syscall.Getuid())
+	launchctl("bootout", domain+"/"+d.superviseLabel())
+	if err := launchctl("bootstrap", domain, path); err != nil {
+		return errors.Wrap(err, "loading the supervisor agent")
+	}
+	return nil
+}
+
+// writeAgent writes the agent plist to path through a new temporary file
+// renamed over it.
+func writeAgent(path string, plist []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(plist)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// uninstallSupervisor unloads and removes the launchd agent of the machine.
+func (d *Driver) uninstallSupervisor() error {
+	path, err := d.superviseAgentPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	launchctl("bootout", fmt.Sprintf("gui/%d/%s", syscall.Getuid(), d.superviseLabel()))
+	return realuser.Do(func() error {
+		return os.Remove(path)
+	})
+}
+
+// launchctl runs launchctl with args.
+func launchctl(args ...string) error {
+	out, err := realuser.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %v: %v: %s", args, err, out)
+	}
+	return nil
+}
+
+// setShouldRun records whether the machine should run.
+func (d *Driver) setShouldRun(run bool) {
+	err := d.updateMetadata(func(m *MachineMetadata) {
+		m.ShouldRun = run
+	})
+	if err != nil {
+		log.Warnf("Failed to record whether %s should run: %v", d.MachineName, err)
+	}
+}
+
+// superviseDelay returns the wait before the restart following restarts
+// ones.
+func superviseDelay(restarts int) time.Duration {
+	delay := superviseBackoff
+	for i := 0; i < restarts && delay < maxSuperviseBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxSuperviseBackoff {
+		delay = maxSuperviseBackoff
+	}
+	return delay
+}
+
+// Supervise restarts the machine stored in machineDir if its hyperkit died
+// while it should run, as allowed by the backoff and restart limit.
+func Supervise(machineDir string) error {
+	d, err := LoadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	if !d.Supervise {
+		return nil
+	}
+	m, err := d.readMetadata()
+	if err != nil {
+		return err
+	}
+	s, err := d.processState()
+	if err != nil {
+		return err
+	}
+	if s == state.Running {
+		if m.SupervisorRestarts > 0 && time.Since(m.StartedAt) > superviseResetAfter {
+			return d.updateMetadata(func(m *MachineMetadata) {
+				m.SupervisorRestarts = 0
+			})
+		}
+		return nil
+	}
+	if !m.ShouldRun || m.Phase == phaseStopping {
+		return nil
+	}
+
+	maxRestarts := d.SuperviseMaxRestarts
+	if maxRestarts <= 0 {
+		maxRestarts = defaultSuperviseMaxRestarts
+	}
+	if m.SupervisorRestarts >= maxRestarts {
+		log.Warnf("hyperkit of %s died, not restarting it after %d restarts in a row", d.MachineName, m.SupervisorRestarts)
+		d.notify("Machine %s keeps dying, it won't be restarted", d.MachineName)
+		d.setShouldRun(false)
+		return nil
+	}
+	if wait := superviseDelay(m.SupervisorRestarts) - time.Since(m.SupervisorRestartAt); wait > 0 {
+		log.Infof("hyperkit of %s died, restarting it in %s", d.MachineName, wait.Round(time.Second))
+		return nil
+	}
+
+	if err := d.updateMetadata(func(m *MachineMetadata) {
+		m.SupervisorRestarts++
+		m.SupervisorRestartAt = time.Now()
+	}); err != nil {
+		return err
+	}
+	log.Warnf("hyperkit of %s died unexpectedly, restarting it (restart %d of %d)", d.MachineName, m.SupervisorRestarts+1, maxRestarts)
+	d.notify("Machine %s died, restarting it", d.MachineName)
+	return d.Start()
+}
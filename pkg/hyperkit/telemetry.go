@@ -0,0 +1,108 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/telemetry"
+)
+
+// Telemetry events
+const (
+	// eventDownload is the copy or download of the boot image on creation.
+	eventDownload = "download"
+	// eventBootToIP is the time from the hyperkit start to the IP lookup.
+	eventBootToIP = "boot_to_ip"
+	// eventSSHReady is the time from the hyperkit start to the SSH banner.
+	eventSSHReady = "ssh_ready"
+	// eventShareSetup is the export and mount of the shared folders.
+	eventShareSetup = "share_setup"
+	eventStart      = "start"
+	eventStop       = "stop"
+)
+
+// sshReadyTimeout bounds the wait for the SSH banner measured for
+// eventSSHReady.
+const sshReadyTimeout = 2 * time.Minute
+
+// validateTelemetryFile checks path is empty or absolute.
+func validateTelemetryFile(path string) error {
+	if path != "" && !filepath.IsAbs(path) {
+		return fmt.Errorf("invalid telemetry file %q: must be an absolute path", path)
+	}
+	return nil
+}
+
+// telemetrySinks returns the sinks configured for the machine.
+func (d *Driver) telemetrySinks() []telemetry.Sink {
+	var sinks []telemetry.Sink
+	if d.TelemetryFile != "" {
+		sinks = append(sinks, telemetry.FileSink{Path: d.TelemetryFile})
+	}
+	if d.TelemetryCommand != "" {
+		sinks = append(sinks, telemetry.CommandSink{Command: d.TelemetryCommand})
+	}
+	return sinks
+}
+
+// emit sends the event of the step name, which started at start and ended
+// now with err, to the telemetry sinks.
+func (d *Driver) emit(name string, start time.Time, attempts int, err error) {
+	sinks := d.telemetrySinks()
+	if len(sinks) == 0 {
+		return
+	}
+	e := telemetry.NewEvent(d.MachineName, name, start, attempts, err)
+	e.DriverVersion = Version
+	for _, sink := range sinks {
+		if err := sink.Emit(e); err != nil {
+			log.Debugf("Emitting telemetry event %s: %v", name, err)
+		}
+	}
+}
+
+// timed runs fn and emits its duration as the event name.
+func (d *Driver) timed(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	d.emit(name, start, 0, err)
+	return err
+}
+
+// emitSSHReady waits for the SSH banner of the guest and emits the time it
+// took since booted, only when telemetry is enabled since it adds a wait.
+func (d *Driver) emitSSHReady(booted time.Time) {
+	if len(d.telemetrySinks()) == 0 {
+		return
+	}
+	attempts := 0
+	ready := func() error {
+		attempts++
+		if err := d.heartbeat(); err != nil {
+			return &RetriableError{Err: err}
+		}
+		return nil
+	}
+	err := Retry(RetryPolicy{Timeout: sshReadyTimeout, Backoff: ConstantBackoff(time.Second)}, ready)
+	d.emit(eventSSHReady, booted, attempts, err)
+}
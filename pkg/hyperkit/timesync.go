@@ -0,0 +1,107 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// TimeSync sets the guest clock from the host one over SSH, as boot2docker
+// guests have no NTP client and drift badly.
+const (
+	// timeSyncRunOnce sets the guest clock on every start.
+	timeSyncRunOnce = "run-once"
+	// timeSyncPeriodic also sets it every TimeSyncInterval from a
+	// "time-sync" process of the driver binary managed alongside the VM.
+	timeSyncPeriodic = "periodic"
+	timeSyncName     = "time-sync"
+	// defaultTimeSyncInterval is the interval between two periodic guest
+	// clock checks.
+	defaultTimeSyncInterval = time.Minute
+)
+
+// validateTimeSync checks the --hyperkit-time-sync mode.
+func validateTimeSync(mode string) error {
+	switch mode {
+	case "", timeSyncRunOnce, timeSyncPeriodic:
+		return nil
+	}
+	return fmt.Errorf("invalid time sync mode %q: must be %q or %q", mode, timeSyncRunOnce, timeSyncPeriodic)
+}
+
+// syncTimeOnStart sets the guest clock after the guest boots, logging a
+// failure.
+func (d *Driver) syncTimeOnStart() {
+	if d.TimeSync == "" {
+		return
+	}
+	if err := d.syncGuestClock(); err != nil {
+		log.Warnf("Cannot set the guest clock of %s from the host: %v", d.MachineName, err)
+	}
+}
+
+// startTimeSync starts the periodic time sync if TimeSync is periodic.
+func (d *Driver) startTimeSync() error {
+	d.stopTimeSync()
+	if d.TimeSync != timeSyncPeriodic {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, timeSyncName, d.ResolveStorePath(""))
+	if err := d.startManagedProcess(timeSyncName, cmd); err != nil {
+		return errors.Wrap(err, "starting time sync")
+	}
+	return nil
+}
+
+// stopTimeSync terminates the periodic time sync.
+func (d *Driver) stopTimeSync() {
+	d.stopManagedProcesses(timeSyncName)
+}
+
+// SyncTime sets the guest clock of the machine stored in machineDir every
+// TimeSyncInterval, until the process is terminated.
+func SyncTime(machineDir string) error {
+	d, err := LoadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	if d.TimeSync != timeSyncPeriodic {
+		return errors.New("the periodic time sync is disabled for this machine")
+	}
+	interval := d.TimeSyncInterval
+	if interval <= 0 {
+		interval = defaultTimeSyncInterval
+	}
+	for {
+		time.Sleep(interval)
+		if err := d.syncGuestClock(); err != nil {
+			log.Warnf("Checking the guest clock: %v", err)
+		}
+	}
+}
@@ -22,9 +22,12 @@ import (
 	"strings"
 	"os/exec"
 	"os"
-	"github.com/leoh0/machine/libmachine/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
 	"bufio"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
 )
 
 type RetriableError struct {
@@ -73,6 +76,72 @@ func RetryAfter(attempts int, callback func() error, d time.Duration) (err error
 	return m.ToError()
 }
 
+// Backoff returns how long to sleep after the given failed attempt, counted
+// from 1.
+type Backoff func(attempt int) time.Duration
+
+// ConstantBackoff always sleeps d.
+func ConstantBackoff(d time.Duration) Backoff {
+	return func(int) time.Duration {
+		return d
+	}
+}
+
+// ExponentialBackoff doubles the delay after every attempt, starting from
+// initial and capped at max. Each delay is randomized by up to +/- jitter
+// (a fraction of the delay) so that concurrent loops don't stay in lockstep.
+func ExponentialBackoff(initial, max time.Duration, jitter float64) Backoff {
+	return func(attempt int) time.Duration {
+		d := initial
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		if jitter > 0 {
+			d += time.Duration((rand.Float64()*2 - 1) * jitter * float64(d))
+		}
+		return d
+	}
+}
+
+// RetryPolicy bounds a Retry loop by a time budget rather than a number of
+// attempts.
+type RetryPolicy struct {
+	Timeout time.Duration
+	Backoff Backoff
+	// Progress, if set, is called after every failed attempt.
+	Progress func(attempt int, elapsed time.Duration, err error)
+}
+
+// Retry calls callback until it succeeds, returns an error which is not a
+// RetriableError or the next attempt would start after the policy timeout.
+// The callback is always called at least once.
+func Retry(p RetryPolicy, callback func() error) error {
+	m := MultiError{}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := callback()
+		if err == nil {
+			return nil
+		}
+		m.Collect(err)
+		if _, ok := err.(*RetriableError); !ok {
+			return m.ToError()
+		}
+		elapsed := time.Since(start)
+		if p.Progress != nil {
+			p.Progress(attempt, elapsed, err)
+		}
+		delay := p.Backoff(attempt)
+		if elapsed+delay > p.Timeout {
+			return m.ToError()
+		}
+		time.Sleep(delay)
+	}
+}
+
 func hdiutil(args ...string) error {
 	cmd := exec.Command("hdiutil", args...)
 	cmd.Stdout = os.Stdout
@@ -103,4 +172,29 @@ func readLine(path string) (string, error) {
 		}
 	}
 	return "", fmt.Errorf("couldn't find kernel option from %s image", path)
-}
\ No newline at end of file
+}
+// writeFileAtomic writes data to a new temporary file renamed to path, so
+// that readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -22,6 +22,9 @@ import (
 	vmnet "github.com/zchee/go-vmnet"
 )
 
+// vmnetSupported tells whether MAC addresses can be derived from UUIDs.
+const vmnetSupported = true
+
 func GetMACAddressFromUUID(UUID string) (string, error) {
 	return vmnet.GetMACAddressFromUUID(UUID)
 }
@@ -22,6 +22,9 @@ import (
 	"errors"
 )
 
+// vmnetSupported tells whether MAC addresses can be derived from UUIDs.
+const vmnetSupported = false
+
 func GetMACAddressFromUUID(UUID string) (string, error) {
 	return "", errors.New("Function not supported on CGO_ENABLED=0 binaries")
 }
@@ -0,0 +1,182 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+	"github.com/pkg/errors"
+)
+
+// A vpnkit network interface can be attached in addition to vmnet, so that
+// the outgoing traffic of the VM goes through the host network stack (and
+// thus its VPN) instead of the vmnet NAT. The interface is backed by the
+// vpnkit of Docker Desktop ("auto"), a given vpnkit socket, or a vpnkit
+// instance of the machine ("managed"). The latter is run by a "vpnkit"
+// process of the driver binary managed alongside the VM, which restarts it
+// when it exits.
+const (
+	vpnkitAuto    = "auto"
+	vpnkitManaged = "managed"
+
+	vpnkitName         = "vpnkit"
+	vpnkitEthernetSock = "vpnkit.eth.sock"
+	vpnkitPortSock     = "vpnkit.port.sock"
+	// dockerDesktopVPNKitSock is the vpnkit socket of Docker Desktop,
+	// relative to the home directory.
+	dockerDesktopVPNKitSock = "Library/Containers/com.docker.docker/Data/vpnkit.eth.sock"
+
+	// vpnkitStartTimeout bounds the wait for a managed vpnkit to listen.
+	vpnkitStartTimeout = 10 * time.Second
+	// vpnkitStableRun is how long vpnkit has to run for its restart delay
+	// to be reset.
+	vpnkitStableRun        = time.Minute
+	vpnkitMaxRestartDelay  = 30 * time.Second
+	vpnkitInitRestartDelay = time.Second
+)
+
+// vpnkitSearchPaths are tried after $PATH to find the vpnkit binary.
+var vpnkitSearchPaths = []string{
+	"/Applications/Docker.app/Contents/Resources/bin/com.docker.vpnkit",
+	"/Applications/Docker.app/Contents/Resources/bin/vpnkit",
+}
+
+// validateVPNKit checks mode is empty, "auto", "managed" or a socket path.
+func validateVPNKit(mode string) error {
+	switch mode {
+	case "", vpnkitAuto, vpnkitManaged:
+		return nil
+	}
+	if !filepath.IsAbs(mode) {
+		return fmt.Errorf("invalid vpnkit %q: must be %q, %q or the absolute path of a vpnkit socket", mode, vpnkitAuto, vpnkitManaged)
+	}
+	return nil
+}
+
+// vpnkitSocket returns the vpnkit socket the VM is attached to, if any.
+func (d *Driver) vpnkitSocket() string {
+	switch d.VPNKit {
+	case "":
+		return ""
+	case vpnkitAuto:
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		return filepath.Join(home, dockerDesktopVPNKitSock)
+	case vpnkitManaged:
+		return d.ResolveStorePath(vpnkitEthernetSock)
+	}
+	return d.VPNKit
+}
+
+// vpnkitBinary returns the vpnkit binary run for the managed mode.
+func (d *Driver) vpnkitBinary() (string, error) {
+	if d.VPNKitBinary != "" {
+		return d.VPNKitBinary, nil
+	}
+	if path, err := exec.LookPath("vpnkit"); err == nil {
+		return path, nil
+	}
+	for _, path := range vpnkitSearchPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("vpnkit not found in $PATH nor in Docker Desktop, set its path with --%s", flagVPNKitBinary)
+}
+
+// startVPNKit starts the vpnkit of the machine in the managed mode, and
+// waits for its socket.
+func (d *Driver) startVPNKit() error {
+	d.stopVPNKit()
+	if d.VPNKit != vpnkitManaged {
+		return nil
+	}
+	if _, err := d.vpnkitBinary(); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	sock := d.vpnkitSocket()
+	os.Remove(sock)
+	cmd := exec.Command(exe, vpnkitName, d.ResolveStorePath(""))
+	if err := d.startManagedProcess(vpnkitName, cmd); err != nil {
+		return errors.Wrap(err, "starting vpnkit")
+	}
+
+	deadline := time.Now().Add(vpnkitStartTimeout)
+	for {
+		if _, err := os.Stat(sock); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			d.stopVPNKit()
+			return fmt.Errorf("vpnkit didn't create %s after %s, see %s", sock, vpnkitStartTimeout, d.scratchPath(vpnkitName+".log"))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stopVPNKit terminates the managed vpnkit.
+func (d *Driver) stopVPNKit() {
+	d.stopManagedProcesses(vpnkitName)
+}
+
+// SuperviseVPNKit runs the vpnkit of the machine stored in machineDir,
+// restarting it with an increasing delay whenever it exits, until terminated.
+func SuperviseVPNKit(machineDir string) error {
+	d, err := LoadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	binary, err := d.vpnkitBinary()
+	if err != nil {
+		return err
+	}
+	backoff := ExponentialBackoff(vpnkitInitRestartDelay, vpnkitMaxRestartDelay, 0)
+	for attempt := 1; ; attempt++ {
+		os.Remove(d.ResolveStorePath(vpnkitEthernetSock))
+		os.Remove(d.ResolveStorePath(vpnkitPortSock))
+		cmd := exec.Command(binary,
+			"--ethernet", d.ResolveStorePath(vpnkitEthernetSock),
+			"--port", d.ResolveStorePath(vpnkitPortSock))
+		// The binary is chosen by the user with --hyperkit-vpnkit-binary:
+		// never run it as root.
+		cmd.SysProcAttr = realuser.SysProcAttr()
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		start := time.Now()
+		err := cmd.Run()
+		if time.Since(start) > vpnkitStableRun {
+			attempt = 1
+		}
+		delay := backoff(attempt)
+		log.Warnf("vpnkit exited (%v), restarting it in %s", err, delay)
+		time.Sleep(delay)
+	}
+}
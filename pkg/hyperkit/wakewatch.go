@@ -0,0 +1,160 @@
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/machine/libmachine/state"
+	"github.com/pkg/errors"
+)
+
+// With WakeWatch, a "wake-watch" process of the driver binary managed
+// alongside the VM notices the host waking up from sleep and reconciles the
+// guest with it: the guest clock, which stood still, is set again, the VM
+// address looked up again and the missing NFS mounts mounted again.
+const (
+	wakeWatchName = "wake-watch"
+	// wakePollInterval is the interval between two checks for a sleep.
+	wakePollInterval = 10 * time.Second
+	// minSleep is the wall clock jump counting as a sleep.
+	minSleep = 30 * time.Second
+	// clockCheckInterval is the interval between two guest clock checks
+	// outside of wakes, catching slower drifts.
+	clockCheckInterval = 10 * time.Minute
+	// maxClockSkew is the guest clock skew above which the guest clock is
+	// set to the host one.
+	maxClockSkew = 2 * time.Second
+)
+
+// startWakeWatch starts the wake watcher if WakeWatch is set.
+func (d *Driver) startWakeWatch() error {
+	d.stopWakeWatch()
+	if !d.WakeWatch {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, wakeWatchName, d.ResolveStorePath(""))
+	if err := d.startManagedProcess(wakeWatchName, cmd); err != nil {
+		return errors.Wrap(err, "starting wake watcher")
+	}
+	return nil
+}
+
+// stopWakeWatch terminates the wake watcher.
+func (d *Driver) stopWakeWatch() {
+	d.stopManagedProcesses(wakeWatchName)
+}
+
+// WatchWake reconciles the guest of the machine stored in machineDir with
+// the host after each host sleep, until the process is terminated.
+//
+// The monotonic clock doesn't advance while the Mac sleeps, unlike the wall
+// clock: a sleep shows as a wall clock jump between two polls.
+func WatchWake(machineDir string) error {
+	d, err := LoadDriver(machineDir)
+	if err != nil {
+		return err
+	}
+	if !d.WakeWatch {
+		return errors.New("the wake watcher is disabled for this machine")
+	}
+	last := time.Now()
+	lastClockCheck := last
+	for {
+		time.Sleep(wakePollInterval)
+		now := time.Now()
+		// Round(0) drops the monotonic reading, comparing wall clocks.
+		slept := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+		last = now
+		switch {
+		case slept >= minSleep:
+			log.Infof("The host slept for %s, reconciling %s", slept.Round(time.Second), d.MachineName)
+			d.reconcileAfterWake()
+			lastClockCheck = now
+		case now.Sub(lastClockCheck) >= clockCheckInterval:
+			if err := d.syncGuestClock(); err != nil {
+				log.Warnf("Checking the guest clock: %v", err)
+			}
+			lastClockCheck = now
+		}
+	}
+}
+
+// reconcileAfterWake brings the guest back in line with the host after a
+// sleep, logging what failed.
+func (d *Driver) reconcileAfterWake() {
+	if s, err := d.processState(); err != nil || s != state.Running {
+		return
+	}
+	// The lease may have expired during the sleep.
+	d.refreshIP()
+	if err := d.heartbeat(); err != nil {
+		log.Warnf("The guest of %s doesn't answer after the sleep: %v", d.MachineName, err)
+		return
+	}
+	if err := d.syncGuestClock(); err != nil {
+		log.Warnf("Syncing the guest clock: %v", err)
+	}
+	if err := d.RemountShares(); err != nil {
+		log.Warnf("Remounting the shares: %v", err)
+	}
+}
+
+// guestClockSkew returns how far the guest clock is ahead of the host one,
+// to the second.
+func (d *Driver) guestClockSkew() (time.Duration, error) {
+	before := time.Now()
+	out, err := d.runSSHCommand("date -u +%s")
+	if err != nil {
+		return 0, err
+	}
+	after := time.Now()
+	seconds, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected guest date %q", strings.TrimSpace(out))
+	}
+	host := before.Add(after.Sub(before) / 2)
+	return time.Unix(seconds, 0).Sub(host.Truncate(time.Second)), nil
+}
+
+// syncGuestClock sets the guest clock to the host one when they are more
+// than maxClockSkew apart.
+func (d *Driver) syncGuestClock() error {
+	skew, err := d.guestClockSkew()
+	if err != nil {
+		return err
+	}
+	if skew < maxClockSkew && skew > -maxClockSkew {
+		return nil
+	}
+	log.Infof("The guest clock of %s is %s off, setting it", d.MachineName, skew)
+	// Both busybox and GNU date accept this format.
+	_, err = d.runSSHCommand(fmt.Sprintf(`sudo date -u -s "%s"`, time.Now().UTC().Format("2006-01-02 15:04:05")))
+	return err
+}
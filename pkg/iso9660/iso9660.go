@@ -0,0 +1,296 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package iso9660 reads the files of ISO 9660 images without mounting them,
+// under their Rock Ridge names when the image has some.
+//
+// Only what booting a VM needs is supported: no Joliet names, multi-extent
+// files, relocated directories or continuation areas.
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	sectorSize = 2048
+	// volumeDescriptorStart is the sector of the first volume descriptor.
+	volumeDescriptorStart = 16
+
+	volumeDescriptorPrimary    = 1
+	volumeDescriptorTerminator = 255
+
+	flagDirectory = 0x02
+	// maxDepth bounds the directory nesting, ISO 9660 allows 8 levels and
+	// Rock Ridge images go deeper.
+	maxDepth = 64
+)
+
+// File is a file or a directory of an image.
+type File struct {
+	// Path is the slash-separated path of the file, relative to the root
+	// of the image.
+	Path  string
+	Size  int64
+	IsDir bool
+
+	extent uint32
+}
+
+// Image is an ISO 9660 image.
+type Image struct {
+	r    io.ReaderAt
+	root record
+	// size bounds the extents of the image.
+	size int64
+}
+
+// record is a directory record.
+type record struct {
+	name   string
+	extent uint32
+	size   uint32
+	isDir  bool
+}
+
+// Open reads the primary volume descriptor of the image read from r.
+func Open(r io.ReaderAt) (*Image, error) {
+	buf := make([]byte, sectorSize)
+	for sector := int64(volumeDescriptorStart); ; sector++ {
+		if _, err := r.ReadAt(buf, sector*sectorSize); err != nil {
+			return nil, fmt.Errorf("reading volume descriptor: %v", err)
+		}
+		if string(buf[1:6]) != "CD001" {
+			return nil, fmt.Errorf("not an ISO 9660 image")
+		}
+		switch buf[0] {
+		case volumeDescriptorPrimary:
+			// The root directory record is at offset 156.
+			root, _, err := parseRecord(buf[156:190])
+			if err != nil {
+				return nil, fmt.Errorf("root directory: %v", err)
+			}
+			return &Image{r: r, root: root, size: imageSize(r, buf)}, nil
+		case volumeDescriptorTerminator:
+			return nil, fmt.Errorf("no primary volume descriptor")
+		}
+	}
+}
+
+// imageSize returns the size of the image read from r, that of the file
+// when known, else that of the volume with the primary volume descriptor
+// pvd.
+func imageSize(r io.ReaderAt, pvd []byte) int64 {
+	// The volume space size is at offset 80.
+	size := int64(binary.LittleEndian.Uint32(pvd[80:84])) * sectorSize
+	switch r := r.(type) {
+	case interface{ Stat() (os.FileInfo, error) }:
+		if fi, err := r.Stat(); err == nil && fi.Size() < size {
+			size = fi.Size()
+		}
+	case interface{ Size() int64 }:
+		if r.Size() < size {
+			size = r.Size()
+		}
+	}
+	return size
+}
+
+// parseRecord parses the directory record at the start of b and returns it
+// with its length.
+func parseRecord(b []byte) (record, int, error) {
+	n := int(b[0])
+	if n < 34 || n > len(b) {
+		return record{}, 0, fmt.Errorf("invalid directory record length %d", n)
+	}
+	nameLen := int(b[32])
+	if 33+nameLen > n {
+		return record{}, 0, fmt.Errorf("invalid directory record name length %d", nameLen)
+	}
+	rec := record{
+		extent: binary.LittleEndian.Uint32(b[2:6]),
+		size:   binary.LittleEndian.Uint32(b[10:14]),
+		isDir:  b[25]&flagDirectory != 0,
+	}
+	name := b[33 : 33+nameLen]
+	if nameLen == 1 && (name[0] == 0 || name[0] == 1) {
+		// "." and ".." entries
+		return rec, n, nil
+	}
+	// The system use area, holding the Rock Ridge entries, follows the
+	// name padded to an even length.
+	susp := 33 + nameLen
+	if nameLen%2 == 0 {
+		susp++
+	}
+	rec.name = isoName(string(name), rec.isDir)
+	if susp <= n {
+		if rr, ok := rockRidgeName(b[susp:n]); ok {
+			rec.name = rr
+		}
+	}
+	if rec.name == "." || rec.name == ".." || strings.ContainsAny(rec.name, "/\x00") {
+		// Skipped rather than letting it escape its directory.
+		rec.name = ""
+	}
+	return rec, n, nil
+}
+
+// rockRidgeName returns the name held by the NM entries of a system use
+// area.
+func rockRidgeName(b []byte) (string, bool) {
+	var name []byte
+	found := false
+	for len(b) >= 4 {
+		n := int(b[2])
+		if n < 4 || n > len(b) {
+			break
+		}
+		if string(b[:2]) == "NM" && n >= 5 {
+			found = true
+			name = append(name, b[5:n]...)
+			// Without the CONTINUE flag, this is the last part.
+			if b[4]&0x01 == 0 {
+				break
+			}
+		}
+		b = b[n:]
+	}
+	return string(name), found && len(name) > 0
+}
+
+// isoName turns an ISO 9660 name like "VMLINUZ.;1" into the lowercase name
+// Linux shows for it.
+func isoName(name string, isDir bool) string {
+	if !isDir {
+		if i := strings.IndexByte(name, ';'); i >= 0 {
+			name = name[:i]
+		}
+		name = strings.TrimSuffix(name, ".")
+	}
+	return strings.ToLower(name)
+}
+
+// readDir returns the records of the directory dir.
+func (img *Image) readDir(dir record) ([]record, error) {
+	if int64(dir.extent)*sectorSize+int64(dir.size) > img.size {
+		return nil, fmt.Errorf("directory extent past the end of the image")
+	}
+	data := make([]byte, dir.size)
+	if _, err := img.r.ReadAt(data, int64(dir.extent)*sectorSize); err != nil {
+		return nil, err
+	}
+	var records []record
+	for off := 0; off < len(data); {
+		if data[off] == 0 {
+			// Records don't cross sectors, the rest of this one is padding.
+			off = (off/sectorSize + 1) * sectorSize
+			continue
+		}
+		rec, n, err := parseRecord(data[off:])
+		if err != nil {
+			return nil, err
+		}
+		off += n
+		if rec.name != "" {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+// Walk calls fn for each file and directory of the image, parents first.
+func (img *Image) Walk(fn func(f *File) error) error {
+	visited := map[uint32]bool{img.root.extent: true}
+	var walk func(dir record, dirPath string, depth int) error
+	walk = func(dir record, dirPath string, depth int) error {
+		if depth > maxDepth {
+			return fmt.Errorf("%s: directories nested too deep", dirPath)
+		}
+		records, err := img.readDir(dir)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", dirPath, err)
+		}
+		for _, rec := range records {
+			f := &File{Path: path.Join(dirPath, rec.name), Size: int64(rec.size), IsDir: rec.isDir, extent: rec.extent}
+			if err := fn(f); err != nil {
+				return err
+			}
+			if rec.isDir && !visited[rec.extent] {
+				visited[rec.extent] = true
+				if err := walk(rec, f.Path, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(img.root, "", 0)
+}
+
+// Reader returns a reader of the content of the file f.
+func (img *Image) Reader(f *File) io.Reader {
+	return io.NewSectionReader(img.r, int64(f.extent)*sectorSize, f.Size)
+}
+
+// Extract copies the files of the image at isoPath matched by match into
+// dir, under their path in the image, and returns their paths.
+func Extract(isoPath, dir string, match func(path string) bool) ([]string, error) {
+	f, err := os.Open(isoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, err := Open(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", isoPath, err)
+	}
+	var extracted []string
+	err = img.Walk(func(file *File) error {
+		if file.IsDir || !match(file.Path) {
+			return nil
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(file.Path))
+		if err := extractFile(img.Reader(file), dest); err != nil {
+			return fmt.Errorf("extracting %s: %v", file.Path, err)
+		}
+		extracted = append(extracted, dest)
+		return nil
+	})
+	return extracted, err
+}
+
+func extractFile(r io.Reader, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
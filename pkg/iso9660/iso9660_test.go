@@ -0,0 +1,235 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// dirRecord returns a directory record of name with the system use area
+// susp, padded to an even length.
+func dirRecord(name string, extent, size uint32, isDir bool, susp []byte) []byte {
+	b := make([]byte, 33, 64)
+	binary.LittleEndian.PutUint32(b[2:6], extent)
+	binary.BigEndian.PutUint32(b[6:10], extent)
+	binary.LittleEndian.PutUint32(b[10:14], size)
+	binary.BigEndian.PutUint32(b[14:18], size)
+	if isDir {
+		b[25] = flagDirectory
+	}
+	b[32] = byte(len(name))
+	b = append(b, name...)
+	if len(name)%2 == 0 {
+		b = append(b, 0)
+	}
+	b = append(b, susp...)
+	if len(b)%2 != 0 {
+		b = append(b, 0)
+	}
+	b[0] = byte(len(b))
+	return b
+}
+
+// nm returns a Rock Ridge NM entry of name with flags.
+func nm(name string, flags byte) []byte {
+	return append([]byte{'N', 'M', byte(5 + len(name)), 1, flags}, name...)
+}
+
+func TestParseRecord(t *testing.T) {
+	valid := dirRecord("VMLINUZ.;1", 20, 100, false, nil)
+	tests := []struct {
+		name    string
+		b       []byte
+		want    record
+		wantErr bool
+	}{
+		{name: "iso name", b: valid, want: record{name: "vmlinuz", extent: 20, size: 100}},
+		{name: "directory", b: dirRecord("BOOT", 21, 2048, true, nil), want: record{name: "boot", extent: 21, size: 2048, isDir: true}},
+		{name: "dot", b: dirRecord("\x00", 18, 2048, true, nil), want: record{extent: 18, size: 2048, isDir: true}},
+		{name: "dot dot", b: dirRecord("\x01", 18, 2048, true, nil), want: record{extent: 18, size: 2048, isDir: true}},
+		{name: "rock ridge name", b: dirRecord("INITRD.;1", 22, 10, false, nm("initrd.img", 0)), want: record{name: "initrd.img", extent: 22, size: 10}},
+		{name: "rock ridge continuation", b: dirRecord("INITRD.;1", 22, 10, false, append(nm("init", 1), nm("rd.img", 0)...)), want: record{name: "initrd.img", extent: 22, size: 10}},
+		{name: "rock ridge after other entries", b: dirRecord("A.;1", 23, 1, false, append([]byte{'P', 'X', 4, 1}, nm("a.txt", 0)...)), want: record{name: "a.txt", extent: 23, size: 1}},
+		{name: "rock ridge slash", b: dirRecord("A.;1", 23, 1, false, nm("../etc", 0)), want: record{extent: 23, size: 1}},
+		{name: "rock ridge dot dot", b: dirRecord("A.;1", 23, 1, false, nm("..", 0)), want: record{extent: 23, size: 1}},
+		{name: "rock ridge nul", b: dirRecord("A.;1", 23, 1, false, nm("a\x00b", 0)), want: record{extent: 23, size: 1}},
+		{name: "truncated", b: valid[:len(valid)-1], wantErr: true},
+		{name: "short length", b: append([]byte{33}, valid[1:]...), wantErr: true},
+		{name: "name past the record", b: append(append([]byte{}, valid[:32]...), append([]byte{byte(len(valid))}, valid[33:]...)...), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, n, err := parseRecord(tt.b)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseRecord() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRecord() error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseRecord() = %+v, want %+v", got, tt.want)
+			}
+			if n != int(tt.b[0]) {
+				t.Errorf("parseRecord() length = %d, want %d", n, tt.b[0])
+			}
+		})
+	}
+}
+
+func TestRockRidgeName(t *testing.T) {
+	tests := []struct {
+		name   string
+		b      []byte
+		want   string
+		wantOK bool
+	}{
+		{name: "empty"},
+		{name: "single", b: nm("vmlinuz", 0), want: "vmlinuz", wantOK: true},
+		{name: "continued", b: append(append(nm("vm", 1), nm("lin", 1)...), nm("uz", 0)...), want: "vmlinuz", wantOK: true},
+		{name: "last part first", b: append(nm("vm", 0), nm("linuz", 0)...), want: "vm", wantOK: true},
+		{name: "continuation area skipped", b: append(append([]byte{'C', 'E', 28, 1}, make([]byte, 24)...), nm("vmlinuz", 0)...), want: "vmlinuz", wantOK: true},
+		{name: "current directory flag", b: nm("", 2)},
+		{name: "entry past the area", b: nm("vmlinuz", 0)[:6]},
+		{name: "entry length too short", b: []byte{'N', 'M', 3, 1, 0, 'a'}},
+		{name: "stops at a bad entry", b: append(nm("a", 1), 'N', 'M', 0, 1), want: "a", wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rockRidgeName(tt.b)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("rockRidgeName() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// testImage returns an image whose root directory, at sector 18, holds the
+// file VMLINUZ at sector 20 and the directory BOOT at sector 19, itself
+// holding INITRD, named initrd.img by Rock Ridge, at sector 21.
+func testImage() []byte {
+	img := make([]byte, 22*sectorSize)
+	pvd := img[16*sectorSize:]
+	pvd[0] = volumeDescriptorPrimary
+	copy(pvd[1:6], "CD001")
+	binary.LittleEndian.PutUint32(pvd[80:84], 22)
+	copy(pvd[156:190], dirRecord("\x00", 18, sectorSize, true, nil))
+	term := img[17*sectorSize:]
+	term[0] = volumeDescriptorTerminator
+	copy(term[1:6], "CD001")
+
+	root := img[18*sectorSize:]
+	off := 0
+	for _, rec := range [][]byte{
+		dirRecord("\x00", 18, sectorSize, true, nil),
+		dirRecord("\x01", 18, sectorSize, true, nil),
+		dirRecord("BOOT", 19, sectorSize, true, nil),
+		dirRecord("VMLINUZ.;1", 20, 6, false, nil),
+	} {
+		off += copy(root[off:], rec)
+	}
+	boot := img[19*sectorSize:]
+	off = 0
+	for _, rec := range [][]byte{
+		dirRecord("\x00", 19, sectorSize, true, nil),
+		dirRecord("\x01", 18, sectorSize, true, nil),
+		dirRecord("INITRD.;1", 21, 6, false, nm("initrd.img", 0)),
+	} {
+		off += copy(boot[off:], rec)
+	}
+	copy(img[20*sectorSize:], "kernel")
+	copy(img[21*sectorSize:], "initrd")
+	return img
+}
+
+func TestWalk(t *testing.T) {
+	img, err := Open(bytes.NewReader(testImage()))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	var paths []string
+	contents := map[string]string{}
+	err = img.Walk(func(f *File) error {
+		paths = append(paths, f.Path)
+		if !f.IsDir {
+			b, err := ioutil.ReadAll(img.Reader(f))
+			if err != nil {
+				return err
+			}
+			contents[f.Path] = string(b)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk() error: %v", err)
+	}
+	if want := []string{"boot", "boot/initrd.img", "vmlinuz"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Walk() paths = %q, want %q", paths, want)
+	}
+	if want := map[string]string{"boot/initrd.img": "initrd", "vmlinuz": "kernel"}; !reflect.DeepEqual(contents, want) {
+		t.Errorf("Walk() contents = %q, want %q", contents, want)
+	}
+}
+
+func TestOpenTruncated(t *testing.T) {
+	for _, size := range []int{0, 16 * sectorSize, 16*sectorSize + 100} {
+		if _, err := Open(bytes.NewReader(testImage()[:size])); err == nil {
+			t.Errorf("Open() of %d bytes succeeded, want an error", size)
+		}
+	}
+}
+
+func TestReadDirOutOfImage(t *testing.T) {
+	data := testImage()
+	// Point the BOOT directory past the end of the image.
+	rec := dirRecord("BOOT", 1000, sectorSize, true, nil)
+	copy(data[18*sectorSize+68:], rec)
+	img, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	if err := img.Walk(func(*File) error { return nil }); err == nil {
+		t.Error("Walk() succeeded, want an error for the directory past the end of the image")
+	}
+}
+
+func TestReadDirLoop(t *testing.T) {
+	data := testImage()
+	// Make BOOT hold itself: the walk must not loop.
+	boot := data[19*sectorSize : 20*sectorSize]
+	for i := range boot[68:] {
+		boot[68+i] = 0
+	}
+	copy(boot[68:], dirRecord("SELF", 19, sectorSize, true, nil))
+	img, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	n := 0
+	if err := img.Walk(func(*File) error { n++; return nil }); err != nil {
+		t.Fatalf("Walk() error: %v", err)
+	}
+	if n > 10 {
+		t.Errorf("Walk() visited %d files, want the loop to be cut", n)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lock serializes the driver processes of concurrent docker-machine
+// commands around the host resources they share, e.g. /etc/exports or the
+// ISO cache, with flock(2) on lock files. The locks are released by the
+// kernel when a process dies.
+package lock
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+)
+
+// HostDir holds the lock files of host-wide resources taken by root, e.g.
+// by the driver installed setuid root. Only root can create or open them,
+// so that no user can plant a lock file or hold a lock forever.
+const HostDir = "/var/run/docker-machine-driver-hyperkit"
+
+// Lock is an exclusive lock held on a lock file.
+type Lock struct {
+	f *os.File
+}
+
+// HostPath returns the lock file of the host-wide resource name: in HostDir
+// for root, else in a directory of the user, which only serializes the
+// processes of that user.
+func HostPath(name string) string {
+	return filepath.Join(hostDir(), name+".lock")
+}
+
+// hostDir returns the directory of the host-wide lock files of the process.
+func hostDir() string {
+	if os.Geteuid() == 0 {
+		return HostDir
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("docker-machine-driver-hyperkit-%d", os.Geteuid()))
+}
+
+// Acquire takes the lock of the file at path, creating it if needed, and
+// waits until the process holding it releases it.
+func Acquire(path string) (*Lock, error) {
+	dir, perm := filepath.Dir(path), os.FileMode(0644)
+	if dir == hostDir() {
+		dirPerm := os.FileMode(0700)
+		if dir == HostDir {
+			dirPerm, perm = 0755, 0600
+		}
+		if err := os.MkdirAll(dir, dirPerm); err != nil {
+			return nil, err
+		}
+		if err := checkLockDir(dir); err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// flock works on read-only descriptors, which lets unprivileged
+	// processes share the lock files they can read. A symbolic link
+	// planted at path is refused.
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE|syscall.O_NOFOLLOW, perm)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		log.Infof("Waiting for another driver process to release %s", path)
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	}
+	if err == syscall.ENOTSUP || err == syscall.EOPNOTSUPP {
+		// Network volumes may not support flock: lock a file on the
+		// host standing for path instead.
+		f.Close()
+		fallback := HostPath(fmt.Sprintf("%x", sha256.Sum256([]byte(path)))[:16])
+		log.Debugf("%s does not support flock, locking %s instead", path, fallback)
+		return Acquire(fallback)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{f: f}, nil
+}
+
+// checkLockDir fails unless the lock directory dir belongs to the process
+// and isn't a symbolic link, e.g. one created beforehand by another user.
+func checkLockDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("refusing the lock directory %s: it must be a directory owned by uid %d", dir, os.Geteuid())
+	}
+	return nil
+}
+
+// Release releases the lock.
+func (l *Lock) Release() error {
+	return l.f.Close()
+}
+
+// With runs fn holding the lock of the file at path.
+func With(path string, fn func() error) error {
+	l, err := Acquire(path)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	return fn()
+}
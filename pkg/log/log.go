@@ -0,0 +1,253 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package log is the logger of the driver. Entries below the configured
+// level are dropped, the others go to the docker-machine log, as text or
+// JSON lines, and to the driver log file of the machine when one is set.
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mlog "github.com/leoh0/machine/libmachine/log"
+)
+
+// Level is the severity of an entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// MarshalText makes levels appear by name in JSON entries.
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// ParseLevel parses a level name. The empty string is LevelInfo, or
+// LevelDebug when docker-machine runs with --debug.
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		if os.Getenv("MACHINE_DEBUG") != "" {
+			return LevelDebug, nil
+		}
+		return LevelInfo, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q: must be one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// Entry formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// ValidateFormat checks format is empty (text), "text" or "json".
+func ValidateFormat(format string) error {
+	switch format {
+	case "", FormatText, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid log format %q: must be %q or %q", format, FormatText, FormatJSON)
+}
+
+// Entry is a log entry.
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Level   Level     `json:"level"`
+	Machine string    `json:"machine,omitempty"`
+	Message string    `json:"msg"`
+}
+
+// Logger is an output of the entries.
+type Logger interface {
+	Log(e Entry)
+}
+
+// MachineLogger writes the entries to the docker-machine log, which the
+// docker-machine client shows for the driver plugin.
+type MachineLogger struct{}
+
+func (MachineLogger) Log(e Entry) {
+	switch e.Level {
+	case LevelDebug:
+		mlog.Debug(e.Message)
+	case LevelInfo:
+		mlog.Info(e.Message)
+	case LevelWarn:
+		mlog.Warn(e.Message)
+	default:
+		mlog.Error(e.Message)
+	}
+}
+
+// WriterLogger writes the entries to W as lines of Format.
+type WriterLogger struct {
+	W      io.Writer
+	Format string
+
+	mu sync.Mutex
+}
+
+func (l *WriterLogger) Log(e Entry) {
+	line := formatEntry(e, l.Format)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// A logger has nowhere to report its own failures.
+	_, _ = l.W.Write(line)
+}
+
+// formatEntry returns e as a line of format.
+func formatEntry(e Entry, format string) []byte {
+	if format == FormatJSON {
+		b, err := json.Marshal(e)
+		if err == nil {
+			return append(b, '\n')
+		}
+	}
+	var b strings.Builder
+	b.WriteString(e.Time.Format(time.RFC3339))
+	fmt.Fprintf(&b, " %-5s ", strings.ToUpper(e.Level.String()))
+	if e.Machine != "" {
+		fmt.Fprintf(&b, "(%s) ", e.Machine)
+	}
+	b.WriteString(strings.TrimRight(e.Message, "\n"))
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// Config configures the package logger.
+type Config struct {
+	// Level is the level below which entries are dropped.
+	Level Level
+	// Format is the format of the docker-machine log and of File: text
+	// entries go through the docker-machine logger, JSON entries are
+	// written to stderr.
+	Format string
+	// Machine is the machine name added to the entries.
+	Machine string
+	// File is the driver log file, rotated by RotatingFile, or empty.
+	File string
+}
+
+var (
+	mu      sync.RWMutex
+	config  = Config{Level: LevelDebug}
+	loggers = []Logger{MachineLogger{}}
+	file    *RotatingFile
+)
+
+// Configure applies c. Loggers set with SetLoggers are replaced.
+func Configure(c Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.Level == LevelDebug {
+		mlog.SetDebug(true)
+	}
+	console := Logger(MachineLogger{})
+	if c.Format == FormatJSON {
+		console = &WriterLogger{W: os.Stderr, Format: FormatJSON}
+	}
+	loggers = []Logger{console}
+	if file == nil || file.Path != c.File {
+		if file != nil {
+			file.Close()
+			file = nil
+		}
+		if c.File != "" {
+			file = &RotatingFile{Path: c.File, MaxSize: DefaultMaxSize, Backups: DefaultBackups}
+		}
+	}
+	if file != nil {
+		loggers = append(loggers, &WriterLogger{W: file, Format: c.Format})
+	}
+	config = c
+}
+
+// SetLoggers replaces the outputs of the entries, keeping the level and
+// the machine name.
+func SetLoggers(l ...Logger) {
+	mu.Lock()
+	defer mu.Unlock()
+	loggers = l
+}
+
+func logf(level Level, message string) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if level < config.Level {
+		return
+	}
+	e := Entry{Time: time.Now(), Level: level, Machine: config.Machine, Message: message}
+	for _, l := range loggers {
+		l.Log(e)
+	}
+}
+
+func Debug(args ...interface{}) {
+	logf(LevelDebug, fmt.Sprint(args...))
+}
+
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func Info(args ...interface{}) {
+	logf(LevelInfo, fmt.Sprint(args...))
+}
+
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func Warn(args ...interface{}) {
+	logf(LevelWarn, fmt.Sprint(args...))
+}
+
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func Error(args ...interface{}) {
+	logf(LevelError, fmt.Sprint(args...))
+}
+
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, fmt.Sprintf(format, args...))
+}
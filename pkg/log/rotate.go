@@ -0,0 +1,107 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package log
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	// DefaultMaxSize is the size beyond which the driver log is rotated.
+	DefaultMaxSize = 10 << 20
+	// DefaultBackups is the number of rotated driver logs kept.
+	DefaultBackups = 3
+)
+
+// RotatingFile is a log file renamed to Path.1, Path.2... up to
+// Path.<Backups> once it grows beyond MaxSize. It is opened on the first
+// write, in append mode since several driver processes write to it.
+type RotatingFile struct {
+	Path    string
+	MaxSize int64
+	Backups int
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.rotate(); err != nil {
+		return 0, err
+	}
+	if r.f == nil {
+		f, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return 0, err
+		}
+		// Keep the log writable by the user when the driver runs setuid.
+		if os.Geteuid() != os.Getuid() {
+			_ = f.Chown(os.Getuid(), os.Getgid())
+		}
+		r.f = f
+	}
+	return r.f.Write(p)
+}
+
+// rotate rotates the file when it is too large. The size is that of the
+// path, not of the open file, so that a file rotated by another process is
+// reopened.
+func (r *RotatingFile) rotate() error {
+	fi, err := os.Stat(r.Path)
+	if os.IsNotExist(err) {
+		r.closeFile()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.f != nil {
+		if open, err := r.f.Stat(); err == nil && !os.SameFile(fi, open) {
+			r.closeFile()
+		}
+	}
+	if r.MaxSize <= 0 || fi.Size() < r.MaxSize {
+		return nil
+	}
+	r.closeFile()
+	for i := r.Backups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.Path, i), fmt.Sprintf("%s.%d", r.Path, i+1))
+	}
+	if r.Backups > 0 {
+		return os.Rename(r.Path, r.Path+".1")
+	}
+	return os.Remove(r.Path)
+}
+
+func (r *RotatingFile) closeFile() {
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+// Close closes the file.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeFile()
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package portforward implements the host to guest port forwarding proxies
+// of the hyperkit driver.
+package portforward
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/log"
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+)
+
+const udpIdleTimeout = 2 * time.Minute
+
+// FirstUnprivilegedPort is the first port which processes without root may
+// bind.
+const FirstUnprivilegedPort = 1024
+
+// Forward forwards HostPort on localhost to GuestPort of the VM.
+type Forward struct {
+	HostPort  int
+	GuestPort int
+	Proto     string
+}
+
+// Parse parses a "hostPort:guestPort[/tcp|udp]" specification.
+func Parse(spec string) (Forward, error) {
+	f := Forward{Proto: "tcp"}
+	ports := spec
+	if i := strings.Index(spec, "/"); i >= 0 {
+		ports, f.Proto = spec[:i], strings.ToLower(spec[i+1:])
+	}
+	if f.Proto != "tcp" && f.Proto != "udp" {
+		return f, fmt.Errorf("invalid port forward %q: protocol must be tcp or udp", spec)
+	}
+	parts := strings.Split(ports, ":")
+	if len(parts) != 2 {
+		return f, fmt.Errorf("invalid port forward %q: expected hostPort:guestPort[/proto]", spec)
+	}
+	var err error
+	if f.HostPort, err = parsePort(parts[0]); err != nil {
+		return f, fmt.Errorf("invalid port forward %q: %v", spec, err)
+	}
+	if f.GuestPort, err = parsePort(parts[1]); err != nil {
+		return f, fmt.Errorf("invalid port forward %q: %v", spec, err)
+	}
+	return f, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%d:%d/%s", f.HostPort, f.GuestPort, f.Proto)
+}
+
+// Serve proxies connections to localhost:f.HostPort to guestIP:f.GuestPort
+// until the listener fails. The privileges of a setuid driver, needed to bind
+// a privileged port, are dropped once listening.
+func Serve(f Forward, guestIP string) error {
+	listen := net.JoinHostPort("127.0.0.1", strconv.Itoa(f.HostPort))
+	target := net.JoinHostPort(guestIP, strconv.Itoa(f.GuestPort))
+	log.Infof("Forwarding %s/%s to %s", listen, f.Proto, target)
+	if f.Proto == "udp" {
+		return serveUDP(listen, target)
+	}
+	return serveTCP(listen, target)
+}
+
+func serveTCP(listen, target string) error {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := realuser.Drop(); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go proxyTCP(conn, target)
+	}
+}
+
+func proxyTCP(conn net.Conn, target string) {
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		log.Warnf("port forward: dialing %s: %v", target, err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func serveUDP(listen, target string) error {
+	laddr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return err
+	}
+	l, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := realuser.Drop(); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	upstreams := map[string]*net.UDPConn{}
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := l.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		upstream, ok := upstreams[client.String()]
+		if !ok {
+			upstream, err = net.DialUDP("udp", nil, raddr)
+			if err != nil {
+				mu.Unlock()
+				log.Warnf("port forward: dialing %s: %v", target, err)
+				continue
+			}
+			upstreams[client.String()] = upstream
+			go func(client *net.UDPAddr, upstream *net.UDPConn) {
+				replyUDP(l, client, upstream)
+				mu.Lock()
+				delete(upstreams, client.String())
+				mu.Unlock()
+			}(client, upstream)
+		}
+		mu.Unlock()
+
+		if _, err := upstream.Write(buf[:n]); err != nil {
+			log.Warnf("port forward: writing to %s: %v", target, err)
+		}
+	}
+}
+
+// replyUDP copies the guest replies back to client until the upstream has
+// been idle for udpIdleTimeout.
+func replyUDP(l *net.UDPConn, client *net.UDPAddr, upstream *net.UDPConn) {
+	defer upstream.Close()
+	buf := make([]byte, 65535)
+	for {
+		upstream.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := l.WriteToUDP(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
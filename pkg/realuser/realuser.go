@@ -0,0 +1,138 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package realuser does the work of the driver on behalf of the user
+// invoking it. The driver binary may be installed setuid root so that it
+// can start hyperkit with vmnet; paths and commands the user controls are
+// then only ever used with the privileges of that user.
+package realuser
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// accessRead is R_OK of access(2).
+const accessRead = 0x4
+
+// Setuid tells whether the driver runs with the privileges of another user
+// than the one invoking it.
+func Setuid() bool {
+	return os.Geteuid() != os.Getuid()
+}
+
+// SysProcAttr returns the attributes running a command as the invoking
+// user, nil when the driver runs as that user already.
+func SysProcAttr() *syscall.SysProcAttr {
+	if !Setuid() {
+		return nil
+	}
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid()), NoSetGroups: true},
+	}
+}
+
+// Command is exec.Command running the command as the invoking user.
+func Command(name string, arg ...string) *exec.Cmd {
+	cmd := exec.Command(name, arg...)
+	cmd.SysProcAttr = SysProcAttr()
+	return cmd
+}
+
+// CheckReadable fails unless the invoking user may read path. access(2)
+// checks the real ids, not the effective ones.
+func CheckReadable(path string) error {
+	if err := syscall.Access(path, accessRead); err != nil {
+		return &os.PathError{Op: "access", Path: path, Err: err}
+	}
+	return nil
+}
+
+// CheckOwned fails unless path is owned by the invoking user and isn't a
+// symbolic link.
+func CheckOwned(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s is a symbolic link", path)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s isn't owned by uid %d", path, os.Getuid())
+	}
+	return nil
+}
+
+// HomeDir returns the home directory of the invoking user from the user
+// database; $HOME is set by that user and isn't trusted.
+func HomeDir() (string, error) {
+	u, err := user.LookupId(strconv.Itoa(os.Getuid()))
+	if err != nil {
+		return "", err
+	}
+	return u.HomeDir, nil
+}
+
+// mu serializes Do: the effective ids are those of the whole process.
+var mu sync.Mutex
+
+// Do runs f with the effective ids of the invoking user and restores the
+// privileges afterwards. The ids are those of the whole process, so the
+// caller makes sure no privileged work runs meanwhile.
+func Do(f func() error) error {
+	if !Setuid() {
+		return f()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	euid, egid := os.Geteuid(), os.Getegid()
+	if err := syscall.Setegid(os.Getgid()); err != nil {
+		return err
+	}
+	if err := syscall.Seteuid(os.Getuid()); err != nil {
+		_ = syscall.Setegid(egid)
+		return err
+	}
+	defer func() {
+		// The saved set-user-ID lets the process take the ids back.
+		if err := syscall.Seteuid(euid); err != nil {
+			panic(fmt.Sprintf("restoring uid %d: %v", euid, err))
+		}
+		if err := syscall.Setegid(egid); err != nil {
+			panic(fmt.Sprintf("restoring gid %d: %v", egid, err))
+		}
+	}()
+	return f()
+}
+
+// Drop gives up the privileges of the driver for good, for the commands
+// that don't need them.
+func Drop() error {
+	if !Setuid() && os.Getegid() == os.Getgid() {
+		return nil
+	}
+	if err := syscall.Setgid(os.Getgid()); err != nil {
+		return err
+	}
+	return syscall.Setuid(os.Getuid())
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package resolver manages the macOS /etc/resolver entries sending the DNS
+// queries of a domain to a VM.
+package resolver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Dir is where macOS looks for per-domain resolver configurations.
+	Dir = "/etc/resolver"
+
+	marker = "# Generated by docker-machine-driver-hyperkit"
+	// ownerPrefix starts the line recording the uid an entry was written
+	// for. Entries of older drivers don't have it and belong to root.
+	ownerPrefix = "# uid "
+)
+
+// userSuffixes are the suffixes of the domains users other than root may
+// send to their VM: names reserved for testing and private use, which the
+// host doesn't otherwise resolve.
+var userSuffixes = []string{".test", ".internal", ".docker"}
+
+var domainRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// ValidateDomain checks domain can safely be used as a resolver file name.
+func ValidateDomain(domain string) error {
+	if !domainRegexp.MatchString(domain) {
+		return fmt.Errorf("invalid resolver domain %q", domain)
+	}
+	return nil
+}
+
+// CheckDomain checks domain is valid and, unless uid is root, below one of
+// userSuffixes, so that users can't redirect the DNS queries of the host
+// for other domains.
+func CheckDomain(domain string, uid int) error {
+	if err := ValidateDomain(domain); err != nil {
+		return err
+	}
+	if uid == 0 {
+		return nil
+	}
+	for _, suffix := range userSuffixes {
+		if strings.HasSuffix(strings.ToLower(domain), suffix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid resolver domain %q: only root may use a domain outside of %s", domain, strings.Join(userSuffixes, ", "))
+}
+
+// Write points the resolution of domain at the name server on ip for the
+// user uid, who may only replace their own entries unless root.
+func Write(domain, ip string, uid int) error {
+	if err := CheckDomain(domain, uid); err != nil {
+		return err
+	}
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid name server address %q", ip)
+	}
+	path := filepath.Join(Dir, domain)
+	if err := checkOwner(path, uid); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(Dir, 0755); err != nil {
+		return err
+	}
+	content := fmt.Sprintf("%s\n%s%d\nnameserver %s\n", marker, ownerPrefix, uid, ip)
+	return ioutil.WriteFile(path, []byte(content), 0644)
+}
+
+// Remove removes the resolver entry of domain if it was created by Write for
+// uid, or for anyone when uid is root.
+func Remove(domain string, uid int) error {
+	if err := ValidateDomain(domain); err != nil {
+		return err
+	}
+	path := filepath.Join(Dir, domain)
+	if err := checkOwner(path, uid); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checkOwner fails unless the entry at path was created by Write for uid, or
+// for anyone when uid is root. A missing entry fails with a not exist error.
+func checkOwner(path string, uid int) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(b), "\n")
+	if lines[0] != marker {
+		return fmt.Errorf("%s exists and was not created by the hyperkit driver", path)
+	}
+	owner := 0
+	if len(lines) > 1 && strings.HasPrefix(lines[1], ownerPrefix) {
+		if owner, err = strconv.Atoi(strings.TrimPrefix(lines[1], ownerPrefix)); err != nil {
+			return fmt.Errorf("%s has an invalid owner line %q", path, lines[1])
+		}
+	}
+	if uid != 0 && owner != uid {
+		return fmt.Errorf("%s belongs to uid %d", path, owner)
+	}
+	return nil
+}
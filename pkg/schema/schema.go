@@ -0,0 +1,285 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package schema describes the files the driver keeps in a machine directory
+// (e.g. ~/.docker/machine/machines/<name>), so that external tools such as
+// backup scripts and dashboards can read them.
+//
+// Fields are only ever added to the types below. Incompatible changes bump
+// the version of the file.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files of a machine directory
+const (
+	// MachineMetadataFile holds a MachineMetadata.
+	MachineMetadataFile = "machine.json"
+	// HyperKitStateFile is written by hyperkit and holds a HyperKitState.
+	HyperKitStateFile = "hyperkit.json"
+	// DriverConfigFile is the docker-machine configuration of the machine,
+	// holding the driver configuration under "Driver".
+	DriverConfigFile = "config.json"
+	// BootSlotFile holds the BootSlot of a boot-a or boot-b directory.
+	BootSlotFile = "slot.json"
+	// SnapshotFile holds the Snapshot of a snapshots/<name> directory.
+	SnapshotFile = "snapshot.json"
+	// SSHHostKeyFile is the pinned guest SSH host key, in authorized_keys
+	// format.
+	SSHHostKeyFile = "ssh_host_key.pub"
+	// LayoutFile holds the Layout of the machine directory.
+	LayoutFile = "layout.json"
+)
+
+// LayoutVersion is the current version of the machine directory layout.
+// Machine directories without a LayoutFile have version 0.
+//
+//	1: the boot artifacts are in the boot-a or boot-b slot directories.
+//	2: the kernel and initrd given by the user are kept in CustomKernel and
+//	   CustomInitrd rather than BootKernel and BootInitrd.
+const LayoutVersion = 2
+
+// Layout records the version of the machine directory layout, which the
+// driver upgrades in place on start.
+type Layout struct {
+	Version int `json:"version"`
+	// DriverVersion is the version of the driver that last upgraded the
+	// layout.
+	DriverVersion string    `json:"driver_version"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// MachineMetadataVersion is the current version of MachineMetadata.
+const MachineMetadataVersion = 1
+
+// MachineMetadata describes a machine for external tools.
+type MachineMetadata struct {
+	Version       int            `json:"version"`
+	DriverVersion string         `json:"driver_version"`
+	MachineName   string         `json:"machine_name"`
+	UUID          string         `json:"uuid"`
+	ISOChecksum   string         `json:"iso_checksum,omitempty"`
+	MACAddress    string         `json:"mac_address,omitempty"`
+	IPHistory     []IPRecord     `json:"ip_history,omitempty"`
+	Cmdline       string         `json:"cmdline"`
+	CPUs          int            `json:"cpus"`
+	Memory        int            `json:"memory"`
+	Disks         []DiskMetadata `json:"disks"`
+	NFSShares     []string       `json:"nfs_shares,omitempty"`
+	DiskUsage     *DiskUsage     `json:"disk_usage,omitempty"`
+	// ExportedShares are the host directories exported over NFS by the
+	// last start, compared to NFSShares on the next one to clean up the
+	// shares removed or renamed since.
+	ExportedShares []string `json:"exported_shares,omitempty"`
+	// ISOSize and ISOModTime are those of the boot ISO when ISOChecksum
+	// was computed, sparing its hashing while they don't change.
+	ISOSize    int64      `json:"iso_size,omitempty"`
+	ISOModTime *time.Time `json:"iso_mod_time,omitempty"`
+	// KernelLog is the state of the guest kernel log monitor.
+	KernelLog *KernelLog `json:"kernel_log,omitempty"`
+	// ConsoleLog is the file the guest console output of the current boot
+	// is appended to, for callers to tail.
+	ConsoleLog string `json:"console_log,omitempty"`
+	// Interfaces are the network interfaces of the guest, as seen after
+	// the last start.
+	Interfaces []NetworkInterface `json:"interfaces,omitempty"`
+	// Phase is the lifecycle phase of the machine, one of the Phase
+	// constants, entered at PhaseChangedAt.
+	Phase          string    `json:"phase,omitempty"`
+	PhaseChangedAt time.Time `json:"phase_changed_at"`
+	// BootCount is the number of hyperkit starts, the last one at
+	// StartedAt.
+	BootCount int       `json:"boot_count"`
+	StartedAt time.Time `json:"started_at"`
+	// UncleanShutdowns counts the starts finding the previous hyperkit
+	// gone without a clean shutdown, e.g. because it crashed.
+	UncleanShutdowns int `json:"unclean_shutdowns"`
+	// ShouldRun is set from a successful start to the next stop, while
+	// the supervisor restarts a hyperkit that died.
+	ShouldRun bool `json:"should_run,omitempty"`
+	// SupervisorRestarts counts the restarts by the supervisor since the
+	// machine last ran long enough, the last one at SupervisorRestartAt.
+	SupervisorRestarts  int       `json:"supervisor_restarts,omitempty"`
+	SupervisorRestartAt time.Time `json:"supervisor_restart_at,omitempty"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+// Lifecycle phases of a machine
+const (
+	PhaseStarting     = "starting"
+	PhaseBooting      = "booting"
+	PhaseProvisioning = "provisioning"
+	PhaseRunning      = "running"
+	PhaseStopping     = "stopping"
+	PhaseError        = "error"
+)
+
+// KernelLog holds the notable guest kernel events, such as OOM kills, found
+// by the kernel log monitor.
+type KernelLog struct {
+	CheckedAt time.Time `json:"checked_at"`
+	// Boot and Cursor locate the last line read: the BootCount of the
+	// machine and the kernel timestamp of the line.
+	Boot   int           `json:"boot"`
+	Cursor float64       `json:"cursor"`
+	Events []KernelEvent `json:"events,omitempty"`
+}
+
+// KernelEvent is a notable guest kernel log line.
+type KernelEvent struct {
+	Time time.Time `json:"time"`
+	// Kind is "oom", "hung_task", "lockup" or "bug".
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// NetworkInterface is a network interface of the guest.
+type NetworkInterface struct {
+	Name string `json:"name"`
+	// Network is "vmnet" or "vpnkit".
+	Network string `json:"network,omitempty"`
+	MAC     string `json:"mac"`
+	IPv4    string `json:"ipv4,omitempty"`
+}
+
+// IPRecord is an IP address the VM had.
+type IPRecord struct {
+	IP        string    `json:"ip"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// DiskMetadata is a disk attached to the VM.
+type DiskMetadata struct {
+	Path string `json:"path"`
+	Size int    `json:"size_mb"`
+}
+
+// DiskUsage is the result of the last guest disk usage check.
+type DiskUsage struct {
+	CheckedAt   time.Time         `json:"checked_at"`
+	Filesystems []FilesystemUsage `json:"filesystems"`
+	LastPrune   *PruneRecord      `json:"last_prune,omitempty"`
+}
+
+// FilesystemUsage is the usage of the guest filesystem holding Path.
+type FilesystemUsage struct {
+	Path        string `json:"path"`
+	Mount       string `json:"mount"`
+	SizeKB      int64  `json:"size_kb"`
+	UsedKB      int64  `json:"used_kb"`
+	UsedPercent int    `json:"used_percent"`
+	Pressure    bool   `json:"pressure"`
+}
+
+// PruneRecord is an automatic "docker system prune" run.
+type PruneRecord struct {
+	At     time.Time `json:"at"`
+	Output string    `json:"output"`
+}
+
+// HyperKitState is the subset of the hyperkit state file relevant to tools.
+// The file is owned by hyperkit and may hold more fields.
+type HyperKitState struct {
+	HyperKit  string   `json:"hyperkit"`
+	StateDir  string   `json:"state_dir"`
+	UUID      string   `json:"uuid"`
+	ISOImages []string `json:"iso"`
+	VSock     bool     `json:"vsock"`
+	VMNet     bool     `json:"vmnet"`
+	Kernel    string   `json:"kernel"`
+	Initrd    string   `json:"initrd"`
+	Bootrom   string   `json:"bootrom"`
+	CPUs      int      `json:"cpus"`
+	Memory    int      `json:"memory"`
+	// Pid is the hyperkit process, which may have exited since.
+	Pid       int      `json:"pid"`
+	Arguments []string `json:"arguments"`
+	CmdLine   string   `json:"cmdline"`
+}
+
+// BootSlot describes the boot artifacts of a boot slot.
+type BootSlot struct {
+	ISOURL  string `json:"iso_url"`
+	Vmlinuz string `json:"vmlinuz"`
+	Initrd  string `json:"initrd"`
+	Cmdline string `json:"cmdline"`
+}
+
+// Snapshot describes a disk snapshot.
+type Snapshot struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	DiskSize  int       `json:"disk_size_mb"`
+}
+
+// ReadMachineMetadata reads the MachineMetadata of the machine stored in
+// machineDir.
+func ReadMachineMetadata(machineDir string) (*MachineMetadata, error) {
+	m := &MachineMetadata{}
+	if err := readJSON(filepath.Join(machineDir, MachineMetadataFile), m); err != nil {
+		return nil, err
+	}
+	if m.Version > MachineMetadataVersion {
+		return nil, fmt.Errorf("%s has version %d, newer than the supported version %d", MachineMetadataFile, m.Version, MachineMetadataVersion)
+	}
+	return m, nil
+}
+
+// ReadLayout reads the Layout of the machine stored in machineDir, with
+// version 0 when the machine predates layout versioning.
+func ReadLayout(machineDir string) (*Layout, error) {
+	l := &Layout{}
+	err := readJSON(filepath.Join(machineDir, LayoutFile), l)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l.Version > LayoutVersion {
+		return nil, fmt.Errorf("%s has version %d, newer than the supported version %d", LayoutFile, l.Version, LayoutVersion)
+	}
+	return l, nil
+}
+
+// ReadHyperKitState reads the HyperKitState of the machine stored in
+// machineDir.
+func ReadHyperKitState(machineDir string) (*HyperKitState, error) {
+	s := &HyperKitState{}
+	if err := readJSON(filepath.Join(machineDir, HyperKitStateFile), s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func readJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package telemetry records how long the steps of the machine lifecycle
+// take, e.g. to track performance regressions across driver and macOS
+// upgrades. Events are only emitted to the sinks configured by the user,
+// nothing leaves the host on its own.
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leoh0/docker-machine-driver-hyperkit/pkg/realuser"
+)
+
+// commandTimeout bounds the run of a CommandSink.
+const commandTimeout = 10 * time.Second
+
+// Event outcomes
+const (
+	OutcomeOK    = "ok"
+	OutcomeError = "error"
+)
+
+// Event is a timed step of an operation on a machine.
+type Event struct {
+	Time            time.Time `json:"time"`
+	Machine         string    `json:"machine"`
+	Name            string    `json:"name"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	// Attempts is the number of tries of retried steps.
+	Attempts      int    `json:"attempts,omitempty"`
+	Outcome       string `json:"outcome"`
+	Error         string `json:"error,omitempty"`
+	DriverVersion string `json:"driver_version"`
+	MacOSVersion  string `json:"macos_version,omitempty"`
+}
+
+// NewEvent returns the event of the step name of machine, which started at
+// start and ended now with err.
+func NewEvent(machine, name string, start time.Time, attempts int, err error) Event {
+	e := Event{
+		Time:            start,
+		Machine:         machine,
+		Name:            name,
+		DurationSeconds: time.Since(start).Seconds(),
+		Attempts:        attempts,
+		Outcome:         OutcomeOK,
+		MacOSVersion:    MacOSVersion(),
+	}
+	if err != nil {
+		e.Outcome = OutcomeError
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// Sink receives the events.
+type Sink interface {
+	Emit(e Event) error
+}
+
+// SinkFunc is a function used as a Sink.
+type SinkFunc func(e Event) error
+
+func (f SinkFunc) Emit(e Event) error {
+	return f(e)
+}
+
+// FileSink appends the events as JSON lines to a file.
+type FileSink struct {
+	Path string
+}
+
+func (s FileSink) Emit(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// The driver binary may be setuid root: open the file as the invoking
+	// user.
+	var f *os.File
+	err = realuser.Do(func() error {
+		f, err = os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// A single write keeps the lines of concurrent drivers whole.
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// CommandSink runs a shell command for each event, with the event as JSON
+// on its standard input, as the invoking user.
+type CommandSink struct {
+	Command string
+}
+
+func (s CommandSink) Emit(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", s.Command)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.SysProcAttr = realuser.SysProcAttr()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", s.Command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+var (
+	macOSVersion     string
+	macOSVersionOnce sync.Once
+)
+
+// MacOSVersion returns the version of the host macOS, or "" if unknown.
+func MacOSVersion() string {
+	macOSVersionOnce.Do(func() {
+		if out, err := exec.Command("sw_vers", "-productVersion").Output(); err == nil {
+			macOSVersion = strings.TrimSpace(string(out))
+		}
+	})
+	return macOSVersion
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package vmnetconf reads and changes the shared network of vmnet, and
+// finds one that doesn't overlap the networks the host routes elsewhere,
+// e.g. its LAN or a VPN.
+//
+// vmnet reads its configuration when its shared network comes up, that is
+// when the first VM attaches to it, so a change only applies once no VM
+// uses the network anymore.
+package vmnetconf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Plist is the vmnet configuration, without its .plist extension as
+	// expected by defaults.
+	Plist = "/Library/Preferences/SystemConfiguration/com.apple.vmnet"
+
+	addressKey = "Shared_Net_Address"
+	maskKey    = "Shared_Net_Mask"
+)
+
+// Default is the shared network vmnet uses without configuration.
+var Default = &net.IPNet{IP: net.IPv4(192, 168, 64, 0).To4(), Mask: net.CIDRMask(24, 32)}
+
+// ParseSubnet parses an IPv4 network in CIDR notation usable by vmnet.
+func ParseSubnet(s string) (*net.IPNet, error) {
+	ip, subnet, err := net.ParseCIDR(s)
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid vmnet subnet %q: must be an IPv4 network like 192.168.100.0/24", s)
+	}
+	if ones, _ := subnet.Mask.Size(); ones < 16 || ones > 28 {
+		return nil, fmt.Errorf("invalid vmnet subnet %q: the prefix must be between /16 and /28", s)
+	}
+	return subnet, nil
+}
+
+// Write makes subnet the shared network of vmnet, the host taking its
+// first address.
+func Write(subnet *net.IPNet) error {
+	subnet, err := ParseSubnet(subnet.String())
+	if err != nil {
+		return err
+	}
+	host := make(net.IP, len(subnet.IP))
+	copy(host, subnet.IP)
+	host[len(host)-1]++
+	for key, value := range map[string]string{
+		addressKey: host.String(),
+		maskKey:    net.IP(subnet.Mask).String(),
+	} {
+		if out, err := exec.Command("defaults", "write", Plist, key, "-string", value).CombinedOutput(); err != nil {
+			return fmt.Errorf("writing %s of %s: %v: %s", key, Plist, err, bytes.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// InUse tells whether a host interface has an address in subnet, that is
+// whether the vmnet shared network is up.
+func InUse(subnet *net.IPNet) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && subnet.Contains(ipnet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostRoutes returns the IPv4 networks the host routes outside of vmnet.
+func HostRoutes() ([]*net.IPNet, error) {
+	out, err := exec.Command("netstat", "-rn", "-f", "inet").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseRoutes(out), nil
+}
+
+// parseRoutes parses the output of netstat -rn -f inet, skipping the
+// default, loopback, link-local and multicast routes and those of the vmnet
+// bridges.
+func parseRoutes(out []byte) []*net.IPNet {
+	var routes []*net.IPNet
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || isVMNetRoute(fields) {
+			continue
+		}
+		route := parseDestination(fields[0])
+		if route == nil || route.IP.IsLoopback() || route.IP.IsLinkLocalUnicast() || route.IP.IsMulticast() {
+			continue
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// isVMNetRoute tells whether a route goes through a vmnet bridge.
+func isVMNetRoute(fields []string) bool {
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, "bridge1") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDestination parses a netstat destination, where "10/8" is 10.0.0.0/8
+// and the prefix of "192.168.1" defaults to its 24 given bits.
+func parseDestination(dest string) *net.IPNet {
+	ones := -1
+	if i := strings.IndexByte(dest, '/'); i >= 0 {
+		n, err := strconv.Atoi(dest[i+1:])
+		if err != nil {
+			return nil
+		}
+		ones, dest = n, dest[:i]
+	}
+	octets := strings.Split(dest, ".")
+	if len(octets) > 4 {
+		return nil
+	}
+	if ones < 0 {
+		ones = 8 * len(octets)
+	}
+	for len(octets) < 4 {
+		octets = append(octets, "0")
+	}
+	ip := net.ParseIP(strings.Join(octets, ".")).To4()
+	if ip == nil || ones > 32 {
+		return nil
+	}
+	mask := net.CIDRMask(ones, 32)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// Overlaps returns the first of routes overlapping subnet, or nil.
+func Overlaps(subnet *net.IPNet, routes []*net.IPNet) *net.IPNet {
+	for _, route := range routes {
+		if route.Contains(subnet.IP) || subnet.Contains(route.IP) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Free returns the first /24 after the default shared network, in
+// 192.168.0.0/16 then 10.0.0.0/8, that overlaps none of routes.
+func Free(routes []*net.IPNet) (*net.IPNet, error) {
+	mask := net.CIDRMask(24, 32)
+	var candidates []*net.IPNet
+	for i := 64; i < 255; i++ {
+		candidates = append(candidates, &net.IPNet{IP: net.IPv4(192, 168, byte(i), 0).To4(), Mask: mask})
+	}
+	for i := 64; i < 255; i++ {
+		candidates = append(candidates, &net.IPNet{IP: net.IPv4(10, byte(i), 0, 0).To4(), Mask: mask})
+	}
+	for _, candidate := range candidates {
+		if Overlaps(candidate, routes) == nil {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("no free vmnet subnet: all candidates overlap routes of the host")
+}